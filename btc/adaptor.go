@@ -0,0 +1,544 @@
+package btc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// AdaptorSignatureSize is the size of a serialized adaptor signature, the compressed nonce point followed by the
+// pre-signature scalar.
+const AdaptorSignatureSize = btcec.PubKeyBytesLenCompressed + 32
+
+var (
+	// ErrInvalidAdaptorSignature is returned when an adaptor signature is malformed or doesn't verify
+	ErrInvalidAdaptorSignature = fmt.Errorf("invalid adaptor signature")
+
+	// ErrInvalidAdaptorSecret is returned when the secret is not the discrete log of the adaptor point
+	ErrInvalidAdaptorSecret = fmt.Errorf("invalid adaptor secret")
+
+	// ErrAdaptorSecretNotFound is returned when none of the signatures of a tx reveals the adaptor secret
+	ErrAdaptorSecretNotFound = fmt.Errorf("adaptor secret not found")
+
+	// ErrAdaptorPreSignaturesLen is returned when the number of pre-signatures doesn't match the inputs of the tx
+	ErrAdaptorPreSignaturesLen = func(have, want int) error {
+		return fmt.Errorf("got %d pre-signatures for %d inputs", have, want)
+	}
+
+	adaptorNonceTag = []byte("GardenAdaptor/nonce")
+)
+
+// AdaptorSignature is a schnorr pre-signature encrypted with an adaptor point T = t*G. It becomes a valid BIP-340
+// signature once it's completed with the secret t, and anyone holding the pre-signature can recover t from the
+// completed signature.
+type AdaptorSignature struct {
+	// r is the nonce point of the completed signature, its parity decides how the secret is applied
+	r btcec.PublicKey
+	s btcec.ModNScalar
+}
+
+// NewAdaptorSecret returns a random secret and its adaptor point.
+func NewAdaptorSecret() ([]byte, []byte, error) {
+	privKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	return privKey.Serialize(), privKey.PubKey().SerializeCompressed(), nil
+}
+
+// AdaptorPoint returns the compressed adaptor point T = t*G of the secret.
+func AdaptorPoint(secret []byte) ([]byte, error) {
+	t, err := adaptorScalar(secret)
+	if err != nil {
+		return nil, err
+	}
+	var point btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(t, &point)
+	point.ToAffine()
+	return btcec.NewPublicKey(&point.X, &point.Y).SerializeCompressed(), nil
+}
+
+// AdaptorSign generates a pre-signature of the 32 bytes hash, encrypted with the compressed adaptor point.
+func AdaptorSign(privKey *btcec.PrivateKey, hash []byte, adaptorPoint []byte) (*AdaptorSignature, error) {
+	if len(hash) != 32 {
+		return nil, fmt.Errorf("invalid hash length %d", len(hash))
+	}
+	adaptor, err := btcec.ParsePubKey(adaptorPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// Signatures commit to the x-only pubkey, so the private key is negated when its pubkey is odd
+	privKey = evenPrivateKey(privKey)
+	pubKey := schnorr.SerializePubKey(privKey.PubKey())
+
+	aux := make([]byte, 32)
+	if _, err := rand.Read(aux); err != nil {
+		return nil, err
+	}
+	secretBytes := privKey.Key.Bytes()
+	nonceHash := chainhash.TaggedHash(adaptorNonceTag, secretBytes[:], pubKey, adaptorPoint, hash, aux)
+	var k btcec.ModNScalar
+	k.SetBytes((*[32]byte)(nonceHash))
+	if k.IsZero() {
+		return nil, fmt.Errorf("zero nonce")
+	}
+
+	// R = k*G + T
+	var kG, tJ, r btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(&k, &kG)
+	adaptor.AsJacobian(&tJ)
+	btcec.AddNonConst(&kG, &tJ, &r)
+	r.ToAffine()
+
+	// The completed signature uses -R when R is odd, which means subtracting the secret instead of adding it
+	if r.Y.IsOdd() {
+		k.Negate()
+	}
+	e := adaptorChallenge(&r.X, pubKey, hash)
+	s := new(btcec.ModNScalar).Mul2(e, &privKey.Key).Add(&k)
+
+	return &AdaptorSignature{
+		r: *btcec.NewPublicKey(&r.X, &r.Y),
+		s: *s,
+	}, nil
+}
+
+// ParseAdaptorSignature parses a serialized adaptor signature.
+func ParseAdaptorSignature(sig []byte) (*AdaptorSignature, error) {
+	if len(sig) != AdaptorSignatureSize {
+		return nil, ErrInvalidAdaptorSignature
+	}
+	r, err := btcec.ParsePubKey(sig[:btcec.PubKeyBytesLenCompressed])
+	if err != nil {
+		return nil, ErrInvalidAdaptorSignature
+	}
+	var s btcec.ModNScalar
+	if overflow := s.SetByteSlice(sig[btcec.PubKeyBytesLenCompressed:]); overflow {
+		return nil, ErrInvalidAdaptorSignature
+	}
+	return &AdaptorSignature{r: *r, s: s}, nil
+}
+
+// Serialize returns the compressed nonce point followed by the pre-signature scalar.
+func (sig *AdaptorSignature) Serialize() []byte {
+	s := sig.s.Bytes()
+	return append(sig.r.SerializeCompressed(), s[:]...)
+}
+
+// Verify checks the pre-signature of the hash against the x-only pubkey of the signer and the compressed adaptor
+// point. A verified pre-signature is guaranteed to become a valid signature once completed with the secret.
+func (sig *AdaptorSignature) Verify(hash []byte, pubKey []byte, adaptorPoint []byte) bool {
+	signer, err := schnorr.ParsePubKey(pubKey)
+	if err != nil {
+		return false
+	}
+	adaptor, err := btcec.ParsePubKey(adaptorPoint)
+	if err != nil {
+		return false
+	}
+
+	var r, tJ, rNonce btcec.JacobianPoint
+	sig.r.AsJacobian(&r)
+	adaptor.AsJacobian(&tJ)
+	// k*G = R - T, negated along with the nonce when R is odd
+	tJ.Y.Negate(1).Normalize()
+	btcec.AddNonConst(&r, &tJ, &rNonce)
+	if r.Y.IsOdd() {
+		rNonce.ToAffine()
+		rNonce.Y.Negate(1).Normalize()
+	}
+
+	// s'*G = k*G + e*P
+	var p, eP, expected, actual btcec.JacobianPoint
+	signer.AsJacobian(&p)
+	e := adaptorChallenge(&r.X, pubKey, hash)
+	btcec.ScalarMultNonConst(e, &p, &eP)
+	btcec.AddNonConst(&rNonce, &eP, &expected)
+	btcec.ScalarBaseMultNonConst(&sig.s, &actual)
+	expected.ToAffine()
+	actual.ToAffine()
+	return expected.X.Equals(&actual.X) && expected.Y.Equals(&actual.Y)
+}
+
+// Complete returns the BIP-340 signature decrypted with the secret of the adaptor point.
+func (sig *AdaptorSignature) Complete(secret []byte) (*schnorr.Signature, error) {
+	t, err := adaptorScalar(secret)
+	if err != nil {
+		return nil, err
+	}
+	s := sig.s
+	if sig.isOdd() {
+		t.Negate()
+	}
+	s.Add(t)
+
+	var r btcec.JacobianPoint
+	sig.r.AsJacobian(&r)
+	return schnorr.NewSignature(&r.X, &s), nil
+}
+
+// RecoverSecret recovers the secret of the adaptor point from the completed signature.
+func (sig *AdaptorSignature) RecoverSecret(completed *schnorr.Signature, adaptorPoint []byte) ([]byte, error) {
+	serialized := completed.Serialize()
+	var r btcec.JacobianPoint
+	sig.r.AsJacobian(&r)
+	rx := r.X.Bytes()
+	if !bytes.Equal(serialized[:32], rx[:]) {
+		return nil, ErrAdaptorSecretNotFound
+	}
+
+	var t btcec.ModNScalar
+	t.SetByteSlice(serialized[32:])
+	pre := sig.s
+	t.Add(pre.Negate())
+	if sig.isOdd() {
+		t.Negate()
+	}
+
+	secret := t.Bytes()
+	point, err := AdaptorPoint(secret[:])
+	if err != nil || !bytes.Equal(point, adaptorPoint) {
+		return nil, ErrAdaptorSecretNotFound
+	}
+	return secret[:], nil
+}
+
+func (sig *AdaptorSignature) isOdd() bool {
+	return sig.r.Y().Bit(0) == 1
+}
+
+// adaptorChallenge returns the BIP-340 challenge of the nonce, the x-only pubkey and the hash.
+func adaptorChallenge(rx *btcec.FieldVal, pubKey []byte, hash []byte) *btcec.ModNScalar {
+	rBytes := rx.Bytes()
+	challenge := chainhash.TaggedHash(chainhash.TagBIP0340Challenge, rBytes[:], pubKey, hash)
+	var e btcec.ModNScalar
+	e.SetBytes((*[32]byte)(challenge))
+	return &e
+}
+
+func adaptorScalar(secret []byte) (*btcec.ModNScalar, error) {
+	if len(secret) != 32 {
+		return nil, ErrInvalidAdaptorSecret
+	}
+	var t btcec.ModNScalar
+	if overflow := t.SetByteSlice(secret); overflow || t.IsZero() {
+		return nil, ErrInvalidAdaptorSecret
+	}
+	return &t, nil
+}
+
+// AdaptorHTLC is a scriptless HTLC, the secret hash is replaced by an adaptor point so the redeem tx doesn't reveal
+// anything linking it to the other leg of the swap. The redeem path is a 2-of-2 between the initiator and the
+// redeemer, where the initiator hands out adaptor pre-signatures which the redeemer can only complete with the
+// secret. The initiator recovers the secret from the published redeem tx. The timelocked refund leaf is kept as the
+// fallback of the initiator.
+type AdaptorHTLC struct {
+	// X-only pubkey of the initiator
+	InitiatorPubkey []byte
+	// X-only pubkey of the redeemer
+	RedeemerPubkey []byte
+	// Compressed adaptor point T = t*G, where t is the secret of the swap
+	AdaptorPoint []byte
+	// Locktime in blocks
+	Timelock uint32
+}
+
+type AdaptorHTLCWallet interface {
+	// Initiate sends the amount to the HTLC address
+	Initiate(ctx context.Context, htlc *AdaptorHTLC, amount int64) (string, error)
+	// RedeemTx builds the unsigned redeem tx sending each utxo of the HTLC to the recipient, with its share of the fee
+	// deducted. The tx is deterministic, so the initiator can build the same tx to pre-sign it with
+	// `AdaptorPreSignRedeem`.
+	RedeemTx(ctx context.Context, htlc *AdaptorHTLC, recipient btcutil.Address, feeRate int) (*wire.MsgTx, txscript.PrevOutputFetcher, error)
+	// Redeem completes the pre-signatures of the initiator with the secret, adds the signature of the redeemer and
+	// submits the redeem tx.
+	Redeem(ctx context.Context, htlc *AdaptorHTLC, redeemTx *wire.MsgTx, preSigs []*AdaptorSignature, secret []byte) (string, error)
+	// Refund refunds the HTLC if the htlc is expired.
+	Refund(ctx context.Context, htlc *AdaptorHTLC) (string, error)
+	// Address returns the tapscript address of the HTLC
+	Address(htlc *AdaptorHTLC) (btcutil.Address, error)
+}
+
+type adaptorHTLCWallet struct {
+	wallet  Wallet
+	chain   *chaincfg.Params
+	indexer IndexerClient
+}
+
+// NewAdaptorHTLCWallet returns an AdaptorHTLCWallet which funds and signs with the given wallet.
+func NewAdaptorHTLCWallet(wallet Wallet, indexer IndexerClient, chain *chaincfg.Params) (AdaptorHTLCWallet, error) {
+	return &adaptorHTLCWallet{
+		wallet:  wallet,
+		chain:   chain,
+		indexer: indexer,
+	}, nil
+}
+
+// Address returns the tapscript address of the HTLC
+func (aw *adaptorHTLCWallet) Address(htlc *AdaptorHTLC) (btcutil.Address, error) {
+	internalKey, err := GardenNUMS()
+	if err != nil {
+		return nil, err
+	}
+	leaves, err := adaptorHTLCLeaves(htlc)
+	if err != nil {
+		return nil, err
+	}
+	tapScriptTree := txscript.AssembleTaprootScriptTree(leaves...)
+	tapScriptRootHash := tapScriptTree.RootNode.TapHash()
+	outputKey := txscript.ComputeTaprootOutputKey(internalKey, tapScriptRootHash[:])
+	return btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), aw.chain)
+}
+
+// Initiate sends the amount to the HTLC address
+func (aw *adaptorHTLCWallet) Initiate(ctx context.Context, htlc *AdaptorHTLC, amount int64) (string, error) {
+	addr, err := aw.Address(htlc)
+	if err != nil {
+		return "", err
+	}
+	return aw.wallet.Send(ctx, []SendRequest{
+		{
+			To:     addr,
+			Amount: amount,
+		},
+	}, nil, nil)
+}
+
+func (aw *adaptorHTLCWallet) RedeemTx(ctx context.Context, htlc *AdaptorHTLC, recipient btcutil.Address, feeRate int) (*wire.MsgTx, txscript.PrevOutputFetcher, error) {
+	_, utxos, fetcher, err := aw.utxos(ctx, htlc)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf, cbBytes, err := adaptorControlBlock(htlc, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	pkScript, err := txscript.PayToAddrScript(recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Each input is signed with SIGHASH_SINGLE|ANYONECANPAY, so it pays for itself and its own output
+	witnessWeight := EstimateWitnessWeight([][]byte{AddSignatureSchnorrOp, AddSignatureSchnorrOp, leaf.Script, cbBytes}, SigHashSingleAnyoneCanPay)
+	fee := int64(feeRate * (InputVirtualSize(witnessWeight) + wire.NewTxOut(0, pkScript).SerializeSize()))
+
+	tx := wire.NewMsgTx(DefaultTxVersion)
+	for _, utxo := range utxos {
+		if utxo.Amount-fee <= DustAmount {
+			return nil, nil, ErrFeeExceedsValue
+		}
+		hash, err := chainhash.NewHashFromStr(utxo.TxID)
+		if err != nil {
+			return nil, nil, err
+		}
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, utxo.Vout), nil, nil))
+		tx.AddTxOut(wire.NewTxOut(utxo.Amount-fee, pkScript))
+	}
+	return tx, fetcher, nil
+}
+
+func (aw *adaptorHTLCWallet) Redeem(ctx context.Context, htlc *AdaptorHTLC, redeemTx *wire.MsgTx, preSigs []*AdaptorSignature, secret []byte) (string, error) {
+	point, err := AdaptorPoint(secret)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(point, htlc.AdaptorPoint) {
+		return "", ErrInvalidAdaptorSecret
+	}
+	if len(preSigs) != len(redeemTx.TxIn) {
+		return "", ErrAdaptorPreSignaturesLen(len(preSigs), len(redeemTx.TxIn))
+	}
+	scriptAddr, _, fetcher, err := aw.utxos(ctx, htlc)
+	if err != nil {
+		return "", err
+	}
+	leaf, cbBytes, err := adaptorControlBlock(htlc, 0)
+	if err != nil {
+		return "", err
+	}
+
+	tx := redeemTx.Copy()
+	sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+	for i, in := range tx.TxIn {
+		prevOut := fetcher.FetchPrevOutput(in.PreviousOutPoint)
+		if prevOut == nil {
+			return "", ErrSACPInvalidInput
+		}
+		sigHash, err := txscript.CalcTapscriptSignaturehash(sigHashes, SigHashSingleAnyoneCanPay, tx, i, fetcher, leaf)
+		if err != nil {
+			return "", err
+		}
+		if !preSigs[i].Verify(sigHash, htlc.InitiatorPubkey, htlc.AdaptorPoint) {
+			return "", ErrInvalidAdaptorSignature
+		}
+		sig, err := preSigs[i].Complete(secret)
+		if err != nil {
+			return "", err
+		}
+
+		// The redeemer signature goes at the 0th index and the initiator signature at the 1st index
+		witness := [][]byte{
+			AddSignatureSchnorrOp,
+			append(sig.Serialize(), byte(SigHashSingleAnyoneCanPay)),
+			leaf.Script,
+			cbBytes,
+		}
+		witnessWithSig, err := aw.wallet.SignSACPTx(tx, i, prevOut.Value, leaf, scriptAddr, witness)
+		if err != nil {
+			return "", err
+		}
+		tx.TxIn[i].Witness = witnessWithSig
+	}
+
+	sacp, err := GetTxRawBytes(tx)
+	if err != nil {
+		return "", err
+	}
+	return aw.wallet.Send(ctx, nil, nil, [][]byte{sacp})
+}
+
+func (aw *adaptorHTLCWallet) Refund(ctx context.Context, htlc *AdaptorHTLC) (string, error) {
+	scriptAddr, utxos, _, err := aw.utxos(ctx, htlc)
+	if err != nil {
+		return "", err
+	}
+	currentTip, err := aw.indexer.GetTipBlockHeight(ctx)
+	if err != nil {
+		return "", err
+	}
+	canRefund, needMoreBlocks := canRefund(utxos, htlc.Timelock, currentTip)
+	if !canRefund {
+		return "", ErrHTLCNeedMoreBlocks(needMoreBlocks)
+	}
+	leaf, cbBytes, err := adaptorControlBlock(htlc, 1)
+	if err != nil {
+		return "", err
+	}
+
+	return aw.wallet.Send(ctx, nil, []SpendRequest{
+		{
+			Witness:       [][]byte{AddSignatureSchnorrOp, leaf.Script, cbBytes},
+			Leaf:          leaf,
+			ScriptAddress: scriptAddr,
+			HashType:      txscript.SigHashAll,
+			Sequence:      htlc.Timelock,
+		},
+	}, nil)
+}
+
+// utxos returns the address, the utxos and the prevout fetcher of the HTLC.
+func (aw *adaptorHTLCWallet) utxos(ctx context.Context, htlc *AdaptorHTLC) (btcutil.Address, UTXOs, *txscript.MultiPrevOutFetcher, error) {
+	scriptAddr, err := aw.Address(htlc)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pkScript, err := txscript.PayToAddrScript(scriptAddr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	utxos, err := aw.indexer.GetUTXOs(ctx, scriptAddr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(utxos) == 0 {
+		return nil, nil, nil, ErrNoHTLCUtxos
+	}
+
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+	for _, utxo := range utxos {
+		hash, err := chainhash.NewHashFromStr(utxo.TxID)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		fetcher.AddPrevOut(*wire.NewOutPoint(hash, utxo.Vout), wire.NewTxOut(utxo.Amount, pkScript))
+	}
+	return scriptAddr, utxos, fetcher, nil
+}
+
+// AdaptorPreSignRedeem returns the adaptor pre-signature of the initiator for each input of the redeem tx built by
+// `RedeemTx`. The pre-signatures are handed to the redeemer, who can only use them once it knows the secret.
+func AdaptorPreSignRedeem(privKey *btcec.PrivateKey, htlc *AdaptorHTLC, redeemTx *wire.MsgTx, fetcher txscript.PrevOutputFetcher) ([]*AdaptorSignature, error) {
+	leaf, _, err := adaptorControlBlock(htlc, 0)
+	if err != nil {
+		return nil, err
+	}
+	sigHashes := txscript.NewTxSigHashes(redeemTx, fetcher)
+	preSigs := make([]*AdaptorSignature, len(redeemTx.TxIn))
+	for i := range redeemTx.TxIn {
+		sigHash, err := txscript.CalcTapscriptSignaturehash(sigHashes, SigHashSingleAnyoneCanPay, redeemTx, i, fetcher, leaf)
+		if err != nil {
+			return nil, err
+		}
+		preSigs[i], err = AdaptorSign(privKey, sigHash, htlc.AdaptorPoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return preSigs, nil
+}
+
+// ExtractAdaptorSecret recovers the secret from the published redeem tx of the HTLC, given the pre-signatures the
+// initiator handed out. The redeem inputs may be batched with other inputs in any order.
+func ExtractAdaptorSecret(htlc *AdaptorHTLC, tx *wire.MsgTx, preSigs []*AdaptorSignature) ([]byte, error) {
+	leaf, _, err := adaptorControlBlock(htlc, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, in := range tx.TxIn {
+		if len(in.Witness) != 4 || !bytes.Equal(in.Witness[2], leaf.Script) || len(in.Witness[1]) < schnorr.SignatureSize {
+			continue
+		}
+		sig, err := schnorr.ParseSignature(in.Witness[1][:schnorr.SignatureSize])
+		if err != nil {
+			continue
+		}
+		for _, preSig := range preSigs {
+			if secret, err := preSig.RecoverSecret(sig, htlc.AdaptorPoint); err == nil {
+				return secret, nil
+			}
+		}
+	}
+	return nil, ErrAdaptorSecretNotFound
+}
+
+// adaptorHTLCLeaves returns the 2-of-2 redeem leaf and the refund leaf of the HTLC.
+func adaptorHTLCLeaves(htlc *AdaptorHTLC) ([]txscript.TapLeaf, error) {
+	redeemLeaf, err := MultiSigLeaf(htlc.InitiatorPubkey, htlc.RedeemerPubkey)
+	if err != nil {
+		return nil, err
+	}
+	refundLeaf, err := RefundLeaf(htlc.InitiatorPubkey, htlc.Timelock)
+	if err != nil {
+		return nil, err
+	}
+	return []txscript.TapLeaf{redeemLeaf, refundLeaf}, nil
+}
+
+// adaptorControlBlock returns the leaf at the given index and its control block.
+func adaptorControlBlock(htlc *AdaptorHTLC, index int) (txscript.TapLeaf, []byte, error) {
+	internalKey, err := GardenNUMS()
+	if err != nil {
+		return txscript.TapLeaf{}, nil, err
+	}
+	leaves, err := adaptorHTLCLeaves(htlc)
+	if err != nil {
+		return txscript.TapLeaf{}, nil, err
+	}
+	tapScriptTree := txscript.AssembleTaprootScriptTree(leaves...)
+	controlBlock := tapScriptTree.LeafMerkleProofs[index].ToControlBlock(internalKey)
+	cbBytes, err := controlBlock.ToBytes()
+	if err != nil {
+		return txscript.TapLeaf{}, nil, err
+	}
+	return leaves[index], cbBytes, nil
+}
@@ -0,0 +1,170 @@
+package btc_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/blockchain/btc"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Adaptor signatures", func() {
+	network := &chaincfg.RegressionNetParams
+
+	It("should complete the pre-signature with the secret and recover the secret from the signature", func() {
+		// Repeat with random keys to cover the parities of the pubkey and the nonce
+		for i := 0; i < 20; i++ {
+			privKey, err := btcec.NewPrivateKey()
+			Expect(err).To(BeNil())
+			pubKey := schnorr.SerializePubKey(privKey.PubKey())
+			secret, point, err := btc.NewAdaptorSecret()
+			Expect(err).To(BeNil())
+			hash := sha256.Sum256([]byte{byte(i)})
+
+			preSig, err := btc.AdaptorSign(privKey, hash[:], point)
+			Expect(err).To(BeNil())
+			Expect(preSig.Verify(hash[:], pubKey, point)).Should(BeTrue())
+
+			By("Reject other adaptor points and messages")
+			_, otherPoint, err := btc.NewAdaptorSecret()
+			Expect(err).To(BeNil())
+			Expect(preSig.Verify(hash[:], pubKey, otherPoint)).Should(BeFalse())
+			otherHash := sha256.Sum256(hash[:])
+			Expect(preSig.Verify(otherHash[:], pubKey, point)).Should(BeFalse())
+
+			By("Round trip the serialization")
+			parsed, err := btc.ParseAdaptorSignature(preSig.Serialize())
+			Expect(err).To(BeNil())
+			Expect(parsed.Serialize()).Should(Equal(preSig.Serialize()))
+
+			By("Complete the signature")
+			sig, err := parsed.Complete(secret)
+			Expect(err).To(BeNil())
+			Expect(sig.Verify(hash[:], privKey.PubKey())).Should(BeTrue())
+
+			By("Recover the secret")
+			recovered, err := preSig.RecoverSecret(sig, point)
+			Expect(err).To(BeNil())
+			Expect(recovered).Should(Equal(secret))
+		}
+	})
+
+	Context("swap", func() {
+		var (
+			initiator, redeemer *btcec.PrivateKey
+			secret              []byte
+			htlc                *btc.AdaptorHTLC
+			indexer             *recordedIndexer
+		)
+
+		BeforeEach(func() {
+			var err error
+			initiator, err = btcec.NewPrivateKey()
+			Expect(err).To(BeNil())
+			redeemer, err = btcec.NewPrivateKey()
+			Expect(err).To(BeNil())
+			var point []byte
+			secret, point, err = btc.NewAdaptorSecret()
+			Expect(err).To(BeNil())
+			htlc = &btc.AdaptorHTLC{
+				InitiatorPubkey: schnorr.SerializePubKey(initiator.PubKey()),
+				RedeemerPubkey:  schnorr.SerializePubKey(redeemer.PubKey()),
+				AdaptorPoint:    point,
+				Timelock:        10,
+			}
+			indexer = newRecordedIndexer()
+		})
+
+		newWallet := func(privKey *btcec.PrivateKey) (btc.Wallet, btc.AdaptorHTLCWallet) {
+			wallet, err := btc.NewSimpleWallet(privKey, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee)
+			Expect(err).To(BeNil())
+			htlcWallet, err := btc.NewAdaptorHTLCWallet(wallet, indexer, network)
+			Expect(err).To(BeNil())
+			return wallet, htlcWallet
+		}
+
+		verify := func(tx *wire.MsgTx) {
+			fetcher := indexer.fetcher()
+			sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+			for i, in := range tx.TxIn {
+				prevOut := fetcher.FetchPrevOutput(in.PreviousOutPoint)
+				engine, err := txscript.NewEngine(prevOut.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+				Expect(err).To(BeNil())
+				Expect(engine.Execute()).To(BeNil())
+			}
+		}
+
+		It("should redeem with the secret and reveal it to the initiator only", func(ctx context.Context) {
+			redeemerWallet, redeemerHTLCWallet := newWallet(redeemer)
+			_, initiatorHTLCWallet := newWallet(initiator)
+			addr, err := redeemerHTLCWallet.Address(htlc)
+			Expect(err).To(BeNil())
+			indexer.fund(addr, 1e5, 2e5)
+			indexer.fund(redeemerWallet.Address(), 1e5)
+
+			By("Both parties build the same redeem tx")
+			redeemTx, fetcher, err := redeemerHTLCWallet.RedeemTx(ctx, htlc, redeemerWallet.Address(), 10)
+			Expect(err).To(BeNil())
+			initiatorTx, _, err := initiatorHTLCWallet.RedeemTx(ctx, htlc, redeemerWallet.Address(), 10)
+			Expect(err).To(BeNil())
+			Expect(initiatorTx.TxHash()).Should(Equal(redeemTx.TxHash()))
+			preSigs, err := btc.AdaptorPreSignRedeem(initiator, htlc, initiatorTx, fetcher)
+			Expect(err).To(BeNil())
+
+			By("Reject a wrong secret")
+			otherSecret, _, err := btc.NewAdaptorSecret()
+			Expect(err).To(BeNil())
+			_, err = redeemerHTLCWallet.Redeem(ctx, htlc, redeemTx, preSigs, otherSecret)
+			Expect(err).Should(Equal(btc.ErrInvalidAdaptorSecret))
+
+			By("Reject pre-signatures of another tx")
+			_, err = redeemerHTLCWallet.Redeem(ctx, htlc, redeemTx, []*btc.AdaptorSignature{preSigs[1], preSigs[0]}, secret)
+			Expect(err).Should(Equal(btc.ErrInvalidAdaptorSignature))
+
+			_, err = redeemerHTLCWallet.Redeem(ctx, htlc, redeemTx, preSigs, secret)
+			Expect(err).To(BeNil())
+			tx := indexer.submitted
+			verify(tx)
+
+			By("Extract the secret from the published tx")
+			extracted, err := btc.ExtractAdaptorSecret(htlc, tx, preSigs)
+			Expect(err).To(BeNil())
+			Expect(extracted).Should(Equal(secret))
+			for _, in := range tx.TxIn {
+				for _, item := range in.Witness {
+					Expect(bytes.Contains(item, secret)).Should(BeFalse())
+				}
+			}
+		})
+
+		It("should refund after the timelock", func(ctx context.Context) {
+			initiatorWallet, initiatorHTLCWallet := newWallet(initiator)
+			addr, err := initiatorHTLCWallet.Address(htlc)
+			Expect(err).To(BeNil())
+			indexer.fund(addr, 1e5)
+			height := uint64(100)
+			indexer.utxos[addr.EncodeAddress()][0].Status = &btc.Status{Confirmed: true, BlockHeight: &height}
+
+			indexer.tip = 101
+			_, err = initiatorHTLCWallet.Refund(ctx, htlc)
+			Expect(err).ShouldNot(BeNil())
+
+			indexer.tip = 110
+			_, err = initiatorHTLCWallet.Refund(ctx, htlc)
+			Expect(err).To(BeNil())
+			Expect(indexer.submitted.TxIn[0].Sequence).Should(Equal(htlc.Timelock))
+			pkScript, err := txscript.PayToAddrScript(initiatorWallet.Address())
+			Expect(err).To(BeNil())
+			Expect(indexer.submitted.TxOut[0].PkScript).Should(Equal(pkScript))
+			verify(indexer.submitted)
+		})
+	})
+})
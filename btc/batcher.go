@@ -148,6 +148,7 @@ type batcherWallet struct {
 	wg   sync.WaitGroup
 
 	chainParams *chaincfg.Params
+	addrType    waddrmgr.AddressType
 	address     btcutil.Address
 	privateKey  *secp256k1.PrivateKey
 	logger      *zap.Logger
@@ -168,13 +169,14 @@ type Batch struct {
 }
 
 func NewBatcherWallet(privateKey *secp256k1.PrivateKey, indexer IndexerClient, feeEstimator FeeEstimator, chainParams *chaincfg.Params, cache Cache, logger *zap.Logger, opts ...func(*batcherWallet) error) (BatcherWallet, error) {
-	address, err := PublicKeyAddress(chainParams, waddrmgr.WitnessPubKey, privateKey.PubKey())
+	address, err := walletAddress(chainParams, waddrmgr.WitnessPubKey, privateKey.PubKey())
 	if err != nil {
 		return nil, err
 	}
 
 	wallet := &batcherWallet{
 		indexer:      indexer,
+		addrType:     waddrmgr.WitnessPubKey,
 		address:      address,
 		privateKey:   privateKey,
 		cache:        cache,
@@ -190,7 +192,7 @@ func NewBatcherWallet(privateKey *secp256k1.PrivateKey, indexer IndexerClient, f
 		}
 	}
 
-	simpleWallet, err := NewSimpleWallet(privateKey, chainParams, indexer, feeEstimator, wallet.opts.TxOptions.FeeLevel)
+	simpleWallet, err := NewSimpleWallet(privateKey, chainParams, indexer, feeEstimator, wallet.opts.TxOptions.FeeLevel, WithSimpleWalletAddressType(wallet.addrType))
 	if err != nil {
 		return nil, err
 	}
@@ -232,6 +234,19 @@ func WithPTI(pti time.Duration) func(*batcherWallet) error {
 	}
 }
 
+// WithAddressType sets the address type of the BatcherWallet. It supports the same address types as the SimpleWallet.
+func WithAddressType(addrType waddrmgr.AddressType) func(*batcherWallet) error {
+	return func(w *batcherWallet) error {
+		address, err := walletAddress(w.chainParams, addrType, w.privateKey.PubKey())
+		if err != nil {
+			return err
+		}
+		w.addrType = addrType
+		w.address = address
+		return nil
+	}
+}
+
 func parseStrategy(strategy Strategy) error {
 	switch strategy {
 	case RBF, CPFP, RBF_CPFP, Multi_CPFP:
@@ -259,6 +274,16 @@ func (w *batcherWallet) Send(ctx context.Context, sends []SendRequest, spends []
 		return "", err
 	}
 
+	// Reject the lock times which can't share a tx with the pending requests
+	pendingRequests, err := w.cache.ReadPendingRequests(ctx)
+	if err != nil {
+		return "", err
+	}
+	pendingSpends, _, pendingSACPs, _ := unpackBatcherRequests(pendingRequests)
+	if err := checkLockTimes(pendingSpends, pendingSACPs, BatcherRequest{Spends: spends, SACPs: sacps}); err != nil {
+		return "", err
+	}
+
 	// generate random id
 	id := chainhash.HashH([]byte(fmt.Sprintf("%v", time.Now().UnixNano()))).String()
 
@@ -518,6 +543,10 @@ func selectFee(feeRate FeeSuggestion, feeLevel FeeLevel) int {
 		return feeRate.High
 	case LowFee:
 		return feeRate.Low
+	case EconomyFee:
+		return feeRate.Economy
+	case MinimumFee:
+		return feeRate.Minimum
 	default:
 		return feeRate.High
 	}
@@ -563,6 +592,31 @@ func unpackBatcherRequests(reqs []BatcherRequest) ([]SpendRequest, []SendRequest
 	return spendRequests, sendRequests, sacps, reqIds
 }
 
+// batchableRequests returns the pending requests which can be batched along with the already batched requests, in
+// order. A request is deferred to a later batch when its lock time can't share a tx with the lock times or the sacps
+// of the requests before it, see `spendLockTime`.
+func batchableRequests(batched, pending []BatcherRequest) []BatcherRequest {
+	spends, _, sacps, _ := unpackBatcherRequests(batched)
+	requests := []BatcherRequest{}
+	for _, req := range pending {
+		if checkLockTimes(spends, sacps, req) != nil {
+			continue
+		}
+		spends = append(spends, req.Spends...)
+		sacps = append(sacps, req.SACPs...)
+		requests = append(requests, req)
+	}
+	return requests
+}
+
+// checkLockTimes returns an error if the lock time of the request can't share a tx with the given spends and sacps.
+func checkLockTimes(spends []SpendRequest, sacps [][]byte, req BatcherRequest) error {
+	spends = append(append([]SpendRequest{}, spends...), req.Spends...)
+	sacps = append(append([][]byte{}, sacps...), req.SACPs...)
+	_, err := spendLockTime(spends, sacps)
+	return err
+}
+
 func populateUTXOsForSpendRequest(ctx context.Context, indexer IndexerClient, spendReq *[]SpendRequest) (UTXOs, utxoMap, int64, error) {
 	utxos := UTXOs{}
 	totalValue := int64(0)
@@ -570,7 +624,7 @@ func populateUTXOsForSpendRequest(ctx context.Context, indexer IndexerClient, sp
 
 	for i := range *spendReq {
 		req := &(*spendReq)[i]
-		utxosForAddress, err := indexer.GetUTXOs(ctx, req.ScriptAddress)
+		utxosForAddress, err := spendableUTXOs(ctx, indexer, req.ScriptAddress, req.Utxos)
 		if err != nil {
 			return nil, nil, 0, err
 		}
@@ -43,18 +43,20 @@ var (
 		return 0, txsizes.RedeemP2WPKHInputWitnessWeight
 	}
 
-	HtlcUpdater = func(secretSize int) func() (int, int) {
-		return func() (int, int) {
-			if secretSize == 0 {
-				return 0, RedeemHtlcRefundSigScriptSize
-			}
-			return 0, RedeemHtlcRedeemSigScriptSize(secretSize)
-		}
+	P2trUpdater = func() (int, int) {
+		return 0, EstimateWitnessWeight(P2trKeyPathWitness, txscript.SigHashDefault)
+	}
+
+	// NestedP2wpkhUpdater is the size of spending a p2sh-p2wpkh utxo, the sigScript pushes the 22 bytes p2wpkh script.
+	NestedP2wpkhUpdater = func() (int, int) {
+		return 1 + 22, txsizes.RedeemP2WPKHInputWitnessWeight
 	}
 
-	MultisigUpdater = func() (int, int) {
-		return 0, RedeemMultisigSigScriptSize
+	HtlcUpdater = func(secretSize int) func() (int, int) {
+		return SpendRequestUpdater(SpendRequest{Witness: HtlcWitnessTemplate(secretSize), HashType: txscript.SigHashAll})
 	}
+
+	MultisigUpdater = SpendRequestUpdater(SpendRequest{Witness: MultisigWitnessTemplate, HashType: txscript.SigHashAll})
 )
 
 type UTXOs []UTXO
@@ -260,6 +262,12 @@ func PublicKeyAddress(network *chaincfg.Params, addrType waddrmgr.AddressType, p
 		return btcutil.NewAddressPubKeyHash(btcutil.Hash160(pub.SerializeCompressed()), network)
 	case waddrmgr.WitnessPubKey:
 		return btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pub.SerializeCompressed()), network)
+	case waddrmgr.NestedWitnessPubKey:
+		redeemScript, err := nestedP2wpkhRedeemScript(pub)
+		if err != nil {
+			return nil, err
+		}
+		return btcutil.NewAddressScriptHash(redeemScript, network)
 	case waddrmgr.TaprootPubKey:
 		tapKey := txscript.ComputeTaprootKeyNoScript(pub)
 		return btcutil.NewAddressTaproot(schnorr.SerializePubKey(tapKey), network)
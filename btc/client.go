@@ -2,6 +2,7 @@ package btc
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -53,6 +54,42 @@ type Client interface {
 
 	// GetNetworkInfo returns the network configuration of the node we connect to.
 	GetNetworkInfo(ctx context.Context) (*btcjson.GetNetworkInfoResult, error)
+
+	// EstimateSmartFee returns the fee rate (in BTC/kvB) the node expects a tx to need to get confirmed within
+	// confTarget blocks. The node reports estimation failures in the `Errors` field of the result.
+	EstimateSmartFee(ctx context.Context, confTarget int64) (*btcjson.EstimateSmartFeeResult, error)
+
+	// GetMempoolInfo returns details about the current state of the node's mempool.
+	GetMempoolInfo(ctx context.Context) (*MempoolInfo, error)
+
+	// GetRawMempoolVerbose returns all the txs in the node's mempool, mapped by their txid.
+	GetRawMempoolVerbose(ctx context.Context) (map[string]MempoolEntry, error)
+}
+
+// MempoolInfo is the result of the `getmempoolinfo` rpc call. The btcjson version doesn't include the fee fields
+// returned by bitcoind.
+type MempoolInfo struct {
+	Size          int64   `json:"size"`
+	Bytes         int64   `json:"bytes"`
+	Usage         int64   `json:"usage"`
+	MaxMempool    int64   `json:"maxmempool"`
+	MempoolMinFee float64 `json:"mempoolminfee"`
+	MinRelayTxFee float64 `json:"minrelaytxfee"`
+}
+
+// MempoolEntry is a single tx of the verbose `getrawmempool` rpc call. Fees are in BTC.
+type MempoolEntry struct {
+	VSize  int64 `json:"vsize"`
+	Weight int64 `json:"weight"`
+	Time   int64 `json:"time"`
+	Height int64 `json:"height"`
+	Fees   struct {
+		Base       float64 `json:"base"`
+		Modified   float64 `json:"modified"`
+		Ancestor   float64 `json:"ancestor"`
+		Descendant float64 `json:"descendant"`
+	} `json:"fees"`
+	Depends []string `json:"depends"`
 }
 
 type client struct {
@@ -339,3 +376,91 @@ func (client *client) GetNetworkInfo(ctx context.Context) (*btcjson.GetNetworkIn
 		return result, nil
 	}
 }
+
+func (client *client) EstimateSmartFee(ctx context.Context, confTarget int64) (*btcjson.EstimateSmartFeeResult, error) {
+	future := client.rpcClient.EstimateSmartFeeAsync(confTarget, &btcjson.EstimateModeConservative)
+	results := make(chan *btcjson.EstimateSmartFeeResult, 1)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(results)
+		defer close(errs)
+
+		result, err := future.Receive()
+		if err != nil {
+			errs <- err
+			return
+		}
+		results <- result
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("EstimateSmartFee : %w", ctx.Err())
+	case err := <-errs:
+		return nil, err
+	case result := <-results:
+		return result, nil
+	}
+}
+
+func (client *client) GetMempoolInfo(ctx context.Context) (*MempoolInfo, error) {
+	future := client.rpcClient.RawRequestAsync("getmempoolinfo", nil)
+	results := make(chan *MempoolInfo, 1)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(results)
+		defer close(errs)
+
+		data, err := future.Receive()
+		if err != nil {
+			errs <- err
+			return
+		}
+		result := new(MempoolInfo)
+		if err := json.Unmarshal(data, result); err != nil {
+			errs <- err
+			return
+		}
+		results <- result
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("GetMempoolInfo : %w", ctx.Err())
+	case err := <-errs:
+		return nil, err
+	case result := <-results:
+		return result, nil
+	}
+}
+
+func (client *client) GetRawMempoolVerbose(ctx context.Context) (map[string]MempoolEntry, error) {
+	future := client.rpcClient.RawRequestAsync("getrawmempool", []json.RawMessage{json.RawMessage("true")})
+	results := make(chan map[string]MempoolEntry, 1)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(results)
+		defer close(errs)
+
+		data, err := future.Receive()
+		if err != nil {
+			errs <- err
+			return
+		}
+		result := map[string]MempoolEntry{}
+		if err := json.Unmarshal(data, &result); err != nil {
+			errs <- err
+			return
+		}
+		results <- result
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("GetRawMempoolVerbose : %w", ctx.Err())
+	case err := <-errs:
+		return nil, err
+	case result := <-results:
+		return result, nil
+	}
+}
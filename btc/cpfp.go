@@ -7,7 +7,7 @@ import (
 
 	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/btcutil"
-	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"go.uber.org/zap"
 )
@@ -22,13 +22,16 @@ type FeeStats struct {
 func (w *batcherWallet) createCPFPBatch(c context.Context) error {
 
 	// Read all pending requests added to the cache
-	// All requests are executed in a single batch
+	// All requests are executed in a single batch, except the ones deferred for their lock times
 	requests, err := w.cache.ReadPendingRequests(c)
 	if err != nil {
 		w.logger.Error("failed to read pending requests", zap.Error(err))
 		return err
 	}
 
+	// Defer the requests whose lock times can't share the tx with the ones before them
+	requests = batchableRequests(nil, requests)
+
 	// Return error if no requests found
 	if len(requests) == 0 {
 		return ErrBatchParametersNotMet
@@ -289,39 +292,38 @@ func (w *batcherWallet) buildCPFPTx(c context.Context, utxos []UTXO, spendReques
 	}
 
 	// Build the transaction with the available UTXOs and requests
-	tx, signIdx, err := buildTransaction(append(spendUTXOs, utxos...), sacps, tempSendRequests, w.address, int64(fee+feeOverhead), sequencesMap)
+	lockTime, err := spendLockTime(spendRequests, sacps)
 	if err != nil {
 		return nil, err
 	}
-
-	swSigs, trSigs := getNumberOfSigs(spendRequests)
-	bufferFee := 0
-	if depth > 0 {
-		// buffer fee accounts for
-		// 4 bytes for each sewgwit signature in the spend requests
-		// 4 bytes per each UTXO in the spend requests
-		// 1 byte for each taproot signature in the spend requests
-		// /2 is to convert the bytes to virtual size
-		bufferFee = ((4*(swSigs+len(utxos)) + trSigs) / 2) * feeRate
+	tx, signIdx, err := buildTransaction(append(spendUTXOs, utxos...), sacps, tempSendRequests, w.address, int64(fee+feeOverhead), sequencesMap)
+	if err != nil {
+		return nil, err
 	}
+	tx.LockTime = lockTime
 
 	// Sign the spend inputs
+	var fetcher txscript.PrevOutputFetcher
 	err = withContextTimeout(c, DefaultAPITimeout, func(ctx context.Context) error {
-		return signSpendTx(ctx, tx, signIdx, spendRequests, spendUTXOsMap, w.indexer, w.privateKey)
+		fetcher, err = buildTxPrevOutFetcher(ctx, tx, signIdx, spendUTXOsMap, w.indexer)
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
+	err = signSpendTx(tx, fetcher, signIdx, spendRequests, spendUTXOsMap, w.privateKey)
+	if err != nil {
+		return nil, err
+	}
 
 	// Sign the fee providing inputs, if any
-	err = signSendTx(tx, utxos, signIdx+len(spendUTXOs), w.address, w.privateKey)
+	err = signSendTx(tx, fetcher, utxos, signIdx+len(spendUTXOs), w.address, w.privateKey)
 	if err != nil {
 		return tx, err
 	}
 
-	// Calculate the true size of the transaction
-	txb := btcutil.NewTx(tx)
-	trueSize := mempool.GetTxVirtualSize(txb)
+	// Calculate the size of the transaction from the witness templates
+	trueSize := estimateSignedVirtualSize(tx, signIdx, spendRequests, spendUTXOsMap, w.address, signIdx+len(spendUTXOs), len(utxos))
 
 	var sacpsInAmount int64
 	var sacpOutAmount int64
@@ -331,7 +333,7 @@ func (w *batcherWallet) buildCPFPTx(c context.Context, utxos []UTXO, spendReques
 	})
 
 	// Estimate the new fee
-	newFeeEstimate := (int(trueSize) * (feeRate)) + feeOverhead + bufferFee - int(sacpsInAmount-sacpOutAmount)
+	newFeeEstimate := (trueSize * feeRate) + feeOverhead - int(sacpsInAmount-sacpOutAmount)
 
 	// If the new fee estimate exceeds the current fee, rebuild the CPFP transaction
 	if newFeeEstimate > fee+feeOverhead {
@@ -344,7 +346,6 @@ func (w *batcherWallet) buildCPFPTx(c context.Context, utxos []UTXO, spendReques
 			zap.Int("depth", depth),
 			zap.Int("fee", fee),
 			zap.Int("feeOverhead", feeOverhead),
-			zap.Int("feeBuffer", bufferFee),
 			zap.Int("required", newFeeEstimate),
 			zap.Int("coverUtxos", len(utxos)),
 			zap.Int("TxIns", len(tx.TxIn)),
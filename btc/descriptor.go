@@ -0,0 +1,113 @@
+package btc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+const (
+	descriptorInputCharset    = "0123456789()[],'/*abcdefgh@:$%{}IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	descriptorChecksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+// ErrInvalidDescriptorCharacter indicates that a descriptor contains a character outside of the BIP-380 charset.
+var ErrInvalidDescriptorCharacter = func(c rune) error {
+	return fmt.Errorf("invalid descriptor character %q", c)
+}
+
+// ErrUnsupportedDescriptorMode is returned when a descriptor is requested for an HTLC whose mode is not
+// HTLCModeMiniscript, as the scripts of the other modes cannot be expressed in miniscript.
+var ErrUnsupportedDescriptorMode = func(mode HTLCMode) error {
+	return fmt.Errorf("descriptors are not supported by %q mode htlcs, use %q mode", mode, HTLCModeMiniscript)
+}
+
+// HTLCDescriptor returns the BIP-386 output descriptor of an HTLC in HTLCModeMiniscript, with its BIP-380 checksum.
+// The script tree is described in the same shape as the HTLC assembles it,
+//
+//	tr(<internal key>,{{and_v(v:<hash>(<secret hash>),pk(<redeemer>)),and_v(v:pk(<initiator>),older(<timelock>))},multi_a(2,<initiator>,<redeemer>)})
+//
+// with after() instead of older() for an AbsoluteTimelock. Descriptor wallets can import it to redeem or refund the
+// HTLC.
+//
+// The other modes are not supported and return ErrUnsupportedDescriptorMode. A tr() descriptor can only describe
+// leaves in miniscript, which adds a SIZE check to hash locks and a VERIFY after timelocks, so it can't rebuild the
+// leaves of HTLCModeScript and HTLCModeMuSig2. The BIP-199 script of HTLCModeP2WSH checks the pubkey hash once after
+// both branches, which miniscript can't express either.
+func HTLCDescriptor(htlc *HTLC) (string, error) {
+	if htlc.Mode != HTLCModeMiniscript {
+		return "", ErrUnsupportedDescriptorMode(htlc.Mode)
+	}
+	internalKey, err := htlc.InternalKey()
+	if err != nil {
+		return "", err
+	}
+	// Validates the HTLC the same way its address is derived
+	if _, err := htlcLeaves(htlc); err != nil {
+		return "", err
+	}
+
+	hash := "sha256"
+	if htlc.HashFunction != HashSHA256 {
+		hash = string(htlc.HashFunction)
+	}
+	timelock := "older"
+	if htlc.TimelockType == AbsoluteTimelock {
+		timelock = "after"
+	}
+	desc := fmt.Sprintf("tr(%x,{{and_v(v:%s(%x),pk(%x)),and_v(v:pk(%x),%s(%d))},multi_a(2,%x,%x)})",
+		schnorr.SerializePubKey(internalKey),
+		hash, htlc.SecretHash, htlc.RedeemerPubkey,
+		htlc.InitiatorPubkey, timelock, htlc.Timelock,
+		htlc.InitiatorPubkey, htlc.RedeemerPubkey,
+	)
+	checksum, err := DescriptorChecksum(desc)
+	if err != nil {
+		return "", err
+	}
+	return desc + "#" + checksum, nil
+}
+
+// DescriptorChecksum returns the BIP-380 checksum of the descriptor, without the '#' separator.
+func DescriptorChecksum(desc string) (string, error) {
+	c := uint64(1)
+	cls, clsCount := 0, 0
+	for _, ch := range desc {
+		pos := strings.IndexRune(descriptorInputCharset, ch)
+		if pos < 0 {
+			return "", ErrInvalidDescriptorCharacter(ch)
+		}
+		c = descriptorPolymod(c, pos&31)
+		cls = cls*3 + pos>>5
+		clsCount++
+		if clsCount == 3 {
+			c = descriptorPolymod(c, cls)
+			cls, clsCount = 0, 0
+		}
+	}
+	if clsCount > 0 {
+		c = descriptorPolymod(c, cls)
+	}
+	for i := 0; i < 8; i++ {
+		c = descriptorPolymod(c, 0)
+	}
+	c ^= 1
+
+	checksum := make([]byte, 8)
+	for i := range checksum {
+		checksum[i] = descriptorChecksumCharset[(c>>(5*(7-i)))&31]
+	}
+	return string(checksum), nil
+}
+
+func descriptorPolymod(c uint64, val int) uint64 {
+	c0 := c >> 35
+	c = ((c & 0x7ffffffff) << 5) ^ uint64(val)
+	for i, gen := range []uint64{0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd} {
+		if (c0>>i)&1 == 1 {
+			c ^= gen
+		}
+	}
+	return c
+}
@@ -0,0 +1,178 @@
+package btc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// HTLCEncodingVersion is the version of the HTLC encoding produced by `EncodeHTLC` and `EncodeHTLCJSON`.
+const HTLCEncodingVersion uint8 = 1
+
+// htlcChecksumSize is the size of the checksum appended to the binary HTLC encoding.
+const htlcChecksumSize = 4
+
+// htlcMaxFieldSize bounds the variable sized fields when decoding an HTLC.
+const htlcMaxFieldSize = 80
+
+var (
+	// ErrHTLCChecksumMismatch indicates that the checksum of an encoded HTLC doesn't match its content.
+	ErrHTLCChecksumMismatch = errors.New("htlc checksum mismatch")
+
+	// ErrUnsupportedHTLCEncodingVersion indicates that the HTLC is encoded with an unknown version.
+	ErrUnsupportedHTLCEncodingVersion = func(version uint8) error {
+		return fmt.Errorf("unsupported htlc encoding version %d", version)
+	}
+
+	// ErrInvalidHTLCEncoding indicates that the encoded HTLC cannot be decoded.
+	ErrInvalidHTLCEncoding = func(err error) error {
+		return fmt.Errorf("invalid htlc encoding: %w", err)
+	}
+)
+
+// EncodeHTLC returns the canonical binary encoding of the HTLC, which is
+//
+//	version || var_bytes(initiator pubkey) || var_bytes(redeemer pubkey) || var_bytes(secret hash) ||
+//	uint32_le(timelock) || var_str(timelock type) || var_str(hash function) || var_str(mode) || checksum
+//
+// where the checksum is the first 4 bytes of the double sha256 of the preceding bytes. Counterparties can exchange
+// it, or back it up, to rebuild the address and control blocks of the HTLC.
+func EncodeHTLC(htlc *HTLC) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(HTLCEncodingVersion)
+	for _, field := range [][]byte{htlc.InitiatorPubkey, htlc.RedeemerPubkey, htlc.SecretHash} {
+		if err := wire.WriteVarBytes(buf, 0, field); err != nil {
+			return nil, err
+		}
+	}
+	if err := binary.Write(buf, binary.LittleEndian, htlc.Timelock); err != nil {
+		return nil, err
+	}
+	for _, field := range []string{string(htlc.TimelockType), string(htlc.HashFunction), string(htlc.Mode)} {
+		if err := wire.WriteVarString(buf, 0, field); err != nil {
+			return nil, err
+		}
+	}
+	buf.Write(htlcChecksum(buf.Bytes()))
+	return buf.Bytes(), nil
+}
+
+// DecodeHTLC decodes an HTLC encoded with `EncodeHTLC` after verifying its checksum.
+func DecodeHTLC(data []byte) (*HTLC, error) {
+	if len(data) < htlcChecksumSize+1 {
+		return nil, ErrInvalidHTLCEncoding(errors.New("too short"))
+	}
+	payload, checksum := data[:len(data)-htlcChecksumSize], data[len(data)-htlcChecksumSize:]
+	if !bytes.Equal(htlcChecksum(payload), checksum) {
+		return nil, ErrHTLCChecksumMismatch
+	}
+	if payload[0] != HTLCEncodingVersion {
+		return nil, ErrUnsupportedHTLCEncodingVersion(payload[0])
+	}
+
+	r := bytes.NewReader(payload[1:])
+	htlc := &HTLC{}
+	var err error
+	for _, field := range []*[]byte{&htlc.InitiatorPubkey, &htlc.RedeemerPubkey, &htlc.SecretHash} {
+		if *field, err = wire.ReadVarBytes(r, 0, htlcMaxFieldSize, "htlc field"); err != nil {
+			return nil, ErrInvalidHTLCEncoding(err)
+		}
+	}
+	if err := binary.Read(r, binary.LittleEndian, &htlc.Timelock); err != nil {
+		return nil, ErrInvalidHTLCEncoding(err)
+	}
+	fields := make([]string, 3)
+	for i := range fields {
+		if fields[i], err = wire.ReadVarString(r, 0); err != nil {
+			return nil, ErrInvalidHTLCEncoding(err)
+		}
+	}
+	htlc.TimelockType, htlc.HashFunction, htlc.Mode = TimelockType(fields[0]), HashFunction(fields[1]), HTLCMode(fields[2])
+	if r.Len() != 0 {
+		return nil, ErrInvalidHTLCEncoding(errors.New("trailing bytes"))
+	}
+	return htlc, nil
+}
+
+// htlcJSON is the JSON encoding of an HTLC, the checksum is the one of its binary encoding.
+type htlcJSON struct {
+	Version         uint8        `json:"version"`
+	InitiatorPubkey string       `json:"initiator_pubkey"`
+	RedeemerPubkey  string       `json:"redeemer_pubkey"`
+	SecretHash      string       `json:"secret_hash"`
+	Timelock        uint32       `json:"timelock"`
+	TimelockType    TimelockType `json:"timelock_type,omitempty"`
+	HashFunction    HashFunction `json:"hash_function,omitempty"`
+	Mode            HTLCMode     `json:"mode,omitempty"`
+	Checksum        string       `json:"checksum"`
+}
+
+// EncodeHTLCJSON returns the JSON encoding of the HTLC, with the same version and checksum as `EncodeHTLC`.
+func EncodeHTLCJSON(htlc *HTLC) ([]byte, error) {
+	encoded, err := EncodeHTLC(htlc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(htlcJSON{
+		Version:         HTLCEncodingVersion,
+		InitiatorPubkey: hex.EncodeToString(htlc.InitiatorPubkey),
+		RedeemerPubkey:  hex.EncodeToString(htlc.RedeemerPubkey),
+		SecretHash:      hex.EncodeToString(htlc.SecretHash),
+		Timelock:        htlc.Timelock,
+		TimelockType:    htlc.TimelockType,
+		HashFunction:    htlc.HashFunction,
+		Mode:            htlc.Mode,
+		Checksum:        hex.EncodeToString(encoded[len(encoded)-htlcChecksumSize:]),
+	})
+}
+
+// DecodeHTLCJSON decodes an HTLC encoded with `EncodeHTLCJSON` after verifying its checksum.
+func DecodeHTLCJSON(data []byte) (*HTLC, error) {
+	var encoded htlcJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, ErrInvalidHTLCEncoding(err)
+	}
+	if encoded.Version != HTLCEncodingVersion {
+		return nil, ErrUnsupportedHTLCEncodingVersion(encoded.Version)
+	}
+
+	htlc := &HTLC{
+		Timelock:     encoded.Timelock,
+		TimelockType: encoded.TimelockType,
+		HashFunction: encoded.HashFunction,
+		Mode:         encoded.Mode,
+	}
+	var err error
+	if htlc.InitiatorPubkey, err = hex.DecodeString(encoded.InitiatorPubkey); err != nil {
+		return nil, ErrInvalidHTLCEncoding(err)
+	}
+	if htlc.RedeemerPubkey, err = hex.DecodeString(encoded.RedeemerPubkey); err != nil {
+		return nil, ErrInvalidHTLCEncoding(err)
+	}
+	if htlc.SecretHash, err = hex.DecodeString(encoded.SecretHash); err != nil {
+		return nil, ErrInvalidHTLCEncoding(err)
+	}
+	checksum, err := hex.DecodeString(encoded.Checksum)
+	if err != nil {
+		return nil, ErrInvalidHTLCEncoding(err)
+	}
+
+	binaryEncoded, err := EncodeHTLC(htlc)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(binaryEncoded[len(binaryEncoded)-htlcChecksumSize:], checksum) {
+		return nil, ErrHTLCChecksumMismatch
+	}
+	return htlc, nil
+}
+
+func htlcChecksum(payload []byte) []byte {
+	return chainhash.DoubleHashB(payload)[:htlcChecksumSize]
+}
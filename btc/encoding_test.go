@@ -0,0 +1,341 @@
+package btc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/blockchain/btc"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTLC encoding", func() {
+	network := &chaincfg.RegressionNetParams
+
+	var htlc *btc.HTLC
+
+	BeforeEach(func() {
+		initiator, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		redeemer, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		secretHash := sha256.Sum256([]byte("secret"))
+		htlc = &btc.HTLC{
+			InitiatorPubkey: schnorr.SerializePubKey(initiator.PubKey()),
+			RedeemerPubkey:  schnorr.SerializePubKey(redeemer.PubKey()),
+			SecretHash:      secretHash[:],
+			Timelock:        850000,
+			TimelockType:    btc.AbsoluteTimelock,
+			Mode:            btc.HTLCModeMuSig2,
+		}
+	})
+
+	It("should encode and decode an HTLC", func() {
+		encoded, err := btc.EncodeHTLC(htlc)
+		Expect(err).To(BeNil())
+		Expect(encoded[0]).Should(Equal(btc.HTLCEncodingVersion))
+		decoded, err := btc.DecodeHTLC(encoded)
+		Expect(err).To(BeNil())
+		Expect(decoded).Should(Equal(htlc))
+
+		By("Reject a corrupted encoding")
+		encoded[5] ^= 1
+		_, err = btc.DecodeHTLC(encoded)
+		Expect(err).Should(Equal(btc.ErrHTLCChecksumMismatch))
+		_, err = btc.DecodeHTLC(encoded[:3])
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("should encode and decode an HTLC in JSON", func() {
+		encoded, err := btc.EncodeHTLCJSON(htlc)
+		Expect(err).To(BeNil())
+		decoded, err := btc.DecodeHTLCJSON(encoded)
+		Expect(err).To(BeNil())
+		Expect(decoded).Should(Equal(htlc))
+
+		By("Reject a tampered field")
+		fields := map[string]interface{}{}
+		Expect(json.Unmarshal(encoded, &fields)).Should(Succeed())
+		Expect(fields["timelock"]).Should(BeNumerically("==", 850000))
+		fields["timelock"] = 850001
+		tampered, err := json.Marshal(fields)
+		Expect(err).To(BeNil())
+		_, err = btc.DecodeHTLCJSON(tampered)
+		Expect(err).Should(Equal(btc.ErrHTLCChecksumMismatch))
+
+		By("Reject unknown versions")
+		fields["version"] = 2
+		tampered, err = json.Marshal(fields)
+		Expect(err).To(BeNil())
+		_, err = btc.DecodeHTLCJSON(tampered)
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("should compute BIP-380 descriptor checksums", func() {
+		checksum, err := btc.DescriptorChecksum("raw(deadbeef)")
+		Expect(err).To(BeNil())
+		Expect(checksum).Should(Equal("89f8spxm"))
+		_, err = btc.DescriptorChecksum("raw(deadbeef)\n")
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("should export a descriptor rebuilding the HTLC address", func() {
+		htlcWallet, err := btc.NewHTLCWallet(nil, nil, network)
+		Expect(err).To(BeNil())
+
+		By("Reject the HTLCs whose leaves are not miniscript")
+		for _, mode := range []btc.HTLCMode{btc.HTLCModeScript, btc.HTLCModeMuSig2, btc.HTLCModeP2WSH} {
+			htlc.Mode = mode
+			_, err = btc.HTLCDescriptor(htlc)
+			Expect(err).Should(Equal(btc.ErrUnsupportedDescriptorMode(mode)))
+		}
+
+		htlc.Mode = btc.HTLCModeMiniscript
+		for _, timelockType := range []btc.TimelockType{btc.AbsoluteTimelock, btc.RelativeTimelock} {
+			htlc.TimelockType = timelockType
+			if timelockType == btc.RelativeTimelock {
+				htlc.Timelock = 144
+			}
+			desc, err := btc.HTLCDescriptor(htlc)
+			Expect(err).To(BeNil())
+			body, checksum, ok := strings.Cut(desc, "#")
+			Expect(ok).Should(BeTrue())
+			Expect(btc.DescriptorChecksum(body)).Should(Equal(checksum))
+
+			By("Rebuild the address from the descriptor only")
+			addr := descriptorAddress(body, network)
+			htlcAddr, err := htlcWallet.Address(htlc)
+			Expect(err).To(BeNil())
+			Expect(addr.EncodeAddress()).Should(Equal(htlcAddr.EncodeAddress()))
+		}
+	})
+
+	It("should keep the leading zeros of the output key in the address", func() {
+		htlcWallet, err := btc.NewHTLCWallet(nil, nil, network)
+		Expect(err).To(BeNil())
+		htlc.Mode = btc.HTLCModeScript
+
+		// The x coordinate of one in 256 output keys starts with a zero byte, which big.Int drops
+		leadingZero := false
+		for i := 0; i < 10000 && !leadingZero; i++ {
+			secretHash := sha256.Sum256([]byte(strconv.Itoa(i)))
+			htlc.SecretHash = secretHash[:]
+			addr, err := htlcWallet.Address(htlc)
+			Expect(err).To(BeNil())
+			outputKey := addr.ScriptAddress()
+			Expect(outputKey).Should(HaveLen(schnorr.PubKeyBytesLen))
+
+			x := new(big.Int).SetBytes(outputKey).Bytes()
+			if outputKey[0] != 0 {
+				oldAddr, err := btcutil.NewAddressTaproot(x, network)
+				Expect(err).To(BeNil())
+				Expect(oldAddr.EncodeAddress()).Should(Equal(addr.EncodeAddress()))
+				continue
+			}
+			leadingZero = true
+			_, err = btcutil.NewAddressTaproot(x, network)
+			Expect(err).ShouldNot(BeNil())
+		}
+		Expect(leadingZero).Should(BeTrue())
+	})
+
+	It("should spend the HTLCs with miniscript leaves", func(ctx context.Context) {
+		indexer := newRecordedIndexer()
+		initiator, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		redeemer, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		initiatorWallet, err := btc.NewSimpleWallet(initiator, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee)
+		Expect(err).To(BeNil())
+		redeemerWallet, err := btc.NewSimpleWallet(redeemer, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee)
+		Expect(err).To(BeNil())
+		initiatorHTLCWallet, err := btc.NewHTLCWallet(initiatorWallet, indexer, network)
+		Expect(err).To(BeNil())
+		redeemerHTLCWallet, err := btc.NewHTLCWallet(redeemerWallet, indexer, network)
+		Expect(err).To(BeNil())
+
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		Expect(err).To(BeNil())
+		secretHash := sha256.Sum256(secret)
+		htlc := &btc.HTLC{
+			InitiatorPubkey: schnorr.SerializePubKey(initiator.PubKey()),
+			RedeemerPubkey:  schnorr.SerializePubKey(redeemer.PubKey()),
+			SecretHash:      secretHash[:],
+			Timelock:        144,
+			Mode:            btc.HTLCModeMiniscript,
+		}
+		addr, err := initiatorHTLCWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		indexer.fund(addr, 1e5, 1e5)
+		verify := func(tx *wire.MsgTx) {
+			fetcher := indexer.fetcher()
+			sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+			for i, in := range tx.TxIn {
+				prevOut := fetcher.FetchPrevOutput(in.PreviousOutPoint)
+				engine, err := txscript.NewEngine(prevOut.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+				Expect(err).To(BeNil())
+				Expect(engine.Execute()).To(BeNil())
+			}
+		}
+
+		By("Redeem the HTLC with a 32 bytes secret")
+		_, err = redeemerHTLCWallet.Redeem(ctx, htlc, secret[:31])
+		Expect(err).ShouldNot(BeNil())
+		_, err = redeemerHTLCWallet.Execute(ctx, []btc.RawHTLCAction{{Action: btc.RedeemHTLCAction, HTLC: *htlc, Secret: secret, UTXOs: indexer.utxos[addr.EncodeAddress()][:1]}})
+		Expect(err).To(BeNil())
+		verify(indexer.submitted)
+		secrets := btc.ExtractSecrets(addr, []btc.Transaction{toTransaction(indexer.submitted, addr)})
+		Expect(secrets).Should(HaveLen(1))
+		Expect(secrets[0].Secret).Should(Equal(secret))
+
+		By("Refund the HTLC after the timelock")
+		height := uint64(100)
+		indexer.utxos[addr.EncodeAddress()][1].Status = &btc.Status{Confirmed: true, BlockHeight: &height}
+		indexer.tip = 300
+		_, err = initiatorHTLCWallet.Execute(ctx, []btc.RawHTLCAction{{Action: btc.RefundHTLCAction, HTLC: *htlc, UTXOs: indexer.utxos[addr.EncodeAddress()][1:]}})
+		Expect(err).To(BeNil())
+		Expect(indexer.submitted.TxIn[0].Sequence).Should(Equal(htlc.Timelock))
+		verify(indexer.submitted)
+		ok, refunder := btc.IsRefundLeaf(indexer.submitted.TxIn[0].Witness[1])
+		Expect(ok).Should(BeTrue())
+		Expect(refunder).Should(Equal(hex.EncodeToString(htlc.InitiatorPubkey)))
+	})
+})
+
+// descriptorAddress derives the address of a tr() descriptor whose leaves use the miniscript fragments of the HTLC
+// descriptors, compiling them as specified by BIP-379.
+func descriptorAddress(desc string, network *chaincfg.Params) btcutil.Address {
+	Expect(strings.HasPrefix(desc, "tr(") && strings.HasSuffix(desc, ")")).Should(BeTrue())
+	key, tree, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(desc, "tr("), ")"), ",")
+	Expect(ok).Should(BeTrue())
+	internalKey, err := schnorr.ParsePubKey(mustDecodeHex(key))
+	Expect(err).To(BeNil())
+	root := descriptorTree(tree).TapHash()
+	outputKey := txscript.ComputeTaprootOutputKey(internalKey, root[:])
+	addr, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), network)
+	Expect(err).To(BeNil())
+	return addr
+}
+
+// descriptorTree returns the node of a script tree expression, a {left,right} branch or a miniscript leaf.
+func descriptorTree(expr string) txscript.TapNode {
+	if !strings.HasPrefix(expr, "{") {
+		builder := txscript.NewScriptBuilder()
+		compileMiniscript(builder, expr)
+		script, err := builder.Script()
+		Expect(err).To(BeNil())
+		return txscript.NewBaseTapLeaf(script)
+	}
+	args := splitArgs(strings.TrimSuffix(strings.TrimPrefix(expr, "{"), "}"))
+	Expect(args).Should(HaveLen(2))
+	return txscript.NewTapBranch(descriptorTree(args[0]), descriptorTree(args[1]))
+}
+
+// compileMiniscript adds the script of the miniscript expression to the builder.
+func compileMiniscript(builder *txscript.ScriptBuilder, expr string) {
+	if inner, ok := strings.CutPrefix(expr, "v:"); ok {
+		verifyOps := map[byte]byte{
+			txscript.OP_CHECKSIG: txscript.OP_CHECKSIGVERIFY,
+			txscript.OP_EQUAL:    txscript.OP_EQUALVERIFY,
+			txscript.OP_NUMEQUAL: txscript.OP_NUMEQUALVERIFY,
+		}
+		inner := compileScript(inner)
+		if op, ok := verifyOps[inner[len(inner)-1]]; ok {
+			inner[len(inner)-1] = op
+		} else {
+			inner = append(inner, txscript.OP_VERIFY)
+		}
+		builder.AddOps(inner)
+		return
+	}
+
+	name, rest, ok := strings.Cut(expr, "(")
+	Expect(ok).Should(BeTrue())
+	args := splitArgs(strings.TrimSuffix(rest, ")"))
+	hashOps := map[string]byte{
+		"sha256":    txscript.OP_SHA256,
+		"hash256":   txscript.OP_HASH256,
+		"ripemd160": txscript.OP_RIPEMD160,
+		"hash160":   txscript.OP_HASH160,
+	}
+	switch name {
+	case "and_v":
+		compileMiniscript(builder, args[0])
+		compileMiniscript(builder, args[1])
+	case "pk":
+		builder.AddData(mustDecodeHex(args[0])).AddOp(txscript.OP_CHECKSIG)
+	case "older", "after":
+		n, err := strconv.ParseInt(args[0], 10, 64)
+		Expect(err).To(BeNil())
+		op := byte(txscript.OP_CHECKSEQUENCEVERIFY)
+		if name == "after" {
+			op = txscript.OP_CHECKLOCKTIMEVERIFY
+		}
+		builder.AddInt64(n).AddOp(op)
+	case "multi_a":
+		k, err := strconv.ParseInt(args[0], 10, 64)
+		Expect(err).To(BeNil())
+		for i, key := range args[1:] {
+			builder.AddData(mustDecodeHex(key))
+			if i == 0 {
+				builder.AddOp(txscript.OP_CHECKSIG)
+			} else {
+				builder.AddOp(txscript.OP_CHECKSIGADD)
+			}
+		}
+		builder.AddInt64(k).AddOp(txscript.OP_NUMEQUAL)
+	default:
+		hashOp, ok := hashOps[name]
+		Expect(ok).Should(BeTrue(), "unknown fragment %v", name)
+		builder.AddOp(txscript.OP_SIZE).AddInt64(32).AddOp(txscript.OP_EQUALVERIFY).
+			AddOp(hashOp).AddData(mustDecodeHex(args[0])).AddOp(txscript.OP_EQUAL)
+	}
+}
+
+func compileScript(expr string) []byte {
+	builder := txscript.NewScriptBuilder()
+	compileMiniscript(builder, expr)
+	script, err := builder.Script()
+	Expect(err).To(BeNil())
+	return script
+}
+
+// splitArgs splits the comma separated arguments of an expression, ignoring the commas of nested expressions.
+func splitArgs(args string) []string {
+	split := []string{}
+	depth, start := 0, 0
+	for i, c := range args {
+		switch c {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				split = append(split, args[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(split, args[start:])
+}
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	Expect(err).To(BeNil())
+	return b
+}
@@ -91,21 +91,28 @@ func (client *htlcClient) HTLCEvents(ctx context.Context, asset blockchain.Asset
 				continue
 			}
 
+			if VIN.Witness == nil {
+				continue
+			}
 			witness := *VIN.Witness
 			if len(witness) < 3 {
 				continue
 			}
 
-			scriptHex := witness[len(witness)-2]
-			script, err := hex.DecodeString(scriptHex)
-			if err != nil {
-				return nil, err
-			}
-
 			switch assestAddr.(type) {
 			case *btcutil.AddressWitnessScriptHash:
+				// The witness script is the last item of p2wsh witnesses
+				script, err := hex.DecodeString(witness[len(witness)-1])
+				if err != nil {
+					return nil, err
+				}
 				handleWitnessScriptHashEvents(&events, asset, assestAddr, blockHeight, tx.TxID, witness, script)
 			case *btcutil.AddressTaproot:
+				// The leaf script is followed by the control block in taproot witnesses
+				script, err := hex.DecodeString(witness[len(witness)-2])
+				if err != nil {
+					return nil, err
+				}
 				handleTaprootEvents(&events, asset, assestAddr, blockHeight, tx.TxID, witness, script)
 			}
 		}
@@ -117,14 +124,23 @@ func (client *htlcClient) HTLCEvents(ctx context.Context, asset blockchain.Asset
 func handleWitnessScriptHashEvents(events *[]HTLCEvent, asset blockchain.Asset, assestAddr btcutil.Address, blockHeight uint64, txID string, witness []string, script []byte) {
 	addressStr := assestAddr.EncodeAddress()
 	branch := witness[len(witness)-2]
-	if IsHtlc(script) {
+	ok, secretHash := ParseHtlc(script)
+	if ok {
 		if branch == "01" && len(witness) == 5 {
+			secret, err := hex.DecodeString(witness[2])
+			if err != nil {
+				return
+			}
+			if hash, err := HashSHA256.Sum(secret); err != nil || !bytes.Equal(hash, secretHash) {
+				return
+			}
 			*events = append(*events, HTLCRedeemed{
 				id:                  addressStr,
 				redeemTxBlockNumber: blockHeight,
 				redeemTxHash:        txID,
 				asset:               asset,
-				secret:              []byte(witness[2]),
+				secret:              secret,
+				hashFunction:        HashSHA256,
 				redeemerPubkey:      witness[1],
 			})
 		} else if branch == "" && len(witness) == 4 {
@@ -142,12 +158,15 @@ func handleWitnessScriptHashEvents(events *[]HTLCEvent, asset blockchain.Asset,
 func handleTaprootEvents(events *[]HTLCEvent, asset blockchain.Asset, assestAddr btcutil.Address, blockHeight uint64, txID string, witness []string, script []byte) {
 	addressStr := assestAddr.EncodeAddress()
 
-	ok, redeemerPubKey := IsRedeemLeaf(script)
+	ok, hashFunction, secretHash, redeemerPubKey := ParseRedeemLeaf(script)
 	if ok {
 		s, err := hex.DecodeString(witness[1])
 		if err != nil {
 			return
 		}
+		if hash, err := hashFunction.Sum(s); err != nil || !bytes.Equal(hash, secretHash) {
+			return
+		}
 
 		*events = append(*events, HTLCRedeemed{
 			id:                  addressStr,
@@ -155,6 +174,7 @@ func handleTaprootEvents(events *[]HTLCEvent, asset blockchain.Asset, assestAddr
 			redeemTxHash:        txID,
 			asset:               asset,
 			secret:              s,
+			hashFunction:        hashFunction,
 			redeemerPubkey:      redeemerPubKey,
 		})
 		return
@@ -239,6 +259,7 @@ type HTLCRedeemed struct {
 	redeemTxHash        string
 	asset               blockchain.Asset
 	secret              []byte
+	hashFunction        HashFunction
 	redeemerPubkey      string
 }
 
@@ -274,6 +295,11 @@ func (e HTLCRedeemed) Secret() []byte {
 	return e.secret
 }
 
+// HashFunction returns the hash function the secret was committed with, SHA256 for the BIP-199 HTLCs.
+func (e HTLCRedeemed) HashFunction() HashFunction {
+	return e.hashFunction
+}
+
 func (e HTLCRedeemed) RedeemerPubkey() string {
 	return e.redeemerPubkey
 }
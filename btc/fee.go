@@ -1,10 +1,13 @@
 package btc
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"math"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
@@ -25,25 +28,27 @@ const (
 type FeeLevel string
 
 var (
-	MediumFee FeeLevel = "medium"
-	HighFee   FeeLevel = "high"
-	LowFee    FeeLevel = "low"
+	MediumFee  FeeLevel = "medium"
+	HighFee    FeeLevel = "high"
+	LowFee     FeeLevel = "low"
+	EconomyFee FeeLevel = "economy"
+	MinimumFee FeeLevel = "minimum"
 )
 
+// FeeLevels are all the fee levels of a FeeSuggestion, from the lowest to the highest.
+var FeeLevels = []FeeLevel{MinimumFee, EconomyFee, LowFee, MediumFee, HighFee}
+
 var (
-	// RedeemHtlcRefundSigScriptSize is an estimate of the sigScript size when refunding an htlc script
-	// stack number + stack size * 4 + signature + public key + script size
-	RedeemHtlcRefundSigScriptSize = 1 + 4 + 73 + 33 + NormalHtlcSize
+	// RedeemHtlcRefundSigScriptSize is an estimate of the witness weight when refunding an htlc script
+	RedeemHtlcRefundSigScriptSize = EstimateWitnessWeight(HtlcWitnessTemplate(0), txscript.SigHashAll)
 
-	// RedeemHtlcRedeemSigScriptSize is an estimate of the sigScript size when redeeming an htlc script
-	// stack number + stack size * 5 + signature + public key + secret + script size
+	// RedeemHtlcRedeemSigScriptSize is an estimate of the witness weight when redeeming an htlc script
 	RedeemHtlcRedeemSigScriptSize = func(secretSize int) int {
-		return 1 + 5 + 73 + 33 + secretSize + +1 + NormalHtlcSize
+		return EstimateWitnessWeight(HtlcWitnessTemplate(secretSize), txscript.SigHashAll)
 	}
 
-	// RedeemMultisigSigScriptSize is an estimate of the sigScript size from an 2-of-2 multisig script
-	// stack number + stack size * 4 + signature * 2 + script size
-	RedeemMultisigSigScriptSize = 1 + 4 + 73*2 + 71
+	// RedeemMultisigSigScriptSize is an estimate of the witness weight when spending a 2-of-2 multisig script
+	RedeemMultisigSigScriptSize = EstimateWitnessWeight(MultisigWitnessTemplate, txscript.SigHashAll)
 )
 
 // EstimateVirtualSize will return an estimate virtual size of the given unsigned tx. The extraBaseSize will be the signature
@@ -75,6 +80,10 @@ func EstimateSegwitFee(tx *wire.MsgTx, estimator FeeEstimator, feeLevel FeeLevel
 		feeRate = fees.High
 	case LowFee:
 		feeRate = fees.Low
+	case EconomyFee:
+		feeRate = fees.Economy
+	case MinimumFee:
+		feeRate = fees.Minimum
 	}
 
 	return vSize * feeRate, nil
@@ -109,6 +118,36 @@ type FeeSuggestion struct {
 	High    int `json:"fastestFee"`
 }
 
+// Level returns the fee rate of the given fee level, it returns the medium fee rate for unknown levels.
+func (fees FeeSuggestion) Level(level FeeLevel) int {
+	return *fees.level(level)
+}
+
+func (fees *FeeSuggestion) level(level FeeLevel) *int {
+	switch level {
+	case MinimumFee:
+		return &fees.Minimum
+	case EconomyFee:
+		return &fees.Economy
+	case LowFee:
+		return &fees.Low
+	case HighFee:
+		return &fees.High
+	default:
+		return &fees.Medium
+	}
+}
+
+// ordered makes sure a faster fee level never suggests a lower fee rate than a slower one.
+func (fees FeeSuggestion) ordered() FeeSuggestion {
+	for i := 1; i < len(FeeLevels); i++ {
+		if prev := fees.Level(FeeLevels[i-1]); *fees.level(FeeLevels[i]) < prev {
+			*fees.level(FeeLevels[i]) = prev
+		}
+	}
+	return fees
+}
+
 type FeeEstimator interface {
 	FeeSuggestion() (FeeSuggestion, error)
 }
@@ -240,3 +279,480 @@ func NewFixFeeEstimator(fee int) FeeEstimator {
 		fee: fee,
 	}
 }
+
+// nodeFeeTargets are the confirmation targets (in blocks) we use for each field of the FeeSuggestion when estimating
+// fees with a bitcoin node. They match the targets used by the blockstream estimator.
+var nodeFeeTargets = struct {
+	Minimum, Economy, Low, Medium, High int64
+}{
+	Minimum: 504,
+	Economy: 144,
+	Low:     6,
+	Medium:  3,
+	High:    1,
+}
+
+// maxBlockVSize is the maximum virtual size of a block.
+const maxBlockVSize = blockchain.MaxBlockWeight / blockchain.WitnessScaleFactor
+
+type nodeFeeEstimator struct {
+	client Client
+
+	mu       *sync.Mutex
+	last     FeeSuggestion
+	lastTime time.Time
+	ttl      time.Duration
+}
+
+// NewNodeFeeEstimator returns a FeeEstimator which estimates fees using the bitcoind node behind the given client. For
+// each fee level it takes the higher fee rate between `estimatesmartfee` and a fee-rate histogram built from the
+// node's mempool, and it never returns a fee rate lower than the `mempoolminfee` of the node.
+func NewNodeFeeEstimator(client Client, ttl time.Duration) FeeEstimator {
+	return &nodeFeeEstimator{
+		client: client,
+		mu:     new(sync.Mutex),
+		ttl:    ttl,
+	}
+}
+
+func (f *nodeFeeEstimator) FeeSuggestion() (FeeSuggestion, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.lastTime.IsZero() && time.Since(f.lastTime) < f.ttl {
+		return f.last, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultAPITimeout)
+	defer cancel()
+
+	info, err := f.client.GetMempoolInfo(ctx)
+	if err != nil {
+		return FeeSuggestion{}, err
+	}
+	minFee := int(math.Ceil(btcPerKvBToSatsPerVB(math.Max(info.MempoolMinFee, info.MinRelayTxFee))))
+	if minFee < 1 {
+		minFee = 1
+	}
+
+	entries, err := f.client.GetRawMempoolVerbose(ctx)
+	if err != nil {
+		return FeeSuggestion{}, err
+	}
+	histogram := newFeeHistogram(entries)
+
+	feeRate := func(target int64) (int, error) {
+		rate := histogram.FeeRateAt(target * maxBlockVSize)
+		result, err := f.client.EstimateSmartFee(ctx, target)
+		if err != nil {
+			return 0, err
+		}
+		// The node returns errors instead of a fee rate when it doesn't have enough data, we rely on the mempool and
+		// the minimum fee in that case.
+		if result.FeeRate != nil && len(result.Errors) == 0 {
+			rate = math.Max(rate, btcPerKvBToSatsPerVB(*result.FeeRate))
+		}
+		if int(math.Ceil(rate)) < minFee {
+			return minFee, nil
+		}
+		return int(math.Ceil(rate)), nil
+	}
+
+	var fees FeeSuggestion
+	targets := []struct {
+		fee    *int
+		target int64
+	}{
+		{&fees.Minimum, nodeFeeTargets.Minimum},
+		{&fees.Economy, nodeFeeTargets.Economy},
+		{&fees.Low, nodeFeeTargets.Low},
+		{&fees.Medium, nodeFeeTargets.Medium},
+		{&fees.High, nodeFeeTargets.High},
+	}
+	for _, t := range targets {
+		if *t.fee, err = feeRate(t.target); err != nil {
+			return FeeSuggestion{}, err
+		}
+	}
+	fees = fees.ordered()
+
+	f.last = fees
+	f.lastTime = time.Now()
+	return fees, nil
+}
+
+// feeHistogram is the mempool txs sorted by their fee rates in descending order, along with the accumulated virtual
+// size of all the txs paying a higher or equal fee rate.
+type feeHistogram []feeHistogramBucket
+
+type feeHistogramBucket struct {
+	// FeeRate in sats/vB
+	FeeRate float64
+	// AccumulatedVSize is the total virtual size of txs paying at least FeeRate
+	AccumulatedVSize int64
+}
+
+func newFeeHistogram(entries map[string]MempoolEntry) feeHistogram {
+	histogram := make(feeHistogram, 0, len(entries))
+	for _, entry := range entries {
+		if entry.VSize <= 0 {
+			continue
+		}
+		histogram = append(histogram, feeHistogramBucket{
+			FeeRate:          math.Round(entry.Fees.Base*1e8) / float64(entry.VSize),
+			AccumulatedVSize: entry.VSize,
+		})
+	}
+	sort.Slice(histogram, func(i, j int) bool {
+		return histogram[i].FeeRate > histogram[j].FeeRate
+	})
+	for i := 1; i < len(histogram); i++ {
+		histogram[i].AccumulatedVSize += histogram[i-1].AccumulatedVSize
+	}
+	return histogram
+}
+
+// FeeRateAt returns the fee rate a tx needs to pay to be ahead of the txs taking `depth` virtual bytes of blocks. It
+// returns 0 if the mempool is not deep enough.
+func (histogram feeHistogram) FeeRateAt(depth int64) float64 {
+	for _, bucket := range histogram {
+		if bucket.AccumulatedVSize > depth {
+			return bucket.FeeRate
+		}
+	}
+	return 0
+}
+
+// btcPerKvBToSatsPerVB converts fee rates returned by bitcoind (BTC/kvB) to sats/vB.
+func btcPerKvBToSatsPerVB(feeRate float64) float64 {
+	return math.Round(feeRate*1e8) / 1000
+}
+
+var (
+	// ErrNotEnoughFeeSources is returned by the aggregate fee estimator when too few of the sources returned a fee
+	// suggestion.
+	ErrNotEnoughFeeSources = func(have, need int) error {
+		return fmt.Errorf("not enough fee sources: have %d, need %d", have, need)
+	}
+
+	// ErrInvalidFeeBounds is returned when the minimum fee rate of a fee level is higher than the maximum.
+	ErrInvalidFeeBounds = func(level FeeLevel, min, max int) error {
+		return fmt.Errorf("invalid fee bounds for %v: min %d > max %d", level, min, max)
+	}
+
+	// ErrCrossingFeeBounds is returned when the minimum fee rate of a fee level is higher than the maximum of a
+	// faster one, the fee levels could not be both bounded and ordered.
+	ErrCrossingFeeBounds = func(slow FeeLevel, min int, fast FeeLevel, max int) error {
+		return fmt.Errorf("crossing fee bounds: min %d of %v > max %d of %v", min, slow, max, fast)
+	}
+)
+
+// FeeAggregation is the method used by the aggregate fee estimator to combine fee rates of different sources.
+type FeeAggregation string
+
+var (
+	// AggregationMedian takes the median of the fee rates.
+	AggregationMedian FeeAggregation = "median"
+
+	// AggregationWeighted takes the weighted average of the fee rates using the weight of each source.
+	AggregationWeighted FeeAggregation = "weighted"
+)
+
+// DefaultOutlierRatio is the default ratio to the median over which a fee rate is considered as an outlier.
+const DefaultOutlierRatio = 3.0
+
+// FeeSource is a named FeeEstimator used by the aggregate fee estimator.
+type FeeSource struct {
+	Name      string
+	Estimator FeeEstimator
+	// Weight of the source when using AggregationWeighted, sources with a non-positive weight count as 1.
+	Weight float64
+}
+
+// AggregatedFeeSuggestion is the result of an aggregate fee estimator along with where the fee rates come from.
+type AggregatedFeeSuggestion struct {
+	FeeSuggestion
+
+	// Contributors are the name of the sources used for each fee level, outliers are not included.
+	Contributors map[FeeLevel][]string
+
+	// Outliers are the name of the sources discarded for each fee level.
+	Outliers map[FeeLevel][]string
+
+	// Failures are the errors returned by the sources, mapped by their names.
+	Failures map[string]error
+}
+
+// AggregateFeeEstimator is a FeeEstimator combining the fee suggestions of multiple FeeEstimators.
+type AggregateFeeEstimator interface {
+	FeeEstimator
+
+	// Aggregate queries all the sources and returns the aggregated fee suggestion and which sources contributed to it.
+	Aggregate() (AggregatedFeeSuggestion, error)
+}
+
+type feeBounds struct {
+	min, max int
+}
+
+type aggregateFeeEstimator struct {
+	sources      []FeeSource
+	aggregation  FeeAggregation
+	outlierRatio float64
+	minSources   int
+	bounds       map[FeeLevel]feeBounds
+	smoothing    float64
+
+	mu   *sync.Mutex
+	last *FeeSuggestion
+}
+
+// NewAggregateFeeEstimator returns a FeeEstimator which queries all the sources concurrently and combines their fee
+// rates for each fee level. By default, it takes the median of the fee rates after discarding the outliers.
+func NewAggregateFeeEstimator(sources []FeeSource, opts ...func(*aggregateFeeEstimator) error) (AggregateFeeEstimator, error) {
+	if len(sources) == 0 {
+		return nil, ErrNotEnoughFeeSources(0, 1)
+	}
+
+	estimator := &aggregateFeeEstimator{
+		sources:      sources,
+		aggregation:  AggregationMedian,
+		outlierRatio: DefaultOutlierRatio,
+		minSources:   1,
+		bounds:       map[FeeLevel]feeBounds{},
+		smoothing:    1,
+		mu:           new(sync.Mutex),
+	}
+	for _, opt := range opts {
+		if err := opt(estimator); err != nil {
+			return nil, err
+		}
+	}
+	if estimator.minSources > len(sources) {
+		return nil, ErrNotEnoughFeeSources(len(sources), estimator.minSources)
+	}
+	for i, slow := range FeeLevels {
+		for _, fast := range FeeLevels[i+1:] {
+			min, max := estimator.bounds[slow].min, estimator.bounds[fast].max
+			if max > 0 && min > max {
+				return nil, ErrCrossingFeeBounds(slow, min, fast, max)
+			}
+		}
+	}
+	return estimator, nil
+}
+
+// WithAggregation sets the method used to combine the fee rates of the sources.
+func WithAggregation(aggregation FeeAggregation) func(*aggregateFeeEstimator) error {
+	return func(f *aggregateFeeEstimator) error {
+		switch aggregation {
+		case AggregationMedian, AggregationWeighted:
+			f.aggregation = aggregation
+			return nil
+		default:
+			return fmt.Errorf("unknown fee aggregation: %v", aggregation)
+		}
+	}
+}
+
+// WithOutlierRatio discards fee rates which are more than `ratio` times higher or lower than the median. A ratio of 0
+// disables the outlier rejection.
+func WithOutlierRatio(ratio float64) func(*aggregateFeeEstimator) error {
+	return func(f *aggregateFeeEstimator) error {
+		if ratio != 0 && ratio <= 1 {
+			return fmt.Errorf("outlier ratio should be greater than 1, got %v", ratio)
+		}
+		f.outlierRatio = ratio
+		return nil
+	}
+}
+
+// WithMinSources sets the minimum number of sources which need to return a fee suggestion.
+func WithMinSources(n int) func(*aggregateFeeEstimator) error {
+	return func(f *aggregateFeeEstimator) error {
+		if n < 1 {
+			return fmt.Errorf("min sources should be at least 1, got %v", n)
+		}
+		f.minSources = n
+		return nil
+	}
+}
+
+// WithFeeBounds sets the floor and ceiling of the fee rate of the given fee level. A max of 0 means no ceiling.
+func WithFeeBounds(level FeeLevel, min, max int) func(*aggregateFeeEstimator) error {
+	return func(f *aggregateFeeEstimator) error {
+		if max > 0 && min > max {
+			return ErrInvalidFeeBounds(level, min, max)
+		}
+		f.bounds[level] = feeBounds{min: min, max: max}
+		return nil
+	}
+}
+
+// WithSmoothing smooths sudden jumps of the fee rates with an exponential moving average, `alpha` is the weight of the
+// latest fee rates in (0, 1]. An alpha of 1 disables the smoothing.
+func WithSmoothing(alpha float64) func(*aggregateFeeEstimator) error {
+	return func(f *aggregateFeeEstimator) error {
+		if alpha <= 0 || alpha > 1 {
+			return fmt.Errorf("smoothing factor should be in (0, 1], got %v", alpha)
+		}
+		f.smoothing = alpha
+		return nil
+	}
+}
+
+func (f *aggregateFeeEstimator) FeeSuggestion() (FeeSuggestion, error) {
+	result, err := f.Aggregate()
+	if err != nil {
+		return FeeSuggestion{}, err
+	}
+	return result.FeeSuggestion, nil
+}
+
+func (f *aggregateFeeEstimator) Aggregate() (AggregatedFeeSuggestion, error) {
+	// Query all the sources concurrently
+	suggestions := make([]FeeSuggestion, len(f.sources))
+	errs := make([]error, len(f.sources))
+	wg := new(sync.WaitGroup)
+	for i := range f.sources {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			suggestions[i], errs[i] = f.sources[i].Estimator.FeeSuggestion()
+		}(i)
+	}
+	wg.Wait()
+
+	result := AggregatedFeeSuggestion{
+		Contributors: map[FeeLevel][]string{},
+		Outliers:     map[FeeLevel][]string{},
+		Failures:     map[string]error{},
+	}
+	sources := make([]FeeSource, 0, len(f.sources))
+	fees := make([]FeeSuggestion, 0, len(f.sources))
+	for i, source := range f.sources {
+		if errs[i] != nil {
+			result.Failures[source.Name] = errs[i]
+			continue
+		}
+		sources = append(sources, source)
+		fees = append(fees, suggestions[i])
+	}
+	if len(sources) < f.minSources {
+		return AggregatedFeeSuggestion{}, ErrNotEnoughFeeSources(len(sources), f.minSources)
+	}
+
+	for _, level := range FeeLevels {
+		rates := make([]float64, len(fees))
+		for i := range fees {
+			rates[i] = float64(fees[i].Level(level))
+		}
+		median := medianOf(rates)
+
+		var kept []float64
+		var weights []float64
+		for i, rate := range rates {
+			if f.isOutlier(rate, median) {
+				result.Outliers[level] = append(result.Outliers[level], sources[i].Name)
+				continue
+			}
+			kept = append(kept, rate)
+			weights = append(weights, sources[i].Weight)
+			result.Contributors[level] = append(result.Contributors[level], sources[i].Name)
+		}
+
+		var rate float64
+		switch f.aggregation {
+		case AggregationWeighted:
+			rate = weightedAverageOf(kept, weights)
+		default:
+			rate = medianOf(kept)
+		}
+		*result.level(level) = int(math.Ceil(rate))
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// The smoothing state is kept before the bounds are applied
+	smoothed := f.smooth(result.FeeSuggestion)
+	f.last = &smoothed
+	result.FeeSuggestion = f.bound(smoothed.ordered())
+	return result, nil
+}
+
+// bound applies the floors and ceilings of the ordered fee levels. A floor also raises the faster levels and a
+// ceiling also lowers the slower ones, so the levels stay ordered. The ceilings are applied last, they never cross
+// the floors of the slower levels.
+func (f *aggregateFeeEstimator) bound(fees FeeSuggestion) FeeSuggestion {
+	for i, level := range FeeLevels {
+		bound := f.bounds[level]
+		for _, faster := range FeeLevels[i:] {
+			if rate := fees.level(faster); *rate < bound.min {
+				*rate = bound.min
+			}
+		}
+	}
+	for i, level := range FeeLevels {
+		bound := f.bounds[level]
+		if bound.max == 0 {
+			continue
+		}
+		for _, slower := range FeeLevels[:i+1] {
+			if rate := fees.level(slower); *rate > bound.max {
+				*rate = bound.max
+			}
+		}
+	}
+	return fees
+}
+
+// isOutlier checks if the rate is too far away from the median. The median is never an outlier, which means we always
+// have at least one fee rate left.
+func (f *aggregateFeeEstimator) isOutlier(rate, median float64) bool {
+	if f.outlierRatio == 0 || median == 0 {
+		return false
+	}
+	return rate > median*f.outlierRatio || rate < median/f.outlierRatio
+}
+
+// smooth applies the exponential moving average on the fee rates using the last result.
+func (f *aggregateFeeEstimator) smooth(fees FeeSuggestion) FeeSuggestion {
+	if f.last == nil || f.smoothing == 1 {
+		return fees
+	}
+	for _, level := range FeeLevels {
+		rate := fees.level(level)
+		*rate = int(math.Ceil(f.smoothing*float64(*rate) + (1-f.smoothing)*float64(f.last.Level(level))))
+	}
+	return fees
+}
+
+func medianOf(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func weightedAverageOf(values, weights []float64) float64 {
+	total, totalWeight := 0.0, 0.0
+	for i, value := range values {
+		weight := weights[i]
+		if weight <= 0 {
+			weight = 1
+		}
+		total += value * weight
+		totalWeight += weight
+	}
+	if totalWeight == 0 {
+		return 0
+	}
+	return total / totalWeight
+}
@@ -4,14 +4,19 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"time"
 
 	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcwallet/waddrmgr"
@@ -163,6 +168,205 @@ var _ = Describe("bitcoin fees", func() {
 				Expect(fees.High).Should(Equal(fee))
 			})
 		})
+
+		Context("node estimator", func() {
+			estimates := map[int64]string{
+				1:   `{"feerate":0.00015,"blocks":2}`,
+				3:   `{"feerate":0.0001,"blocks":3}`,
+				6:   `{"feerate":0.00005,"blocks":6}`,
+				144: `{"errors":["Insufficient data or no feerate found"],"blocks":0}`,
+				504: `{"feerate":0.00001,"blocks":504}`,
+			}
+			mempoolInfo := `{"loaded":true,"size":4,"bytes":3100000,"usage":9000000,"maxmempool":300000000,"mempoolminfee":0.00002,"minrelaytxfee":0.00001}`
+			rawMempool := `{
+				"a":{"vsize":600000,"weight":2400000,"time":1700000000,"height":800000,"fees":{"base":0.3,"modified":0.3,"ancestor":0.3,"descendant":0.3},"depends":[]},
+				"b":{"vsize":600000,"weight":2400000,"time":1700000000,"height":800000,"fees":{"base":0.12,"modified":0.12,"ancestor":0.12,"descendant":0.12},"depends":[]},
+				"c":{"vsize":1500000,"weight":6000000,"time":1700000000,"height":800000,"fees":{"base":0.075,"modified":0.075,"ancestor":0.075,"descendant":0.075},"depends":[]},
+				"d":{"vsize":400000,"weight":1600000,"time":1700000000,"height":800000,"fees":{"base":0.008,"modified":0.008,"ancestor":0.008,"descendant":0.008},"depends":[]}
+			}`
+
+			It("should combine estimatesmartfee with the mempool histogram", func() {
+				nodeClient := newRecordedNodeClient(estimates, mempoolInfo, rawMempool)
+				estimator := btc.NewNodeFeeEstimator(nodeClient, 15*time.Second)
+				fees, err := estimator.FeeSuggestion()
+				Expect(err).Should(BeNil())
+
+				// 2nd tx in the mempool is the one at 1 block deep
+				Expect(fees.High).Should(Equal(20))
+				Expect(fees.Medium).Should(Equal(10))
+				Expect(fees.Low).Should(Equal(5))
+				// no estimation from the node, fallback to mempoolminfee
+				Expect(fees.Economy).Should(Equal(2))
+				// estimation from the node is lower than the mempoolminfee
+				Expect(fees.Minimum).Should(Equal(2))
+			})
+
+			It("should never suggest a fee lower than the mempool minimum fee", func() {
+				noEstimates := map[int64]string{}
+				for target := range estimates {
+					noEstimates[target] = `{"errors":["Insufficient data or no feerate found"],"blocks":0}`
+				}
+				nodeClient := newRecordedNodeClient(noEstimates, mempoolInfo, `{}`)
+				estimator := btc.NewNodeFeeEstimator(nodeClient, 15*time.Second)
+				fees, err := estimator.FeeSuggestion()
+				Expect(err).Should(BeNil())
+				Expect(fees).Should(Equal(btc.FeeSuggestion{Minimum: 2, Economy: 2, Low: 2, Medium: 2, High: 2}))
+			})
+
+			It("should keep the fee levels in ascending order", func() {
+				unordered := map[int64]string{
+					1:   `{"feerate":0.00003,"blocks":2}`,
+					3:   `{"feerate":0.00004,"blocks":3}`,
+					6:   `{"feerate":0.00008,"blocks":6}`,
+					144: `{"feerate":0.00006,"blocks":144}`,
+					504: `{"feerate":0.00002,"blocks":504}`,
+				}
+				nodeClient := newRecordedNodeClient(unordered, mempoolInfo, `{}`)
+				estimator := btc.NewNodeFeeEstimator(nodeClient, 15*time.Second)
+				fees, err := estimator.FeeSuggestion()
+				Expect(err).Should(BeNil())
+				Expect(fees).Should(Equal(btc.FeeSuggestion{Minimum: 2, Economy: 6, Low: 8, Medium: 8, High: 8}))
+			})
+
+			It("should return an error if the node is not reachable", func() {
+				nodeClient := newRecordedNodeClient(estimates, mempoolInfo, rawMempool)
+				estimator := btc.NewNodeFeeEstimator(nodeClient, 15*time.Second)
+				_, err := estimator.FeeSuggestion()
+				Expect(err).Should(BeNil())
+
+				By("Use the cached result")
+				closeRecordedNodes()
+				_, err = estimator.FeeSuggestion()
+				Expect(err).Should(BeNil())
+
+				By("Request again after the cache expires")
+				estimator = btc.NewNodeFeeEstimator(nodeClient, 0)
+				_, err = estimator.FeeSuggestion()
+				Expect(err).ShouldNot(BeNil())
+			})
+		})
+
+		Context("aggregate estimator", func() {
+			fixed := func(min, economy, low, medium, high int) btc.FeeEstimator {
+				return staticFeeEstimator{fees: btc.FeeSuggestion{Minimum: min, Economy: economy, Low: low, Medium: medium, High: high}}
+			}
+
+			It("should take the median of the sources and discard the outliers", func() {
+				estimator, err := btc.NewAggregateFeeEstimator([]btc.FeeSource{
+					{Name: "a", Estimator: fixed(1, 2, 4, 8, 10)},
+					{Name: "b", Estimator: fixed(1, 2, 5, 9, 12)},
+					{Name: "c", Estimator: fixed(1, 2, 6, 10, 300)},
+				})
+				Expect(err).Should(BeNil())
+				result, err := estimator.Aggregate()
+				Expect(err).Should(BeNil())
+				Expect(result.FeeSuggestion).Should(Equal(btc.FeeSuggestion{Minimum: 1, Economy: 2, Low: 5, Medium: 9, High: 11}))
+				Expect(result.Contributors[btc.HighFee]).Should(Equal([]string{"a", "b"}))
+				Expect(result.Outliers[btc.HighFee]).Should(Equal([]string{"c"}))
+				Expect(result.Contributors[btc.MediumFee]).Should(Equal([]string{"a", "b", "c"}))
+				Expect(result.Failures).Should(BeEmpty())
+			})
+
+			It("should use the weight of the sources", func() {
+				estimator, err := btc.NewAggregateFeeEstimator([]btc.FeeSource{
+					{Name: "a", Estimator: btc.NewFixFeeEstimator(10), Weight: 3},
+					{Name: "b", Estimator: btc.NewFixFeeEstimator(20), Weight: 1},
+				}, btc.WithAggregation(btc.AggregationWeighted))
+				Expect(err).Should(BeNil())
+				fees, err := estimator.FeeSuggestion()
+				Expect(err).Should(BeNil())
+				Expect(fees.Medium).Should(Equal(13))
+			})
+
+			It("should ignore the failed sources", func() {
+				estimator, err := btc.NewAggregateFeeEstimator([]btc.FeeSource{
+					{Name: "a", Estimator: btc.NewFixFeeEstimator(10)},
+					{Name: "b", Estimator: staticFeeEstimator{err: fmt.Errorf("unavailable")}},
+				})
+				Expect(err).Should(BeNil())
+				result, err := estimator.Aggregate()
+				Expect(err).Should(BeNil())
+				Expect(result.Medium).Should(Equal(10))
+				Expect(result.Failures).Should(HaveKey("b"))
+
+				By("Require both sources")
+				estimator, err = btc.NewAggregateFeeEstimator([]btc.FeeSource{
+					{Name: "a", Estimator: btc.NewFixFeeEstimator(10)},
+					{Name: "b", Estimator: staticFeeEstimator{err: fmt.Errorf("unavailable")}},
+				}, btc.WithMinSources(2))
+				Expect(err).Should(BeNil())
+				_, err = estimator.FeeSuggestion()
+				Expect(err).ShouldNot(BeNil())
+			})
+
+			It("should enforce the floors and ceilings of the fee levels", func() {
+				estimator, err := btc.NewAggregateFeeEstimator([]btc.FeeSource{
+					{Name: "a", Estimator: fixed(1, 1, 1, 50, 500)},
+				}, btc.WithFeeBounds(btc.LowFee, 3, 0), btc.WithFeeBounds(btc.HighFee, 0, 100))
+				Expect(err).Should(BeNil())
+				fees, err := estimator.FeeSuggestion()
+				Expect(err).Should(BeNil())
+				Expect(fees).Should(Equal(btc.FeeSuggestion{Minimum: 1, Economy: 1, Low: 3, Medium: 50, High: 100}))
+
+				_, err = btc.NewAggregateFeeEstimator([]btc.FeeSource{
+					{Name: "a", Estimator: fixed(1, 1, 1, 50, 500)},
+				}, btc.WithFeeBounds(btc.LowFee, 10, 5))
+				Expect(err).ShouldNot(BeNil())
+			})
+
+			It("should keep the fee levels ordered when the bounds cross other levels", func() {
+				estimator, err := btc.NewAggregateFeeEstimator([]btc.FeeSource{
+					{Name: "a", Estimator: fixed(1, 2, 10, 50, 60)},
+				}, btc.WithFeeBounds(btc.HighFee, 1, 30), btc.WithFeeBounds(btc.EconomyFee, 20, 0))
+				Expect(err).Should(BeNil())
+				fees, err := estimator.FeeSuggestion()
+				Expect(err).Should(BeNil())
+				Expect(fees).Should(Equal(btc.FeeSuggestion{Minimum: 1, Economy: 20, Low: 20, Medium: 30, High: 30}))
+
+				_, err = btc.NewAggregateFeeEstimator([]btc.FeeSource{
+					{Name: "a", Estimator: fixed(1, 2, 10, 50, 60)},
+				}, btc.WithFeeBounds(btc.HighFee, 1, 30), btc.WithFeeBounds(btc.LowFee, 40, 0))
+				Expect(err).ShouldNot(BeNil())
+			})
+
+			It("should smooth the fee rates before applying the bounds", func() {
+				source := &staticFeeEstimator{fees: btc.FeeSuggestion{Minimum: 1, Economy: 1, Low: 1, Medium: 10, High: 500}}
+				estimator, err := btc.NewAggregateFeeEstimator([]btc.FeeSource{
+					{Name: "a", Estimator: source},
+				}, btc.WithSmoothing(0.5), btc.WithFeeBounds(btc.HighFee, 0, 100))
+				Expect(err).Should(BeNil())
+				fees, err := estimator.FeeSuggestion()
+				Expect(err).Should(BeNil())
+				Expect(fees.High).Should(Equal(100))
+
+				source.fees.High = 20
+				fees, err = estimator.FeeSuggestion()
+				Expect(err).Should(BeNil())
+				Expect(fees.High).Should(Equal(100))
+
+				By("Not share the state with the results")
+				fees.Medium = 1000
+				fees, err = estimator.FeeSuggestion()
+				Expect(err).Should(BeNil())
+				Expect(fees.Medium).Should(Equal(10))
+			})
+
+			It("should smooth sudden jumps of the fee rates", func() {
+				source := &staticFeeEstimator{fees: btc.FeeSuggestion{Minimum: 10, Economy: 10, Low: 10, Medium: 10, High: 10}}
+				estimator, err := btc.NewAggregateFeeEstimator([]btc.FeeSource{
+					{Name: "a", Estimator: source},
+				}, btc.WithSmoothing(0.5))
+				Expect(err).Should(BeNil())
+				fees, err := estimator.FeeSuggestion()
+				Expect(err).Should(BeNil())
+				Expect(fees.Medium).Should(Equal(10))
+
+				source.fees = btc.FeeSuggestion{Minimum: 30, Economy: 30, Low: 30, Medium: 30, High: 30}
+				fees, err = estimator.FeeSuggestion()
+				Expect(err).Should(BeNil())
+				Expect(fees.Medium).Should(Equal(20))
+			})
+		})
 	})
 
 	Context("estimate transaction fees", func() {
@@ -447,3 +651,59 @@ var _ = Describe("bitcoin fees", func() {
 		})
 	})
 })
+
+var recordedNodes []*httptest.Server
+
+// newRecordedNodeClient returns a btc.Client talking to a JSON-RPC stand-in of bitcoind, which replies the fee related
+// rpc calls with the given recorded responses.
+func newRecordedNodeClient(estimates map[int64]string, mempoolInfo, rawMempool string) btc.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+			ID     json.RawMessage   `json:"id"`
+		}
+		Expect(json.NewDecoder(r.Body).Decode(&req)).Should(Succeed())
+
+		result := "null"
+		switch req.Method {
+		case "estimatesmartfee":
+			var target int64
+			Expect(json.Unmarshal(req.Params[0], &target)).Should(Succeed())
+			result = estimates[target]
+		case "getmempoolinfo":
+			result = mempoolInfo
+		case "getrawmempool":
+			result = rawMempool
+		}
+		fmt.Fprintf(w, `{"result":%v,"error":null,"id":%s}`, result, req.ID)
+	}))
+	recordedNodes = append(recordedNodes, server)
+
+	nodeClient, err := btc.NewClient(&rpcclient.ConnConfig{
+		Params:       chaincfg.MainNetParams.Name,
+		Host:         strings.TrimPrefix(server.URL, "http://"),
+		User:         "user",
+		Pass:         "password",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	})
+	Expect(err).Should(BeNil())
+	return nodeClient
+}
+
+func closeRecordedNodes() {
+	for _, server := range recordedNodes {
+		server.Close()
+	}
+	recordedNodes = nil
+}
+
+type staticFeeEstimator struct {
+	fees btc.FeeSuggestion
+	err  error
+}
+
+func (f staticFeeEstimator) FeeSuggestion() (btc.FeeSuggestion, error) {
+	return f.fees, f.err
+}
@@ -0,0 +1,93 @@
+package btc
+
+import (
+	"context"
+)
+
+// FundingStatus is the state of the deposits of an HTLC compared to the amount agreed by the counterparties, see
+// `HTLCWallet.VerifyFunding`.
+type FundingStatus struct {
+	// Expected amount of the HTLC
+	Expected int64
+	// UTXOs are the deposits confirmed deeply enough and above the dust amount. They are the ones to redeem or
+	// refund, by passing them in `RawHTLCAction.UTXOs`.
+	UTXOs UTXOs
+	// Amount is the total amount of the UTXOs
+	Amount int64
+	// Unconfirmed are the deposits with less confirmations than required
+	Unconfirmed UTXOs
+	// Dust are the deposits not above the dust amount, which cost more to spend than they are worth
+	Dust UTXOs
+}
+
+// Funded returns true if the validated deposits cover the expected amount.
+func (status FundingStatus) Funded() bool {
+	return status.Amount >= status.Expected
+}
+
+// Underfunded returns true if the validated deposits are less than the expected amount, the HTLC might still be
+// funded once the unconfirmed deposits confirm.
+func (status FundingStatus) Underfunded() bool {
+	return status.Amount < status.Expected
+}
+
+// Overfunded returns true if the validated deposits are more than the expected amount.
+func (status FundingStatus) Overfunded() bool {
+	return status.Amount > status.Expected
+}
+
+// SplitFunded returns true if the HTLC is funded by more than one validated deposit.
+func (status FundingStatus) SplitFunded() bool {
+	return len(status.UTXOs) > 1
+}
+
+// Pending returns true if some deposits don't have enough confirmations yet.
+func (status FundingStatus) Pending() bool {
+	return len(status.Unconfirmed) > 0
+}
+
+// VerifyFunding compares the deposits of the HTLC against the expected amount. Only the deposits with at least
+// minConfirmations confirmations, and above the dust amount, are validated. Unconfirmed deposits are accepted when
+// minConfirmations is 0.
+func (hw *htlcWallet) VerifyFunding(ctx context.Context, htlc *HTLC, expected int64, minConfirmations uint64) (FundingStatus, error) {
+	scriptAddr, err := hw.Address(htlc)
+	if err != nil {
+		return FundingStatus{}, err
+	}
+	utxos, err := hw.indexer.GetUTXOs(ctx, scriptAddr)
+	if err != nil {
+		return FundingStatus{}, err
+	}
+	tip := uint64(0)
+	if minConfirmations > 0 {
+		tip, err = hw.indexer.GetTipBlockHeight(ctx)
+		if err != nil {
+			return FundingStatus{}, err
+		}
+	}
+	return verifyFunding(utxos, expected, minConfirmations, tip), nil
+}
+
+func verifyFunding(utxos UTXOs, expected int64, minConfirmations, tip uint64) FundingStatus {
+	status := FundingStatus{Expected: expected}
+	for _, utxo := range utxos {
+		switch {
+		case utxo.Amount <= DustAmount:
+			status.Dust = append(status.Dust, utxo)
+		case confirmations(utxo, tip) < minConfirmations:
+			status.Unconfirmed = append(status.Unconfirmed, utxo)
+		default:
+			status.UTXOs = append(status.UTXOs, utxo)
+			status.Amount += utxo.Amount
+		}
+	}
+	return status
+}
+
+// confirmations returns the number of confirmations of the utxo at the given tip
+func confirmations(utxo UTXO, tip uint64) uint64 {
+	if utxo.Status == nil || !utxo.Status.Confirmed || utxo.Status.BlockHeight == nil || *utxo.Status.BlockHeight > tip {
+		return 0
+	}
+	return tip - *utxo.Status.BlockHeight + 1
+}
@@ -0,0 +1,138 @@
+package btc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/blockchain/btc"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTLC funding", func() {
+	network := &chaincfg.RegressionNetParams
+
+	var (
+		indexer    *recordedIndexer
+		htlcWallet btc.HTLCWallet
+		htlc       *btc.HTLC
+		secret     []byte
+		addr       btcutil.Address
+		utxos      btc.UTXOs
+	)
+
+	BeforeEach(func() {
+		indexer = newRecordedIndexer()
+		privKey, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		wallet, err := btc.NewSimpleWallet(privKey, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee)
+		Expect(err).To(BeNil())
+		htlcWallet, err = btc.NewHTLCWallet(wallet, indexer, network)
+		Expect(err).To(BeNil())
+
+		secret = make([]byte, 32)
+		_, err = rand.Read(secret)
+		Expect(err).To(BeNil())
+		secretHash := sha256.Sum256(secret)
+		// The wallet is both the initiator and the redeemer to redeem and refund
+		htlc = &btc.HTLC{
+			InitiatorPubkey: schnorr.SerializePubKey(privKey.PubKey()),
+			RedeemerPubkey:  schnorr.SerializePubKey(privKey.PubKey()),
+			SecretHash:      secretHash[:],
+			Timelock:        10,
+		}
+		addr, err = htlcWallet.Address(htlc)
+		Expect(err).To(BeNil())
+
+		// A deposit of the agreed amount, a later one, some dust and an unconfirmed one
+		indexer.fund(addr, 1e5, 5e4, 500, 2e4)
+		utxos = indexer.utxos[addr.EncodeAddress()]
+		for i, height := range []uint64{100, 105, 100} {
+			height := height
+			utxos[i].Status = &btc.Status{Confirmed: true, BlockHeight: &height}
+		}
+		utxos[3].Status = &btc.Status{}
+		indexer.tip = 106
+	})
+
+	verify := func(tx *wire.MsgTx) {
+		fetcher := indexer.fetcher()
+		sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+		for i, in := range tx.TxIn {
+			prevOut := fetcher.FetchPrevOutput(in.PreviousOutPoint)
+			engine, err := txscript.NewEngine(prevOut.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+			Expect(err).To(BeNil())
+			Expect(engine.Execute()).To(BeNil())
+		}
+	}
+
+	It("should report the funding state of the HTLC", func(ctx context.Context) {
+		status, err := htlcWallet.VerifyFunding(ctx, htlc, 1e5, 3)
+		Expect(err).To(BeNil())
+		Expect(status.UTXOs).Should(Equal(utxos[:1]))
+		Expect(status.Amount).Should(Equal(int64(1e5)))
+		Expect(status.Unconfirmed).Should(Equal(btc.UTXOs{utxos[1], utxos[3]}))
+		Expect(status.Dust).Should(Equal(utxos[2:3]))
+		Expect(status.Funded()).Should(BeTrue())
+		Expect(status.Overfunded()).Should(BeFalse())
+		Expect(status.SplitFunded()).Should(BeFalse())
+		Expect(status.Pending()).Should(BeTrue())
+
+		By("Accept shallower deposits")
+		status, err = htlcWallet.VerifyFunding(ctx, htlc, 1e5, 1)
+		Expect(err).To(BeNil())
+		Expect(status.Amount).Should(Equal(int64(1.5e5)))
+		Expect(status.Overfunded()).Should(BeTrue())
+		Expect(status.SplitFunded()).Should(BeTrue())
+
+		By("Accept unconfirmed deposits")
+		status, err = htlcWallet.VerifyFunding(ctx, htlc, 2e5, 0)
+		Expect(err).To(BeNil())
+		Expect(status.UTXOs).Should(HaveLen(3))
+		Expect(status.Pending()).Should(BeFalse())
+		Expect(status.Underfunded()).Should(BeTrue())
+		Expect(status.Funded()).Should(BeFalse())
+	})
+
+	It("should only redeem the validated deposits", func(ctx context.Context) {
+		status, err := htlcWallet.VerifyFunding(ctx, htlc, 1e5, 3)
+		Expect(err).To(BeNil())
+		_, err = htlcWallet.Execute(ctx, []btc.RawHTLCAction{{
+			Action: btc.RedeemHTLCAction,
+			HTLC:   *htlc,
+			Secret: secret,
+			UTXOs:  status.UTXOs,
+		}})
+		Expect(err).To(BeNil())
+		Expect(indexer.submitted.TxIn).Should(HaveLen(1))
+		Expect(indexer.submitted.TxIn[0].PreviousOutPoint.Hash.String()).Should(Equal(utxos[0].TxID))
+		verify(indexer.submitted)
+	})
+
+	It("should only refund the validated deposits", func(ctx context.Context) {
+		indexer.tip = 110
+		_, err := htlcWallet.Refund(ctx, htlc, nil)
+		Expect(err).ShouldNot(BeNil())
+
+		status, err := htlcWallet.VerifyFunding(ctx, htlc, 1e5, 10)
+		Expect(err).To(BeNil())
+		Expect(status.UTXOs).Should(Equal(utxos[:1]))
+		_, err = htlcWallet.Execute(ctx, []btc.RawHTLCAction{{
+			Action: btc.RefundHTLCAction,
+			HTLC:   *htlc,
+			UTXOs:  status.UTXOs,
+		}})
+		Expect(err).To(BeNil())
+		Expect(indexer.submitted.TxIn).Should(HaveLen(1))
+		Expect(indexer.submitted.TxIn[0].PreviousOutPoint.Hash.String()).Should(Equal(utxos[0].TxID))
+		verify(indexer.submitted)
+	})
+})
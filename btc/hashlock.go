@@ -0,0 +1,104 @@
+package btc
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"golang.org/x/crypto/ripemd160"
+)
+
+// HashFunction is the digest an HTLC commits the secret to. Bitcoin script has no keccak opcode, so only the hash
+// opcodes of the script are supported. The EVM GardenHTLC commits to the SHA-256 of the secret, which makes
+// HashSHA256 the one to use for swaps against it.
+type HashFunction string
+
+const (
+	// HashSHA256 is `OP_SHA256` with a 32-byte hash, the default and the convention of the EVM GardenHTLC.
+	HashSHA256 HashFunction = ""
+
+	// HashHASH256 is `OP_HASH256`, the double SHA-256, with a 32-byte hash.
+	HashHASH256 HashFunction = "hash256"
+
+	// HashHASH160 is `OP_HASH160`, RIPEMD-160 of the SHA-256, with a 20-byte hash. It can be paired with a Lightning
+	// payment hash, as HASH160(preimage) = RIPEMD160(payment hash).
+	HashHASH160 HashFunction = "hash160"
+
+	// HashRIPEMD160 is `OP_RIPEMD160` with a 20-byte hash.
+	HashRIPEMD160 HashFunction = "ripemd160"
+)
+
+var (
+	// ErrUnknownHashFunction is returned when the hash function of the HTLC is not supported
+	ErrUnknownHashFunction = func(hashFunction HashFunction) error {
+		return fmt.Errorf("unknown hash function %q", hashFunction)
+	}
+
+	// ErrInvalidSecretHashLen is returned when the secret hash doesn't match the digest size of the hash function
+	ErrInvalidSecretHashLen = func(have, want int) error {
+		return fmt.Errorf("invalid secret hash length %d, expected %d", have, want)
+	}
+)
+
+// Opcode returns the script opcode computing the hash function.
+func (hashFunction HashFunction) Opcode() (byte, error) {
+	switch hashFunction {
+	case HashSHA256:
+		return txscript.OP_SHA256, nil
+	case HashHASH256:
+		return txscript.OP_HASH256, nil
+	case HashHASH160:
+		return txscript.OP_HASH160, nil
+	case HashRIPEMD160:
+		return txscript.OP_RIPEMD160, nil
+	default:
+		return 0, ErrUnknownHashFunction(hashFunction)
+	}
+}
+
+// Size returns the size of the digest in bytes.
+func (hashFunction HashFunction) Size() int {
+	switch hashFunction {
+	case HashHASH160, HashRIPEMD160:
+		return ripemd160.Size
+	default:
+		return sha256.Size
+	}
+}
+
+// Sum returns the digest of the secret.
+func (hashFunction HashFunction) Sum(secret []byte) ([]byte, error) {
+	switch hashFunction {
+	case HashSHA256:
+		hash := sha256.Sum256(secret)
+		return hash[:], nil
+	case HashHASH256:
+		return chainhash.DoubleHashB(secret), nil
+	case HashHASH160:
+		return btcutil.Hash160(secret), nil
+	case HashRIPEMD160:
+		hasher := ripemd160.New()
+		hasher.Write(secret)
+		return hasher.Sum(nil), nil
+	default:
+		return nil, ErrUnknownHashFunction(hashFunction)
+	}
+}
+
+// hashFunctionFromOpcode returns the hash function computed by the opcode.
+func hashFunctionFromOpcode(opcode byte) (HashFunction, bool) {
+	switch opcode {
+	case txscript.OP_SHA256:
+		return HashSHA256, true
+	case txscript.OP_HASH256:
+		return HashHASH256, true
+	case txscript.OP_HASH160:
+		return HashHASH160, true
+	case txscript.OP_RIPEMD160:
+		return HashRIPEMD160, true
+	default:
+		return "", false
+	}
+}
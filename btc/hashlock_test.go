@@ -0,0 +1,122 @@
+package btc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/catalogfi/blockchain/btc"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTLC hash functions", func() {
+	network := &chaincfg.RegressionNetParams
+
+	newSecret := func() []byte {
+		secret := make([]byte, 32)
+		_, err := rand.Read(secret)
+		Expect(err).To(BeNil())
+		return secret
+	}
+
+	DescribeTable("should redeem the HTLC with the secret",
+		func(ctx context.Context, hashFunction btc.HashFunction, hashSize int) {
+			indexer := newRecordedIndexer()
+			initiator, err := btcec.NewPrivateKey()
+			Expect(err).To(BeNil())
+			redeemer, err := btcec.NewPrivateKey()
+			Expect(err).To(BeNil())
+			redeemerWallet, err := btc.NewSimpleWallet(redeemer, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee)
+			Expect(err).To(BeNil())
+			htlcWallet, err := btc.NewHTLCWallet(redeemerWallet, indexer, network)
+			Expect(err).To(BeNil())
+
+			secret := newSecret()
+			secretHash, err := hashFunction.Sum(secret)
+			Expect(err).To(BeNil())
+			Expect(secretHash).Should(HaveLen(hashSize))
+			htlc := &btc.HTLC{
+				InitiatorPubkey: schnorr.SerializePubKey(initiator.PubKey()),
+				RedeemerPubkey:  schnorr.SerializePubKey(redeemer.PubKey()),
+				SecretHash:      secretHash,
+				Timelock:        144,
+				HashFunction:    hashFunction,
+			}
+			addr, err := htlcWallet.Address(htlc)
+			Expect(err).To(BeNil())
+			indexer.fund(addr, 1e5)
+
+			By("Reject a wrong secret")
+			_, err = htlcWallet.Redeem(ctx, htlc, newSecret())
+			Expect(err).Should(Equal(btc.ErrInvalidSecret))
+
+			_, err = htlcWallet.Redeem(ctx, htlc, secret)
+			Expect(err).To(BeNil())
+			tx := indexer.submitted
+			fetcher := indexer.fetcher()
+			prevOut := fetcher.FetchPrevOutput(tx.TxIn[0].PreviousOutPoint)
+			engine, err := txscript.NewEngine(prevOut.PkScript, tx, 0, txscript.StandardVerifyFlags, nil, txscript.NewTxSigHashes(tx, fetcher), prevOut.Value, fetcher)
+			Expect(err).To(BeNil())
+			Expect(engine.Execute()).To(BeNil())
+
+			By("Detect the revealed leaf")
+			witness := tx.TxIn[0].Witness
+			Expect(witness[1]).Should(Equal(secret))
+			ok, leafHashFunction, leafSecretHash, redeemerPubkey := btc.ParseRedeemLeaf(witness[2])
+			Expect(ok).Should(BeTrue())
+			Expect(leafHashFunction).Should(Equal(hashFunction))
+			Expect(leafSecretHash).Should(Equal(secretHash))
+			Expect(redeemerPubkey).Should(Equal(hex.EncodeToString(htlc.RedeemerPubkey)))
+			ok, _ = btc.IsRedeemLeaf(witness[2])
+			Expect(ok).Should(BeTrue())
+		},
+		Entry("SHA-256", btc.HashSHA256, 32),
+		Entry("HASH256", btc.HashHASH256, 32),
+		Entry("HASH160", btc.HashHASH160, 20),
+		Entry("RIPEMD-160", btc.HashRIPEMD160, 20),
+	)
+
+	It("should reject secret hashes of the wrong size", func() {
+		pubkey := make([]byte, 32)
+		_, err := btc.RedeemLeafWithHash(btc.HashHASH160, pubkey, make([]byte, 32))
+		Expect(err).ShouldNot(BeNil())
+		_, err = btc.RedeemLeafWithHash("keccak256", pubkey, make([]byte, 32))
+		Expect(err).Should(Equal(btc.ErrUnknownHashFunction("keccak256")))
+	})
+
+	It("should share the secret hash of the EVM GardenHTLC", func() {
+		// The EVM GardenHTLC is initiated with the sha256 of a 32 bytes secret
+		secret := [32]byte{}
+		_, err := rand.Read(secret[:])
+		Expect(err).To(BeNil())
+		evmSecretHash := sha256.Sum256(secret[:])
+
+		secretHash, err := btc.HashSHA256.Sum(secret[:])
+		Expect(err).To(BeNil())
+		Expect(secretHash).Should(Equal(evmSecretHash[:]))
+
+		leaf, err := btc.RedeemLeaf(make([]byte, 32), evmSecretHash[:])
+		Expect(err).To(BeNil())
+		ok, hashFunction, leafSecretHash, _ := btc.ParseRedeemLeaf(leaf.Script)
+		Expect(ok).Should(BeTrue())
+		Expect(hashFunction).Should(Equal(btc.HashSHA256))
+		Expect(leafSecretHash).Should(Equal(evmSecretHash[:]))
+	})
+
+	It("should pair a HASH160 lock with a lightning payment hash", func() {
+		preimage := newSecret()
+		paymentHash := sha256.Sum256(preimage)
+		hash160, err := btc.HashHASH160.Sum(preimage)
+		Expect(err).To(BeNil())
+		ripemd160, err := btc.HashRIPEMD160.Sum(paymentHash[:])
+		Expect(err).To(BeNil())
+		Expect(hash160).Should(Equal(ripemd160))
+	})
+})
@@ -0,0 +1,476 @@
+package btc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcwallet/waddrmgr"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// DefaultGapLimit is the number of consecutive unused addresses after which the address discovery stops, as
+// recommended by BIP-44.
+const DefaultGapLimit = 20
+
+// HDPurpose is the purpose field of the derivation path, it decides the address type of the wallet.
+type HDPurpose uint32
+
+var (
+	// BIP44 derives p2pkh addresses. (m/44'/coin'/account'/change/index)
+	BIP44 HDPurpose = 44
+
+	// BIP49 derives p2sh-p2wpkh addresses. (m/49'/coin'/account'/change/index)
+	BIP49 HDPurpose = 49
+
+	// BIP84 derives p2wpkh addresses. (m/84'/coin'/account'/change/index)
+	BIP84 HDPurpose = 84
+
+	// BIP86 derives p2tr key path addresses. (m/86'/coin'/account'/change/index)
+	BIP86 HDPurpose = 86
+)
+
+// AddressType returns the address type of the addresses derived with the purpose.
+func (purpose HDPurpose) AddressType() (waddrmgr.AddressType, error) {
+	switch purpose {
+	case BIP44:
+		return waddrmgr.PubKeyHash, nil
+	case BIP49:
+		return waddrmgr.NestedWitnessPubKey, nil
+	case BIP84:
+		return waddrmgr.WitnessPubKey, nil
+	case BIP86:
+		return waddrmgr.TaprootPubKey, nil
+	default:
+		return 0, fmt.Errorf("unsupported hd purpose %d", purpose)
+	}
+}
+
+const (
+	// ExternalChain is the derivation branch of the receive addresses.
+	ExternalChain uint32 = 0
+
+	// InternalChain is the derivation branch of the change addresses.
+	InternalChain uint32 = 1
+)
+
+var (
+	// ErrInvalidAccountKey is returned when the extended key is neither a master key nor an account key.
+	ErrInvalidAccountKey = fmt.Errorf("extended key should be a master key or an account key")
+
+	// ErrNotPrivateKey is returned when the extended key is a public key.
+	ErrNotPrivateKey = fmt.Errorf("extended key is not a private key")
+)
+
+// HDWallet is a Wallet deriving its addresses from a BIP-32 extended key. Sends are funded by the utxos of all the used
+// addresses of the account and the change goes to a fresh internal address.
+//
+// Address() always returns the first receive address of the account. Its key is the one used to sign the spend
+// requests and the SACPs, so scripts should be built with the public key of that address.
+type HDWallet interface {
+	Wallet
+
+	// XPub returns the extended public key of the account. It can be used to derive the same addresses in a
+	// watch-only wallet.
+	XPub() string
+
+	// Discover scans both the receive and the change addresses until finding `gap limit` consecutive addresses without
+	// any transaction.
+	Discover(ctx context.Context) error
+
+	// ReceiveAddress returns the first receive address which has not been used or given out yet.
+	ReceiveAddress(ctx context.Context) (btcutil.Address, error)
+
+	// DeriveAddress returns the address at the given branch and index of the account.
+	DeriveAddress(branch, index uint32) (btcutil.Address, error)
+}
+
+type hdKey struct {
+	address    btcutil.Address
+	privateKey *secp256k1.PrivateKey
+}
+
+type hdWallet struct {
+	// SimpleWallet of the first receive address, used for signing scripts and SACPs
+	*SimpleWallet
+
+	account     *hdkeychain.ExtendedKey
+	addrType    waddrmgr.AddressType
+	chainParams *chaincfg.Params
+	indexer     IndexerClient
+	gapLimit    uint32
+
+	mu         *sync.Mutex
+	discovered bool
+	// next is the index of the first unused address of each branch
+	next map[uint32]uint32
+	keys map[uint32][]hdKey
+}
+
+// NewHDWalletFromSeed creates an HDWallet from the seed, using the account of the purpose and the coin type of the
+// network.
+func NewHDWalletFromSeed(seed []byte, purpose HDPurpose, account uint32, chainParams *chaincfg.Params, indexer IndexerClient, feeEstimator FeeEstimator, feeLevel FeeLevel, opts ...func(*hdWallet) error) (HDWallet, error) {
+	master, err := hdkeychain.NewMaster(seed, chainParams)
+	if err != nil {
+		return nil, err
+	}
+	return newHDWallet(master, purpose, account, chainParams, indexer, feeEstimator, feeLevel, opts...)
+}
+
+// NewHDWallet creates an HDWallet from an extended private key. The key can either be the master key, in which case
+// the account is derived using the purpose, or the key of the account itself.
+func NewHDWallet(xprv string, purpose HDPurpose, account uint32, chainParams *chaincfg.Params, indexer IndexerClient, feeEstimator FeeEstimator, feeLevel FeeLevel, opts ...func(*hdWallet) error) (HDWallet, error) {
+	key, err := hdkeychain.NewKeyFromString(xprv)
+	if err != nil {
+		return nil, err
+	}
+	return newHDWallet(key, purpose, account, chainParams, indexer, feeEstimator, feeLevel, opts...)
+}
+
+// WithGapLimit sets the number of consecutive unused addresses after which the address discovery stops.
+func WithGapLimit(gapLimit uint32) func(*hdWallet) error {
+	return func(w *hdWallet) error {
+		if gapLimit == 0 {
+			return fmt.Errorf("gap limit should be greater than 0")
+		}
+		w.gapLimit = gapLimit
+		return nil
+	}
+}
+
+func newHDWallet(key *hdkeychain.ExtendedKey, purpose HDPurpose, account uint32, chainParams *chaincfg.Params, indexer IndexerClient, feeEstimator FeeEstimator, feeLevel FeeLevel, opts ...func(*hdWallet) error) (HDWallet, error) {
+	if !key.IsPrivate() {
+		return nil, ErrNotPrivateKey
+	}
+	if !key.IsForNet(chainParams) {
+		return nil, fmt.Errorf("extended key is not for %v", chainParams.Name)
+	}
+	addrType, err := purpose.AddressType()
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.Depth() {
+	case 0:
+		path := []uint32{
+			hdkeychain.HardenedKeyStart + uint32(purpose),
+			hdkeychain.HardenedKeyStart + chainParams.HDCoinType,
+			hdkeychain.HardenedKeyStart + account,
+		}
+		for _, i := range path {
+			key, err = key.Derive(i)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case 3:
+	default:
+		return nil, ErrInvalidAccountKey
+	}
+
+	wallet := &hdWallet{
+		account:     key,
+		addrType:    addrType,
+		chainParams: chainParams,
+		indexer:     indexer,
+		gapLimit:    DefaultGapLimit,
+		mu:          new(sync.Mutex),
+		next:        map[uint32]uint32{ExternalChain: 0, InternalChain: 0},
+		keys:        map[uint32][]hdKey{},
+	}
+	for _, opt := range opts {
+		if err := opt(wallet); err != nil {
+			return nil, err
+		}
+	}
+
+	first, err := wallet.key(ExternalChain, 0)
+	if err != nil {
+		return nil, err
+	}
+	simpleWallet, err := NewSimpleWallet(first.privateKey, chainParams, indexer, feeEstimator, feeLevel, WithSimpleWalletAddressType(addrType))
+	if err != nil {
+		return nil, err
+	}
+	wallet.SimpleWallet = simpleWallet.(*SimpleWallet)
+	return wallet, nil
+}
+
+func (w *hdWallet) XPub() string {
+	pub, err := w.account.Neuter()
+	if err != nil {
+		// Neuter only fails for unknown network versions which we have checked when creating the wallet.
+		panic(err)
+	}
+	return pub.String()
+}
+
+func (w *hdWallet) DeriveAddress(branch, index uint32) (btcutil.Address, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key, err := w.key(branch, index)
+	if err != nil {
+		return nil, err
+	}
+	return key.address, nil
+}
+
+func (w *hdWallet) Discover(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.discover(ctx)
+}
+
+func (w *hdWallet) ReceiveAddress(ctx context.Context) (btcutil.Address, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.discoverOnce(ctx); err != nil {
+		return nil, err
+	}
+	key, err := w.key(ExternalChain, w.next[ExternalChain])
+	if err != nil {
+		return nil, err
+	}
+	w.next[ExternalChain]++
+	return key.address, nil
+}
+
+func (w *hdWallet) Send(ctx context.Context, sendRequests []SendRequest, spendRequests []SpendRequest, sacps [][]byte) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// validate the requests
+	if err := validateRequests(spendRequests, sendRequests, sacps); err != nil {
+		return "", err
+	}
+	if err := w.discoverOnce(ctx); err != nil {
+		return "", err
+	}
+
+	sacpsFee, err := getFeeUsedInSACPs(ctx, sacps, w.indexer)
+	if err != nil {
+		return "", err
+	}
+	coins, err := w.coins(ctx)
+	if err != nil {
+		return "", err
+	}
+	change, err := w.key(InternalChain, w.next[InternalChain])
+	if err != nil {
+		return "", err
+	}
+
+	// The fee of the SACPs is deducted from the fee paid by the wallet
+	tx, err := w.spendAndSend(ctx, sendRequests, spendRequests, sacps, coins, change.address, sacpsFee, max(1000-sacpsFee, 0), 0)
+	if err != nil {
+		return "", err
+	}
+	txid, err := submitTx(ctx, w.indexer, tx)
+	if err != nil {
+		return "", err
+	}
+
+	// Don't reuse the change address if we have sent anything to it
+	for _, out := range tx.TxOut {
+		if isPayingTo(out, change.address) {
+			w.next[InternalChain]++
+			break
+		}
+	}
+	return txid, nil
+}
+
+// hdCoin is an utxo of the wallet with the key to spend it.
+type hdCoin struct {
+	UTXO
+	key hdKey
+}
+
+func (w *hdWallet) spendAndSend(ctx context.Context, sendRequests []SendRequest, spendRequests []SpendRequest, sacps [][]byte, coins []hdCoin, changeAddr btcutil.Address, sacpFee, fee int, depth int) (*wire.MsgTx, error) {
+	// This means we made 100 recursive calls and still could not find enough utxos to send the amount
+	if depth > 100 {
+		return nil, ErrNoUTXOsForRequests
+	}
+
+	spendUTXOs, utxoMap, balanceOfScripts, err := getUTXOsForSpendRequest(ctx, w.indexer, spendRequests)
+	if err != nil {
+		return nil, err
+	}
+
+	// Select the coins to cover the remaining amount required to send
+	var cover []hdCoin
+	totalSendAmount := calculateTotalSendAmount(sendRequests)
+	if balanceOfScripts <= totalSendAmount && totalSendAmount-balanceOfScripts+int64(fee) > 0 {
+		cover, err = selectCoins(coins, totalSendAmount-balanceOfScripts+int64(fee))
+		if err != nil {
+			return nil, err
+		}
+	}
+	coverUTXOs := make(UTXOs, len(cover))
+	for i, coin := range cover {
+		coverUTXOs[i] = coin.UTXO
+		addr := coin.key.address.EncodeAddress()
+		utxoMap[addr] = append(utxoMap[addr], coin.UTXO)
+	}
+
+	// build the transaction
+	sequenceMap := generateSequenceMap(utxoMap, spendRequests)
+	lockTime, err := spendLockTime(spendRequests, sacps)
+	if err != nil {
+		return nil, err
+	}
+	tx, signingIdx, err := buildTransaction(append(spendUTXOs, coverUTXOs...), sacps, sendRequests, changeAddr, int64(fee), sequenceMap)
+	if err != nil {
+		return nil, err
+	}
+	tx.LockTime = lockTime
+
+	// estimate the fee required to make the transaction once signed
+	feeRate, err := w.feeRate()
+	if err != nil {
+		return nil, err
+	}
+	coverIdx := signingIdx + len(spendUTXOs)
+	feeToBePaid := estimateSignedVirtualSize(tx, signingIdx, spendRequests, utxoMap, changeAddr, coverIdx, len(coverUTXOs))*feeRate - sacpFee
+	if feeToBePaid > fee {
+		return w.spendAndSend(ctx, sendRequests, spendRequests, sacps, coins, changeAddr, sacpFee, feeToBePaid, depth+1)
+	}
+
+	fetcher, err := buildTxPrevOutFetcher(ctx, tx, signingIdx, utxoMap, w.indexer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sign the spend inputs with the key of the first receive address
+	if err := signSpendTx(tx, fetcher, signingIdx, spendRequests, utxoMap, w.privateKey); err != nil {
+		return nil, err
+	}
+
+	// Sign the cover inputs with the key of their own address
+	for i, coin := range cover {
+		if err := signSendTx(tx, fetcher, UTXOs{coin.UTXO}, coverIdx+i, coin.key.address, coin.key.privateKey); err != nil {
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// selectCoins picks the coins in order until they cover the amount.
+func selectCoins(coins []hdCoin, amount int64) ([]hdCoin, error) {
+	total := int64(0)
+	for i, coin := range coins {
+		total += coin.Amount
+		if total >= amount {
+			return coins[:i+1], nil
+		}
+	}
+	return nil, ErrInsufficientFunds(total, amount)
+}
+
+// coins returns the utxos of all the used and given out addresses of the wallet.
+func (w *hdWallet) coins(ctx context.Context) ([]hdCoin, error) {
+	var coins []hdCoin
+	for _, branch := range []uint32{ExternalChain, InternalChain} {
+		for i := uint32(0); i < w.next[branch]; i++ {
+			key, err := w.key(branch, i)
+			if err != nil {
+				return nil, err
+			}
+			utxos, err := w.indexer.GetUTXOs(ctx, key.address)
+			if err != nil {
+				return nil, err
+			}
+			for _, utxo := range utxos {
+				coins = append(coins, hdCoin{UTXO: utxo, key: key})
+			}
+		}
+	}
+	return coins, nil
+}
+
+func (w *hdWallet) discoverOnce(ctx context.Context) error {
+	if w.discovered {
+		return nil
+	}
+	return w.discover(ctx)
+}
+
+func (w *hdWallet) discover(ctx context.Context) error {
+	for _, branch := range []uint32{ExternalChain, InternalChain} {
+		gap := uint32(0)
+		for i := uint32(0); gap < w.gapLimit; i++ {
+			key, err := w.key(branch, i)
+			if err != nil {
+				return err
+			}
+			txs, err := w.indexer.GetAddressTxs(ctx, key.address, "")
+			if err != nil {
+				return err
+			}
+			if len(txs) == 0 {
+				gap++
+				continue
+			}
+			gap = 0
+			if i >= w.next[branch] {
+				w.next[branch] = i + 1
+			}
+		}
+	}
+
+	// The first receive address is always considered as used, since it's the address of the wallet.
+	if w.next[ExternalChain] == 0 {
+		w.next[ExternalChain] = 1
+	}
+	w.discovered = true
+	return nil
+}
+
+// key returns the key at the given branch and index, derived keys are cached.
+func (w *hdWallet) key(branch, index uint32) (hdKey, error) {
+	if branch != ExternalChain && branch != InternalChain {
+		return hdKey{}, fmt.Errorf("invalid branch %d", branch)
+	}
+	keys := w.keys[branch]
+	if uint32(len(keys)) > index {
+		return keys[index], nil
+	}
+
+	branchKey, err := w.account.Derive(branch)
+	if err != nil {
+		return hdKey{}, err
+	}
+	for uint32(len(keys)) <= index {
+		child, err := branchKey.Derive(uint32(len(keys)))
+		if err != nil {
+			return hdKey{}, err
+		}
+		privateKey, err := child.ECPrivKey()
+		if err != nil {
+			return hdKey{}, err
+		}
+		address, err := PublicKeyAddress(w.chainParams, w.addrType, privateKey.PubKey())
+		if err != nil {
+			return hdKey{}, err
+		}
+		keys = append(keys, hdKey{address: address, privateKey: privateKey})
+	}
+	w.keys[branch] = keys
+	return keys[index], nil
+}
+
+func isPayingTo(out *wire.TxOut, addr btcutil.Address) bool {
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return false
+	}
+	return string(out.PkScript) == string(script)
+}
@@ -0,0 +1,134 @@
+package btc_test
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcwallet/waddrmgr"
+	"github.com/catalogfi/blockchain/btc"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HD wallet", func() {
+	// Seed of the mnemonic "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon
+	// about" used by the test vectors of BIP-84 and BIP-86
+	seed, _ := hex.DecodeString("5eb00bbddcf069084889a8ab9155568165f5c453ccb85e70811aaed6f6da5fc19a5ac40b389cd370d086206dec8aa6c43daea6690f20ad3d8d48b2d2ce9e38e4")
+	feeEstimator := btc.NewFixFeeEstimator(10)
+
+	DescribeTable("should derive the addresses of the test vectors",
+		func(purpose btc.HDPurpose, receive, change string) {
+			wallet, err := btc.NewHDWalletFromSeed(seed, purpose, 0, &chaincfg.MainNetParams, newRecordedIndexer(), feeEstimator, btc.HighFee)
+			Expect(err).To(BeNil())
+
+			addr, err := wallet.DeriveAddress(btc.ExternalChain, 0)
+			Expect(err).To(BeNil())
+			Expect(addr.EncodeAddress()).Should(Equal(receive))
+			Expect(wallet.Address().EncodeAddress()).Should(Equal(receive))
+
+			addr, err = wallet.DeriveAddress(btc.InternalChain, 0)
+			Expect(err).To(BeNil())
+			Expect(addr.EncodeAddress()).Should(Equal(change))
+		},
+		Entry("BIP-44", btc.BIP44, "1LqBGSKuX5yYUonjxT5qGfpUsXKYYWeabA", "1J3J6EvPrv8q6AC3VCjWV45Uf3nssNMRtH"),
+		Entry("BIP-84", btc.BIP84, "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu", "bc1q8c6fshw2dlwun7ekn9qwf37cu2rn755upcp6el"),
+		Entry("BIP-86", btc.BIP86, "bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr", "bc1p3qkhfews2uk44qtvauqyr2ttdsw7svhkl9nkm9s9c3x4ax5h60wqwruhk7"),
+	)
+
+	It("should derive the same addresses from the xpub", func() {
+		wallet, err := btc.NewHDWalletFromSeed(seed, btc.BIP84, 0, &chaincfg.MainNetParams, newRecordedIndexer(), feeEstimator, btc.HighFee)
+		Expect(err).To(BeNil())
+
+		xpub, err := hdkeychain.NewKeyFromString(wallet.XPub())
+		Expect(err).To(BeNil())
+		Expect(xpub.IsPrivate()).Should(BeFalse())
+		branch, err := xpub.Derive(btc.ExternalChain)
+		Expect(err).To(BeNil())
+		child, err := branch.Derive(5)
+		Expect(err).To(BeNil())
+		pub, err := child.ECPubKey()
+		Expect(err).To(BeNil())
+		expected, err := btc.PublicKeyAddress(&chaincfg.MainNetParams, waddrmgr.WitnessPubKey, pub)
+		Expect(err).To(BeNil())
+
+		addr, err := wallet.DeriveAddress(btc.ExternalChain, 5)
+		Expect(err).To(BeNil())
+		Expect(addr.EncodeAddress()).Should(Equal(expected.EncodeAddress()))
+	})
+
+	It("should accept an account key", func() {
+		master, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+		Expect(err).To(BeNil())
+		account := master
+		for _, i := range []uint32{84, 0, 0} {
+			account, err = account.Derive(hdkeychain.HardenedKeyStart + i)
+			Expect(err).To(BeNil())
+		}
+
+		wallet, err := btc.NewHDWallet(account.String(), btc.BIP84, 0, &chaincfg.MainNetParams, newRecordedIndexer(), feeEstimator, btc.HighFee)
+		Expect(err).To(BeNil())
+		Expect(wallet.Address().EncodeAddress()).Should(Equal("bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"))
+
+		By("Reject keys of other networks")
+		_, err = btc.NewHDWallet(account.String(), btc.BIP84, 0, &chaincfg.TestNet3Params, newRecordedIndexer(), feeEstimator, btc.HighFee)
+		Expect(err).ShouldNot(BeNil())
+
+		By("Reject public keys")
+		pub, err := account.Neuter()
+		Expect(err).To(BeNil())
+		_, err = btc.NewHDWallet(pub.String(), btc.BIP84, 0, &chaincfg.MainNetParams, newRecordedIndexer(), feeEstimator, btc.HighFee)
+		Expect(err).Should(Equal(btc.ErrNotPrivateKey))
+	})
+
+	It("should discover the used addresses and spend their utxos", func(ctx context.Context) {
+		network := &chaincfg.RegressionNetParams
+		indexer := newRecordedIndexer()
+		wallet, err := btc.NewHDWalletFromSeed(seed, btc.BIP86, 0, network, indexer, feeEstimator, btc.HighFee, btc.WithGapLimit(3))
+		Expect(err).To(BeNil())
+
+		derive := func(branch, index uint32) btcutil.Address {
+			addr, err := wallet.DeriveAddress(branch, index)
+			Expect(err).To(BeNil())
+			return addr
+		}
+		// Funds within the gap limit are discovered and funds after the gap are not
+		indexer.fund(derive(btc.ExternalChain, 2), 1e5)
+		indexer.fund(derive(btc.ExternalChain, 5), 1e5)
+		indexer.fund(derive(btc.InternalChain, 0), 1e5)
+		indexer.fund(derive(btc.ExternalChain, 9), 1e5)
+
+		receive, err := wallet.ReceiveAddress(ctx)
+		Expect(err).To(BeNil())
+		Expect(receive.EncodeAddress()).Should(Equal(derive(btc.ExternalChain, 6).EncodeAddress()))
+
+		_, err = wallet.Send(ctx, []btc.SendRequest{{Amount: 2.5e5, To: receive}}, nil, nil)
+		Expect(err).To(BeNil())
+		tx := indexer.submitted
+		Expect(tx.TxIn).Should(HaveLen(3))
+
+		By("Verify the signatures")
+		fetcher := indexer.fetcher()
+		sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+		for i, in := range tx.TxIn {
+			prevOut := fetcher.FetchPrevOutput(in.PreviousOutPoint)
+			engine, err := txscript.NewEngine(prevOut.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+			Expect(err).To(BeNil())
+			Expect(engine.Execute()).To(BeNil())
+		}
+
+		By("Send the change to a fresh internal address")
+		change, err := txscript.PayToAddrScript(derive(btc.InternalChain, 1))
+		Expect(err).To(BeNil())
+		Expect(tx.TxOut).Should(HaveLen(2))
+		Expect(tx.TxOut[1].PkScript).Should(Equal(change))
+
+		By("Fail when the discovered funds are not enough")
+		_, err = wallet.Send(ctx, []btc.SendRequest{{Amount: 3.5e5, To: receive}}, nil, nil)
+		Expect(err).ShouldNot(BeNil())
+	})
+})
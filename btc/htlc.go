@@ -4,10 +4,10 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"fmt"
 
 	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/txscript"
@@ -33,6 +33,9 @@ type RawHTLCAction struct {
 	Secret []byte
 	// Only used in the case of RefundHTLCAction.
 	InsantRefundSACPTxBytes []byte
+	// UTXOs of the HTLC to spend, usually the ones validated by `VerifyFunding`. All the utxos of the HTLC are spent
+	// when nil, an empty set has no funds to spend. Not used in the case of InitiateHTLCAction.
+	UTXOs UTXOs
 }
 
 var (
@@ -60,16 +63,91 @@ var (
 	ErrInvalidInstantRefundScript = fmt.Errorf("invalid instant refund script")
 
 	ErrHTLCNeedMoreBlocks = func(blocks uint64) error { return fmt.Errorf("need more %d blocks to refund", blocks) }
+
+	// ErrHTLCNeedMoreTime is returned when the median time past hasn't reached the timestamp of an absolute timelock
+	ErrHTLCNeedMoreTime = func(seconds uint64) error { return fmt.Errorf("need more %d seconds to refund", seconds) }
+
+	// ErrUnknownTimelockType is returned when the timelock type of the HTLC is not supported
+	ErrUnknownTimelockType = func(timelockType TimelockType) error {
+		return fmt.Errorf("unknown timelock type %q", timelockType)
+	}
+
+	// ErrUnknownHTLCMode is returned when the mode of the HTLC is not supported
+	ErrUnknownHTLCMode = func(mode HTLCMode) error { return fmt.Errorf("unknown htlc mode %q", mode) }
+
+	// ErrNotTaprootHTLC is returned when taproot details are requested for a p2wsh HTLC
+	ErrNotTaprootHTLC = fmt.Errorf("htlc is not a taproot htlc")
+
+	// ErrInstantRefundNotSupported is returned when an instant refund is requested for a p2wsh HTLC
+	ErrInstantRefundNotSupported = fmt.Errorf("instant refunds are not supported by p2wsh htlcs")
+)
+
+// HTLCMode decides the internal key and the leaves of the taproot output of an HTLC.
+type HTLCMode string
+
+const (
+	// HTLCModeScript uses the unspendable GardenNUMS point as the internal key, so the HTLC can only be spent with one
+	// of its leaves. This is the default mode.
+	HTLCModeScript HTLCMode = ""
+
+	// HTLCModeMuSig2 uses the MuSig2 aggregate of the initiator and redeemer pubkeys as the internal key. Both parties
+	// can settle the HTLC with a key path spend, which looks like any other single-sig p2tr spend on-chain, while the
+	// redeem, refund and instant refund leaves are kept as fallbacks.
+	HTLCModeMuSig2 HTLCMode = "musig2"
+
+	// HTLCModeP2WSH uses the BIP-199 segwit v0 script, see `HtlcScript`, for counterparties whose wallets don't
+	// support taproot. The pubkeys of the HTLC must be compressed pubkeys in this mode. BIP-199 has no cooperative
+	// branch, so these HTLCs can't be refunded instantly.
+	HTLCModeP2WSH HTLCMode = "p2wsh"
+
+	// HTLCModeMiniscript uses the GardenNUMS point as the internal key like HTLCModeScript, with leaves compiled from
+	// miniscript, see `MiniscriptRedeemLeaf` and `MiniscriptRefundLeaf`. Descriptor wallets can import these HTLCs
+	// with `HTLCDescriptor` to redeem or refund them. The secret of the HTLC must be 32 bytes in this mode.
+	HTLCModeMiniscript HTLCMode = "miniscript"
+)
+
+// TimelockType decides how the refund leaf of an HTLC interprets its timelock.
+type TimelockType string
+
+const (
+	// RelativeTimelock locks the refund for a number of blocks after the HTLC is confirmed, using
+	// `OP_CHECKSEQUENCEVERIFY`. This is the default type.
+	RelativeTimelock TimelockType = ""
+
+	// AbsoluteTimelock locks the refund until a block height, or a unix timestamp compared against the median time
+	// past when it is not below txscript.LockTimeThreshold, using `OP_CHECKLOCKTIMEVERIFY`. It is only supported by
+	// taproot HTLCs, and timestamps need an indexer implementing MedianTimeIndexer.
+	AbsoluteTimelock TimelockType = "absolute"
 )
 
 type HTLC struct {
-	// X-only pubkey of the initiator
+	// X-only pubkey of the initiator, or compressed pubkey in HTLCModeP2WSH
 	InitiatorPubkey []byte
-	// X-only pubkey of the redeemer
+	// X-only pubkey of the redeemer, or compressed pubkey in HTLCModeP2WSH
 	RedeemerPubkey []byte
 	SecretHash     []byte
-	// Locktime in blocks
+	// Locktime in blocks, or an absolute block height or timestamp in AbsoluteTimelock
 	Timelock uint32
+	// Type of the timelock, defaults to RelativeTimelock
+	TimelockType TimelockType
+	// Hash function the SecretHash is computed with, defaults to HashSHA256
+	HashFunction HashFunction
+	// Mode of the taproot output, defaults to HTLCModeScript
+	Mode HTLCMode
+}
+
+// InternalKey returns the taproot internal key of the HTLC according to its mode.
+func (htlc *HTLC) InternalKey() (*btcec.PublicKey, error) {
+	switch htlc.Mode {
+	case HTLCModeScript, HTLCModeMiniscript:
+		return GardenNUMS()
+	case HTLCModeMuSig2:
+		return MuSig2AggregateKey(htlc)
+	case HTLCModeP2WSH:
+		return nil, ErrNotTaprootHTLC
+	default:
+		return nil, ErrUnknownHTLCMode(htlc.Mode)
+	}
 }
 
 type HTLCWallet interface {
@@ -84,8 +162,20 @@ type HTLCWallet interface {
 	//
 	// Signature is added at the first index of the witness of the transaction inputs.
 	GenerateInstantRefundSACP(ctx context.Context, htlc *HTLC, recipient btcutil.Address) ([]byte, error)
-	// Address returns the tapscript address of the HTLC
+	// GenerateRedeemSACP generates a signed SACP tx redeeming the HTLC to the recipient, which a sponsor can merge
+	// into a tx paid by its own utxos.
+	GenerateRedeemSACP(ctx context.Context, htlc *HTLC, secret []byte, recipient btcutil.Address) ([]byte, error)
+	// GenerateRefundSACP generates a signed SACP tx refunding the expired HTLC to the recipient, which a sponsor can
+	// merge into a tx paid by its own utxos.
+	GenerateRefundSACP(ctx context.Context, htlc *HTLC, recipient btcutil.Address) ([]byte, error)
+	// CooperativeSettlementTx builds the unsigned tx sending all the utxos of a MuSig2 HTLC to the recipient with a
+	// key path spend. It returns the prevout fetcher needed to sign the tx with a CooperativeSession.
+	CooperativeSettlementTx(ctx context.Context, htlc *HTLC, recipient btcutil.Address, feeRate int) (*wire.MsgTx, txscript.PrevOutputFetcher, error)
+	// Address returns the tapscript address of the HTLC, or the p2wsh address in HTLCModeP2WSH
 	Address(htlc *HTLC) (btcutil.Address, error)
+	// VerifyFunding compares the deposits of the HTLC against the expected amount, and returns the deposits with at
+	// least minConfirmations confirmations which are safe to redeem or refund.
+	VerifyFunding(ctx context.Context, htlc *HTLC, expected int64, minConfirmations uint64) (FundingStatus, error)
 	// Status returns the transaction if submitted and bool indicating whether the transaction
 	// is submitted or not
 	Status(ctx context.Context, id string) (Transaction, bool, error)
@@ -96,23 +186,16 @@ type HTLCWallet interface {
 
 type htlcWallet struct {
 	// Wallet here could be a batcher wallet or RBF wallet or simple wallet
-	wallet      Wallet
-	chain       *chaincfg.Params
-	internalKey *btcec.PublicKey
-	indexer     IndexerClient
+	wallet  Wallet
+	chain   *chaincfg.Params
+	indexer IndexerClient
 }
 
 func NewHTLCWallet(wallet Wallet, indexer IndexerClient, chain *chaincfg.Params) (HTLCWallet, error) {
-	internalKey, err := GardenNUMS()
-	if err != nil {
-		return nil, err
-	}
-
 	return &htlcWallet{
-		wallet:      wallet,
-		chain:       chain,
-		internalKey: internalKey,
-		indexer:     indexer,
+		wallet:  wallet,
+		chain:   chain,
+		indexer: indexer,
 	}, nil
 }
 
@@ -120,22 +203,25 @@ func (hw *htlcWallet) Status(ctx context.Context, id string) (Transaction, bool,
 	return hw.wallet.Status(ctx, id)
 }
 
-// Address returns the tapscript address of the HTLC
+// Address returns the tapscript address of the HTLC, or the p2wsh address in HTLCModeP2WSH
 func (hw *htlcWallet) Address(htlc *HTLC) (btcutil.Address, error) {
-
-	leaves, err := htlcLeaves(htlc)
+	if htlc.Mode == HTLCModeP2WSH {
+		_, addr, err := p2wshHTLC(htlc, hw.chain)
+		return addr, err
+	}
+	internalKey, err := htlc.InternalKey()
+	if err != nil {
+		return nil, err
+	}
+	tapScriptRootHash, err := htlcTapscriptRoot(htlc)
 	if err != nil {
 		return nil, err
 	}
-
-	tapScriptTree := txscript.AssembleTaprootScriptTree(leaves.ToArray()...)
-
-	tapScriptRootHash := tapScriptTree.RootNode.TapHash()
 	outputKey := txscript.ComputeTaprootOutputKey(
-		hw.internalKey, tapScriptRootHash[:],
+		internalKey, tapScriptRootHash,
 	)
 
-	addr, err := btcutil.NewAddressTaproot(outputKey.X().Bytes(), hw.chain)
+	addr, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), hw.chain)
 	if err != nil {
 		return nil, err
 	}
@@ -144,7 +230,10 @@ func (hw *htlcWallet) Address(htlc *HTLC) (btcutil.Address, error) {
 
 // GenerateInstantRefundSACP generates the SACP tx needed for the instant refunds
 func (hw *htlcWallet) GenerateInstantRefundSACP(ctx context.Context, htlc *HTLC, recipient btcutil.Address) ([]byte, error) {
-	instantRefundLeaf, cbBytes, err := getControlBlock(hw.internalKey, htlc, LeafInstantRefund)
+	if htlc.Mode == HTLCModeP2WSH {
+		return nil, ErrInstantRefundNotSupported
+	}
+	instantRefundLeaf, cbBytes, err := getControlBlock(htlc, LeafInstantRefund)
 	if err != nil {
 		return nil, err
 	}
@@ -152,7 +241,7 @@ func (hw *htlcWallet) GenerateInstantRefundSACP(ctx context.Context, htlc *HTLC,
 		AddSignatureSchnorrOp,
 		// insert random sig placeholder for other parties to insert their signature
 		// this is for proper fee calculation
-		randomSig(),
+		randomSig(SchnorrSignatureSize + 1),
 		instantRefundLeaf.Script,
 		cbBytes,
 	}
@@ -175,6 +264,26 @@ func (hw *htlcWallet) GenerateInstantRefundSACP(ctx context.Context, htlc *HTLC,
 	return txBytes, nil
 }
 
+// GenerateRedeemSACP generates a signed SACP tx redeeming the HTLC to the recipient
+func (hw *htlcWallet) GenerateRedeemSACP(ctx context.Context, htlc *HTLC, secret []byte, recipient btcutil.Address) ([]byte, error) {
+	spendRequest, err := hw.redeem(ctx, htlc, secret, nil)
+	if err != nil {
+		return nil, err
+	}
+	spendRequest.HashType = SigHashSingleAnyoneCanPay
+	return hw.wallet.GenerateSACP(ctx, spendRequest, recipient)
+}
+
+// GenerateRefundSACP generates a signed SACP tx refunding the expired HTLC to the recipient
+func (hw *htlcWallet) GenerateRefundSACP(ctx context.Context, htlc *HTLC, recipient btcutil.Address) ([]byte, error) {
+	spendRequest, err := hw.refund(ctx, htlc, nil)
+	if err != nil {
+		return nil, err
+	}
+	spendRequest.HashType = SigHashSingleAnyoneCanPay
+	return hw.wallet.GenerateSACP(ctx, spendRequest, recipient)
+}
+
 // Initiate sends the amount to the HTLC address
 func (hw *htlcWallet) Initiate(ctx context.Context, htlc *HTLC, amount int64) (string, error) {
 	addr, err := hw.Address(htlc)
@@ -189,12 +298,26 @@ func (hw *htlcWallet) Initiate(ctx context.Context, htlc *HTLC, amount int64) (s
 	}, nil, nil)
 }
 
-func (hw *htlcWallet) redeem(htlc *HTLC, secret []byte) (SpendRequest, error) {
+// redeem returns the spend request redeeming the given utxos of the HTLC, or all its current utxos when nil.
+func (hw *htlcWallet) redeem(ctx context.Context, htlc *HTLC, secret []byte, utxos UTXOs) (SpendRequest, error) {
 	if !isSecretValid(secret, htlc) {
 		return SpendRequest{}, ErrInvalidSecret
 	}
+	scriptAddr, err := hw.Address(htlc)
+	if err != nil {
+		return SpendRequest{}, err
+	}
+	utxos, err = hw.htlcUTXOs(ctx, scriptAddr, utxos)
+	if err != nil {
+		return SpendRequest{}, err
+	}
+	if htlc.Mode == HTLCModeP2WSH {
+		spendRequest, err := hw.p2wshSpendRequest(htlc, secret, 0)
+		spendRequest.Utxos = utxos
+		return spendRequest, err
+	}
 
-	redeemTapLeaf, cbBytes, err := getControlBlock(hw.internalKey, htlc, LeafRedeem)
+	redeemTapLeaf, cbBytes, err := getControlBlock(htlc, LeafRedeem)
 	if err != nil {
 		return SpendRequest{}, err
 	}
@@ -205,22 +328,18 @@ func (hw *htlcWallet) redeem(htlc *HTLC, secret []byte) (SpendRequest, error) {
 		cbBytes,
 	}
 
-	scriptAddr, err := hw.Address(htlc)
-	if err != nil {
-		return SpendRequest{}, err
-	}
-
 	return SpendRequest{
 		Witness:       witness,
 		Leaf:          redeemTapLeaf,
 		ScriptAddress: scriptAddr,
 		HashType:      txscript.SigHashAll,
+		Utxos:         utxos,
 	}, nil
 }
 
 // Redeem redeems the HTLC with the secret
 func (hw *htlcWallet) Redeem(ctx context.Context, htlc *HTLC, secret []byte) (string, error) {
-	redeemSpendRequest, err := hw.redeem(htlc, secret)
+	redeemSpendRequest, err := hw.redeem(ctx, htlc, secret, nil)
 	if err != nil {
 		return "", err
 	}
@@ -230,25 +349,25 @@ func (hw *htlcWallet) Redeem(ctx context.Context, htlc *HTLC, secret []byte) (st
 	}, nil)
 }
 
-// instantRefund refunds given the counterparty signed SACP tx
-func (hw *htlcWallet) instantRefund(ctx context.Context, htlc *HTLC, instantRefundSACPTx []byte) ([]byte, error) {
+// instantRefund refunds given the counterparty signed SACP tx, which must spend the given utxos of the HTLC, or all
+// its current utxos when nil.
+func (hw *htlcWallet) instantRefund(ctx context.Context, htlc *HTLC, instantRefundSACPTx []byte, utxos UTXOs) ([]byte, error) {
 	if instantRefundSACPTx == nil {
 		return nil, fmt.Errorf("instantRefundSACPTx is nil")
 	}
+	if htlc.Mode == HTLCModeP2WSH {
+		return nil, ErrInstantRefundNotSupported
+	}
 	scriptAddr, err := hw.Address(htlc)
 	if err != nil {
 		return nil, err
 	}
 
-	utxos, err := hw.indexer.GetUTXOs(ctx, scriptAddr)
+	utxos, err = hw.htlcUTXOs(ctx, scriptAddr, utxos)
 	if err != nil {
 		return nil, err
 	}
-	utxoValue := int64(0)
-	for _, utxo := range utxos {
-		utxoValue += utxo.Amount
-	}
-	instandRefundLeaf, cbBytes, err := getControlBlock(hw.internalKey, htlc, LeafInstantRefund)
+	instandRefundLeaf, cbBytes, err := getControlBlock(htlc, LeafInstantRefund)
 	if err != nil {
 		return nil, err
 	}
@@ -261,14 +380,14 @@ func (hw *htlcWallet) instantRefund(ctx context.Context, htlc *HTLC, instantRefu
 		AddSignatureSchnorrOp,
 		// insert invalid placeholder signature for other parties to insert their signature
 		// this is for proper fee calculation
-		randomSig(),
+		randomSig(SchnorrSignatureSize + 1),
 		instandRefundLeaf.Script,
 		cbBytes,
 	}
 
 	for i := range tx.TxIn {
 		// 0th index is the signature of this wallet
-		witnessWithSig, err := hw.wallet.SignSACPTx(tx, i, utxoValue, instandRefundLeaf, scriptAddr, instantRefundWitness)
+		witnessWithSig, err := hw.wallet.SignSACPTx(tx, i, utxos[i].Amount, instandRefundLeaf, scriptAddr, instantRefundWitness)
 		if err != nil {
 			return nil, err
 		}
@@ -305,19 +424,19 @@ func (hw *htlcWallet) Execute(ctx context.Context, htlcActions []RawHTLCAction)
 				Amount: htlcAction.Amount,
 			})
 		case RedeemHTLCAction:
-			redeemSpendRequest, err := hw.redeem(&htlcAction.HTLC, htlcAction.Secret)
+			redeemSpendRequest, err := hw.redeem(ctx, &htlcAction.HTLC, htlcAction.Secret, htlcAction.UTXOs)
 			if err != nil {
 				return "", err
 			}
 			spends = append(spends, redeemSpendRequest)
 		case RefundHTLCAction:
-			refundSpendRequest, err := hw.refund(&htlcAction.HTLC)
+			refundSpendRequest, err := hw.refund(ctx, &htlcAction.HTLC, htlcAction.UTXOs)
 			if err != nil {
 				return "", err
 			}
 			spends = append(spends, refundSpendRequest)
 		case InstantRefundHTLCAction:
-			refundSACP, err := hw.instantRefund(ctx, &htlcAction.HTLC, htlcAction.InsantRefundSACPTxBytes)
+			refundSACP, err := hw.instantRefund(ctx, &htlcAction.HTLC, htlcAction.InsantRefundSACPTxBytes, htlcAction.UTXOs)
 			if err != nil {
 				fmt.Println("dcfgjvhbkjnkmjhkgjfdxfcgvhbjnkm")
 				return "", err
@@ -329,28 +448,47 @@ func (hw *htlcWallet) Execute(ctx context.Context, htlcActions []RawHTLCAction)
 	return hw.send(ctx, sends, spends, sacps)
 }
 
-func (hw *htlcWallet) refund(htlc *HTLC) (SpendRequest, error) {
+// refund returns the spend request refunding the given utxos of the HTLC, or all its current utxos when nil. It
+// fails if the timelock of any of them hasn't expired.
+func (hw *htlcWallet) refund(ctx context.Context, htlc *HTLC, utxos UTXOs) (SpendRequest, error) {
 
 	scriptAddr, err := hw.Address(htlc)
 	if err != nil {
 		return SpendRequest{}, err
 	}
 
-	currentTip, err := hw.indexer.GetTipBlockHeight(context.Background())
+	currentTip, err := hw.indexer.GetTipBlockHeight(ctx)
 	if err != nil {
 		return SpendRequest{}, err
 	}
 
-	utxos, err := hw.indexer.GetUTXOs(context.Background(), scriptAddr)
+	// Only the utxos checked here are spent, not the ones received in the meantime
+	utxos, err = hw.htlcUTXOs(ctx, scriptAddr, utxos)
 	if err != nil {
 		return SpendRequest{}, err
 	}
+	if htlc.TimelockType == AbsoluteTimelock {
+		if err := hw.checkAbsoluteTimelock(ctx, htlc, currentTip); err != nil {
+			return SpendRequest{}, err
+		}
+	} else {
+		canRefund, needMoreBlocks := canRefund(utxos, htlc.Timelock, currentTip)
+		if !canRefund {
+			return SpendRequest{}, ErrHTLCNeedMoreBlocks(needMoreBlocks)
+		}
+	}
+
+	spendRequest, err := hw.refundSpendRequest(htlc, scriptAddr)
+	spendRequest.Utxos = utxos
+	return spendRequest, err
+}
 
-	canRefund, needMoreBlocks := canRefund(utxos, htlc, currentTip)
-	if !canRefund {
-		return SpendRequest{}, ErrHTLCNeedMoreBlocks(needMoreBlocks)
+// refundSpendRequest returns the spend request of the refund path of the HTLC, without checking its timelock.
+func (hw *htlcWallet) refundSpendRequest(htlc *HTLC, scriptAddr btcutil.Address) (SpendRequest, error) {
+	if htlc.Mode == HTLCModeP2WSH {
+		return hw.p2wshSpendRequest(htlc, nil, htlc.Timelock)
 	}
-	tapLeaf, cbBytes, err := getControlBlock(hw.internalKey, htlc, LeafRefund)
+	tapLeaf, cbBytes, err := getControlBlock(htlc, LeafRefund)
 	if err != nil {
 		return SpendRequest{}, err
 	}
@@ -360,25 +498,31 @@ func (hw *htlcWallet) refund(htlc *HTLC) (SpendRequest, error) {
 		cbBytes,
 	}
 
-	return SpendRequest{
+	spendRequest := SpendRequest{
 		Witness:       witness,
 		Leaf:          tapLeaf,
 		ScriptAddress: scriptAddr,
 		HashType:      txscript.SigHashAll,
 		Sequence:      htlc.Timelock,
-	}, nil
+	}
+	if htlc.TimelockType == AbsoluteTimelock {
+		// The lock time of the tx is only enforced with a non-final sequence, which also keeps the refund replaceable
+		spendRequest.Sequence = wire.MaxTxInSequenceNum - 2
+		spendRequest.LockTime = htlc.Timelock
+	}
+	return spendRequest, nil
 }
 
 func (hw *htlcWallet) Refund(ctx context.Context, htlc *HTLC, sigTx []byte) (string, error) {
 	if sigTx != nil {
-		sacp, err := hw.instantRefund(ctx, htlc, sigTx)
+		sacp, err := hw.instantRefund(ctx, htlc, sigTx, nil)
 		if err != nil {
 			return "", err
 		}
 		return hw.send(ctx, nil, nil, [][]byte{sacp})
 	}
 
-	refundSpendRequest, err := hw.refund(htlc)
+	refundSpendRequest, err := hw.refund(ctx, htlc, nil)
 	if err != nil {
 		return "", err
 	}
@@ -390,37 +534,35 @@ func (hw *htlcWallet) Refund(ctx context.Context, htlc *HTLC, sigTx []byte) (str
 
 // ------------------ Helper functions ------------------
 
-func isSecretValid(secret []byte, htlc *HTLC) bool {
-	hash := sha256.Sum256(secret)
-	return bytes.Equal(hash[:], htlc.SecretHash)
-}
-
-func validateInstantRefundSACP(refundSACP []byte, utxos []UTXO, recipient btcutil.Address, cb []byte, instantRefundLeaf txscript.TapLeaf) (*wire.MsgTx, error) {
-	btcTx, err := btcutil.NewTxFromBytes(refundSACP)
+// htlcUTXOs returns the given utxos of the HTLC, or all its current utxos when nil. It fails with ErrNoFundsToSpend
+// when there is none to spend.
+func (hw *htlcWallet) htlcUTXOs(ctx context.Context, scriptAddr btcutil.Address, utxos UTXOs) (UTXOs, error) {
+	utxos, err := spendableUTXOs(ctx, hw.indexer, scriptAddr, utxos)
 	if err != nil {
 		return nil, err
 	}
-
-	tx := btcTx.MsgTx()
-
-	// Validate the tx
-	if len(tx.TxIn) != len(utxos) {
-		return nil, ErrSACPInvalidInputsLen
+	if len(utxos) == 0 {
+		return nil, ErrNoFundsToSpend
 	}
+	return utxos, nil
+}
 
-	pkScript, err := txscript.PayToAddrScript(recipient)
+func isSecretValid(secret []byte, htlc *HTLC) bool {
+	// The miniscript leaves check the size of the secret
+	if htlc.Mode == HTLCModeMiniscript && len(secret) != 32 {
+		return false
+	}
+	hash, err := htlc.HashFunction.Sum(secret)
 	if err != nil {
-		return nil, err
+		return false
 	}
+	return bytes.Equal(hash, htlc.SecretHash)
+}
 
-	// Check if txHashs match with the utxos
-	for i, txIn := range tx.TxIn {
-		if txIn.PreviousOutPoint.Hash.String() != utxos[i].TxID {
-			return nil, ErrSACPInvalidInput
-		}
-		if !bytes.Equal(tx.TxOut[i].PkScript, pkScript) {
-			return nil, ErrSACPInvalidOutput
-		}
+func validateInstantRefundSACP(refundSACP []byte, utxos []UTXO, recipient btcutil.Address, cb []byte, instantRefundLeaf txscript.TapLeaf) (*wire.MsgTx, error) {
+	tx, err := decodeInstantRefundSACP(refundSACP, utxos, recipient)
+	if err != nil {
+		return nil, err
 	}
 
 	// witness should have 4 elements
@@ -446,11 +588,42 @@ func validateInstantRefundSACP(refundSACP []byte, utxos []UTXO, recipient btcuti
 	return tx, nil
 }
 
+// decodeInstantRefundSACP decodes the SACP tx and checks it spends the utxos to the recipient.
+func decodeInstantRefundSACP(refundSACP []byte, utxos []UTXO, recipient btcutil.Address) (*wire.MsgTx, error) {
+	btcTx, err := btcutil.NewTxFromBytes(refundSACP)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := btcTx.MsgTx()
+
+	// Validate the tx
+	if len(tx.TxIn) != len(utxos) {
+		return nil, ErrSACPInvalidInputsLen
+	}
+
+	pkScript, err := txscript.PayToAddrScript(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if txHashs match with the utxos
+	for i, txIn := range tx.TxIn {
+		if txIn.PreviousOutPoint.Hash.String() != utxos[i].TxID {
+			return nil, ErrSACPInvalidInput
+		}
+		if i >= len(tx.TxOut) || !bytes.Equal(tx.TxOut[i].PkScript, pkScript) {
+			return nil, ErrSACPInvalidOutput
+		}
+	}
+	return tx, nil
+}
+
 // checks if the utxos can be refunded
-func canRefund(utxos []UTXO, htlc *HTLC, currentTip uint64) (bool, uint64) {
+func canRefund(utxos []UTXO, htlcTimelock uint32, currentTip uint64) (bool, uint64) {
 	for _, utxo := range utxos {
 		needMoreBlocks := uint64(0)
-		timelock := uint64(htlc.Timelock)
+		timelock := uint64(htlcTimelock)
 
 		// check if utxo has been expired
 		if utxo.Status.Confirmed && *utxo.Status.BlockHeight+timelock-1 > currentTip {
@@ -465,18 +638,70 @@ func canRefund(utxos []UTXO, htlc *HTLC, currentTip uint64) (bool, uint64) {
 	return true, 0
 }
 
-func randomSig() []byte {
-	sig := make([]byte, 65)
+// checkAbsoluteTimelock returns an error if the absolute timelock of the HTLC hasn't expired at the current tip.
+func (hw *htlcWallet) checkAbsoluteTimelock(ctx context.Context, htlc *HTLC, currentTip uint64) error {
+	medianTime := uint64(0)
+	if htlc.Timelock >= txscript.LockTimeThreshold {
+		var err error
+		medianTime, err = tipMedianTime(ctx, hw.indexer)
+		if err != nil {
+			return err
+		}
+	}
+	if ok, remaining := canRefundAbsolute(htlc.Timelock, currentTip, medianTime); !ok {
+		if htlc.Timelock >= txscript.LockTimeThreshold {
+			return ErrHTLCNeedMoreTime(remaining)
+		}
+		return ErrHTLCNeedMoreBlocks(remaining)
+	}
+	return nil
+}
+
+// canRefundAbsolute checks if an absolute timelock has expired. A tx is final once its lock time is below the height
+// of the block including it, or below the median time past of the previous block for timestamps (BIP-113). It returns
+// the number of blocks, or seconds for timestamps, left before the HTLC can be refunded.
+func canRefundAbsolute(lockTime uint32, currentTip, medianTime uint64) (bool, uint64) {
+	if lockTime < txscript.LockTimeThreshold {
+		if uint64(lockTime) > currentTip {
+			return false, uint64(lockTime) - currentTip
+		}
+		return true, 0
+	}
+	if uint64(lockTime) >= medianTime {
+		return false, uint64(lockTime) - medianTime + 1
+	}
+	return true, 0
+}
+
+func randomSig(size int) []byte {
+	sig := make([]byte, size)
 	_, _ = rand.Read(sig)
 	return sig
 }
 
 func htlcLeaves(htlc *HTLC) (*htlcTapLeaves, error) {
-	redeemLeaf, err := RedeemLeaf(htlc.RedeemerPubkey, htlc.SecretHash)
-	if err != nil {
-		return &htlcTapLeaves{}, err
+	var redeemLeaf, refundLeaf txscript.TapLeaf
+	var err error
+	if htlc.Mode == HTLCModeMiniscript {
+		redeemLeaf, err = MiniscriptRedeemLeaf(htlc.HashFunction, htlc.RedeemerPubkey, htlc.SecretHash)
+		if err != nil {
+			return &htlcTapLeaves{}, err
+		}
+		refundLeaf, err = MiniscriptRefundLeaf(htlc.InitiatorPubkey, htlc.TimelockType, htlc.Timelock)
+	} else {
+		redeemLeaf, err = RedeemLeafWithHash(htlc.HashFunction, htlc.RedeemerPubkey, htlc.SecretHash)
+		if err != nil {
+			return &htlcTapLeaves{}, err
+		}
+		switch htlc.TimelockType {
+		case RelativeTimelock:
+			refundLeaf, err = RefundLeaf(htlc.InitiatorPubkey, htlc.Timelock)
+		case AbsoluteTimelock:
+			refundLeaf, err = AbsoluteRefundLeaf(htlc.InitiatorPubkey, htlc.Timelock)
+		default:
+			err = ErrUnknownTimelockType(htlc.TimelockType)
+		}
 	}
-	refundLeaf, err := RefundLeaf(htlc.InitiatorPubkey, htlc.Timelock)
 	if err != nil {
 		return &htlcTapLeaves{}, err
 	}
@@ -516,7 +741,22 @@ func (l *htlcTapLeaves) ToArray() []txscript.TapLeaf {
 	return []txscript.TapLeaf{l.redeem, l.refund, l.instantRefund}
 }
 
-func getControlBlock(internalKey *btcec.PublicKey, htlc *HTLC, leaf Leaf) (txscript.TapLeaf, []byte, error) {
+// htlcTapscriptRoot returns the merkle root of the script tree of the HTLC.
+func htlcTapscriptRoot(htlc *HTLC) ([]byte, error) {
+	leaves, err := htlcLeaves(htlc)
+	if err != nil {
+		return nil, err
+	}
+	tapScriptTree := txscript.AssembleTaprootScriptTree(leaves.ToArray()...)
+	rootHash := tapScriptTree.RootNode.TapHash()
+	return rootHash[:], nil
+}
+
+func getControlBlock(htlc *HTLC, leaf Leaf) (txscript.TapLeaf, []byte, error) {
+	internalKey, err := htlc.InternalKey()
+	if err != nil {
+		return txscript.TapLeaf{}, nil, err
+	}
 	leaves, err := htlcLeaves(htlc)
 	if err != nil {
 		return txscript.TapLeaf{}, nil, err
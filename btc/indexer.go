@@ -92,6 +92,26 @@ type IndexerClient interface {
 	FeeEstimate(ctx context.Context) (FeeSuggestion, error)
 }
 
+// ErrMedianTimeNotSupported is returned when the median time past is needed from an indexer which doesn't implement
+// MedianTimeIndexer.
+var ErrMedianTimeNotSupported = errors.New("indexer does not support the median time past")
+
+// MedianTimeIndexer is implemented by the indexers which can report the median time past of the tip block. It is only
+// required to spend the HTLCs with timestamp lock times.
+type MedianTimeIndexer interface {
+	// GetTipMedianTime returns the median time past of the tip block, which is compared against timestamp lock times.
+	GetTipMedianTime(ctx context.Context) (uint64, error)
+}
+
+// tipMedianTime returns the median time past of the tip block if the indexer implements MedianTimeIndexer.
+func tipMedianTime(ctx context.Context, indexer IndexerClient) (uint64, error) {
+	client, ok := indexer.(MedianTimeIndexer)
+	if !ok {
+		return 0, ErrMedianTimeNotSupported
+	}
+	return client.GetTipMedianTime(ctx)
+}
+
 type electrsIndexerClient struct {
 	logger        *zap.Logger
 	url           string
@@ -276,6 +296,61 @@ func (client *electrsIndexerClient) GetTipBlockHeight(ctx context.Context) (uint
 	return height, nil
 }
 
+func (client *electrsIndexerClient) GetTipMedianTime(ctx context.Context) (uint64, error) {
+	hashEndpoint, err := url.JoinPath(client.url, "blocks", "tip", "hash")
+	if err != nil {
+		return 0, err
+	}
+
+	// Send the request
+	var block struct {
+		MedianTime uint64 `json:"mediantime"`
+	}
+	if err := retry(client.logger, ctx, client.retryInterval, func() error {
+		resp, err := http.Get(hashEndpoint)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("fail to read response from %s: %w", hashEndpoint, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("GetTipMedianTime : %v", string(data))
+		}
+
+		blockEndpoint, err := url.JoinPath(client.url, "block", string(data))
+		if err != nil {
+			return err
+		}
+		blockResp, err := http.Get(blockEndpoint)
+		if err != nil {
+			return err
+		}
+		defer blockResp.Body.Close()
+
+		if blockResp.StatusCode != http.StatusOK {
+			errMsg, err := io.ReadAll(blockResp.Body)
+			if err != nil {
+				return fmt.Errorf("fail to read response from %s: %w", blockEndpoint, err)
+			}
+			return fmt.Errorf("GetTipMedianTime : %v", string(errMsg))
+		}
+
+		// Decode response
+		if err := json.NewDecoder(blockResp.Body).Decode(&block); err != nil {
+			return fmt.Errorf("failed to decode block: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	return block.MedianTime, nil
+}
+
 func (client *electrsIndexerClient) GetTxHex(ctx context.Context, txid string) (string, error) {
 	endpoint, err := url.JoinPath(client.url, "tx", txid, "hex")
 	if err != nil {
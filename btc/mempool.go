@@ -0,0 +1,266 @@
+package btc
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrMempoolWatcherStillRunning = errors.New("mempool watcher is still running")
+	ErrMempoolWatcherNotRunning   = errors.New("mempool watcher is not running")
+)
+
+// RevealedSecret is a secret revealed by a spend of the redeem leaf of an HTLC.
+type RevealedSecret struct {
+	// Address of the HTLC
+	Address string
+	Secret  []byte
+	// TxID of the redeem tx revealing the secret
+	TxID string
+	// Confirmed is false while the redeem tx is in the mempool
+	Confirmed bool
+	// BlockHeight of the redeem tx, only set when it is confirmed
+	BlockHeight uint64
+}
+
+// MempoolWatcher watches HTLC addresses for redeems and reports their secrets as soon as they reach the mempool,
+// without waiting for the redeem to confirm. A replacement of the redeem with another txid is reported again, so
+// the secret is not missed if the first redeem never confirms.
+type MempoolWatcher interface {
+	Lifecycle
+
+	// Watch starts watching the HTLC address.
+	Watch(address btcutil.Address)
+
+	// Unwatch stops watching the HTLC address.
+	Unwatch(address btcutil.Address)
+
+	// Secrets returns the channel the revealed secrets are sent to. It is never closed.
+	Secrets() <-chan RevealedSecret
+}
+
+type mempoolWatcher struct {
+	quit chan struct{}
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+
+	logger   *zap.Logger
+	indexer  IndexerClient
+	interval time.Duration
+	secrets  chan RevealedSecret
+
+	// watched maps the watched addresses to the txids of the redeems already reported
+	watched map[string]map[string]bool
+	addrs   map[string]btcutil.Address
+}
+
+// NewMempoolWatcher creates a MempoolWatcher polling the indexer for the txs of the watched addresses.
+func NewMempoolWatcher(indexer IndexerClient, logger *zap.Logger, opts ...func(*mempoolWatcher) error) (MempoolWatcher, error) {
+	watcher := &mempoolWatcher{
+		logger:   logger,
+		indexer:  indexer,
+		interval: 5 * time.Second,
+		secrets:  make(chan RevealedSecret, 16),
+		watched:  map[string]map[string]bool{},
+		addrs:    map[string]btcutil.Address{},
+	}
+	for _, opt := range opts {
+		if err := opt(watcher); err != nil {
+			return nil, err
+		}
+	}
+	return watcher, nil
+}
+
+// WithMempoolPollInterval sets the interval between two polls of the watched addresses.
+func WithMempoolPollInterval(interval time.Duration) func(*mempoolWatcher) error {
+	return func(w *mempoolWatcher) error {
+		w.interval = interval
+		return nil
+	}
+}
+
+func (w *mempoolWatcher) Watch(address btcutil.Address) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	addr := address.EncodeAddress()
+	if _, ok := w.watched[addr]; !ok {
+		w.watched[addr] = map[string]bool{}
+		w.addrs[addr] = address
+	}
+}
+
+func (w *mempoolWatcher) Unwatch(address btcutil.Address) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.watched, address.EncodeAddress())
+	delete(w.addrs, address.EncodeAddress())
+}
+
+func (w *mempoolWatcher) Secrets() <-chan RevealedSecret {
+	return w.secrets
+}
+
+// Start starts polling the watched addresses
+func (w *mempoolWatcher) Start(ctx context.Context) error {
+	if w.quit != nil {
+		return ErrMempoolWatcherStillRunning
+	}
+	w.quit = make(chan struct{})
+
+	ticker := time.NewTicker(w.interval)
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.quit:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				w.poll(ctx)
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops polling the watched addresses
+func (w *mempoolWatcher) Stop() error {
+	if w.quit == nil {
+		return ErrMempoolWatcherNotRunning
+	}
+	close(w.quit)
+	w.wg.Wait()
+	w.quit = nil
+	return nil
+}
+
+// Restart restarts the mempool watcher
+func (w *mempoolWatcher) Restart(ctx context.Context) error {
+	if err := w.Stop(); err != nil {
+		return err
+	}
+	return w.Start(ctx)
+}
+
+func (w *mempoolWatcher) poll(ctx context.Context) {
+	w.mu.Lock()
+	addrs := make([]btcutil.Address, 0, len(w.addrs))
+	for _, addr := range w.addrs {
+		addrs = append(addrs, addr)
+	}
+	w.mu.Unlock()
+
+	for _, addr := range addrs {
+		txs, err := w.indexer.GetAddressTxs(ctx, addr, "")
+		if err != nil {
+			w.logger.Error("failed to get htlc txs", zap.String("address", addr.EncodeAddress()), zap.Error(err))
+			continue
+		}
+		for _, secret := range ExtractSecrets(addr, txs) {
+			if !w.markReported(secret) {
+				continue
+			}
+			select {
+			case w.secrets <- secret:
+			case <-w.quit:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// markReported returns false if the redeem has already been reported or the address is no longer watched
+func (w *mempoolWatcher) markReported(secret RevealedSecret) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	reported, ok := w.watched[secret.Address]
+	if !ok || reported[secret.TxID] {
+		return false
+	}
+	reported[secret.TxID] = true
+	return true
+}
+
+// ExtractSecrets returns the secrets revealed by the txs spending the redeem leaf of the HTLC address, whether they
+// are confirmed or not. The secret is only returned when it matches the secret hash of the leaf.
+func ExtractSecrets(htlcAddr btcutil.Address, txs []Transaction) []RevealedSecret {
+	addr := htlcAddr.EncodeAddress()
+	secrets := []RevealedSecret{}
+	for _, tx := range txs {
+		for _, vin := range tx.VINs {
+			if vin.Prevout.ScriptPubKeyAddress != addr || vin.Witness == nil {
+				continue
+			}
+			secret, ok := redeemSecret(*vin.Witness)
+			if !ok {
+				continue
+			}
+
+			revealed := RevealedSecret{
+				Address:   addr,
+				Secret:    secret,
+				TxID:      tx.TxID,
+				Confirmed: tx.Status.Confirmed,
+			}
+			if tx.Status.Confirmed && tx.Status.BlockHeight != nil {
+				revealed.BlockHeight = *tx.Status.BlockHeight
+			}
+			secrets = append(secrets, revealed)
+			break
+		}
+	}
+	return secrets
+}
+
+// redeemSecret returns the secret revealed by the witness of an HTLC redeem, which is either the tapscript spend of a
+// redeem leaf [signature, secret, script, control block] or the spend of the redeem branch of a BIP-199 HTLC
+// [signature, pubkey, secret, 01, script].
+func redeemSecret(witness []string) ([]byte, bool) {
+	var (
+		ok           bool
+		hashFunction HashFunction
+		secretHash   []byte
+		secretHex    string
+	)
+	switch {
+	case len(witness) == 5 && witness[3] == "01":
+		script, err := hex.DecodeString(witness[4])
+		if err != nil {
+			return nil, false
+		}
+		ok, secretHash = ParseHtlc(script)
+		hashFunction, secretHex = HashSHA256, witness[2]
+	case len(witness) == 4:
+		script, err := hex.DecodeString(witness[2])
+		if err != nil {
+			return nil, false
+		}
+		ok, hashFunction, secretHash, _ = ParseRedeemLeaf(script)
+		secretHex = witness[1]
+	}
+	if !ok {
+		return nil, false
+	}
+
+	secret, err := hex.DecodeString(secretHex)
+	if err != nil {
+		return nil, false
+	}
+	if hash, err := hashFunction.Sum(secret); err != nil || !bytes.Equal(hash, secretHash) {
+		return nil, false
+	}
+	return secret, true
+}
@@ -0,0 +1,163 @@
+package btc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/blockchain/btc"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Mempool watcher", func() {
+	network := &chaincfg.RegressionNetParams
+
+	var (
+		indexer    *recordedIndexer
+		htlcWallet btc.HTLCWallet
+		htlc       *btc.HTLC
+		addr       btcutil.Address
+		secret     []byte
+		redeemer   *btcec.PrivateKey
+	)
+
+	BeforeEach(func() {
+		indexer = newRecordedIndexer()
+		var err error
+		redeemer, err = btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		wallet, err := btc.NewSimpleWallet(redeemer, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee)
+		Expect(err).To(BeNil())
+		htlcWallet, err = btc.NewHTLCWallet(wallet, indexer, network)
+		Expect(err).To(BeNil())
+
+		initiator, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		secret = make([]byte, 32)
+		_, err = rand.Read(secret)
+		Expect(err).To(BeNil())
+		secretHash := sha256.Sum256(secret)
+		htlc = &btc.HTLC{
+			InitiatorPubkey: schnorr.SerializePubKey(initiator.PubKey()),
+			RedeemerPubkey:  schnorr.SerializePubKey(redeemer.PubKey()),
+			SecretHash:      secretHash[:],
+			Timelock:        10,
+		}
+		addr, err = htlcWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		indexer.fund(addr, 1e5)
+	})
+
+	// redeem redeems the htlc and returns the redeem tx the way the indexer reports it, unconfirmed
+	redeem := func(ctx context.Context) btc.Transaction {
+		_, err := htlcWallet.Redeem(ctx, htlc, secret)
+		Expect(err).To(BeNil())
+		return toTransaction(indexer.submitted, addr)
+	}
+
+	It("should extract the secret of an unconfirmed redeem", func(ctx context.Context) {
+		tx := redeem(ctx)
+		secrets := btc.ExtractSecrets(addr, []btc.Transaction{{TxID: "funding"}, tx})
+		Expect(secrets).Should(HaveLen(1))
+		Expect(secrets[0].Secret).Should(Equal(secret))
+		Expect(secrets[0].TxID).Should(Equal(tx.TxID))
+		Expect(secrets[0].Address).Should(Equal(addr.EncodeAddress()))
+		Expect(secrets[0].Confirmed).Should(BeFalse())
+
+		By("Report the block height once confirmed")
+		height := uint64(120)
+		tx.Status = btc.Status{Confirmed: true, BlockHeight: &height}
+		secrets = btc.ExtractSecrets(addr, []btc.Transaction{tx})
+		Expect(secrets[0].Confirmed).Should(BeTrue())
+		Expect(secrets[0].BlockHeight).Should(Equal(height))
+
+		By("Ignore a witness whose secret does not match the hash")
+		(*tx.VINs[0].Witness)[1] = hex.EncodeToString(make([]byte, 32))
+		Expect(btc.ExtractSecrets(addr, []btc.Transaction{tx})).Should(BeEmpty())
+	})
+
+	It("should extract the secret of a p2wsh redeem", func(ctx context.Context) {
+		initiator, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		htlc.InitiatorPubkey = initiator.PubKey().SerializeCompressed()
+		htlc.RedeemerPubkey = redeemer.PubKey().SerializeCompressed()
+		htlc.Mode = btc.HTLCModeP2WSH
+		addr, err = htlcWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		indexer.fund(addr, 1e5)
+
+		tx := redeem(ctx)
+		Expect(*tx.VINs[0].Witness).Should(HaveLen(5))
+		secrets := btc.ExtractSecrets(addr, []btc.Transaction{tx})
+		Expect(secrets).Should(HaveLen(1))
+		Expect(secrets[0].Secret).Should(Equal(secret))
+		Expect(secrets[0].TxID).Should(Equal(tx.TxID))
+
+		By("Ignore a witness whose secret does not match the hash")
+		(*tx.VINs[0].Witness)[2] = hex.EncodeToString(make([]byte, 32))
+		Expect(btc.ExtractSecrets(addr, []btc.Transaction{tx})).Should(BeEmpty())
+	})
+
+	It("should report each redeem of a watched address once", func(ctx context.Context) {
+		watcher, err := btc.NewMempoolWatcher(indexer, zap.NewNop(), btc.WithMempoolPollInterval(5*time.Millisecond))
+		Expect(err).To(BeNil())
+		watcher.Watch(addr)
+		tx := redeem(ctx)
+		indexer.txs[addr.EncodeAddress()] = append(indexer.txs[addr.EncodeAddress()], tx)
+
+		Expect(watcher.Start(ctx)).To(BeNil())
+		Expect(watcher.Start(ctx)).Should(Equal(btc.ErrMempoolWatcherStillRunning))
+		var revealed btc.RevealedSecret
+		Eventually(watcher.Secrets()).Should(Receive(&revealed))
+		Expect(revealed.Secret).Should(Equal(secret))
+		Expect(revealed.TxID).Should(Equal(tx.TxID))
+		Expect(revealed.Confirmed).Should(BeFalse())
+		Consistently(watcher.Secrets(), 50*time.Millisecond).ShouldNot(Receive())
+		Expect(watcher.Stop()).To(BeNil())
+
+		By("Report the replacement of the redeem")
+		replacement := tx
+		replacement.TxID = "replacement"
+		indexer.txs[addr.EncodeAddress()] = append(indexer.txs[addr.EncodeAddress()], replacement)
+		Expect(watcher.Restart(ctx)).Should(Equal(btc.ErrMempoolWatcherNotRunning))
+		Expect(watcher.Start(ctx)).To(BeNil())
+		Eventually(watcher.Secrets()).Should(Receive(&revealed))
+		Expect(revealed.TxID).Should(Equal("replacement"))
+
+		By("Stop reporting unwatched addresses")
+		watcher.Unwatch(addr)
+		Expect(watcher.Stop()).To(BeNil())
+		indexer.txs[addr.EncodeAddress()] = []btc.Transaction{{TxID: "other", VINs: tx.VINs}}
+		Expect(watcher.Start(ctx)).To(BeNil())
+		Consistently(watcher.Secrets(), 50*time.Millisecond).ShouldNot(Receive())
+		Expect(watcher.Stop()).To(BeNil())
+	})
+})
+
+// toTransaction converts the tx spending the address to the indexer representation
+func toTransaction(tx *wire.MsgTx, spent btcutil.Address) btc.Transaction {
+	vins := make([]btc.VIN, len(tx.TxIn))
+	for i, in := range tx.TxIn {
+		witness := make([]string, len(in.Witness))
+		for j, item := range in.Witness {
+			witness[j] = hex.EncodeToString(item)
+		}
+		vins[i] = btc.VIN{
+			TxID:    in.PreviousOutPoint.Hash.String(),
+			Vout:    int(in.PreviousOutPoint.Index),
+			Prevout: btc.Prevout{ScriptPubKeyAddress: spent.EncodeAddress()},
+			Witness: &witness,
+		}
+	}
+	return btc.Transaction{TxID: tx.TxHash().String(), VINs: vins}
+}
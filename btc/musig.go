@@ -0,0 +1,246 @@
+package btc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr/musig2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var (
+	// ErrNotMuSig2HTLC is returned when a cooperative spend is requested for an HTLC which is not in MuSig2 mode
+	ErrNotMuSig2HTLC = fmt.Errorf("htlc is not in musig2 mode")
+
+	// ErrNotHTLCParticipant is returned when the signing key is neither the initiator nor the redeemer of the HTLC
+	ErrNotHTLCParticipant = fmt.Errorf("key is neither the initiator nor the redeemer of the htlc")
+
+	// ErrNoHTLCUtxos is returned when there is nothing to settle at the HTLC address
+	ErrNoHTLCUtxos = fmt.Errorf("no utxos found at the htlc address")
+
+	// ErrCooperativeSessionInputs is returned when the number of nonces, partial signatures or tx inputs doesn't match
+	// the number of inputs of the session
+	ErrCooperativeSessionInputs = func(have, want int) error {
+		return fmt.Errorf("got %d items for a session of %d inputs", have, want)
+	}
+)
+
+// MuSig2AggregateKey returns the MuSig2 aggregate of the initiator and redeemer pubkeys of the HTLC, before applying
+// the taproot tweak. The x-only pubkeys are lifted to their even y coordinate and sorted, so both parties compute the
+// same key regardless of their order.
+func MuSig2AggregateKey(htlc *HTLC) (*btcec.PublicKey, error) {
+	signers, err := htlcSigners(htlc)
+	if err != nil {
+		return nil, err
+	}
+	aggKey, _, _, err := musig2.AggregateKeys(signers, true)
+	if err != nil {
+		return nil, err
+	}
+	return aggKey.PreTweakedKey, nil
+}
+
+// CooperativeSession signs the key path spend of a MuSig2 HTLC together with the counterparty. The protocol takes
+// two rounds:
+//
+//  1. Both parties create a session for the same HTLC and number of inputs and exchange their `PublicNonces`, which
+//     are registered with `RegisterNonces`.
+//  2. Both parties `Sign` the same tx and exchange their partial signatures, then either of them calls `Combine` to
+//     add the final signatures to the tx.
+//
+// A session can only sign once. A new session must be created to sign another tx, as reusing nonces leaks the
+// private key.
+type CooperativeSession struct {
+	sessions []*musig2.Session
+	hashType txscript.SigHashType
+	signed   bool
+}
+
+// NewCooperativeSession creates a signing session for `numInputs` inputs spending the MuSig2 HTLC. The private key
+// must belong to either the initiator or the redeemer.
+func NewCooperativeSession(privKey *btcec.PrivateKey, htlc *HTLC, numInputs int) (*CooperativeSession, error) {
+	if htlc.Mode != HTLCModeMuSig2 {
+		return nil, ErrNotMuSig2HTLC
+	}
+	signers, err := htlcSigners(htlc)
+	if err != nil {
+		return nil, err
+	}
+	root, err := htlcTapscriptRoot(htlc)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signers are committed with their even y coordinate, so the private key is negated when its pubkey is odd.
+	privKey = evenPrivateKey(privKey)
+	xOnly := schnorr.SerializePubKey(privKey.PubKey())
+	if !bytes.Equal(xOnly, htlc.InitiatorPubkey) && !bytes.Equal(xOnly, htlc.RedeemerPubkey) {
+		return nil, ErrNotHTLCParticipant
+	}
+
+	signingCtx, err := musig2.NewContext(privKey, true, musig2.WithKnownSigners(signers), musig2.WithTaprootTweakCtx(root))
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*musig2.Session, numInputs)
+	for i := range sessions {
+		sessions[i], err = signingCtx.NewSession()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &CooperativeSession{
+		sessions: sessions,
+	}, nil
+}
+
+// PublicNonces returns the public nonce of each input, they should be sent to the counterparty.
+func (cs *CooperativeSession) PublicNonces() [][]byte {
+	nonces := make([][]byte, len(cs.sessions))
+	for i, session := range cs.sessions {
+		nonce := session.PublicNonce()
+		nonces[i] = nonce[:]
+	}
+	return nonces
+}
+
+// RegisterNonces registers the public nonces of the counterparty.
+func (cs *CooperativeSession) RegisterNonces(nonces [][]byte) error {
+	if len(nonces) != len(cs.sessions) {
+		return ErrCooperativeSessionInputs(len(nonces), len(cs.sessions))
+	}
+	for i, session := range cs.sessions {
+		var nonce [musig2.PubNonceSize]byte
+		if len(nonces[i]) != musig2.PubNonceSize {
+			return fmt.Errorf("invalid nonce length %d", len(nonces[i]))
+		}
+		copy(nonce[:], nonces[i])
+		if _, err := session.RegisterPubNonce(nonce); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sign returns the partial signature of each input of the tx with the given hash type. Use txscript.SigHashDefault for
+// a tx which is broadcast as is, or SigHashSingleAnyoneCanPay for a SACP which is merged into another tx.
+func (cs *CooperativeSession) Sign(tx *wire.MsgTx, fetcher txscript.PrevOutputFetcher, hashType txscript.SigHashType) ([][]byte, error) {
+	if len(tx.TxIn) != len(cs.sessions) {
+		return nil, ErrCooperativeSessionInputs(len(tx.TxIn), len(cs.sessions))
+	}
+
+	sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+	partialSigs := make([][]byte, len(cs.sessions))
+	for i, session := range cs.sessions {
+		sigHash, err := txscript.CalcTaprootSignatureHash(sigHashes, hashType, tx, i, fetcher)
+		if err != nil {
+			return nil, err
+		}
+		var msg [32]byte
+		copy(msg[:], sigHash)
+		partialSig, err := session.Sign(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := new(bytes.Buffer)
+		if err := partialSig.Encode(buf); err != nil {
+			return nil, err
+		}
+		partialSigs[i] = buf.Bytes()
+	}
+	cs.hashType = hashType
+	cs.signed = true
+	return partialSigs, nil
+}
+
+// Combine combines our partial signatures with the ones of the counterparty and sets the key path witness of each
+// input of the tx. The tx must be the one passed to `Sign`.
+func (cs *CooperativeSession) Combine(tx *wire.MsgTx, partialSigs [][]byte) error {
+	if !cs.signed {
+		return musig2.ErrCombinedNonceUnavailable
+	}
+	if len(partialSigs) != len(cs.sessions) || len(tx.TxIn) != len(cs.sessions) {
+		return ErrCooperativeSessionInputs(len(partialSigs), len(cs.sessions))
+	}
+
+	for i, session := range cs.sessions {
+		partialSig := new(musig2.PartialSignature)
+		if err := partialSig.Decode(bytes.NewReader(partialSigs[i])); err != nil {
+			return err
+		}
+		if _, err := session.CombineSig(partialSig); err != nil {
+			return err
+		}
+		sig := session.FinalSig().Serialize()
+		if cs.hashType != txscript.SigHashDefault {
+			sig = append(sig, byte(cs.hashType))
+		}
+		tx.TxIn[i].Witness = wire.TxWitness{sig}
+	}
+	return nil
+}
+
+// CooperativeSettlementTx builds the unsigned tx sending all the utxos of a MuSig2 HTLC to the recipient with a key
+// path spend. It returns the prevout fetcher needed to sign the tx with a CooperativeSession.
+func (hw *htlcWallet) CooperativeSettlementTx(ctx context.Context, htlc *HTLC, recipient btcutil.Address, feeRate int) (*wire.MsgTx, txscript.PrevOutputFetcher, error) {
+	if htlc.Mode != HTLCModeMuSig2 {
+		return nil, nil, ErrNotMuSig2HTLC
+	}
+	scriptAddr, err := hw.Address(htlc)
+	if err != nil {
+		return nil, nil, err
+	}
+	pkScript, err := txscript.PayToAddrScript(scriptAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	utxos, err := hw.indexer.GetUTXOs(ctx, scriptAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(utxos) == 0 {
+		return nil, nil, ErrNoHTLCUtxos
+	}
+
+	// Estimate with the sighash byte, so the fee rate is met whichever hash type the parties sign with
+	inputs := NewSpendRawInputs([]SpendRequest{{Witness: P2trKeyPathWitness, HashType: SigHashSingleAnyoneCanPay, Utxos: utxos}})
+	tx, err := BuildTransaction(hw.chain, feeRate, inputs, nil, nil, nil, recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+	for i, in := range tx.TxIn {
+		fetcher.AddPrevOut(in.PreviousOutPoint, wire.NewTxOut(utxos[i].Amount, pkScript))
+	}
+	return tx, fetcher, nil
+}
+
+// htlcSigners returns the pubkeys of the initiator and redeemer lifted to their even y coordinate.
+func htlcSigners(htlc *HTLC) ([]*btcec.PublicKey, error) {
+	initiator, err := schnorr.ParsePubKey(htlc.InitiatorPubkey)
+	if err != nil {
+		return nil, err
+	}
+	redeemer, err := schnorr.ParsePubKey(htlc.RedeemerPubkey)
+	if err != nil {
+		return nil, err
+	}
+	return []*btcec.PublicKey{initiator, redeemer}, nil
+}
+
+// evenPrivateKey returns the private key whose pubkey is the even y lift of the x-only pubkey of the given key.
+func evenPrivateKey(privKey *btcec.PrivateKey) *btcec.PrivateKey {
+	if privKey.PubKey().Y().Bit(0) == 0 {
+		return privKey
+	}
+	key := privKey.Key
+	key.Negate()
+	return btcec.PrivKeyFromScalar(&key)
+}
@@ -0,0 +1,173 @@
+package btc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/blockchain/btc"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MuSig2 HTLC", func() {
+	network := &chaincfg.RegressionNetParams
+	feeEstimator := btc.NewFixFeeEstimator(10)
+
+	// newKey returns a private key whose pubkey has the given y parity, so both the even and the odd keys are covered.
+	newKey := func(odd bool) *btcec.PrivateKey {
+		for {
+			key, err := btcec.NewPrivateKey()
+			Expect(err).To(BeNil())
+			if (key.PubKey().Y().Bit(0) == 1) == odd {
+				return key
+			}
+		}
+	}
+
+	newHTLC := func(initiator, redeemer *btcec.PrivateKey) (*btc.HTLC, []byte) {
+		secret := make([]byte, 32)
+		_, err := rand.Read(secret)
+		Expect(err).To(BeNil())
+		secretHash := sha256.Sum256(secret)
+		return &btc.HTLC{
+			InitiatorPubkey: schnorr.SerializePubKey(initiator.PubKey()),
+			RedeemerPubkey:  schnorr.SerializePubKey(redeemer.PubKey()),
+			SecretHash:      secretHash[:],
+			Timelock:        144,
+			Mode:            btc.HTLCModeMuSig2,
+		}, secret
+	}
+
+	verify := func(tx *wire.MsgTx, fetcher txscript.PrevOutputFetcher) {
+		sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+		for i, in := range tx.TxIn {
+			prevOut := fetcher.FetchPrevOutput(in.PreviousOutPoint)
+			engine, err := txscript.NewEngine(prevOut.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+			Expect(err).To(BeNil())
+			Expect(engine.Execute()).To(BeNil())
+		}
+	}
+
+	It("should use the aggregate key as the internal key", func() {
+		initiator, redeemer := newKey(false), newKey(true)
+		htlc, _ := newHTLC(initiator, redeemer)
+		wallet, err := btc.NewHTLCWallet(nil, newRecordedIndexer(), network)
+		Expect(err).To(BeNil())
+
+		musigAddr, err := wallet.Address(htlc)
+		Expect(err).To(BeNil())
+		htlc.Mode = btc.HTLCModeScript
+		scriptAddr, err := wallet.Address(htlc)
+		Expect(err).To(BeNil())
+		Expect(musigAddr.EncodeAddress()).ShouldNot(Equal(scriptAddr.EncodeAddress()))
+
+		By("Aggregate the keys regardless of their order")
+		htlc.Mode = btc.HTLCModeMuSig2
+		aggKey, err := btc.MuSig2AggregateKey(htlc)
+		Expect(err).To(BeNil())
+		swapped, _ := newHTLC(redeemer, initiator)
+		swappedKey, err := btc.MuSig2AggregateKey(swapped)
+		Expect(err).To(BeNil())
+		Expect(aggKey.IsEqual(swappedKey)).Should(BeTrue())
+
+		By("Reject unknown modes")
+		htlc.Mode = "unknown"
+		_, err = wallet.Address(htlc)
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	DescribeTable("should settle cooperatively with a key path spend",
+		func(ctx context.Context, hashType txscript.SigHashType, amounts []int64) {
+			initiator, redeemer := newKey(true), newKey(false)
+			htlc, _ := newHTLC(initiator, redeemer)
+			indexer := newRecordedIndexer()
+			wallet, err := btc.NewHTLCWallet(nil, indexer, network)
+			Expect(err).To(BeNil())
+			addr, err := wallet.Address(htlc)
+			Expect(err).To(BeNil())
+			indexer.fund(addr, amounts...)
+
+			recipient, err := btc.PublicKeyAddress(network, 0, redeemer.PubKey())
+			Expect(err).To(BeNil())
+			tx, fetcher, err := wallet.CooperativeSettlementTx(ctx, htlc, recipient, 10)
+			Expect(err).To(BeNil())
+			Expect(tx.TxIn).Should(HaveLen(len(amounts)))
+			Expect(tx.TxOut).Should(HaveLen(1))
+
+			By("Exchange the nonces")
+			initiatorSession, err := btc.NewCooperativeSession(initiator, htlc, len(tx.TxIn))
+			Expect(err).To(BeNil())
+			redeemerSession, err := btc.NewCooperativeSession(redeemer, htlc, len(tx.TxIn))
+			Expect(err).To(BeNil())
+			Expect(initiatorSession.RegisterNonces(redeemerSession.PublicNonces())).To(BeNil())
+			Expect(redeemerSession.RegisterNonces(initiatorSession.PublicNonces())).To(BeNil())
+
+			By("Exchange the partial signatures")
+			initiatorSigs, err := initiatorSession.Sign(tx, fetcher, hashType)
+			Expect(err).To(BeNil())
+			redeemerSigs, err := redeemerSession.Sign(tx, fetcher, hashType)
+			Expect(err).To(BeNil())
+			Expect(redeemerSession.Combine(tx, initiatorSigs)).To(BeNil())
+			verify(tx, fetcher)
+
+			By("Look like a single-sig p2tr spend")
+			for _, in := range tx.TxIn {
+				Expect(in.Witness).Should(HaveLen(1))
+				Expect(in.Witness.SerializeSize()).Should(Equal(btc.EstimateWitnessWeight(btc.P2trKeyPathWitness, hashType)))
+			}
+
+			By("Pay the fee rate")
+			fee := -tx.TxOut[0].Value
+			for _, amount := range amounts {
+				fee += amount
+			}
+			Expect(fee).Should(BeNumerically(">=", 10*btc.TxVirtualSize(tx)))
+
+			By("Combine on the other side as well")
+			Expect(initiatorSession.Combine(tx, redeemerSigs)).To(BeNil())
+			verify(tx, fetcher)
+
+			By("Never sign twice with the same session")
+			_, err = redeemerSession.Sign(tx, fetcher, hashType)
+			Expect(err).ShouldNot(BeNil())
+		},
+		Entry("with the default hash type", txscript.SigHashDefault, []int64{1e5, 2e5}),
+		// Each input of a SACP needs its own output
+		Entry("with SIGHASH_SINGLE|ANYONECANPAY", btc.SigHashSingleAnyoneCanPay, []int64{1e5}),
+	)
+
+	It("should reject keys of other parties", func() {
+		htlc, _ := newHTLC(newKey(false), newKey(false))
+		_, err := btc.NewCooperativeSession(newKey(false), htlc, 1)
+		Expect(err).Should(Equal(btc.ErrNotHTLCParticipant))
+
+		htlc.Mode = btc.HTLCModeScript
+		_, err = btc.NewCooperativeSession(newKey(false), htlc, 1)
+		Expect(err).Should(Equal(btc.ErrNotMuSig2HTLC))
+	})
+
+	It("should keep the redeem leaf as a fallback", func(ctx context.Context) {
+		initiator, redeemer := newKey(false), newKey(true)
+		htlc, secret := newHTLC(initiator, redeemer)
+		indexer := newRecordedIndexer()
+		redeemerWallet, err := btc.NewSimpleWallet(redeemer, network, indexer, feeEstimator, btc.HighFee)
+		Expect(err).To(BeNil())
+		wallet, err := btc.NewHTLCWallet(redeemerWallet, indexer, network)
+		Expect(err).To(BeNil())
+		addr, err := wallet.Address(htlc)
+		Expect(err).To(BeNil())
+		indexer.fund(addr, 1e5)
+
+		_, err = wallet.Redeem(ctx, htlc, secret)
+		Expect(err).To(BeNil())
+		Expect(indexer.submitted.TxIn[0].Witness).Should(HaveLen(4))
+		verify(indexer.submitted, indexer.fetcher())
+	})
+})
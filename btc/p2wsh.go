@@ -0,0 +1,52 @@
+package btc
+
+import (
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// p2wshHTLC returns the BIP-199 witness script, see `HtlcScript`, and the address of the p2wsh HTLC. The initiator
+// owns the refund branch and the redeemer the secret branch.
+func p2wshHTLC(htlc *HTLC, chain *chaincfg.Params) ([]byte, btcutil.Address, error) {
+	if htlc.TimelockType != RelativeTimelock {
+		return nil, nil, ErrUnknownTimelockType(htlc.TimelockType)
+	}
+	if htlc.HashFunction != HashSHA256 {
+		return nil, nil, ErrUnknownHashFunction(htlc.HashFunction)
+	}
+	for _, pubkey := range [][]byte{htlc.InitiatorPubkey, htlc.RedeemerPubkey} {
+		if len(pubkey) != btcec.PubKeyBytesLenCompressed {
+			return nil, nil, ErrInvalidCompressedPubkey
+		}
+		if _, err := btcec.ParsePubKey(pubkey); err != nil {
+			return nil, nil, ErrInvalidCompressedPubkey
+		}
+	}
+	script, err := HtlcScript(btcutil.Hash160(htlc.InitiatorPubkey), btcutil.Hash160(htlc.RedeemerPubkey), htlc.SecretHash, int64(htlc.Timelock))
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := P2wshAddress(script, chain)
+	if err != nil {
+		return nil, nil, err
+	}
+	return script, addr, nil
+}
+
+// p2wshSpendRequest returns the spend request of the p2wsh HTLC with the witness of `HtlcWitness`, signed by the
+// wallet key. The refund branch is spent when the secret is nil.
+func (hw *htlcWallet) p2wshSpendRequest(htlc *HTLC, secret []byte, sequence uint32) (SpendRequest, error) {
+	script, scriptAddr, err := p2wshHTLC(htlc, hw.chain)
+	if err != nil {
+		return SpendRequest{}, err
+	}
+	return SpendRequest{
+		Witness:       HtlcWitness(script, AddPubkeyCompressedOp, AddSignatureSegwitOp, secret),
+		Script:        script,
+		ScriptAddress: scriptAddr,
+		HashType:      txscript.SigHashAll,
+		Sequence:      sequence,
+	}, nil
+}
@@ -0,0 +1,229 @@
+package btc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/blockchain"
+	"github.com/catalogfi/blockchain/btc"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTLC Wallet(p2wsh)", func() {
+	network := &chaincfg.RegressionNetParams
+	feeRate := 10
+
+	var (
+		indexer                        *recordedIndexer
+		aliceWallet, bobWallet         btc.Wallet
+		aliceHTLCWallet, bobHTLCWallet btc.HTLCWallet
+		htlc                           *btc.HTLC
+		secret                         []byte
+	)
+
+	BeforeEach(func() {
+		indexer = newRecordedIndexer()
+		alicePrivKey, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		bobPrivKey, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+
+		aliceWallet, err = btc.NewSimpleWallet(alicePrivKey, network, indexer, btc.NewFixFeeEstimator(feeRate), btc.HighFee)
+		Expect(err).To(BeNil())
+		bobWallet, err = btc.NewSimpleWallet(bobPrivKey, network, indexer, btc.NewFixFeeEstimator(feeRate), btc.HighFee)
+		Expect(err).To(BeNil())
+		aliceHTLCWallet, err = btc.NewHTLCWallet(aliceWallet, indexer, network)
+		Expect(err).To(BeNil())
+		bobHTLCWallet, err = btc.NewHTLCWallet(bobWallet, indexer, network)
+		Expect(err).To(BeNil())
+
+		secret = make([]byte, 32)
+		_, err = rand.Read(secret)
+		Expect(err).To(BeNil())
+		secretHash := sha256.Sum256(secret)
+		htlc = &btc.HTLC{
+			InitiatorPubkey: alicePrivKey.PubKey().SerializeCompressed(),
+			RedeemerPubkey:  bobPrivKey.PubKey().SerializeCompressed(),
+			SecretHash:      secretHash[:],
+			Timelock:        144,
+			Mode:            btc.HTLCModeP2WSH,
+		}
+	})
+
+	verify := func(tx *wire.MsgTx) {
+		fetcher := indexer.fetcher()
+		sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+		totalIn := int64(0)
+		for i, in := range tx.TxIn {
+			prevOut := fetcher.FetchPrevOutput(in.PreviousOutPoint)
+			engine, err := txscript.NewEngine(prevOut.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+			Expect(err).To(BeNil())
+			Expect(engine.Execute()).To(BeNil())
+			totalIn += prevOut.Value
+		}
+		totalOut := int64(0)
+		for _, out := range tx.TxOut {
+			totalOut += out.Value
+		}
+		// The ecdsa signatures can be a byte or two shorter than estimated
+		size := btc.TxVirtualSize(tx)
+		Expect(totalIn - totalOut).Should(BeNumerically(">=", size*feeRate))
+		Expect(totalIn - totalOut).Should(BeNumerically("<=", (size+len(tx.TxIn))*feeRate))
+	}
+
+	// spendEvents returns the HTLC events of the address once the tx spending it is indexed
+	spendEvents := func(ctx context.Context, addr btcutil.Address, tx *wire.MsgTx) []btc.HTLCEvent {
+		fetcher := indexer.fetcher()
+		vins := make([]btc.VIN, len(tx.TxIn))
+		for i, in := range tx.TxIn {
+			witness := make([]string, len(in.Witness))
+			for j, item := range in.Witness {
+				witness[j] = hex.EncodeToString(item)
+			}
+			_, addrs, _, err := txscript.ExtractPkScriptAddrs(fetcher.FetchPrevOutput(in.PreviousOutPoint).PkScript, network)
+			Expect(err).To(BeNil())
+			Expect(addrs).Should(HaveLen(1))
+			vins[i] = btc.VIN{
+				TxID:    in.PreviousOutPoint.Hash.String(),
+				Vout:    int(in.PreviousOutPoint.Index),
+				Prevout: btc.Prevout{ScriptPubKeyAddress: addrs[0].EncodeAddress()},
+				Witness: &witness,
+			}
+		}
+		indexer.txs[addr.EncodeAddress()] = append(indexer.txs[addr.EncodeAddress()], btc.Transaction{TxID: tx.TxHash().String(), VINs: vins})
+
+		events, err := btc.NewHTLCClient(indexer).HTLCEvents(ctx, btc.NewBTCAsset(addr, blockchain.UtxoChain{}), 0, 0)
+		Expect(err).To(BeNil())
+		return events
+	}
+
+	It("should initiate and redeem the HTLC", func(ctx context.Context) {
+		indexer.fund(aliceWallet.Address(), 1e6)
+		addr, err := aliceHTLCWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		Expect(addr).Should(BeAssignableToTypeOf(&btcutil.AddressWitnessScriptHash{}))
+
+		_, err = aliceHTLCWallet.Initiate(ctx, htlc, 1e5)
+		Expect(err).To(BeNil())
+		pkScript, err := txscript.PayToAddrScript(addr)
+		Expect(err).To(BeNil())
+		Expect(indexer.submitted.TxOut[0].PkScript).Should(Equal(pkScript))
+		Expect(indexer.submitted.TxOut[0].Value).Should(Equal(int64(1e5)))
+
+		indexer.fund(addr, 1e5)
+		_, err = bobHTLCWallet.Execute(ctx, []btc.RawHTLCAction{{Action: btc.RedeemHTLCAction, HTLC: *htlc, Secret: secret}})
+		Expect(err).To(BeNil())
+		Expect(indexer.submitted.TxIn[0].Witness).Should(HaveLen(5))
+		Expect(indexer.submitted.TxIn[0].Witness[1]).Should(Equal(htlc.RedeemerPubkey))
+		Expect(indexer.submitted.TxIn[0].Witness[2]).Should(Equal(secret))
+		verify(indexer.submitted)
+
+		By("Use the BIP-199 script")
+		script, err := btc.HtlcScript(btcutil.Hash160(htlc.InitiatorPubkey), btcutil.Hash160(htlc.RedeemerPubkey), htlc.SecretHash, int64(htlc.Timelock))
+		Expect(err).To(BeNil())
+		Expect(indexer.submitted.TxIn[0].Witness[4]).Should(Equal(script))
+
+		events := spendEvents(ctx, addr, indexer.submitted)
+		Expect(events).Should(HaveLen(1))
+		redeemed, ok := events[0].(btc.HTLCRedeemed)
+		Expect(ok).Should(BeTrue())
+		Expect(redeemed.TxHash()).Should(Equal(indexer.submitted.TxHash().String()))
+		Expect(redeemed.Secret()).Should(Equal(secret))
+		Expect(redeemed.HashFunction()).Should(Equal(btc.HashSHA256))
+		Expect(redeemed.RedeemerPubkey()).Should(Equal(hex.EncodeToString(htlc.RedeemerPubkey)))
+	})
+
+	It("should only spend the given utxos of the HTLC", func(ctx context.Context) {
+		addr, err := aliceHTLCWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		_, err = bobHTLCWallet.Redeem(ctx, htlc, secret)
+		Expect(err).Should(Equal(btc.ErrNoFundsToSpend))
+
+		indexer.fund(addr, 1e5, 2e5)
+		_, err = bobHTLCWallet.Execute(ctx, []btc.RawHTLCAction{{Action: btc.RedeemHTLCAction, HTLC: *htlc, Secret: secret, UTXOs: btc.UTXOs{}}})
+		Expect(err).Should(Equal(btc.ErrNoFundsToSpend))
+
+		utxo := indexer.utxos[addr.EncodeAddress()][1]
+		_, err = bobHTLCWallet.Execute(ctx, []btc.RawHTLCAction{{Action: btc.RedeemHTLCAction, HTLC: *htlc, Secret: secret, UTXOs: btc.UTXOs{utxo}}})
+		Expect(err).To(BeNil())
+		Expect(indexer.submitted.TxIn).Should(HaveLen(1))
+		Expect(indexer.submitted.TxIn[0].PreviousOutPoint.Hash.String()).Should(Equal(utxo.TxID))
+		Expect(indexer.submitted.TxIn[0].PreviousOutPoint.Index).Should(Equal(utxo.Vout))
+		verify(indexer.submitted)
+
+		_, err = bobHTLCWallet.Redeem(ctx, htlc, secret)
+		Expect(err).To(BeNil())
+		Expect(indexer.submitted.TxIn).Should(HaveLen(2))
+		verify(indexer.submitted)
+	})
+
+	It("should refund the HTLC after the timelock", func(ctx context.Context) {
+		addr, err := aliceHTLCWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		indexer.fund(addr, 1e5)
+		height := uint64(100)
+		indexer.utxos[addr.EncodeAddress()][0].Status = &btc.Status{Confirmed: true, BlockHeight: &height}
+
+		indexer.tip = 200
+		_, err = aliceHTLCWallet.Refund(ctx, htlc, nil)
+		Expect(err).ShouldNot(BeNil())
+
+		indexer.tip = 300
+		_, err = aliceHTLCWallet.Refund(ctx, htlc, nil)
+		Expect(err).To(BeNil())
+		tx := indexer.submitted
+		Expect(tx.Version).Should(BeNumerically(">=", 2))
+		Expect(tx.TxIn[0].Sequence).Should(Equal(htlc.Timelock))
+		Expect(tx.TxIn[0].Witness).Should(HaveLen(4))
+		Expect(tx.TxIn[0].Witness[1]).Should(Equal(htlc.InitiatorPubkey))
+		verify(tx)
+
+		events := spendEvents(ctx, addr, tx)
+		Expect(events).Should(HaveLen(1))
+		refunded, ok := events[0].(btc.HTLCRefunded)
+		Expect(ok).Should(BeTrue())
+		Expect(refunded.TxHash()).Should(Equal(tx.TxHash().String()))
+		Expect(refunded.RefunderPubkey()).Should(Equal(hex.EncodeToString(htlc.InitiatorPubkey)))
+	})
+
+	It("should ignore the redeems of another secret", func(ctx context.Context) {
+		addr, err := aliceHTLCWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		indexer.fund(addr, 1e5)
+		_, err = bobHTLCWallet.Redeem(ctx, htlc, secret)
+		Expect(err).To(BeNil())
+
+		tx := indexer.submitted.Copy()
+		tx.TxIn[0].Witness[2] = make([]byte, len(secret))
+		Expect(spendEvents(ctx, addr, tx)).Should(BeEmpty())
+	})
+
+	It("should not refund the HTLC instantly", func(ctx context.Context) {
+		addr, err := aliceHTLCWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		indexer.fund(addr, 1e5)
+
+		_, err = bobHTLCWallet.GenerateInstantRefundSACP(ctx, htlc, aliceWallet.Address())
+		Expect(err).Should(Equal(btc.ErrInstantRefundNotSupported))
+		_, err = aliceHTLCWallet.Refund(ctx, htlc, []byte{0x1})
+		Expect(err).Should(Equal(btc.ErrInstantRefundNotSupported))
+	})
+
+	It("should reject x-only pubkeys", func() {
+		privKey, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		htlc.InitiatorPubkey = schnorr.SerializePubKey(privKey.PubKey())
+		_, err = aliceHTLCWallet.Address(htlc)
+		Expect(err).Should(Equal(btc.ErrInvalidCompressedPubkey))
+	})
+})
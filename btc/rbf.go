@@ -9,7 +9,6 @@ import (
 	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
-	"github.com/btcsuite/btcd/mempool"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"go.uber.org/zap"
@@ -74,6 +73,14 @@ func (w *batcherWallet) reSubmitBatchWithNewRequests(c context.Context, batch Ba
 		return fmt.Errorf("transaction %s in the batch has no weight", batch.Tx.TxID)
 	}
 
+	// Defer the pending requests whose lock times can't share the tx with the batched requests
+	if len(pendingRequests) > 0 {
+		pendingRequests = batchableRequests(batchedRequests, pendingRequests)
+		if len(pendingRequests) == 0 {
+			return ErrBatchParametersNotMet
+		}
+	}
+
 	// Calculate the current fee rate for the batch transaction.
 	currentFeeRate := int(batch.Tx.Fee) * blockchain.WitnessScaleFactor / (batch.Tx.Weight)
 
@@ -164,6 +171,12 @@ func getMissingRequestIds(batchedIds, confirmedIds map[string]bool) []string {
 
 // createNewRBFBatch creates a new RBF batch transaction and saves it to the cache
 func (w *batcherWallet) createNewRBFBatch(c context.Context, pendingRequests []BatcherRequest, currentFeeRate, requiredFeeRate int) error {
+	// Defer the requests whose lock times can't share the tx with the ones before them
+	pendingRequests = batchableRequests(nil, pendingRequests)
+	if len(pendingRequests) == 0 {
+		return ErrBatchParametersNotMet
+	}
+
 	// Filter requests to get spend and send requests
 	spendRequests, sendRequests, sacps, reqIds := unpackBatcherRequests(pendingRequests)
 
@@ -365,6 +378,10 @@ func (w *batcherWallet) createRBFTx(
 		sequencesMap = generateSequenceMap(spendUTXOsMap, spendRequests)
 	}
 	sequencesMap = getRbfSequenceMap(sequencesMap, utxos)
+	lockTime, err := spendLockTime(spendRequests, sacps)
+	if err != nil {
+		return nil, err
+	}
 
 	// Combine spend UTXOs with provided UTXOs
 	totalUtxos := append(spendUTXOs, utxos...)
@@ -374,32 +391,33 @@ func (w *batcherWallet) createRBFTx(
 	if err != nil {
 		return nil, err
 	}
+	tx.LockTime = lockTime
 
 	// Sign the inputs related to spend requests
+	var fetcher txscript.PrevOutputFetcher
 	err = withContextTimeout(c, DefaultAPITimeout, func(ctx context.Context) error {
-		return signSpendTx(ctx, tx, signIdx, spendRequests, spendUTXOsMap, w.indexer, w.privateKey)
+		fetcher, err = buildTxPrevOutFetcher(ctx, tx, signIdx, spendUTXOsMap, w.indexer)
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
+	err = signSpendTx(tx, fetcher, signIdx, spendRequests, spendUTXOsMap, w.privateKey)
+	if err != nil {
+		return nil, err
+	}
 
 	// Sign the inputs related to provided UTXOs
-	err = signSendTx(tx, utxos, signIdx+len(spendUTXOs), w.address, w.privateKey)
+	err = signSendTx(tx, fetcher, utxos, signIdx+len(spendUTXOs), w.address, w.privateKey)
 	if err != nil {
 		return nil, err
 	}
 
-	// Calculate the transaction size
-	txb := btcutil.NewTx(tx)
-	trueSize := mempool.GetTxVirtualSize(txb)
-
-	// Calculate the number of signatures required
-	swSigs, trSigs := getNumberOfSigs(spendRequests)
-	bufferFee := 0
-	if depth > 0 {
-		bufferFee = ((4*(swSigs+len(utxos)) + trSigs) / 2) * feeRate
-	}
-	newFeeEstimate := ((int(trueSize)) * feeRate) + bufferFee
+	// Calculate the transaction size from the witness templates, so ecdsa signatures shorter than the maximum size
+	// don't make us underpay
+	coverIdx := signIdx + len(spendUTXOs)
+	size := estimateSignedVirtualSize(tx, signIdx, spendRequests, spendUTXOsMap, w.address, coverIdx, len(utxos))
+	newFeeEstimate := size * feeRate
 
 	// Check if the new fee estimate exceeds the provided fee
 	if newFeeEstimate > int(fee) {
@@ -445,7 +463,6 @@ func (w *batcherWallet) createRBFTx(
 			zap.Int("depth", depth),
 			zap.Uint("fee", fee),
 			zap.Int("newFeeEstimate", newFeeEstimate),
-			zap.Int("bufferFee", bufferFee),
 			zap.Int("requiredFeeRate", feeRate),
 			zap.Int("TxIns", len(tx.TxIn)),
 			zap.Int("TxOuts", len(tx.TxOut)),
@@ -525,7 +542,7 @@ func (w *batcherWallet) getUtxosWithFee(ctx context.Context, amount, feeRate int
 		}
 		total += utxo.Amount
 		selectedUtxos = append(selectedUtxos, utxo)
-		overhead = int64(len(selectedUtxos)*(SegwitSpendWeight)) * feeRate
+		overhead = int64(len(selectedUtxos)*addressInputVirtualSize(w.address)) * feeRate
 		if total >= amount+overhead {
 			break
 		}
@@ -0,0 +1,455 @@
+package btc
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrRefunderStillRunning = errors.New("refunder is still running")
+	ErrRefunderNotRunning   = errors.New("refunder is not running")
+)
+
+// Refunder is a service which refunds the HTLCs we initiated as soon as they expire. The tracked HTLCs are persisted
+// in a RefundStore, so they are refunded even if the service was down when they expired.
+//
+// Every utxo of the HTLC address is refunded once its own timelock expires, so HTLCs funded with less or more than
+// the expected amount, or funded several times, are refunded as well. A refund which is not confirmed after
+// `StuckBlocks` blocks is replaced with a higher fee rate, unless the refunds go through a BatcherWallet which bumps
+// the fees of its batches itself.
+type Refunder interface {
+	Lifecycle
+
+	// Track starts tracking the HTLC and returns its ID, which is the HTLC address.
+	Track(ctx context.Context, htlc *HTLC) (string, error)
+
+	// Untrack stops tracking the HTLC with the given ID.
+	Untrack(ctx context.Context, id string) error
+}
+
+// RefundStore persists the HTLCs tracked by the Refunder.
+type RefundStore interface {
+	// SaveRefund saves the tracked HTLC, overwriting the one with the same ID.
+	SaveRefund(ctx context.Context, refund TrackedRefund) error
+	// ReadRefunds reads all the tracked HTLCs.
+	ReadRefunds(ctx context.Context) ([]TrackedRefund, error)
+	// DeleteRefund deletes the tracked HTLC with the given ID.
+	DeleteRefund(ctx context.Context, id string) error
+}
+
+// TrackedRefund is an HTLC tracked by the Refunder along with its pending refund, if any.
+type TrackedRefund struct {
+	// ID of the tracked HTLC, which is the HTLC address
+	ID   string
+	HTLC HTLC
+
+	// RefundTxID is the txid of the pending refund, or its request ID when refunding through a BatcherWallet. It is
+	// empty when there is none.
+	RefundTxID string
+	// SubmittedAt is the tip height when the pending refund was submitted
+	SubmittedAt uint64
+	// FeeRate of the pending refund
+	FeeRate int
+	// FeeBumps is the number of times the pending refund was replaced
+	FeeBumps int
+}
+
+type RefunderOptions struct {
+	// Interval between two checks of the tracked HTLCs
+	Interval time.Duration
+	// StuckBlocks is the number of blocks after which an unconfirmed refund is replaced
+	StuckBlocks uint64
+	// FeeBumpPercent is the fee rate increase of a replacement, it is always increased by at least 1 sat/vB
+	FeeBumpPercent int
+	// MaxFeeRate caps the fee rate of the replacements, no limit if zero
+	MaxFeeRate int
+}
+
+type refunder struct {
+	quit chan struct{}
+	wg   sync.WaitGroup
+
+	logger       *zap.Logger
+	opts         RefunderOptions
+	indexer      IndexerClient
+	store        RefundStore
+	feeEstimator *refundFeeEstimator
+	feeLevel     FeeLevel
+	wallet       Wallet
+	batcher      BatcherWallet
+	htlcWallet   *htlcWallet
+}
+
+// NewRefunder creates a Refunder which refunds the HTLCs initiated with the given private key to its SimpleWallet
+// address, or through the BatcherWallet given with `WithRefunderBatcher`.
+func NewRefunder(privateKey *btcec.PrivateKey, chainParams *chaincfg.Params, indexer IndexerClient, feeEstimator FeeEstimator, feeLevel FeeLevel, store RefundStore, logger *zap.Logger, opts ...func(*refunder) error) (Refunder, error) {
+	r := &refunder{
+		logger:       logger,
+		opts:         defaultRefunderOptions(),
+		indexer:      indexer,
+		store:        store,
+		feeEstimator: &refundFeeEstimator{estimator: feeEstimator},
+		feeLevel:     feeLevel,
+	}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.batcher != nil {
+		r.wallet = r.batcher
+	} else {
+		wallet, err := NewSimpleWallet(privateKey, chainParams, indexer, r.feeEstimator, feeLevel)
+		if err != nil {
+			return nil, err
+		}
+		r.wallet = wallet
+	}
+	r.htlcWallet = &htlcWallet{
+		wallet:  r.wallet,
+		indexer: indexer,
+		chain:   chainParams,
+	}
+	return r, nil
+}
+
+func defaultRefunderOptions() RefunderOptions {
+	return RefunderOptions{
+		Interval:       1 * time.Minute,
+		StuckBlocks:    3,
+		FeeBumpPercent: 25,
+		MaxFeeRate:     0,
+	}
+}
+
+// WithRefunderInterval sets the interval between two checks of the tracked HTLCs.
+func WithRefunderInterval(interval time.Duration) func(*refunder) error {
+	return func(r *refunder) error {
+		r.opts.Interval = interval
+		return nil
+	}
+}
+
+// WithRefunderBatcher refunds the HTLCs through the given BatcherWallet, which must use the private key of the
+// Refunder. The refunds are batched with the other requests of the batcher and their fees are bumped by it.
+func WithRefunderBatcher(batcher BatcherWallet) func(*refunder) error {
+	return func(r *refunder) error {
+		r.batcher = batcher
+		return nil
+	}
+}
+
+// WithStuckRefund sets the number of blocks after which an unconfirmed refund is replaced, its fee rate is increased
+// by `bumpPercent` up to `maxFeeRate`.
+func WithStuckRefund(blocks uint64, bumpPercent, maxFeeRate int) func(*refunder) error {
+	return func(r *refunder) error {
+		r.opts.StuckBlocks = blocks
+		r.opts.FeeBumpPercent = bumpPercent
+		r.opts.MaxFeeRate = maxFeeRate
+		return nil
+	}
+}
+
+func (r *refunder) Track(ctx context.Context, htlc *HTLC) (string, error) {
+	addr, err := r.htlcWallet.Address(htlc)
+	if err != nil {
+		return "", err
+	}
+	id := addr.EncodeAddress()
+	return id, r.store.SaveRefund(ctx, TrackedRefund{
+		ID:   id,
+		HTLC: *htlc,
+	})
+}
+
+func (r *refunder) Untrack(ctx context.Context, id string) error {
+	return r.store.DeleteRefund(ctx, id)
+}
+
+// Start starts the refunder service
+func (r *refunder) Start(ctx context.Context) error {
+	if r.quit != nil {
+		return ErrRefunderStillRunning
+	}
+	r.quit = make(chan struct{})
+	r.logger.Info("--------starting refunder--------")
+
+	ticker := time.NewTicker(r.opts.Interval)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.quit:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.processRefunds(ctx)
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop gracefully stops the refunder service
+func (r *refunder) Stop() error {
+	if r.quit == nil {
+		return ErrRefunderNotRunning
+	}
+
+	r.logger.Info("--------stopping refunder--------")
+	close(r.quit)
+	r.wg.Wait()
+	r.quit = nil
+	r.logger.Info("refunder stopped")
+	return nil
+}
+
+// Restart restarts the refunder service
+func (r *refunder) Restart(ctx context.Context) error {
+	if err := r.Stop(); err != nil {
+		return err
+	}
+	return r.Start(ctx)
+}
+
+// processRefunds refunds the expired utxos of the tracked HTLCs and replaces the stuck refunds
+func (r *refunder) processRefunds(ctx context.Context) {
+	refunds, err := r.store.ReadRefunds(ctx)
+	if err != nil {
+		r.logger.Error("failed to read tracked htlcs", zap.Error(err))
+		return
+	}
+	if len(refunds) == 0 {
+		return
+	}
+	tip, err := r.indexer.GetTipBlockHeight(ctx)
+	if err != nil {
+		r.logger.Error("failed to get tip block height", zap.Error(err))
+		return
+	}
+
+	for _, refund := range refunds {
+		if err := r.processRefund(ctx, refund, tip); err != nil {
+			r.logger.Error("failed to refund htlc", zap.String("id", refund.ID), zap.Error(err))
+		}
+	}
+}
+
+func (r *refunder) processRefund(ctx context.Context, refund TrackedRefund, tip uint64) error {
+	htlc := &refund.HTLC
+	scriptAddr, err := r.htlcWallet.Address(htlc)
+	if err != nil {
+		return err
+	}
+
+	// Wait for the pending refund before refunding the utxos funded since then
+	if refund.RefundTxID != "" {
+		tx, ok, err := r.wallet.Status(ctx, refund.RefundTxID)
+		switch {
+		case err != nil:
+			return err
+		case !ok && r.batcher != nil:
+			// The refund request is waiting for the next batch
+			return nil
+		case !ok:
+			r.logger.Warn("refund dropped from the mempool", zap.String("id", refund.ID), zap.String("txid", refund.RefundTxID))
+		case tx.Status.Confirmed:
+			r.logger.Info("refund confirmed", zap.String("id", refund.ID), zap.String("txid", refund.RefundTxID))
+		case r.batcher != nil:
+			// The batcher replaces its stuck batches itself
+			return nil
+		case tip >= refund.SubmittedAt+r.opts.StuckBlocks:
+			return r.replaceRefund(ctx, refund, scriptAddr, tx, tip)
+		default:
+			return nil
+		}
+		refund.RefundTxID = ""
+		refund.FeeRate = 0
+		refund.FeeBumps = 0
+	}
+
+	utxos, err := r.indexer.GetUTXOs(ctx, scriptAddr)
+	if err != nil {
+		return err
+	}
+	if len(utxos) == 0 {
+		// The HTLC has been spent by either a refund or a redeem, otherwise it hasn't been funded yet
+		txs, err := r.indexer.GetAddressTxs(ctx, scriptAddr, "")
+		if err != nil {
+			return err
+		}
+		if len(txs) > 0 {
+			r.logger.Info("htlc settled", zap.String("id", refund.ID))
+			return r.store.DeleteRefund(ctx, refund.ID)
+		}
+		return r.store.SaveRefund(ctx, refund)
+	}
+
+	refundable, err := r.refundableUTXOs(ctx, htlc, utxos, tip)
+	if err != nil {
+		return err
+	}
+	if len(refundable) == 0 {
+		return r.store.SaveRefund(ctx, refund)
+	}
+	return r.submitRefund(ctx, refund, scriptAddr, refundable, 0, tip)
+}
+
+// replaceRefund replaces the stuck refund with one spending the same utxos at a higher fee rate
+func (r *refunder) replaceRefund(ctx context.Context, refund TrackedRefund, scriptAddr btcutil.Address, stuckTx Transaction, tip uint64) error {
+	pkScript, err := txscript.PayToAddrScript(scriptAddr)
+	if err != nil {
+		return err
+	}
+	utxos := UTXOs{}
+	for _, vin := range stuckTx.VINs {
+		if vin.Prevout.ScriptPubKey != hex.EncodeToString(pkScript) {
+			continue
+		}
+		utxos = append(utxos, UTXO{
+			TxID:   vin.TxID,
+			Vout:   uint32(vin.Vout),
+			Amount: int64(vin.Prevout.Value),
+		})
+	}
+	if len(utxos) == 0 {
+		return ErrNoHTLCUtxos
+	}
+
+	minFeeRate := refund.FeeRate + max(refund.FeeRate*r.opts.FeeBumpPercent/100, 1)
+	if r.opts.MaxFeeRate > 0 && minFeeRate > r.opts.MaxFeeRate {
+		return ErrHighFeeEstimate
+	}
+	refund.FeeBumps++
+	r.logger.Info("replacing stuck refund", zap.String("id", refund.ID), zap.String("txid", refund.RefundTxID), zap.Int("feeRate", minFeeRate))
+	return r.submitRefund(ctx, refund, scriptAddr, utxos, minFeeRate, tip)
+}
+
+// submitRefund refunds the utxos paying at least the given fee rate
+func (r *refunder) submitRefund(ctx context.Context, refund TrackedRefund, scriptAddr btcutil.Address, utxos UTXOs, minFeeRate int, tip uint64) error {
+	spendRequest, err := r.htlcWallet.refundSpendRequest(&refund.HTLC, scriptAddr)
+	if err != nil {
+		return err
+	}
+	spendRequest.Utxos = utxos
+
+	r.feeEstimator.minFeeRate = minFeeRate
+	fees, err := r.feeEstimator.FeeSuggestion()
+	if err != nil {
+		return err
+	}
+	txid, err := r.wallet.Send(ctx, nil, []SpendRequest{spendRequest}, nil)
+	if err != nil {
+		return err
+	}
+	r.logger.Info("refund submitted", zap.String("id", refund.ID), zap.String("txid", txid))
+
+	refund.RefundTxID = txid
+	refund.SubmittedAt = tip
+	refund.FeeRate = fees.Level(r.feeLevel)
+	return r.store.SaveRefund(ctx, refund)
+}
+
+// refundableUTXOs returns the utxos of the HTLC whose timelock has expired at the current tip
+func (r *refunder) refundableUTXOs(ctx context.Context, htlc *HTLC, utxos UTXOs, tip uint64) (UTXOs, error) {
+	if htlc.TimelockType == AbsoluteTimelock {
+		medianTime := uint64(0)
+		if htlc.Timelock >= txscript.LockTimeThreshold {
+			var err error
+			medianTime, err = tipMedianTime(ctx, r.indexer)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if ok, _ := canRefundAbsolute(htlc.Timelock, tip, medianTime); !ok {
+			return nil, nil
+		}
+		return utxos, nil
+	}
+
+	refundable := UTXOs{}
+	for _, utxo := range utxos {
+		if ok, _ := canRefund([]UTXO{utxo}, htlc.Timelock, tip); ok {
+			refundable = append(refundable, utxo)
+		}
+	}
+	return refundable, nil
+}
+
+// refundFeeEstimator raises the suggestions of the wrapped estimator to a minimum fee rate, so a replacement pays
+// more than the refund it replaces.
+type refundFeeEstimator struct {
+	estimator  FeeEstimator
+	minFeeRate int
+}
+
+func (e *refundFeeEstimator) FeeSuggestion() (FeeSuggestion, error) {
+	fees, err := e.estimator.FeeSuggestion()
+	if err != nil {
+		return FeeSuggestion{}, err
+	}
+	for _, level := range FeeLevels {
+		if rate := fees.level(level); *rate < e.minFeeRate {
+			*rate = e.minFeeRate
+		}
+	}
+	return fees, nil
+}
+
+// RefunderStore is a leveldb implementation of the RefundStore
+type RefunderStore struct {
+	db *leveldb.DB
+}
+
+func NewRefunderStore(db *leveldb.DB) RefundStore {
+	return &RefunderStore{db: db}
+}
+
+func (s *RefunderStore) refundKey(id string) []byte {
+	return []byte("refunder_htlc_" + id)
+}
+
+func (s *RefunderStore) SaveRefund(_ context.Context, refund TrackedRefund) error {
+	data, err := json.Marshal(refund)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(s.refundKey(refund.ID), data, nil)
+}
+
+func (s *RefunderStore) ReadRefunds(_ context.Context) ([]TrackedRefund, error) {
+	iter := s.db.NewIterator(util.BytesPrefix(s.refundKey("")), nil)
+	defer iter.Release()
+	var refunds []TrackedRefund
+	for iter.Next() {
+		var refund TrackedRefund
+		if err := json.Unmarshal(iter.Value(), &refund); err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, refund)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return refunds, nil
+}
+
+func (s *RefunderStore) DeleteRefund(_ context.Context, id string) error {
+	return s.db.Delete(s.refundKey(id), nil)
+}
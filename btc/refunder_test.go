@@ -0,0 +1,231 @@
+package btc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/blockchain/btc"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Refunder", func() {
+	network := &chaincfg.RegressionNetParams
+
+	var (
+		indexer  *recordedIndexer
+		store    btc.RefundStore
+		refunder btc.Refunder
+		htlc     *btc.HTLC
+		addr     btcutil.Address
+		privKey  *btcec.PrivateKey
+	)
+
+	BeforeEach(func() {
+		indexer = newRecordedIndexer()
+		db, err := leveldb.Open(storage.NewMemStorage(), nil)
+		Expect(err).To(BeNil())
+		DeferCleanup(db.Close)
+		store = btc.NewRefunderStore(db)
+
+		privKey, err = btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		refunder, err = btc.NewRefunder(privKey, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee, store, zap.NewNop(), btc.WithRefunderInterval(5*time.Millisecond), btc.WithStuckRefund(2, 25, 0))
+		Expect(err).To(BeNil())
+
+		redeemer, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		secretHash := sha256.Sum256([]byte("secret"))
+		htlc = &btc.HTLC{
+			InitiatorPubkey: schnorr.SerializePubKey(privKey.PubKey()),
+			RedeemerPubkey:  schnorr.SerializePubKey(redeemer.PubKey()),
+			SecretHash:      secretHash[:],
+			Timelock:        10,
+		}
+	})
+
+	track := func(ctx context.Context) {
+		id, err := refunder.Track(ctx, htlc)
+		Expect(err).To(BeNil())
+		htlcWallet, err := btc.NewHTLCWallet(nil, indexer, network)
+		Expect(err).To(BeNil())
+		addr, err = htlcWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		Expect(id).Should(Equal(addr.EncodeAddress()))
+	}
+
+	readRefunds := func(ctx context.Context) []btc.TrackedRefund {
+		refunds, err := store.ReadRefunds(ctx)
+		Expect(err).To(BeNil())
+		return refunds
+	}
+
+	// run runs the refunder until the tracked refunds match, the indexer is only updated while it is stopped
+	run := func(ctx context.Context, matcher func([]btc.TrackedRefund) bool) {
+		Expect(refunder.Start(ctx)).To(BeNil())
+		Eventually(func() bool { return matcher(readRefunds(ctx)) }).Should(BeTrue())
+		Expect(refunder.Stop()).To(BeNil())
+	}
+
+	confirm := func(utxo *btc.UTXO, height uint64) {
+		utxo.Status = &btc.Status{Confirmed: true, BlockHeight: &height}
+	}
+
+	verify := func(tx *wire.MsgTx) {
+		fetcher := indexer.fetcher()
+		sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+		for i, in := range tx.TxIn {
+			prevOut := fetcher.FetchPrevOutput(in.PreviousOutPoint)
+			engine, err := txscript.NewEngine(prevOut.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+			Expect(err).To(BeNil())
+			Expect(engine.Execute()).To(BeNil())
+		}
+	}
+
+	It("should refund each utxo of a multiply funded HTLC once it expires", func(ctx context.Context) {
+		track(ctx)
+		indexer.fund(addr, 1e5, 5e4)
+		utxos := indexer.utxos[addr.EncodeAddress()]
+		confirm(&utxos[0], 100)
+		confirm(&utxos[1], 105)
+
+		By("Wait for the timelock")
+		indexer.tip = 105
+		Expect(refunder.Start(ctx)).To(BeNil())
+		Consistently(func() string { return readRefunds(ctx)[0].RefundTxID }, 50*time.Millisecond).Should(BeEmpty())
+		Expect(refunder.Stop()).To(BeNil())
+		Expect(indexer.submitted).Should(BeNil())
+
+		By("Refund the expired utxo only")
+		indexer.tip = 110
+		run(ctx, func(refunds []btc.TrackedRefund) bool { return refunds[0].RefundTxID != "" })
+		first := indexer.submitted
+		Expect(first.TxIn).Should(HaveLen(1))
+		Expect(first.TxIn[0].PreviousOutPoint.Hash.String()).Should(Equal(utxos[0].TxID))
+		verify(first)
+
+		By("Refund the other utxo once the first refund confirms")
+		indexer.confirmed[first.TxHash().String()] = true
+		indexer.utxos[addr.EncodeAddress()] = utxos[1:]
+		indexer.tip = 115
+		run(ctx, func(refunds []btc.TrackedRefund) bool {
+			return refunds[0].RefundTxID != "" && refunds[0].RefundTxID != first.TxHash().String()
+		})
+		Expect(indexer.submitted.TxIn).Should(HaveLen(1))
+		Expect(indexer.submitted.TxIn[0].PreviousOutPoint.Hash.String()).Should(Equal(utxos[1].TxID))
+		verify(indexer.submitted)
+
+		By("Stop tracking the refunded HTLC")
+		indexer.confirmed[indexer.submitted.TxHash().String()] = true
+		indexer.utxos[addr.EncodeAddress()] = nil
+		run(ctx, func(refunds []btc.TrackedRefund) bool { return len(refunds) == 0 })
+	})
+
+	It("should replace a stuck refund with a higher fee", func(ctx context.Context) {
+		htlc.Timelock = 100
+		htlc.TimelockType = btc.AbsoluteTimelock
+		track(ctx)
+		indexer.fund(addr, 1e5)
+		indexer.tip = 100
+		run(ctx, func(refunds []btc.TrackedRefund) bool { return refunds[0].RefundTxID != "" })
+		stuck := indexer.submitted
+		Expect(stuck.LockTime).Should(Equal(htlc.Timelock))
+		verify(stuck)
+
+		// The utxo is spent by the refund in the mempool
+		utxos := indexer.utxos[addr.EncodeAddress()]
+		indexer.utxos[addr.EncodeAddress()] = nil
+		indexer.tip = 102
+		run(ctx, func(refunds []btc.TrackedRefund) bool { return refunds[0].FeeBumps == 1 })
+		replacement := indexer.submitted
+		Expect(replacement.TxHash()).ShouldNot(Equal(stuck.TxHash()))
+		Expect(replacement.TxIn[0].PreviousOutPoint).Should(Equal(stuck.TxIn[0].PreviousOutPoint))
+		Expect(replacement.TxIn[0].Sequence).Should(BeNumerically("<", wire.MaxTxInSequenceNum-1))
+		Expect(replacement.TxOut[0].Value).Should(BeNumerically("<", stuck.TxOut[0].Value))
+		indexer.utxos[addr.EncodeAddress()] = utxos
+		verify(replacement)
+		Expect(readRefunds(ctx)[0].FeeRate).Should(Equal(12))
+	})
+
+	It("should refund through the batcher", func(ctx context.Context) {
+		db, err := leveldb.Open(storage.NewMemStorage(), nil)
+		Expect(err).To(BeNil())
+		DeferCleanup(db.Close)
+		cache := btc.NewBatcherCache(db, btc.RBF)
+		batcher, err := btc.NewBatcherWallet(privKey, indexer, btc.NewFixFeeEstimator(10), network, cache, zap.NewNop(), btc.WithPTI(5*time.Millisecond), btc.WithStrategy(btc.RBF))
+		Expect(err).To(BeNil())
+		refunder, err = btc.NewRefunder(privKey, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee, store, zap.NewNop(), btc.WithRefunderInterval(5*time.Millisecond), btc.WithStuckRefund(2, 25, 0), btc.WithRefunderBatcher(batcher))
+		Expect(err).To(BeNil())
+
+		track(ctx)
+		indexer.fund(addr, 1e5)
+		indexer.fund(batcher.Address(), 1e6)
+		confirm(&indexer.utxos[addr.EncodeAddress()][0], 100)
+		indexer.tip = 110
+
+		By("Queue the refund in the batcher")
+		run(ctx, func(refunds []btc.TrackedRefund) bool { return refunds[0].RefundTxID != "" })
+		Expect(indexer.submitted).Should(BeNil())
+		requests, err := cache.ReadPendingRequests(ctx)
+		Expect(err).To(BeNil())
+		Expect(requests).Should(HaveLen(1))
+		Expect(requests[0].ID).Should(Equal(readRefunds(ctx)[0].RefundTxID))
+
+		By("Wait for the batch without replacing it")
+		Expect(batcher.Start(ctx)).To(BeNil())
+		Eventually(func() []btc.BatcherRequest {
+			requests, err := cache.ReadPendingRequests(ctx)
+			Expect(err).To(BeNil())
+			return requests
+		}).Should(BeEmpty())
+		Expect(batcher.Stop()).To(BeNil())
+		batch := indexer.submitted
+		Expect(batch.TxIn[0].PreviousOutPoint.Hash.String()).Should(Equal(indexer.utxos[addr.EncodeAddress()][0].TxID))
+		verify(batch)
+
+		indexer.utxos[addr.EncodeAddress()] = nil
+		indexer.tip = 120
+		Expect(refunder.Start(ctx)).To(BeNil())
+		Consistently(func() btc.TrackedRefund { return readRefunds(ctx)[0] }, 50*time.Millisecond).Should(Equal(readRefunds(ctx)[0]))
+		Expect(refunder.Stop()).To(BeNil())
+		Expect(indexer.submitted).Should(Equal(batch))
+
+		By("Stop tracking the HTLC once the batch confirms")
+		indexer.confirmed[batch.TxHash().String()] = true
+		run(ctx, func(refunds []btc.TrackedRefund) bool { return len(refunds) == 0 })
+	})
+
+	It("should stop tracking an HTLC redeemed by the counterparty", func(ctx context.Context) {
+		track(ctx)
+		indexer.fund(addr, 1e5)
+		indexer.utxos[addr.EncodeAddress()] = nil
+		run(ctx, func(refunds []btc.TrackedRefund) bool { return len(refunds) == 0 })
+
+		By("Keep tracking an HTLC which is not funded yet")
+		secret := make([]byte, 32)
+		_, err := rand.Read(secret)
+		Expect(err).To(BeNil())
+		secretHash := sha256.Sum256(secret)
+		htlc.SecretHash = secretHash[:]
+		track(ctx)
+		Expect(refunder.Start(ctx)).To(BeNil())
+		Consistently(func() []btc.TrackedRefund { return readRefunds(ctx) }, 50*time.Millisecond).Should(HaveLen(1))
+		Expect(refunder.Stop()).To(BeNil())
+
+		id := readRefunds(ctx)[0].ID
+		Expect(refunder.Untrack(ctx, id)).To(BeNil())
+		Expect(readRefunds(ctx)).Should(BeEmpty())
+	})
+})
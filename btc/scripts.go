@@ -1,6 +1,7 @@
 package btc
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
+	"golang.org/x/crypto/ripemd160"
 )
 
 var (
@@ -27,13 +29,31 @@ var (
 
 var ErrInvalidLockTime = fmt.Errorf("invalid lock-time")
 
+// ErrInvalidCompressedPubkey is returned when a script expecting compressed pubkeys gets anything else.
+var ErrInvalidCompressedPubkey = fmt.Errorf("invalid compressed pubkey")
+
 // RedeemLeaf is one of the leaf scripts in the HTLC script which can be spent by revealing the secret
 // by the redeemer.
 //
 // redeemerPubkey must be x-only pubkey of the redeemer.
 func RedeemLeaf(redeemerPubkey, secretHash []byte) (txscript.TapLeaf, error) {
+	return RedeemLeafWithHash(HashSHA256, redeemerPubkey, secretHash)
+}
+
+// RedeemLeafWithHash is the redeem leaf committing to the secret with the given hash function.
+//
+// redeemerPubkey must be x-only pubkey of the redeemer.
+func RedeemLeafWithHash(hashFunction HashFunction, redeemerPubkey, secretHash []byte) (txscript.TapLeaf, error) {
+	hashOp, err := hashFunction.Opcode()
+	if err != nil {
+		return txscript.TapLeaf{}, err
+	}
+	if len(secretHash) != hashFunction.Size() {
+		return txscript.TapLeaf{}, ErrInvalidSecretHashLen(len(secretHash), hashFunction.Size())
+	}
+
 	script, err := txscript.NewScriptBuilder().
-		AddOp(txscript.OP_SHA256).
+		AddOp(hashOp).
 		AddData(secretHash).
 		AddOp(txscript.OP_EQUALVERIFY).
 		AddData(redeemerPubkey).
@@ -67,6 +87,92 @@ func RefundLeaf(initiatorPubkey []byte, lockTime uint32) (txscript.TapLeaf, erro
 	return toLeaf(script), nil
 }
 
+// AbsoluteRefundLeaf is the refund leaf of an HTLC with an absolute timelock. It can be spent by the initiator once
+// the chain has reached the lock time, which is a block height when it is below txscript.LockTimeThreshold and a unix
+// timestamp compared against the median time past otherwise.
+//
+// initiatorPubkey must be x-only pubkey of the initiator.
+func AbsoluteRefundLeaf(initiatorPubkey []byte, lockTime uint32) (txscript.TapLeaf, error) {
+	if lockTime == 0 {
+		return txscript.TapLeaf{}, ErrInvalidLockTime
+	}
+
+	script, err := txscript.NewScriptBuilder().
+		AddInt64(int64(lockTime)).
+		AddOp(txscript.OP_CHECKLOCKTIMEVERIFY).
+		AddOp(txscript.OP_DROP).
+		AddData(initiatorPubkey).
+		AddOp(txscript.OP_CHECKSIG).
+		Script()
+	if err != nil {
+		return txscript.TapLeaf{}, err
+	}
+	return toLeaf(script), nil
+}
+
+// MiniscriptRedeemLeaf is the redeem leaf of HTLCModeMiniscript, compiled from the miniscript
+// `and_v(v:<hash>(secretHash),pk(redeemerPubkey))`. Unlike RedeemLeafWithHash, it checks that the secret is 32 bytes.
+//
+// redeemerPubkey must be x-only pubkey of the redeemer.
+func MiniscriptRedeemLeaf(hashFunction HashFunction, redeemerPubkey, secretHash []byte) (txscript.TapLeaf, error) {
+	hashOp, err := hashFunction.Opcode()
+	if err != nil {
+		return txscript.TapLeaf{}, err
+	}
+	if len(secretHash) != hashFunction.Size() {
+		return txscript.TapLeaf{}, ErrInvalidSecretHashLen(len(secretHash), hashFunction.Size())
+	}
+
+	script, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_SIZE).
+		AddInt64(32).
+		AddOp(txscript.OP_EQUALVERIFY).
+		AddOp(hashOp).
+		AddData(secretHash).
+		AddOp(txscript.OP_EQUALVERIFY).
+		AddData(redeemerPubkey).
+		AddOp(txscript.OP_CHECKSIG).
+		Script()
+	if err != nil {
+		return txscript.TapLeaf{}, err
+	}
+	return toLeaf(script), nil
+}
+
+// MiniscriptRefundLeaf is the refund leaf of HTLCModeMiniscript, compiled from the miniscript
+// `and_v(v:pk(initiatorPubkey),older(lockTime))`, or `and_v(v:pk(initiatorPubkey),after(lockTime))` for an
+// AbsoluteTimelock.
+//
+// initiatorPubkey must be x-only pubkey of the initiator.
+func MiniscriptRefundLeaf(initiatorPubkey []byte, timelockType TimelockType, lockTime uint32) (txscript.TapLeaf, error) {
+	var timelockOp byte
+	switch timelockType {
+	case RelativeTimelock:
+		if lockTime == 0 || lockTime > math.MaxUint16 {
+			return txscript.TapLeaf{}, ErrInvalidLockTime
+		}
+		timelockOp = txscript.OP_CHECKSEQUENCEVERIFY
+	case AbsoluteTimelock:
+		if lockTime == 0 || lockTime > math.MaxInt32 {
+			return txscript.TapLeaf{}, ErrInvalidLockTime
+		}
+		timelockOp = txscript.OP_CHECKLOCKTIMEVERIFY
+	default:
+		return txscript.TapLeaf{}, ErrUnknownTimelockType(timelockType)
+	}
+
+	script, err := txscript.NewScriptBuilder().
+		AddData(initiatorPubkey).
+		AddOp(txscript.OP_CHECKSIGVERIFY).
+		AddInt64(int64(lockTime)).
+		AddOp(timelockOp).
+		Script()
+	if err != nil {
+		return txscript.TapLeaf{}, err
+	}
+	return toLeaf(script), nil
+}
+
 // MultiSigLeaf is a 2 on 2 multisig leaf script
 //
 // pubkeys must be x-only pubkeys of the initiator and the redeemer.
@@ -131,64 +237,114 @@ func isWaitTimeOpCode(opCode byte) bool {
 		(opCode >= txscript.OP_DATA_1 && opCode <= txscript.OP_DATA_3)
 }
 
+// isLockTimeOpCode returns if the given opCode is a valid opCode for a `OP_CHECKLOCKTIMEVERIFY` params.
+// The lock time is a uint32 which takes up to 5 bytes as a script number.
+func isLockTimeOpCode(opCode byte) bool {
+	return (opCode >= txscript.OP_1 && opCode <= txscript.OP_16) ||
+		(opCode >= txscript.OP_DATA_1 && opCode <= txscript.OP_DATA_5)
+}
+
 func IsRedeemLeaf(script []byte) (bool, string) {
+	ok, _, _, redeemerPubkey := ParseRedeemLeaf(script)
+	return ok, redeemerPubkey
+}
+
+// ParseRedeemLeaf returns if the script is a redeem leaf, along with its hash function, secret hash and the pubkey
+// of the redeemer.
+func ParseRedeemLeaf(script []byte) (bool, HashFunction, []byte, string) {
+	tokenizer := txscript.MakeScriptTokenizer(0, script)
+	if !tokenizer.Next() {
+		return false, "", nil, ""
+	}
+
+	// The miniscript leaves start with a check of the secret size
+	if tokenizer.Opcode() == txscript.OP_SIZE {
+		if !tokenizer.Next() || tokenizer.Opcode() != txscript.OP_DATA_1 || !bytes.Equal(tokenizer.Data(), []byte{32}) {
+			return false, "", nil, ""
+		}
+		if !tokenizer.Next() || tokenizer.Opcode() != txscript.OP_EQUALVERIFY || !tokenizer.Next() {
+			return false, "", nil, ""
+		}
+	}
+	hashFunction, ok := hashFunctionFromOpcode(tokenizer.Opcode())
+	if !ok {
+		return false, "", nil, ""
+	}
+
 	validRedeem := []byte{
-		txscript.OP_SHA256,
 		txscript.OP_DATA_32,
 		txscript.OP_EQUALVERIFY,
 		txscript.OP_DATA_32,
 		txscript.OP_CHECKSIG,
 	}
-	tokenizer := txscript.MakeScriptTokenizer(0, script)
+	if hashFunction.Size() == ripemd160.Size {
+		validRedeem[0] = txscript.OP_DATA_20
+	}
 
+	var secretHash []byte
 	var redeemerPubkey string
-	isSecond := false
-
-	for _, opCode := range validRedeem {
+	for i, opCode := range validRedeem {
 		if !tokenizer.Next() {
-			return false, ""
+			return false, "", nil, ""
 		}
 		if tokenizer.Opcode() != opCode {
-			return false, ""
+			return false, "", nil, ""
 		}
 
-		if opCode == txscript.OP_DATA_32 {
-			if isSecond {
-				redeemerPubkey = hex.EncodeToString(tokenizer.Data())
-			}
-			isSecond = !isSecond
+		switch i {
+		case 0:
+			secretHash = tokenizer.Data()
+		case 2:
+			redeemerPubkey = hex.EncodeToString(tokenizer.Data())
 		}
 	}
-	return tokenizer.Done(), redeemerPubkey
+	if !tokenizer.Done() {
+		return false, "", nil, ""
+	}
+	return true, hashFunction, secretHash, redeemerPubkey
 }
 
+// IsRefundLeaf returns if the script is a refund leaf with either a relative (`OP_CHECKSEQUENCEVERIFY`) or an
+// absolute (`OP_CHECKLOCKTIMEVERIFY`) timelock, along with the pubkey of the refunder.
 func IsRefundLeaf(script []byte) (bool, string) {
+	if ok, refunderPubkey := isMiniscriptRefundLeaf(script); ok {
+		return true, refunderPubkey
+	}
+
 	validRefund := []byte{
-		0xff,
-		txscript.OP_CHECKSEQUENCEVERIFY,
 		txscript.OP_DROP,
 		txscript.OP_DATA_32,
 		txscript.OP_CHECKSIG,
 	}
 	tokenizer := txscript.MakeScriptTokenizer(0, script)
 
+	// The lock time is checked once we know which timelock opcode follows it
+	if !tokenizer.Next() {
+		return false, ""
+	}
+	lockTimeOp, lockTime := tokenizer.Opcode(), decodeLocktime(tokenizer.Data())
+	if !tokenizer.Next() {
+		return false, ""
+	}
+	switch tokenizer.Opcode() {
+	case txscript.OP_CHECKSEQUENCEVERIFY:
+		if !isWaitTimeOpCode(lockTimeOp) || lockTime > math.MaxUint16 || lockTime < 0 {
+			return false, ""
+		}
+	case txscript.OP_CHECKLOCKTIMEVERIFY:
+		if !isLockTimeOpCode(lockTimeOp) || lockTime > math.MaxUint32 || lockTime < 0 {
+			return false, ""
+		}
+	default:
+		return false, ""
+	}
+
 	var refunderPubkey string
 
 	for _, opCode := range validRefund {
 		if !tokenizer.Next() {
 			return false, ""
 		}
-		if opCode == 0xff {
-			if !isWaitTimeOpCode(tokenizer.Opcode()) {
-				return false, ""
-			}
-			lockTime := decodeLocktime(tokenizer.Data())
-			if lockTime > math.MaxUint16 || lockTime < 0 {
-				return false, ""
-			}
-			continue
-		}
-
 		if tokenizer.Opcode() != opCode {
 			return false, ""
 		}
@@ -201,6 +357,36 @@ func IsRefundLeaf(script []byte) (bool, string) {
 	return tokenizer.Done(), refunderPubkey
 }
 
+// isMiniscriptRefundLeaf returns if the script is a refund leaf of HTLCModeMiniscript, along with the pubkey of the
+// refunder.
+func isMiniscriptRefundLeaf(script []byte) (bool, string) {
+	tokenizer := txscript.MakeScriptTokenizer(0, script)
+	if !tokenizer.Next() || tokenizer.Opcode() != txscript.OP_DATA_32 {
+		return false, ""
+	}
+	refunderPubkey := hex.EncodeToString(tokenizer.Data())
+	if !tokenizer.Next() || tokenizer.Opcode() != txscript.OP_CHECKSIGVERIFY || !tokenizer.Next() {
+		return false, ""
+	}
+	lockTimeOp, lockTime := tokenizer.Opcode(), decodeLocktime(tokenizer.Data())
+	if !tokenizer.Next() {
+		return false, ""
+	}
+	switch tokenizer.Opcode() {
+	case txscript.OP_CHECKSEQUENCEVERIFY:
+		if !isWaitTimeOpCode(lockTimeOp) || lockTime > math.MaxUint16 || lockTime <= 0 {
+			return false, ""
+		}
+	case txscript.OP_CHECKLOCKTIMEVERIFY:
+		if !isLockTimeOpCode(lockTimeOp) || lockTime > math.MaxInt32 || lockTime <= 0 {
+			return false, ""
+		}
+	default:
+		return false, ""
+	}
+	return tokenizer.Done(), refunderPubkey
+}
+
 func IsMultiSigLeaf(script []byte) (bool, string) {
 	validMultiSig := []byte{
 		txscript.OP_DATA_32,
@@ -235,6 +421,13 @@ func IsMultiSigLeaf(script []byte) (bool, string) {
 
 // IsHtlc returns if the given script is a HTLC script.
 func IsHtlc(script []byte) bool {
+	ok, _ := ParseHtlc(script)
+	return ok
+}
+
+// ParseHtlc returns if the given script is a HTLC script generated by `HtlcScript`, along with the secret hash of its
+// redeem branch.
+func ParseHtlc(script []byte) (bool, []byte) {
 	// 0xff is used to represent a data of variable length
 	validHtlc := []byte{
 		txscript.OP_IF,
@@ -257,26 +450,33 @@ func IsHtlc(script []byte) bool {
 	}
 	tokenizer := txscript.MakeScriptTokenizer(0, script)
 
+	var secretHash []byte
 	for _, opCode := range validHtlc {
 		if !tokenizer.Next() {
-			return false
+			return false, nil
 		}
 		// Extra check for the lock time
 		if opCode == 0xff {
 			if !isWaitTimeOpCode(tokenizer.Opcode()) {
-				return false
+				return false, nil
 			}
 			lockTime := decodeLocktime(tokenizer.Data())
 			if lockTime > math.MaxUint16 || lockTime < 0 {
-				return false
+				return false, nil
 			}
 			continue
 		}
 		if tokenizer.Opcode() != opCode {
-			return false
+			return false, nil
 		}
+		if opCode == txscript.OP_DATA_32 {
+			secretHash = tokenizer.Data()
+		}
+	}
+	if !tokenizer.Done() {
+		return false, nil
 	}
-	return tokenizer.Done()
+	return true, secretHash
 }
 
 // MultisigWitness used for generating the witness script for spending a multisig utxo.
@@ -385,9 +585,9 @@ func decodeLocktime(v []byte) int64 {
 	// set, the result is negative.  So, remove the sign bit from the result
 	// and make it negative.
 	if v[len(v)-1]&0x80 != 0 {
-		// The maximum length of v has already been determined to be 4
+		// The maximum length of v has already been determined to be 5
 		// above, so uint8 is enough to cover the max possible shift
-		// value of 24.
+		// value of 32.
 		result &= ^(int64(0x80) << uint8(8*(len(v)-1)))
 		return -result
 	}
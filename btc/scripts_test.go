@@ -8,6 +8,7 @@ import (
 	"math"
 	"time"
 
+	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
@@ -484,6 +485,33 @@ var _ = Describe("Bitcoin scripts", func() {
 			})
 		})
 	})
+
+	Context("ParseHtlc function", func() {
+		It("should return the secret hash of the HTLC script", func() {
+			privKey1, err := btcec.NewPrivateKey()
+			Expect(err).To(BeNil())
+			privKey2, err := btcec.NewPrivateKey()
+			Expect(err).To(BeNil())
+			secretHash := sha256.Sum256(localnet.RandomSecret())
+
+			for _, waitTime := range []int64{1, 16, 144, math.MaxUint16} {
+				script, err := btc.HtlcScript(btcutil.Hash160(privKey1.PubKey().SerializeCompressed()), btcutil.Hash160(privKey2.PubKey().SerializeCompressed()), secretHash[:], waitTime)
+				Expect(err).To(BeNil())
+				ok, hash := btc.ParseHtlc(script)
+				Expect(ok).Should(BeTrue())
+				Expect(hash).Should(Equal(secretHash[:]))
+				Expect(btc.IsHtlc(script)).Should(BeTrue())
+			}
+
+			By("Reject the scripts with trailing opcodes")
+			script, err := btc.HtlcScript(btcutil.Hash160(privKey1.PubKey().SerializeCompressed()), btcutil.Hash160(privKey2.PubKey().SerializeCompressed()), secretHash[:], 144)
+			Expect(err).To(BeNil())
+			ok, hash := btc.ParseHtlc(append(script, txscript.OP_DROP))
+			Expect(ok).Should(BeFalse())
+			Expect(hash).Should(BeNil())
+		})
+	})
+
 	Context("GardenNUMS", func() {
 		It("should be able to create static GardenNUMS point", func() {
 			gardenNUMS, err := btc.GardenNUMS()
@@ -0,0 +1,465 @@
+package btc
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrSponsorStillRunning = errors.New("sponsor is still running")
+	ErrSponsorNotRunning   = errors.New("sponsor is not running")
+
+	// ErrNoSACPsToSponsor indicates that there is no queued SACP to sponsor.
+	ErrNoSACPsToSponsor = errors.New("no sacps to sponsor")
+
+	// ErrSACPLockTime indicates that the SACP has a lock time, which the sponsored tx cannot commit to.
+	ErrSACPLockTime = errors.New("sacp with a lock time cannot be sponsored")
+
+	// ErrSACPInvalidVersion indicates that the SACP is signed for another tx version than the sponsored tx.
+	ErrSACPInvalidVersion = func(version int32) error {
+		return fmt.Errorf("sacp tx version %d, expected %d", version, DefaultTxVersion)
+	}
+
+	// ErrSACPInsufficientFee indicates that the fee contribution of the SACP is lower than the fee policy requires.
+	ErrSACPInsufficientFee = func(have, need int64) error {
+		return fmt.Errorf("insufficient sacp fee: have %d, need %d", have, need)
+	}
+
+	// ErrSACPInputSpent indicates that an input of the SACP is already spent.
+	ErrSACPInputSpent = func(outpoint wire.OutPoint) error {
+		return fmt.Errorf("sacp input %v is already spent", outpoint)
+	}
+
+	// ErrSACPUnsupportedInput indicates that an input of the SACP does not spend an output paying to a single
+	// address, which the sponsor cannot track.
+	ErrSACPUnsupportedInput = func(outpoint wire.OutPoint) error {
+		return fmt.Errorf("sacp input %v does not spend an output paying to a single address", outpoint)
+	}
+
+	// ErrSACPAlreadyQueued indicates that an input of the SACP is already spent by a queued SACP.
+	ErrSACPAlreadyQueued = func(outpoint wire.OutPoint) error {
+		return fmt.Errorf("sacp input %v is already queued", outpoint)
+	}
+
+	// ErrSACPInvalidSignature indicates that an input of the SACP is not signed with SigHashSingleAnyoneCanPay.
+	ErrSACPInvalidSignature = func(idx int, err error) error {
+		return fmt.Errorf("invalid sacp signature of input %d: %w", idx, err)
+	}
+)
+
+// FeePolicy returns the fee a user has to contribute in its SACP, given the fee the SACP costs to the sponsor at the
+// current fee rate.
+type FeePolicy func(user string, cost int64) int64
+
+// FullReimbursement requires the users to pay the whole fee of their SACPs.
+func FullReimbursement() FeePolicy {
+	return func(user string, cost int64) int64 {
+		return cost
+	}
+}
+
+// PartialReimbursement requires the users to pay the given percentage of the fee of their SACPs, the sponsor pays
+// the rest.
+func PartialReimbursement(percent int64) FeePolicy {
+	return func(user string, cost int64) int64 {
+		return cost * percent / 100
+	}
+}
+
+// PerUserFeePolicy applies the policy of the user, or the fallback policy for the users without one.
+func PerUserFeePolicy(policies map[string]FeePolicy, fallback FeePolicy) FeePolicy {
+	return func(user string, cost int64) int64 {
+		if policy, ok := policies[user]; ok {
+			return policy(user, cost)
+		}
+		return fallback(user, cost)
+	}
+}
+
+// Sponsor pays the fee of the SACPs signed by the users, like the redeems generated by
+// `HTLCWallet.GenerateRedeemSACP`. Users without funds in their wallets can then redeem or refund their HTLCs.
+// The queued SACPs are merged into a single tx paid by the utxos of the sponsor wallet.
+type Sponsor interface {
+	Lifecycle
+
+	// Submit validates the inputs, outputs and fee contribution of the SACP signed by the user, and queues it for
+	// the next batch. It returns the id of the SACP, which is its first outpoint.
+	Submit(ctx context.Context, user string, sacp []byte) (string, error)
+
+	// Flush sponsors the queued SACPs and returns the txids of the sponsoring txs. The SACPs are merged into a single
+	// tx, when it is rejected the batch is split in halves sponsored separately, and the SACPs rejected on their own
+	// are evicted from the queue.
+	Flush(ctx context.Context) ([]string, error)
+
+	// Status returns the txid of the tx sponsoring the SACP, which is empty while the SACP is queued. The bool is
+	// false if the SACP is unknown.
+	Status(id string) (string, bool)
+}
+
+type SponsorOptions struct {
+	// Interval between two batches
+	Interval time.Duration
+	// FeePolicy decides the fee contribution of each SACP
+	FeePolicy FeePolicy
+}
+
+func defaultSponsorOptions() SponsorOptions {
+	return SponsorOptions{
+		Interval:  time.Minute,
+		FeePolicy: FullReimbursement(),
+	}
+}
+
+type queuedSACP struct {
+	id   string
+	user string
+	tx   *wire.MsgTx
+	raw  []byte
+}
+
+type sponsor struct {
+	quit chan struct{}
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	// flushMu serializes the flushes, the queue stays open to new SACPs while a batch is sent
+	flushMu sync.Mutex
+
+	logger       *zap.Logger
+	opts         SponsorOptions
+	chainParams  *chaincfg.Params
+	wallet       Wallet
+	indexer      IndexerClient
+	feeEstimator FeeEstimator
+	feeLevel     FeeLevel
+
+	queue     []queuedSACP
+	queued    map[wire.OutPoint]bool
+	sponsored map[string]string
+}
+
+// NewSponsor creates a Sponsor paying the fee of the SACPs with the utxos of the wallet.
+func NewSponsor(wallet Wallet, chainParams *chaincfg.Params, indexer IndexerClient, feeEstimator FeeEstimator, feeLevel FeeLevel, logger *zap.Logger, opts ...func(*sponsor) error) (Sponsor, error) {
+	s := &sponsor{
+		logger:       logger,
+		opts:         defaultSponsorOptions(),
+		chainParams:  chainParams,
+		wallet:       wallet,
+		indexer:      indexer,
+		feeEstimator: feeEstimator,
+		feeLevel:     feeLevel,
+		queued:       map[wire.OutPoint]bool{},
+		sponsored:    map[string]string{},
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// WithSponsorInterval sets the interval between two batches of sponsored SACPs.
+func WithSponsorInterval(interval time.Duration) func(*sponsor) error {
+	return func(s *sponsor) error {
+		s.opts.Interval = interval
+		return nil
+	}
+}
+
+// WithSponsorFeePolicy sets the policy deciding the fee contribution of each SACP.
+func WithSponsorFeePolicy(policy FeePolicy) func(*sponsor) error {
+	return func(s *sponsor) error {
+		s.opts.FeePolicy = policy
+		return nil
+	}
+}
+
+func (s *sponsor) Submit(ctx context.Context, user string, sacp []byte) (string, error) {
+	tx, err := buildAndValidateSacpTx(sacp)
+	if err != nil {
+		return "", err
+	}
+	if tx.Version != DefaultTxVersion {
+		return "", ErrSACPInvalidVersion(tx.Version)
+	}
+	if tx.LockTime != 0 {
+		return "", ErrSACPLockTime
+	}
+
+	prevOuts, err := s.unspentPrevOuts(ctx, tx)
+	if err != nil {
+		return "", err
+	}
+	if err := verifySACPSignatures(tx, prevOuts); err != nil {
+		return "", err
+	}
+
+	// The fee contribution is checked against the whole SACP tx, its overhead covers the share of the sponsor
+	fee := int64(0)
+	for _, prevOut := range prevOuts {
+		fee += prevOut.Value
+	}
+	for _, out := range tx.TxOut {
+		fee -= out.Value
+	}
+	fees, err := s.feeEstimator.FeeSuggestion()
+	if err != nil {
+		return "", err
+	}
+	cost := int64(TxVirtualSize(tx) * fees.Level(s.feeLevel))
+	if need := s.opts.FeePolicy(user, cost); fee < need {
+		return "", ErrSACPInsufficientFee(fee, need)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, in := range tx.TxIn {
+		if s.queued[in.PreviousOutPoint] {
+			return "", ErrSACPAlreadyQueued(in.PreviousOutPoint)
+		}
+	}
+	for _, in := range tx.TxIn {
+		s.queued[in.PreviousOutPoint] = true
+	}
+	id := tx.TxIn[0].PreviousOutPoint.String()
+	s.queue = append(s.queue, queuedSACP{id: id, user: user, tx: tx, raw: sacp})
+	s.sponsored[id] = ""
+	return id, nil
+}
+
+func (s *sponsor) Flush(ctx context.Context) ([]string, error) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	queue := append([]queuedSACP{}, s.queue...)
+	s.mu.Unlock()
+
+	// Drop the SACPs spent since they were queued, they would invalidate the whole batch
+	batch := []queuedSACP{}
+	for _, sacp := range queue {
+		if _, err := s.unspentPrevOuts(ctx, sacp.tx); err != nil {
+			s.evict(sacp, err)
+			continue
+		}
+		batch = append(batch, sacp)
+	}
+	if len(batch) == 0 {
+		return nil, ErrNoSACPsToSponsor
+	}
+
+	txids, rejected, err := s.sponsorBatch(ctx, batch)
+	for _, sacp := range rejected {
+		// A SACP rejected on its own is only evicted when the sponsor could send other batches, or when it is no
+		// longer valid, so that a failure of the sponsor wallet does not empty the queue
+		if len(txids) > 0 {
+			s.evict(sacp, err)
+			continue
+		}
+		if err := s.validate(ctx, sacp.tx); err != nil {
+			s.evict(sacp, err)
+		}
+	}
+	if len(txids) == 0 {
+		return nil, err
+	}
+	return txids, nil
+}
+
+// sponsorBatch sponsors the SACPs in a single tx. When the tx is rejected, the halves of the batch are sponsored
+// separately, down to the SACPs rejected on their own which are returned along with the error of the whole batch.
+func (s *sponsor) sponsorBatch(ctx context.Context, batch []queuedSACP) ([]string, []queuedSACP, error) {
+	sacps := make([][]byte, len(batch))
+	for i, sacp := range batch {
+		sacps[i] = sacp.raw
+	}
+	txid, err := s.wallet.Send(ctx, nil, nil, sacps)
+	if err == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, sacp := range batch {
+			s.dequeue(sacp)
+			s.sponsored[sacp.id] = txid
+		}
+		return []string{txid}, nil, nil
+	}
+	if len(batch) == 1 {
+		return nil, batch, err
+	}
+
+	txids, rejected, _ := s.sponsorBatch(ctx, batch[:len(batch)/2])
+	moreTxids, moreRejected, _ := s.sponsorBatch(ctx, batch[len(batch)/2:])
+	return append(txids, moreTxids...), append(rejected, moreRejected...), err
+}
+
+func (s *sponsor) Status(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	txid, ok := s.sponsored[id]
+	return txid, ok
+}
+
+// Start starts sponsoring the queued SACPs at every interval
+func (s *sponsor) Start(ctx context.Context) error {
+	if s.quit != nil {
+		return ErrSponsorStillRunning
+	}
+	s.quit = make(chan struct{})
+
+	ticker := time.NewTicker(s.opts.Interval)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.quit:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				txids, err := s.Flush(ctx)
+				if err != nil {
+					if !errors.Is(err, ErrNoSACPsToSponsor) {
+						s.logger.Error("failed to sponsor sacps", zap.Error(err))
+					}
+					continue
+				}
+				s.logger.Info("sponsored sacps", zap.Strings("txids", txids))
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops sponsoring the queued SACPs
+func (s *sponsor) Stop() error {
+	if s.quit == nil {
+		return ErrSponsorNotRunning
+	}
+	close(s.quit)
+	s.wg.Wait()
+	s.quit = nil
+	return nil
+}
+
+// Restart restarts the sponsor
+func (s *sponsor) Restart(ctx context.Context) error {
+	if err := s.Stop(); err != nil {
+		return err
+	}
+	return s.Start(ctx)
+}
+
+// dequeue removes the SACP from the queue, it must be called with the lock held
+func (s *sponsor) dequeue(sacp queuedSACP) {
+	for _, in := range sacp.tx.TxIn {
+		delete(s.queued, in.PreviousOutPoint)
+	}
+	for i := range s.queue {
+		if s.queue[i].id == sacp.id {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+}
+
+// evict removes the SACP from the queue without sponsoring it
+func (s *sponsor) evict(sacp queuedSACP, err error) {
+	s.logger.Warn("dropping sacp", zap.String("id", sacp.id), zap.String("user", sacp.user), zap.Error(err))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dequeue(sacp)
+	delete(s.sponsored, sacp.id)
+}
+
+// validate checks that the inputs of the SACP are unspent and still signed for the sponsored tx
+func (s *sponsor) validate(ctx context.Context, tx *wire.MsgTx) error {
+	prevOuts, err := s.unspentPrevOuts(ctx, tx)
+	if err != nil {
+		return err
+	}
+	return verifySACPSignatures(tx, prevOuts)
+}
+
+// unspentPrevOuts returns the outputs spent by the SACP, they must all be unspent
+func (s *sponsor) unspentPrevOuts(ctx context.Context, tx *wire.MsgTx) ([]*wire.TxOut, error) {
+	prevOuts := make([]*wire.TxOut, len(tx.TxIn))
+	for i, in := range tx.TxIn {
+		outpoint := in.PreviousOutPoint
+		prevTx, err := s.indexer.GetTx(ctx, outpoint.Hash.String())
+		if err != nil {
+			return nil, err
+		}
+		if int(outpoint.Index) >= len(prevTx.VOUTs) {
+			return nil, ErrSACPInputSpent(outpoint)
+		}
+		pkScript, err := hex.DecodeString(prevTx.VOUTs[outpoint.Index].ScriptPubKey)
+		if err != nil {
+			return nil, err
+		}
+		prevOuts[i] = wire.NewTxOut(int64(prevTx.VOUTs[outpoint.Index].Value), pkScript)
+
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, s.chainParams)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) != 1 {
+			return nil, ErrSACPUnsupportedInput(outpoint)
+		}
+		utxos, err := s.indexer.GetUTXOs(ctx, addrs[0])
+		if err != nil {
+			return nil, err
+		}
+		unspent := false
+		for _, utxo := range utxos {
+			if utxo.TxID == outpoint.Hash.String() && utxo.Vout == outpoint.Index {
+				unspent = true
+				break
+			}
+		}
+		if !unspent {
+			return nil, ErrSACPInputSpent(outpoint)
+		}
+	}
+	return prevOuts, nil
+}
+
+// verifySACPSignatures verifies the inputs of the SACP once shifted by another input and output, as they are in the
+// sponsored tx. Only the inputs signed with SigHashSingleAnyoneCanPay stay valid.
+func verifySACPSignatures(tx *wire.MsgTx, prevOuts []*wire.TxOut) error {
+	shifted := wire.NewMsgTx(tx.Version)
+	shifted.LockTime = tx.LockTime
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+
+	sponsorOutpoint := wire.OutPoint{Index: wire.MaxPrevOutIndex - 1}
+	shifted.AddTxIn(wire.NewTxIn(&sponsorOutpoint, nil, nil))
+	shifted.AddTxOut(wire.NewTxOut(0, prevOuts[0].PkScript))
+	fetcher.AddPrevOut(sponsorOutpoint, wire.NewTxOut(0, prevOuts[0].PkScript))
+	for i, in := range tx.TxIn {
+		shifted.AddTxIn(in)
+		shifted.AddTxOut(tx.TxOut[i])
+		fetcher.AddPrevOut(in.PreviousOutPoint, prevOuts[i])
+	}
+
+	sigHashes := txscript.NewTxSigHashes(shifted, fetcher)
+	for i := range tx.TxIn {
+		engine, err := txscript.NewEngine(prevOuts[i].PkScript, shifted, i+1, txscript.StandardVerifyFlags, nil, sigHashes, prevOuts[i].Value, fetcher)
+		if err != nil {
+			return ErrSACPInvalidSignature(i, err)
+		}
+		if err := engine.Execute(); err != nil {
+			return ErrSACPInvalidSignature(i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package btc_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/blockchain/btc"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sponsor", func() {
+	network := &chaincfg.RegressionNetParams
+
+	var (
+		indexer       *recordedIndexer
+		userKey       *btcec.PrivateKey
+		userWallet    btc.Wallet
+		sponsorWallet btc.Wallet
+	)
+
+	BeforeEach(func() {
+		indexer = newRecordedIndexer()
+		var err error
+		userKey, err = btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		userWallet, err = btc.NewSimpleWallet(userKey, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee)
+		Expect(err).To(BeNil())
+
+		sponsorKey, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		sponsorWallet, err = btc.NewSimpleWallet(sponsorKey, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee)
+		Expect(err).To(BeNil())
+		indexer.fund(sponsorWallet.Address(), 1e6)
+	})
+
+	// newHTLC returns an HTLC redeemable by the user and its secret
+	newHTLC := func() (*btc.HTLC, []byte) {
+		initiator, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		Expect(err).To(BeNil())
+		secretHash := sha256.Sum256(secret)
+		return &btc.HTLC{
+			InitiatorPubkey: schnorr.SerializePubKey(initiator.PubKey()),
+			RedeemerPubkey:  schnorr.SerializePubKey(userKey.PubKey()),
+			SecretHash:      secretHash[:],
+			Timelock:        10,
+		}, secret
+	}
+
+	// redeemSACP funds a new htlc and returns its redeem SACP signed by the user with the given fee rate
+	redeemSACP := func(ctx context.Context, feeRate int) ([]byte, btcutil.Address) {
+		htlc, secret := newHTLC()
+		wallet, err := btc.NewSimpleWallet(userKey, network, indexer, btc.NewFixFeeEstimator(feeRate), btc.HighFee)
+		Expect(err).To(BeNil())
+		htlcWallet, err := btc.NewHTLCWallet(wallet, indexer, network)
+		Expect(err).To(BeNil())
+		addr, err := htlcWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		indexer.fund(addr, 1e5)
+		sacp, err := htlcWallet.GenerateRedeemSACP(ctx, htlc, secret, userWallet.Address())
+		Expect(err).To(BeNil())
+		return sacp, addr
+	}
+
+	verify := func(tx *wire.MsgTx) {
+		fetcher := indexer.fetcher()
+		sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+		for i, in := range tx.TxIn {
+			prevOut := fetcher.FetchPrevOutput(in.PreviousOutPoint)
+			engine, err := txscript.NewEngine(prevOut.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+			Expect(err).To(BeNil())
+			Expect(engine.Execute()).To(BeNil())
+		}
+		Expect(btc.TotalFee(tx, fetcher)).Should(BeNumerically(">=", btc.TxVirtualSize(tx)*10))
+	}
+
+	It("should merge the SACPs of the users into a tx paid by the sponsor", func(ctx context.Context) {
+		sponsor, err := btc.NewSponsor(sponsorWallet, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee, zap.NewNop())
+		Expect(err).To(BeNil())
+		first, _ := redeemSACP(ctx, 10)
+		firstID, err := sponsor.Submit(ctx, "alice", first)
+		Expect(err).To(BeNil())
+		_, err = sponsor.Submit(ctx, "alice", first)
+		Expect(err).ShouldNot(BeNil())
+		second, _ := redeemSACP(ctx, 12)
+		secondID, err := sponsor.Submit(ctx, "bob", second)
+		Expect(err).To(BeNil())
+		txid, ok := sponsor.Status(firstID)
+		Expect(ok).Should(BeTrue())
+		Expect(txid).Should(BeEmpty())
+
+		txids, err := sponsor.Flush(ctx)
+		Expect(err).To(BeNil())
+		Expect(txids).Should(HaveLen(1))
+		txid = txids[0]
+		tx := indexer.submitted
+		Expect(tx.TxHash().String()).Should(Equal(txid))
+		// The users fully reimburse the fee, the sponsor does not add any input
+		Expect(tx.TxIn).Should(HaveLen(2))
+		for _, out := range tx.TxOut[:2] {
+			Expect(out.PkScript).Should(Equal(mustPayToAddr(userWallet.Address())))
+		}
+		verify(tx)
+		for _, id := range []string{firstID, secondID} {
+			sponsored, ok := sponsor.Status(id)
+			Expect(ok).Should(BeTrue())
+			Expect(sponsored).Should(Equal(txid))
+		}
+
+		_, err = sponsor.Flush(ctx)
+		Expect(err).Should(Equal(btc.ErrNoSACPsToSponsor))
+	})
+
+	It("should enforce the fee policy of each user", func(ctx context.Context) {
+		sponsor, err := btc.NewSponsor(sponsorWallet, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee, zap.NewNop(),
+			btc.WithSponsorFeePolicy(btc.PerUserFeePolicy(map[string]btc.FeePolicy{"vip": btc.PartialReimbursement(0)}, btc.FullReimbursement())))
+		Expect(err).To(BeNil())
+
+		sacp, _ := redeemSACP(ctx, 2)
+		_, err = sponsor.Submit(ctx, "alice", sacp)
+		Expect(err).ShouldNot(BeNil())
+		Expect(err.Error()).Should(ContainSubstring("insufficient sacp fee"))
+
+		id, err := sponsor.Submit(ctx, "vip", sacp)
+		Expect(err).To(BeNil())
+		txids, err := sponsor.Flush(ctx)
+		Expect(err).To(BeNil())
+		Expect(txids).Should(HaveLen(1))
+		txid := txids[0]
+		tx := indexer.submitted
+		Expect(tx.TxIn).Should(HaveLen(2))
+		Expect(tx.TxIn[1].PreviousOutPoint.Hash.String()).Should(Equal(indexer.utxos[sponsorWallet.Address().EncodeAddress()][0].TxID))
+		verify(tx)
+		sponsored, _ := sponsor.Status(id)
+		Expect(sponsored).Should(Equal(txid))
+	})
+
+	It("should reject SACPs which would invalidate the batch", func(ctx context.Context) {
+		sponsor, err := btc.NewSponsor(sponsorWallet, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee, zap.NewNop())
+		Expect(err).To(BeNil())
+
+		By("Reject inputs not signed with SigHashSingleAnyoneCanPay")
+		htlc, secret := newHTLC()
+		htlcWallet, err := btc.NewHTLCWallet(userWallet, indexer, network)
+		Expect(err).To(BeNil())
+		addr, err := htlcWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		indexer.fund(addr, 1e5)
+		_, err = htlcWallet.Redeem(ctx, htlc, secret)
+		Expect(err).To(BeNil())
+		_, err = sponsor.Submit(ctx, "alice", serialize(indexer.submitted))
+		Expect(err).ShouldNot(BeNil())
+		Expect(err.Error()).Should(ContainSubstring("invalid sacp signature"))
+
+		By("Reject spent inputs")
+		sacp, addr := redeemSACP(ctx, 10)
+		// The spent utxo is kept under another key, so the indexer still finds its tx
+		spent := indexer.utxos[addr.EncodeAddress()]
+		indexer.utxos[addr.EncodeAddress()] = nil
+		indexer.utxos["spent"] = spent
+		_, err = sponsor.Submit(ctx, "alice", sacp)
+		Expect(err).ShouldNot(BeNil())
+		Expect(err.Error()).Should(ContainSubstring("already spent"))
+
+		By("Drop the SACPs spent while queued")
+		indexer.utxos[addr.EncodeAddress()] = spent
+		delete(indexer.utxos, "spent")
+		id, err := sponsor.Submit(ctx, "alice", sacp)
+		Expect(err).To(BeNil())
+		indexer.utxos[addr.EncodeAddress()] = nil
+		indexer.utxos["spent"] = spent
+		_, err = sponsor.Flush(ctx)
+		Expect(errors.Is(err, btc.ErrNoSACPsToSponsor)).Should(BeTrue())
+		_, ok := sponsor.Status(id)
+		Expect(ok).Should(BeFalse())
+	})
+
+	It("should evict the SACPs rejected on their own", func(ctx context.Context) {
+		// The sponsor wallet submits its txs through the rejecting indexer
+		rejecting := &rejectingIndexer{recordedIndexer: indexer, rejected: map[wire.OutPoint]bool{}}
+		sponsorKey, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		wallet, err := btc.NewSimpleWallet(sponsorKey, network, rejecting, btc.NewFixFeeEstimator(10), btc.HighFee)
+		Expect(err).To(BeNil())
+		indexer.fund(wallet.Address(), 1e6)
+		sponsor, err := btc.NewSponsor(wallet, network, rejecting, btc.NewFixFeeEstimator(10), btc.HighFee, zap.NewNop())
+		Expect(err).To(BeNil())
+
+		ids := make([]string, 3)
+		for i := range ids {
+			sacp, _ := redeemSACP(ctx, 10)
+			ids[i], err = sponsor.Submit(ctx, "alice", sacp)
+			Expect(err).To(BeNil())
+		}
+
+		By("Keep the queue when the sponsor cannot send any batch")
+		rejecting.down = true
+		_, err = sponsor.Flush(ctx)
+		Expect(err).Should(Equal(errRejectedTx))
+		for _, id := range ids {
+			txid, ok := sponsor.Status(id)
+			Expect(ok).Should(BeTrue())
+			Expect(txid).Should(BeEmpty())
+		}
+
+		By("Sponsor the other SACPs without the rejected one")
+		rejecting.down = false
+		rejecting.rejected[mustOutPoint(ids[1])] = true
+		txids, err := sponsor.Flush(ctx)
+		Expect(err).To(BeNil())
+		Expect(txids).Should(HaveLen(2))
+		for _, tx := range []string{txids[0], txids[1]} {
+			verify(rejecting.mempool[tx])
+		}
+		first, _ := sponsor.Status(ids[0])
+		Expect(first).Should(Equal(txids[0]))
+		last, _ := sponsor.Status(ids[2])
+		Expect(last).Should(Equal(txids[1]))
+		_, ok := sponsor.Status(ids[1])
+		Expect(ok).Should(BeFalse())
+
+		_, err = sponsor.Flush(ctx)
+		Expect(err).Should(Equal(btc.ErrNoSACPsToSponsor))
+	})
+})
+
+var errRejectedTx = errors.New("tx rejected")
+
+// rejectingIndexer rejects the txs spending any of the rejected outpoints, like a mempool rejecting a conflict, or
+// all the txs while it is down.
+type rejectingIndexer struct {
+	*recordedIndexer
+	rejected map[wire.OutPoint]bool
+	down     bool
+}
+
+func (indexer *rejectingIndexer) SubmitTx(ctx context.Context, tx *wire.MsgTx) error {
+	if indexer.down {
+		return errRejectedTx
+	}
+	for _, in := range tx.TxIn {
+		if indexer.rejected[in.PreviousOutPoint] {
+			return errRejectedTx
+		}
+	}
+	return indexer.recordedIndexer.SubmitTx(ctx, tx)
+}
+
+func mustOutPoint(id string) wire.OutPoint {
+	outpoint, err := wire.NewOutPointFromString(id)
+	Expect(err).To(BeNil())
+	return *outpoint
+}
+
+func mustPayToAddr(addr btcutil.Address) []byte {
+	script, err := txscript.PayToAddrScript(addr)
+	Expect(err).To(BeNil())
+	return script
+}
+
+func serialize(tx *wire.MsgTx) []byte {
+	buf := new(bytes.Buffer)
+	Expect(tx.Serialize(buf)).To(BeNil())
+	return buf.Bytes()
+}
@@ -25,6 +25,7 @@ type serializableSpendRequest struct {
 	ScriptAddress string
 	HashType      txscript.SigHashType
 	Sequence      uint32
+	LockTime      uint32
 	Utxos         UTXOs
 }
 
@@ -61,6 +62,7 @@ func serializeBatcherRequest(req BatcherRequest) ([]byte, error) {
 			ScriptAddress: spend.ScriptAddress.EncodeAddress(),
 			HashType:      spend.HashType,
 			Sequence:      spend.Sequence,
+			LockTime:      spend.LockTime,
 			Utxos:         spend.Utxos,
 		}
 	}
@@ -102,6 +104,7 @@ func deserializeBatcherRequest(data []byte) (BatcherRequest, error) {
 			ScriptAddress: addr,
 			HashType:      spend.HashType,
 			Sequence:      spend.Sequence,
+			LockTime:      spend.LockTime,
 			Utxos:         spend.Utxos,
 		}
 	}
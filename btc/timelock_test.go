@@ -0,0 +1,255 @@
+package btc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/blockchain/btc"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTLC Wallet(absolute timelock)", func() {
+	network := &chaincfg.RegressionNetParams
+
+	var (
+		indexer            *recordedIndexer
+		wallet             btc.Wallet
+		htlcWallet         btc.HTLCWallet
+		redeemerHTLCWallet btc.HTLCWallet
+		htlc               *btc.HTLC
+		privKey            *btcec.PrivateKey
+	)
+
+	BeforeEach(func() {
+		indexer = newRecordedIndexer()
+		var err error
+		privKey, err = btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		wallet, err = btc.NewSimpleWallet(privKey, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee)
+		Expect(err).To(BeNil())
+		htlcWallet, err = btc.NewHTLCWallet(wallet, indexer, network)
+		Expect(err).To(BeNil())
+
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		Expect(err).To(BeNil())
+		secretHash := sha256.Sum256(secret)
+		redeemer, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		redeemerWallet, err := btc.NewSimpleWallet(redeemer, network, indexer, btc.NewFixFeeEstimator(10), btc.HighFee)
+		Expect(err).To(BeNil())
+		redeemerHTLCWallet, err = btc.NewHTLCWallet(redeemerWallet, indexer, network)
+		Expect(err).To(BeNil())
+		htlc = &btc.HTLC{
+			InitiatorPubkey: schnorr.SerializePubKey(privKey.PubKey()),
+			RedeemerPubkey:  schnorr.SerializePubKey(redeemer.PubKey()),
+			SecretHash:      secretHash[:],
+			Timelock:        1000,
+			TimelockType:    btc.AbsoluteTimelock,
+		}
+	})
+
+	verify := func(tx *wire.MsgTx) {
+		fetcher := indexer.fetcher()
+		sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+		for i, in := range tx.TxIn {
+			prevOut := fetcher.FetchPrevOutput(in.PreviousOutPoint)
+			engine, err := txscript.NewEngine(prevOut.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+			Expect(err).To(BeNil())
+			Expect(engine.Execute()).To(BeNil())
+		}
+	}
+
+	It("should use a different address than the relative timelock", func() {
+		addr, err := htlcWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		htlc.TimelockType = btc.RelativeTimelock
+		relativeAddr, err := htlcWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		Expect(addr.EncodeAddress()).ShouldNot(Equal(relativeAddr.EncodeAddress()))
+
+		By("Reject unknown timelock types")
+		htlc.TimelockType = "unknown"
+		_, err = htlcWallet.Address(htlc)
+		Expect(err).ShouldNot(BeNil())
+
+		By("Reject absolute timelocks in p2wsh mode")
+		htlc.TimelockType = btc.AbsoluteTimelock
+		htlc.Mode = btc.HTLCModeP2WSH
+		_, err = htlcWallet.Address(htlc)
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("should refund the HTLC once the block height is reached", func(ctx context.Context) {
+		addr, err := htlcWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		indexer.fund(addr, 1e5)
+
+		indexer.tip = 990
+		_, err = htlcWallet.Refund(ctx, htlc, nil)
+		Expect(err).Should(Equal(btc.ErrHTLCNeedMoreBlocks(10)))
+
+		indexer.tip = 1000
+		_, err = htlcWallet.Refund(ctx, htlc, nil)
+		Expect(err).To(BeNil())
+		tx := indexer.submitted
+		Expect(tx.LockTime).Should(Equal(htlc.Timelock))
+		Expect(tx.TxIn[0].Sequence).Should(BeNumerically("<", wire.MaxTxInSequenceNum))
+		verify(tx)
+	})
+
+	It("should refund the HTLC once the median time past is reached", func(ctx context.Context) {
+		htlc.Timelock = 1700000000
+		addr, err := htlcWallet.Address(htlc)
+		Expect(err).To(BeNil())
+		indexer.fund(addr, 1e5)
+
+		indexer.tip = 1000
+		indexer.medianTime = 1700000000
+		_, err = htlcWallet.Refund(ctx, htlc, nil)
+		Expect(err).Should(Equal(btc.ErrHTLCNeedMoreTime(1)))
+
+		indexer.medianTime = 1700000001
+		_, err = htlcWallet.Refund(ctx, htlc, nil)
+		Expect(err).To(BeNil())
+		Expect(indexer.submitted.LockTime).Should(Equal(htlc.Timelock))
+		verify(indexer.submitted)
+	})
+
+	It("should not mix block height and timestamp lock times", func(ctx context.Context) {
+		timestampHTLC := *htlc
+		timestampHTLC.Timelock = 1700000000
+		for _, h := range []*btc.HTLC{htlc, &timestampHTLC} {
+			addr, err := htlcWallet.Address(h)
+			Expect(err).To(BeNil())
+			indexer.fund(addr, 1e5)
+		}
+		indexer.tip = 1000
+		indexer.medianTime = 1700000001
+
+		_, err := htlcWallet.Execute(ctx, []btc.RawHTLCAction{
+			{Action: btc.RefundHTLCAction, HTLC: *htlc},
+			{Action: btc.RefundHTLCAction, HTLC: timestampHTLC},
+		})
+		Expect(err).Should(Equal(btc.ErrMixedLockTimes))
+	})
+
+	It("should not batch lock times with sacps", func(ctx context.Context) {
+		instantRefundHTLC := *htlc
+		instantRefundHTLC.TimelockType = btc.RelativeTimelock
+		instantRefundHTLC.Timelock = 144
+		for _, h := range []*btc.HTLC{htlc, &instantRefundHTLC} {
+			addr, err := htlcWallet.Address(h)
+			Expect(err).To(BeNil())
+			indexer.fund(addr, 1e5)
+		}
+		indexer.fund(wallet.Address(), 1e5)
+		indexer.tip = 1000
+		sacp, err := redeemerHTLCWallet.GenerateInstantRefundSACP(ctx, &instantRefundHTLC, wallet.Address())
+		Expect(err).To(BeNil())
+
+		refund := btc.RawHTLCAction{Action: btc.RefundHTLCAction, HTLC: *htlc}
+		instantRefund := btc.RawHTLCAction{Action: btc.InstantRefundHTLCAction, HTLC: instantRefundHTLC, InsantRefundSACPTxBytes: sacp}
+		_, err = htlcWallet.Execute(ctx, []btc.RawHTLCAction{refund, instantRefund})
+		Expect(err).Should(Equal(btc.ErrLockTimeWithSACPs))
+
+		By("Spend them in separate txs")
+		_, err = htlcWallet.Execute(ctx, []btc.RawHTLCAction{instantRefund})
+		Expect(err).To(BeNil())
+		Expect(indexer.submitted.LockTime).Should(BeZero())
+		verify(indexer.submitted)
+
+		_, err = htlcWallet.Execute(ctx, []btc.RawHTLCAction{refund})
+		Expect(err).To(BeNil())
+		Expect(indexer.submitted.LockTime).Should(Equal(htlc.Timelock))
+		verify(indexer.submitted)
+	})
+
+	It("should defer the lock times which can't share a batch", func(ctx context.Context) {
+		timestampHTLC := *htlc
+		timestampHTLC.Timelock = 1700000000
+		height := uint64(10)
+		for _, h := range []*btc.HTLC{htlc, &timestampHTLC} {
+			addr, err := htlcWallet.Address(h)
+			Expect(err).To(BeNil())
+			indexer.fund(addr, 1e5)
+			indexer.utxos[addr.EncodeAddress()][0].Status = &btc.Status{Confirmed: true, BlockHeight: &height}
+		}
+		indexer.tip = 1000
+		indexer.medianTime = 1700000001
+
+		newBatcher := func() (btc.HTLCWallet, btc.BatcherWallet, btc.Cache) {
+			db, err := leveldb.Open(storage.NewMemStorage(), nil)
+			Expect(err).To(BeNil())
+			DeferCleanup(db.Close)
+			cache := btc.NewBatcherCache(db, btc.RBF)
+			batcher, err := btc.NewBatcherWallet(privKey, indexer, btc.NewFixFeeEstimator(10), network, cache, zap.NewNop(), btc.WithPTI(5*time.Millisecond), btc.WithStrategy(btc.RBF))
+			Expect(err).To(BeNil())
+			batcherHTLCWallet, err := btc.NewHTLCWallet(batcher, indexer, network)
+			Expect(err).To(BeNil())
+			return batcherHTLCWallet, batcher, cache
+		}
+		batcherHTLCWallet, batcher, cache := newBatcher()
+		indexer.fund(batcher.Address(), 1e6)
+
+		By("Reject the request clashing with a pending one")
+		_, err := batcherHTLCWallet.Refund(ctx, htlc, nil)
+		Expect(err).To(BeNil())
+		_, err = batcherHTLCWallet.Refund(ctx, &timestampHTLC, nil)
+		Expect(err).Should(Equal(btc.ErrMixedLockTimes))
+
+		By("Defer the clashing request accepted by another instance")
+		otherHTLCWallet, _, otherCache := newBatcher()
+		_, err = otherHTLCWallet.Refund(ctx, &timestampHTLC, nil)
+		Expect(err).To(BeNil())
+		requests, err := otherCache.ReadPendingRequests(ctx)
+		Expect(err).To(BeNil())
+		Expect(requests).Should(HaveLen(1))
+		Expect(cache.SaveRequest(ctx, requests[0])).To(BeNil())
+
+		pending := func() []btc.BatcherRequest {
+			requests, err := cache.ReadPendingRequests(ctx)
+			Expect(err).To(BeNil())
+			return requests
+		}
+		Expect(batcher.Start(ctx)).To(BeNil())
+		Eventually(pending).Should(HaveLen(1))
+		Consistently(pending, 50*time.Millisecond).Should(HaveLen(1))
+		Expect(batcher.Stop()).To(BeNil())
+
+		deferred := pending()[0].Spends[0].LockTime
+		Expect([]uint32{htlc.Timelock, timestampHTLC.Timelock}).Should(ContainElement(deferred))
+		Expect(indexer.submitted.LockTime).ShouldNot(Equal(deferred))
+		Expect([]uint32{htlc.Timelock, timestampHTLC.Timelock}).Should(ContainElement(indexer.submitted.LockTime))
+		verify(indexer.submitted)
+	})
+
+	It("should parse both kinds of refund leaves", func() {
+		leaf, err := btc.AbsoluteRefundLeaf(htlc.InitiatorPubkey, 1700000000)
+		Expect(err).To(BeNil())
+		ok, refunder := btc.IsRefundLeaf(leaf.Script)
+		Expect(ok).Should(BeTrue())
+		Expect(refunder).Should(Equal(hex.EncodeToString(htlc.InitiatorPubkey)))
+
+		leaf, err = btc.RefundLeaf(htlc.InitiatorPubkey, 144)
+		Expect(err).To(BeNil())
+		ok, _ = btc.IsRefundLeaf(leaf.Script)
+		Expect(ok).Should(BeTrue())
+
+		_, err = btc.AbsoluteRefundLeaf(htlc.InitiatorPubkey, 0)
+		Expect(err).Should(Equal(btc.ErrInvalidLockTime))
+	})
+})
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
@@ -60,6 +61,11 @@ var (
 		return fmt.Errorf("invalid pubkey, use %s", op)
 	}
 
+	// ErrUnsupportedAddressType indicates that the wallet can't sign for the given address type.
+	ErrUnsupportedAddressType = func(addr btcutil.Address) error {
+		return fmt.Errorf("unsupported address type %T", addr)
+	}
+
 	// ErrInsufficientFunds indicates that the funds are insufficient to spend the script.
 	ErrInsufficientFunds = func(have int64, need int64) error {
 		return fmt.Errorf("insufficient funds: have %d, need %d", have, need)
@@ -75,6 +81,14 @@ var (
 
 	// ErrSCAPInputsNotEqualOutputs indicates that the number of inputs and outputs are not equal in the sacp.
 	ErrSCAPInputsNotEqualOutputs = fmt.Errorf("number of inputs and outputs are not equal in sacp")
+
+	// ErrMixedLockTimes indicates that the spend requests require both a block height and a timestamp lock time,
+	// which cannot be satisfied by a single tx.
+	ErrMixedLockTimes = fmt.Errorf("spend requests mix block height and timestamp lock times")
+
+	// ErrLockTimeWithSACPs indicates that the spend requests require a lock time while sacps are included in the tx.
+	// The sacps are signed with a zero lock time, which their signatures commit to.
+	ErrLockTimeWithSACPs = fmt.Errorf("spend requests with a lock time cannot be batched with sacps")
 )
 
 var (
@@ -113,7 +127,11 @@ type SpendRequest struct {
 	// Sequence number for the input
 	Sequence uint32
 
-	// UTXO to spend
+	// LockTime required by the script, e.g. by `OP_CHECKLOCKTIMEVERIFY`. The lock time of the tx is the greatest lock
+	// time of its spend requests, so the Sequence must be non-final for it to be enforced.
+	LockTime uint32
+
+	// UTXOs to spend, all the utxos of the script address are spent when nil. An empty set has no funds to spend.
 	Utxos UTXOs
 }
 
@@ -125,7 +143,8 @@ type SendRequest struct {
 }
 
 type Wallet interface {
-	// Address returns the Pay-to-Witness-Public-Key-Hash (P2WPKH) address of the wallet.
+	// Address returns the address of the wallet. It's a Pay-to-Witness-Public-Key-Hash (P2WPKH) address unless another
+	// address type is specified when creating the wallet.
 	Address() btcutil.Address
 
 	// Spend funds from multiple scripts and send funds to multiple recipients at the same time in a
@@ -158,8 +177,9 @@ type Wallet interface {
 	// Uses the hash type SigHashSingleAnyoneCanPay.
 	GenerateSACP(ctx context.Context, spendReq SpendRequest, to btcutil.Address) ([]byte, error)
 
-	// SignSACPTx generates a schnorr signature for the given details.
-	// Returns the witness containing the schnorr signature and an error if any.
+	// SignSACPTx generates a SIGHASH_SINGLE|ANYONECANPAY signature for the given details, a schnorr signature for
+	// tapscript spends or an ecdsa signature for p2wsh spends, where the last item of the witness is the witness script.
+	// Returns the witness containing the signature and an error if any.
 	//
 	// tx is not mutated instead a new copy is created internally to perform the signing.
 	SignSACPTx(tx *wire.MsgTx, idx int, amount int64, leaf txscript.TapLeaf, scriptAddr btcutil.Address, witness [][]byte) ([][]byte, error)
@@ -179,21 +199,51 @@ type SimpleWallet struct {
 	feeLevel     FeeLevel
 }
 
-// Generates a new p2wpkh simple wallet
-func NewSimpleWallet(privKey *btcec.PrivateKey, chainParams *chaincfg.Params, indexer IndexerClient, feeEstimator FeeEstimator, feeLevel FeeLevel) (Wallet, error) {
-	address, err := PublicKeyAddress(chainParams, waddrmgr.WitnessPubKey, privKey.PubKey())
+// Generates a new simple wallet, it uses a p2wpkh address unless another address type is given in the options.
+func NewSimpleWallet(privKey *btcec.PrivateKey, chainParams *chaincfg.Params, indexer IndexerClient, feeEstimator FeeEstimator, feeLevel FeeLevel, opts ...func(*SimpleWallet) error) (Wallet, error) {
+	address, err := walletAddress(chainParams, waddrmgr.WitnessPubKey, privKey.PubKey())
 	if err != nil {
 		return nil, err
 	}
 
-	return &SimpleWallet{
+	wallet := &SimpleWallet{
 		indexer:      indexer,
 		signerAddr:   address,
 		privateKey:   privKey,
 		chainParams:  chainParams,
 		feeEstimator: feeEstimator,
 		feeLevel:     feeLevel,
-	}, nil
+	}
+	for _, opt := range opts {
+		if err := opt(wallet); err != nil {
+			return nil, err
+		}
+	}
+	return wallet, nil
+}
+
+// WithSimpleWalletAddressType sets the address type of the SimpleWallet. Supported types are waddrmgr.WitnessPubKey
+// (p2wpkh), waddrmgr.TaprootPubKey (p2tr key path), waddrmgr.PubKeyHash (p2pkh) and waddrmgr.NestedWitnessPubKey
+// (p2sh-p2wpkh).
+func WithSimpleWalletAddressType(addrType waddrmgr.AddressType) func(*SimpleWallet) error {
+	return func(sw *SimpleWallet) error {
+		address, err := walletAddress(sw.chainParams, addrType, sw.privateKey.PubKey())
+		if err != nil {
+			return err
+		}
+		sw.signerAddr = address
+		return nil
+	}
+}
+
+// walletAddress returns the address of the public key for the address types a wallet can sign for.
+func walletAddress(chainParams *chaincfg.Params, addrType waddrmgr.AddressType, pub *btcec.PublicKey) (btcutil.Address, error) {
+	switch addrType {
+	case waddrmgr.WitnessPubKey, waddrmgr.TaprootPubKey, waddrmgr.PubKeyHash, waddrmgr.NestedWitnessPubKey:
+		return PublicKeyAddress(chainParams, addrType, pub)
+	default:
+		return nil, fmt.Errorf("unsupported wallet address type %v", addrType)
+	}
 }
 
 // Returns the address of the wallet.
@@ -216,7 +266,8 @@ func (sw *SimpleWallet) Send(ctx context.Context, sendRequests []SendRequest, sp
 		return "", err
 	}
 
-	tx, err := sw.spendAndSend(ctx, sendRequests, spendRequests, sacps, sacpsFee, fee, 0)
+	// The fee of the SACPs is deducted from the fee paid by the wallet
+	tx, err := sw.spendAndSend(ctx, sendRequests, spendRequests, sacps, sacpsFee, max(fee-sacpsFee, 0), 0)
 	if err != nil {
 		return "", err
 	}
@@ -224,7 +275,7 @@ func (sw *SimpleWallet) Send(ctx context.Context, sendRequests []SendRequest, sp
 	return submitTx(ctx, sw.indexer, tx)
 }
 
-// SignSACPTx generates a schnorr signature for the given details.
+// SignSACPTx generates a SIGHASH_SINGLE|ANYONECANPAY signature for the given details.
 func (sw *SimpleWallet) SignSACPTx(tx *wire.MsgTx, idx int, amount int64, leaf txscript.TapLeaf, scriptAddr btcutil.Address, witness [][]byte) ([][]byte, error) {
 	cTx := tx.Copy()
 	script, err := txscript.PayToAddrScript(scriptAddr)
@@ -232,8 +283,14 @@ func (sw *SimpleWallet) SignSACPTx(tx *wire.MsgTx, idx int, amount int64, leaf t
 		return nil, err
 	}
 
+	// p2wsh signatures commit to the witness script instead of the pkScript
+	signScript := script
+	if _, ok := scriptAddr.(*btcutil.AddressWitnessScriptHash); ok && len(witness) > 0 {
+		signScript = witness[len(witness)-1]
+	}
+
 	fetcher := txscript.NewCannedPrevOutputFetcher(script, amount)
-	err = signTx(cTx, fetcher, amount, idx, witness, script, &leaf, SigHashSingleAnyoneCanPay, sw.privateKey)
+	err = signTx(cTx, fetcher, amount, idx, witness, signScript, &leaf, SigHashSingleAnyoneCanPay, sw.privateKey)
 	if err != nil {
 		return nil, err
 	}
@@ -277,21 +334,26 @@ func (sw *SimpleWallet) generateSACP(ctx context.Context, spendRequest SpendRequ
 	if err != nil {
 		return nil, err
 	}
+	tx.LockTime = spendRequest.LockTime
 
-	// sign the transaction
-	err = signSpendTx(ctx, tx, 0, []SpendRequest{spendRequest}, utxoMap, sw.indexer, sw.privateKey)
+	// estimate the fee required to make the transaction once signed
+	feeRate, err := sw.feeRate()
 	if err != nil {
 		return nil, err
 	}
+	feeToBePaid := estimateSignedVirtualSize(tx, 0, []SpendRequest{spendRequest}, utxoMap, sw.signerAddr, len(tx.TxIn), 0) * feeRate
+	if int64(feeToBePaid) > fee {
+		return sw.generateSACP(ctx, spendRequest, to, int64(feeToBePaid))
+	}
 
-	// estimate the fee required to make the transaction
-	feeToBePaid, err := EstimateSegwitFee(tx, sw.feeEstimator, sw.feeLevel)
+	// sign the transaction
+	fetcher, err := buildTxPrevOutFetcher(ctx, tx, 0, utxoMap, sw.indexer)
 	if err != nil {
 		return nil, err
 	}
-
-	if int64(feeToBePaid) > fee {
-		return sw.generateSACP(ctx, spendRequest, to, int64(feeToBePaid))
+	err = signSpendTx(tx, fetcher, 0, []SpendRequest{spendRequest}, utxoMap, sw.privateKey)
+	if err != nil {
+		return nil, err
 	}
 
 	// serialize the transaction
@@ -312,13 +374,17 @@ func (sw *SimpleWallet) spendAndSend(ctx context.Context, sendRequests []SendReq
 	// spendUTXOs are the UTXOs used to spend the scripts
 	// coverUTXOs are the UTXOs used to cover the remaining amount required to send
 	// utxoMap is a map of script address to UTXOs
-	spendUTXOs, coverUTXOs, utxoMap, err := getUTXOsForRequests(ctx, sw.indexer, spendRequests, sendRequests, sw.signerAddr, fee, sacpFee)
+	spendUTXOs, coverUTXOs, utxoMap, err := getUTXOsForRequests(ctx, sw.indexer, spendRequests, sendRequests, sw.signerAddr, fee)
 	if err != nil {
 		return nil, err
 	}
 
 	// generate sequence map (used to set sequence number for each input)
 	sequenceMap := generateSequenceMap(utxoMap, spendRequests)
+	lockTime, err := spendLockTime(spendRequests, sacps)
+	if err != nil {
+		return nil, err
+	}
 
 	// build the transaction
 	// Signing index indicates from which index we need to start signing the transaction
@@ -326,37 +392,54 @@ func (sw *SimpleWallet) spendAndSend(ctx context.Context, sendRequests []SendReq
 	if err != nil {
 		return nil, err
 	}
+	tx.LockTime = lockTime
 
-	// Sign the spend inputs
-	err = signSpendTx(ctx, tx, signingIdx, spendRequests, utxoMap, sw.indexer, sw.privateKey)
+	// estimate the fee required to make the transaction once signed
+	feeRate, err := sw.feeRate()
 	if err != nil {
 		return nil, err
 	}
+	coverIdx := signingIdx + len(spendUTXOs)
+	feeToBePaid := estimateSignedVirtualSize(tx, signingIdx, spendRequests, utxoMap, sw.signerAddr, coverIdx, len(coverUTXOs)) * feeRate
 
-	// Sign the cover inputs
-	// This is a no op if there are no cover utxos
-	err = signSendTx(tx, coverUTXOs, signingIdx+len(spendRequests), sw.signerAddr, sw.privateKey)
+	// sacpFee is the fee used in the SACPs
+	// This could be zero if there are no SACPs or SACPs have no fee
+	feeToBePaid -= sacpFee
+
+	if feeToBePaid > fee {
+		return sw.spendAndSend(ctx, sendRequests, spendRequests, sacps, sacpFee, feeToBePaid, depth+1)
+	}
+
+	fetcher, err := buildTxPrevOutFetcher(ctx, tx, signingIdx, utxoMap, sw.indexer)
 	if err != nil {
 		return nil, err
 	}
 
-	// estimate the fee required to make the transaction
-	feeToBePaid, err := EstimateSegwitFee(tx, sw.feeEstimator, sw.feeLevel)
+	// Sign the spend inputs
+	err = signSpendTx(tx, fetcher, signingIdx, spendRequests, utxoMap, sw.privateKey)
 	if err != nil {
 		return nil, err
 	}
 
-	// sacpFee is the fee used in the SACPs
-	// This could be zero if there are no SACPs or SACPs have no fee
-	feeToBePaid -= sacpFee
-
-	if feeToBePaid > fee {
-		return sw.spendAndSend(ctx, sendRequests, spendRequests, sacps, sacpFee, feeToBePaid, depth+1)
+	// Sign the cover inputs
+	// This is a no op if there are no cover utxos
+	err = signSendTx(tx, fetcher, coverUTXOs, coverIdx, sw.signerAddr, sw.privateKey)
+	if err != nil {
+		return nil, err
 	}
 
 	return tx, nil
 }
 
+// feeRate returns the fee rate of the wallet's fee level.
+func (sw *SimpleWallet) feeRate() (int, error) {
+	fees, err := sw.feeEstimator.FeeSuggestion()
+	if err != nil {
+		return 0, err
+	}
+	return fees.Level(sw.feeLevel), nil
+}
+
 // Status checks the status of a transaction using its transaction ID (txid).
 func (sw *SimpleWallet) Status(ctx context.Context, id string) (Transaction, bool, error) {
 	tx, err := sw.indexer.GetTx(ctx, id)
@@ -440,7 +523,7 @@ func getPrevoutsForSACPs(ctx context.Context, tx *wire.MsgTx, endingSACPIdx int,
 }
 
 // getUTXOsForRequests returns the UTXOs required to spend the scripts and cover the send amount.
-func getUTXOsForRequests(ctx context.Context, indexer IndexerClient, spendReqs []SpendRequest, sendReqs []SendRequest, feePayer btcutil.Address, fee, sacpFee int) (UTXOs, UTXOs, utxoMap, error) {
+func getUTXOsForRequests(ctx context.Context, indexer IndexerClient, spendReqs []SpendRequest, sendReqs []SendRequest, feePayer btcutil.Address, fee int) (UTXOs, UTXOs, utxoMap, error) {
 
 	spendUTXOs, spendUTXOsMap, balanceOfScripts, err := getUTXOsForSpendRequest(ctx, indexer, spendReqs)
 	if err != nil {
@@ -450,7 +533,7 @@ func getUTXOsForRequests(ctx context.Context, indexer IndexerClient, spendReqs [
 	// coverUTXOs are the UTXOs used to cover the remaining amount required to send
 	var coverUTXOs UTXOs
 	totalSendAmount := calculateTotalSendAmount(sendReqs)
-	if balanceOfScripts <= totalSendAmount && sacpFee <= fee {
+	if balanceOfScripts <= totalSendAmount && totalSendAmount-balanceOfScripts+int64(fee) > 0 {
 		utxos, _, err := indexer.GetUTXOsForAmount(ctx, feePayer, totalSendAmount-balanceOfScripts+int64(fee))
 		if err != nil {
 			return nil, nil, nil, err
@@ -482,6 +565,28 @@ func generateSequenceMap(utxosMap utxoMap, spendRequest []SpendRequest) map[stri
 	return sequencesMap
 }
 
+// spendLockTime returns the lock time of a tx spending the given requests, which is the greatest lock time among
+// them. Block heights and timestamps cannot be mixed, and the lock time of a tx including sacps must stay zero as
+// their signatures commit to it.
+func spendLockTime(spendRequests []SpendRequest, sacps [][]byte) (uint32, error) {
+	lockTime := uint32(0)
+	for _, req := range spendRequests {
+		if req.LockTime == 0 {
+			continue
+		}
+		if lockTime != 0 && (lockTime < txscript.LockTimeThreshold) != (req.LockTime < txscript.LockTimeThreshold) {
+			return 0, ErrMixedLockTimes
+		}
+		if req.LockTime > lockTime {
+			lockTime = req.LockTime
+		}
+	}
+	if lockTime != 0 && len(sacps) > 0 {
+		return 0, ErrLockTimeWithSACPs
+	}
+	return lockTime, nil
+}
+
 // Merge multiple sacps into a single transaction
 func buildTxFromSacps(sacps [][]byte) (*wire.MsgTx, int, error) {
 	idx := 0
@@ -558,13 +663,25 @@ func buildTransaction(utxos UTXOs, sacps [][]byte, recipients []SendRequest, cha
 	return tx, idx, nil
 }
 
+// spendableUTXOs returns the given utxos of the script address, or all its utxos when nil. It fails with
+// ErrNoFundsToSpend when the given set is empty.
+func spendableUTXOs(ctx context.Context, indexer IndexerClient, scriptAddr btcutil.Address, utxos UTXOs) (UTXOs, error) {
+	if utxos == nil {
+		return indexer.GetUTXOs(ctx, scriptAddr)
+	}
+	if len(utxos) == 0 {
+		return nil, ErrNoFundsToSpend
+	}
+	return utxos, nil
+}
+
 func getUTXOsForSpendRequest(ctx context.Context, indexer IndexerClient, spendReq []SpendRequest) (UTXOs, utxoMap, int64, error) {
 	utxos := UTXOs{}
 	totalValue := int64(0)
 	utxoMap := make(utxoMap)
 
 	for _, req := range spendReq {
-		utxosForAddress, err := indexer.GetUTXOs(ctx, req.ScriptAddress)
+		utxosForAddress, err := spendableUTXOs(ctx, indexer, req.ScriptAddress, req.Utxos)
 		if err != nil {
 			return nil, nil, 0, err
 		}
@@ -640,24 +757,23 @@ func getScriptToSign(scriptAddr btcutil.Address, script []byte) ([]byte, error)
 	return script, nil
 }
 
-// Signs the spend transaction
+// Builds the prevOutFetcher of all the inputs of the tx. The first `sacpIdx` inputs are from the sacps and their
+// prevouts are fetched from the indexer, the others are taken from the utxoMap.
 //
-// Internally signTx is called for each input to sign the transaction.
-func signSpendTx(ctx context.Context, tx *wire.MsgTx, startingIdx int, inputs []SpendRequest, utxoMap utxoMap, indexer IndexerClient, privateKey *secp256k1.PrivateKey) error {
-
-	// building the prevOutFetcherBuilder
+// This is an important step if we are spending from p2tr scripts as the signature commits to all the prevouts.
+func buildTxPrevOutFetcher(ctx context.Context, tx *wire.MsgTx, sacpIdx int, utxoMap utxoMap, indexer IndexerClient) (txscript.PrevOutputFetcher, error) {
 	// get the prevouts and txouts for the sacps to build the prevOutFetcher
-	outpoints, txouts, err := getPrevoutsForSACPs(ctx, tx, startingIdx, indexer)
+	outpoints, txouts, err := getPrevoutsForSACPs(ctx, tx, sacpIdx, indexer)
 	if err != nil {
-		return err
-	}
-
-	// This is an important step if we are spending from p2tr scripts which contain signature checks
-	prevOutFetcher, err := buildPrevOutFetcher(utxoMap, outpoints, txouts)
-	if err != nil {
-		return err
+		return nil, err
 	}
+	return buildPrevOutFetcher(utxoMap, outpoints, txouts)
+}
 
+// Signs the spend transaction
+//
+// Internally signTx is called for each input to sign the transaction.
+func signSpendTx(tx *wire.MsgTx, prevOutFetcher txscript.PrevOutputFetcher, startingIdx int, inputs []SpendRequest, utxoMap utxoMap, privateKey *secp256k1.PrivateKey) error {
 	idx := startingIdx
 
 	// Loop through all the inputs, get utxos and sign the transaction
@@ -718,7 +834,7 @@ func signTx(tx *wire.MsgTx, prevOutFetcher txscript.PrevOutputFetcher, amount in
 		// Adds 32 byte xonly pubkey
 		// Make sure to use this only with segwit v1 scripts
 		case string(AddXOnlyPubkeyOp):
-			newWitness = append(newWitness, privateKey.PubKey().X().Bytes())
+			newWitness = append(newWitness, schnorr.SerializePubKey(privateKey.PubKey()))
 		// Adds the witness data as is
 		default:
 			newWitness = append(newWitness, w)
@@ -728,24 +844,45 @@ func signTx(tx *wire.MsgTx, prevOutFetcher txscript.PrevOutputFetcher, amount in
 	return nil
 }
 
-// Signs the send transaction (p2wpkh spend).
+// Signs the send transaction (spending the utxos of the wallet address).
 // Use startingIdx to start signing from a specific index
-func signSendTx(tx *wire.MsgTx, utxos UTXOs, startingIdx int, scriptAddr btcutil.Address, privateKey *secp256k1.PrivateKey) error {
+func signSendTx(tx *wire.MsgTx, prevOutFetcher txscript.PrevOutputFetcher, utxos UTXOs, startingIdx int, scriptAddr btcutil.Address, privateKey *secp256k1.PrivateKey) error {
 	// get the send signing script
 	script, err := txscript.PayToAddrScript(scriptAddr)
 	if err != nil {
 		return err
 	}
 
-	// for p2wpkh, we only need to add the signature and pubkey
-	witness := [][]byte{
-		AddSignatureSegwitOp,
-		AddPubkeyCompressedOp,
-	}
 	idx := startingIdx
 	for i := range utxos {
-		fetcher := txscript.NewCannedPrevOutputFetcher(script, utxos[i].Amount)
-		err := signTx(tx, fetcher, utxos[i].Amount, idx, witness, script, nil, txscript.SigHashAll, privateKey)
+		switch scriptAddr.(type) {
+		// for p2wpkh, we only need to add the signature and pubkey
+		case *btcutil.AddressWitnessPubKeyHash:
+			err = signTx(tx, prevOutFetcher, utxos[i].Amount, idx, P2wpkhWitness, script, nil, txscript.SigHashAll, privateKey)
+		// for p2tr key path, the witness is a single signature of the tweaked key
+		case *btcutil.AddressTaproot:
+			sigHashes := txscript.NewTxSigHashes(tx, prevOutFetcher)
+			var sig []byte
+			sig, err = txscript.RawTxInTaprootSignature(tx, sigHashes, idx, utxos[i].Amount, script, []byte{}, txscript.SigHashDefault, privateKey)
+			tx.TxIn[idx].Witness = wire.TxWitness{sig}
+		// for p2sh-p2wpkh, the p2wpkh witness is the same and the sigScript pushes the p2wpkh script
+		case *btcutil.AddressScriptHash:
+			var redeemScript []byte
+			redeemScript, err = nestedP2wpkhRedeemScript(privateKey.PubKey())
+			if err != nil {
+				return err
+			}
+			err = signTx(tx, prevOutFetcher, utxos[i].Amount, idx, P2wpkhWitness, redeemScript, nil, txscript.SigHashAll, privateKey)
+			if err != nil {
+				return err
+			}
+			tx.TxIn[idx].SignatureScript, err = txscript.NewScriptBuilder().AddData(redeemScript).Script()
+		// for p2pkh, the signature and pubkey are in the sigScript
+		case *btcutil.AddressPubKeyHash:
+			tx.TxIn[idx].SignatureScript, err = txscript.SignatureScript(tx, idx, script, txscript.SigHashAll, privateKey, true)
+		default:
+			return ErrUnsupportedAddressType(scriptAddr)
+		}
 		if err != nil {
 			return err
 		}
@@ -754,6 +891,14 @@ func signSendTx(tx *wire.MsgTx, utxos UTXOs, startingIdx int, scriptAddr btcutil
 	return nil
 }
 
+// nestedP2wpkhRedeemScript returns the p2wpkh script wrapped in a p2sh-p2wpkh address.
+func nestedP2wpkhRedeemScript(pub *btcec.PublicKey) ([]byte, error) {
+	return txscript.NewScriptBuilder().
+		AddOp(txscript.OP_0).
+		AddData(btcutil.Hash160(pub.SerializeCompressed())).
+		Script()
+}
+
 func validateRequests(spendReqs []SpendRequest, sendReqs []SendRequest, sacps [][]byte) error {
 	for _, in := range spendReqs {
 		if len(in.Witness) == 0 {
@@ -835,6 +980,10 @@ func validateRequests(spendReqs []SpendRequest, sendReqs []SendRequest, sacps []
 		}
 	}
 
+	if _, err := spendLockTime(spendReqs, sacps); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -846,21 +995,6 @@ func calculateTotalSendAmount(req []SendRequest) int64 {
 	return totalSendAmount
 }
 
-func getNumberOfSigs(spends []SpendRequest) (int, int) {
-	numSegwitSigs := 0
-	numSchnorrSigs := 0
-	for _, spend := range spends {
-		for _, w := range spend.Witness {
-			if string(w) == string(AddSignatureSegwitOp) {
-				numSegwitSigs++
-			} else if string(w) == string(AddSignatureSchnorrOp) {
-				numSchnorrSigs++
-			}
-		}
-	}
-	return numSegwitSigs, numSchnorrSigs
-}
-
 func buildAndValidateSacpTx(sacp []byte) (*wire.MsgTx, error) {
 	btcTx, err := btcutil.NewTxFromBytes(sacp)
 	if err != nil {
@@ -10,6 +10,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 	"github.com/btcsuite/btcd/btcutil"
@@ -1426,3 +1427,203 @@ func skipFor(mode MODE, modes ...MODE) {
 		}
 	}
 }
+
+var _ = Describe("Wallet address types", func() {
+	chainParams := chaincfg.RegressionNetParams
+	feeRate := 10
+
+	DescribeTable("should sign and size the tx for the address type",
+		func(addrType waddrmgr.AddressType, expected func(addr btcutil.Address) bool) {
+			privateKey, err := btcec.NewPrivateKey()
+			Expect(err).To(BeNil())
+
+			indexer := newRecordedIndexer()
+			wallet, err := btc.NewSimpleWallet(privateKey, &chainParams, indexer, btc.NewFixFeeEstimator(feeRate), btc.HighFee, btc.WithSimpleWalletAddressType(addrType))
+			Expect(err).To(BeNil())
+			Expect(expected(wallet.Address())).Should(BeTrue())
+			indexer.fund(wallet.Address(), 1e5, 2e5)
+
+			recipient, err := btc.PublicKeyAddress(&chainParams, waddrmgr.WitnessPubKey, privateKey.PubKey())
+			Expect(err).To(BeNil())
+			_, err = wallet.Send(context.Background(), []btc.SendRequest{{Amount: 2.5e5, To: recipient}}, nil, nil)
+			Expect(err).To(BeNil())
+
+			tx := indexer.submitted
+			Expect(tx).ShouldNot(BeNil())
+			Expect(tx.TxIn).Should(HaveLen(2))
+
+			By("Verify the signatures")
+			fetcher := indexer.fetcher()
+			sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+			for i, in := range tx.TxIn {
+				prevOut := fetcher.FetchPrevOutput(in.PreviousOutPoint)
+				engine, err := txscript.NewEngine(prevOut.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+				Expect(err).To(BeNil())
+				Expect(engine.Execute()).To(BeNil())
+			}
+
+			By("Check the fee covers the size of the signed tx without overpaying")
+			fee := btc.TotalFee(tx, fetcher)
+			size := btc.TxVirtualSize(tx)
+			Expect(fee).Should(BeNumerically(">=", size*feeRate))
+			// ecdsa signatures can be up to 2 bytes shorter than estimated
+			Expect(fee).Should(BeNumerically("<=", (size+2*len(tx.TxIn))*feeRate))
+
+			By("Send the change back to the wallet")
+			change := tx.TxOut[len(tx.TxOut)-1]
+			script, err := txscript.PayToAddrScript(wallet.Address())
+			Expect(err).To(BeNil())
+			Expect(change.PkScript).Should(Equal(script))
+		},
+		Entry("p2wpkh", waddrmgr.WitnessPubKey, func(addr btcutil.Address) bool {
+			_, ok := addr.(*btcutil.AddressWitnessPubKeyHash)
+			return ok
+		}),
+		Entry("p2tr", waddrmgr.TaprootPubKey, func(addr btcutil.Address) bool {
+			_, ok := addr.(*btcutil.AddressTaproot)
+			return ok
+		}),
+		Entry("p2sh-p2wpkh", waddrmgr.NestedWitnessPubKey, func(addr btcutil.Address) bool {
+			_, ok := addr.(*btcutil.AddressScriptHash)
+			return ok
+		}),
+		Entry("p2pkh", waddrmgr.PubKeyHash, func(addr btcutil.Address) bool {
+			_, ok := addr.(*btcutil.AddressPubKeyHash)
+			return ok
+		}),
+	)
+
+	It("should not support raw public key addresses", func() {
+		privateKey, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		_, err = btc.NewSimpleWallet(privateKey, &chainParams, newRecordedIndexer(), btc.NewFixFeeEstimator(feeRate), btc.HighFee, btc.WithSimpleWalletAddressType(waddrmgr.RawPubKey))
+		Expect(err).ShouldNot(BeNil())
+	})
+})
+
+// recordedIndexer is an in-memory IndexerClient which records the submitted tx.
+type recordedIndexer struct {
+	btc.IndexerClient
+
+	utxos      map[string]btc.UTXOs
+	txs        map[string][]btc.Transaction
+	scripts    map[string][]byte
+	submitted  *wire.MsgTx
+	tip        uint64
+	medianTime uint64
+
+	// mempool has all the submitted txs, the ones in confirmed are reported as confirmed
+	mempool   map[string]*wire.MsgTx
+	confirmed map[string]bool
+	prevOuts  map[wire.OutPoint]*wire.TxOut
+}
+
+func newRecordedIndexer() *recordedIndexer {
+	return &recordedIndexer{
+		utxos:     map[string]btc.UTXOs{},
+		txs:       map[string][]btc.Transaction{},
+		scripts:   map[string][]byte{},
+		mempool:   map[string]*wire.MsgTx{},
+		confirmed: map[string]bool{},
+		prevOuts:  map[wire.OutPoint]*wire.TxOut{},
+	}
+}
+
+func (indexer *recordedIndexer) fund(addr btcutil.Address, amounts ...int64) {
+	script, err := txscript.PayToAddrScript(addr)
+	Expect(err).To(BeNil())
+	funded := len(indexer.utxos[addr.EncodeAddress()])
+	for i, amount := range amounts {
+		txid := chainhash.HashH([]byte(fmt.Sprintf("%v-%v", addr.EncodeAddress(), funded+i)))
+		indexer.utxos[addr.EncodeAddress()] = append(indexer.utxos[addr.EncodeAddress()], btc.UTXO{TxID: txid.String(), Vout: 0, Amount: amount})
+		indexer.txs[addr.EncodeAddress()] = append(indexer.txs[addr.EncodeAddress()], btc.Transaction{TxID: txid.String()})
+		indexer.scripts[txid.String()] = script
+	}
+}
+
+func (indexer *recordedIndexer) fetcher() txscript.PrevOutputFetcher {
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+	for _, utxos := range indexer.utxos {
+		for _, utxo := range utxos {
+			hash, err := chainhash.NewHashFromStr(utxo.TxID)
+			Expect(err).To(BeNil())
+			fetcher.AddPrevOut(wire.OutPoint{Hash: *hash, Index: utxo.Vout}, wire.NewTxOut(utxo.Amount, indexer.scripts[utxo.TxID]))
+		}
+	}
+	return fetcher
+}
+
+func (indexer *recordedIndexer) GetAddressTxs(ctx context.Context, address btcutil.Address, lastSeenTxid string) ([]btc.Transaction, error) {
+	return indexer.txs[address.EncodeAddress()], nil
+}
+
+func (indexer *recordedIndexer) GetUTXOs(ctx context.Context, address btcutil.Address) (btc.UTXOs, error) {
+	return indexer.utxos[address.EncodeAddress()], nil
+}
+
+func (indexer *recordedIndexer) GetUTXOsForAmount(ctx context.Context, address btcutil.Address, amount int64) (btc.UTXOs, int64, error) {
+	total := int64(0)
+	utxos := btc.UTXOs{}
+	for _, utxo := range indexer.utxos[address.EncodeAddress()] {
+		if total >= amount {
+			break
+		}
+		utxos = append(utxos, utxo)
+		total += utxo.Amount
+	}
+	if total < amount {
+		return nil, 0, fmt.Errorf("insufficient funds")
+	}
+	return utxos, total, nil
+}
+
+func (indexer *recordedIndexer) GetTx(ctx context.Context, txid string) (btc.Transaction, error) {
+	if tx, ok := indexer.mempool[txid]; ok {
+		fee := int64(0)
+		vins := make([]btc.VIN, len(tx.TxIn))
+		for i, in := range tx.TxIn {
+			prevOut := indexer.prevOuts[in.PreviousOutPoint]
+			vins[i] = btc.VIN{TxID: in.PreviousOutPoint.Hash.String(), Vout: int(in.PreviousOutPoint.Index)}
+			if prevOut != nil {
+				vins[i].Prevout = btc.Prevout{ScriptPubKey: hex.EncodeToString(prevOut.PkScript), Value: int(prevOut.Value)}
+				fee += prevOut.Value
+			}
+		}
+		for _, out := range tx.TxOut {
+			fee -= out.Value
+		}
+		weight := blockchain.GetTransactionWeight(btcutil.NewTx(tx))
+		return btc.Transaction{TxID: txid, VINs: vins, Fee: fee, Weight: int(weight), Status: btc.Status{Confirmed: indexer.confirmed[txid]}}, nil
+	}
+	for _, utxos := range indexer.utxos {
+		for _, utxo := range utxos {
+			if utxo.TxID != txid {
+				continue
+			}
+			vouts := make([]btc.Prevout, utxo.Vout+1)
+			vouts[utxo.Vout] = btc.Prevout{ScriptPubKey: hex.EncodeToString(indexer.scripts[txid]), Value: int(utxo.Amount)}
+			return btc.Transaction{TxID: txid, VOUTs: vouts}, nil
+		}
+	}
+	return btc.Transaction{}, fmt.Errorf("Transaction not found")
+}
+
+func (indexer *recordedIndexer) GetTipBlockHeight(ctx context.Context) (uint64, error) {
+	return indexer.tip, nil
+}
+
+func (indexer *recordedIndexer) GetTipMedianTime(ctx context.Context) (uint64, error) {
+	return indexer.medianTime, nil
+}
+
+func (indexer *recordedIndexer) SubmitTx(ctx context.Context, tx *wire.MsgTx) error {
+	indexer.submitted = tx
+	indexer.mempool[tx.TxHash().String()] = tx
+	fetcher := indexer.fetcher()
+	for _, in := range tx.TxIn {
+		if prevOut := fetcher.FetchPrevOutput(in.PreviousOutPoint); prevOut != nil {
+			indexer.prevOuts[in.PreviousOutPoint] = prevOut
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package btc
+
+import (
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// SchnorrSignatureSize is the size of a schnorr signature using txscript.SigHashDefault. Any other hash type
+	// appends the sighash byte to the signature.
+	SchnorrSignatureSize = schnorr.SignatureSize
+
+	// EcdsaSignatureMaxSize is the maximum size of a DER encoded ecdsa signature including the sighash byte.
+	EcdsaSignatureMaxSize = 73
+
+	// CompressedPubkeySize is the size of a compressed public key.
+	CompressedPubkeySize = btcec.PubKeyBytesLenCompressed
+
+	// XOnlyPubkeySize is the size of a xonly public key.
+	XOnlyPubkeySize = schnorr.PubKeyBytesLen
+
+	// InputBaseSize is the non-witness size of a segwit input.
+	// previous outpoint (txid + vout) + script length + sequence
+	InputBaseSize = 32 + 4 + 1 + 4
+)
+
+var (
+	// P2wpkhWitness is the witness template of spending a p2wpkh utxo.
+	P2wpkhWitness = [][]byte{AddSignatureSegwitOp, AddPubkeyCompressedOp}
+
+	// P2trKeyPathWitness is the witness template of spending a p2tr utxo with the key path.
+	P2trKeyPathWitness = [][]byte{AddSignatureSchnorrOp}
+
+	// MultisigWitnessTemplate is the witness template of spending a 2-of-2 `MultisigScript` with `MultisigWitness`.
+	MultisigWitnessTemplate = [][]byte{nil, AddSignatureSegwitOp, AddSignatureSegwitOp, make([]byte, 1+2*(1+CompressedPubkeySize)+2)}
+)
+
+// HtlcWitnessTemplate returns the witness template of spending a BIP-199 `HtlcScript` with `HtlcWitness`, redeeming
+// with a secret of the given size or refunding when the size is 0. The script is assumed to be `NormalHtlcSize` long.
+func HtlcWitnessTemplate(secretSize int) [][]byte {
+	script := make([]byte, NormalHtlcSize)
+	if secretSize == 0 {
+		return [][]byte{AddSignatureSegwitOp, AddPubkeyCompressedOp, nil, script}
+	}
+	return [][]byte{AddSignatureSegwitOp, AddPubkeyCompressedOp, make([]byte, secretSize), {0x1}, script}
+}
+
+// WitnessItemSize returns the size of a witness item once the placeholder ops are replaced by the actual signature or
+// public key. Any other item is returned as is.
+func WitnessItemSize(item []byte, hashType txscript.SigHashType) int {
+	switch string(item) {
+	case string(AddSignatureSchnorrOp):
+		if hashType == txscript.SigHashDefault {
+			return SchnorrSignatureSize
+		}
+		return SchnorrSignatureSize + 1
+	case string(AddSignatureSegwitOp):
+		return EcdsaSignatureMaxSize
+	case string(AddPubkeyCompressedOp):
+		return CompressedPubkeySize
+	case string(AddXOnlyPubkeyOp):
+		return XOnlyPubkeySize
+	default:
+		return len(item)
+	}
+}
+
+// EstimateWitnessWeight returns the weight of the witness after signing the given witness template, including the
+// item count and the length prefix of each item. For tapscript spends, the template should end with the leaf script
+// and the control block. The result is exact for schnorr signatures and an upper bound for ecdsa signatures, which
+// can be one or two bytes shorter.
+func EstimateWitnessWeight(witness [][]byte, hashType txscript.SigHashType) int {
+	weight := wire.VarIntSerializeSize(uint64(len(witness)))
+	for _, item := range witness {
+		size := WitnessItemSize(item, hashType)
+		weight += wire.VarIntSerializeSize(uint64(size)) + size
+	}
+	return weight
+}
+
+// WitnessWeight returns the witness weight of spending a single utxo of the spend request.
+func (req SpendRequest) WitnessWeight() int {
+	return EstimateWitnessWeight(req.Witness, req.HashType)
+}
+
+// InputVirtualSize returns the virtual size added to a transaction by a segwit input with the given witness weight. It
+// doesn't include the segwit marker and flag of the transaction.
+func InputVirtualSize(witnessWeight int) int {
+	return (InputBaseSize*blockchain.WitnessScaleFactor + witnessWeight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor
+}
+
+// SpendRequestUpdater returns a SizeUpdater with the exact witness weight of the spend request, it can be used when all
+// the utxos passed to `BuildTransaction` are spent with the same witness template.
+func SpendRequestUpdater(req SpendRequest) SizeUpdater {
+	return func() (int, int) {
+		return 0, req.WitnessWeight()
+	}
+}
+
+// NewSpendRawInputs returns the RawInputs spending the utxos of the given spend requests, with the exact witness
+// weight of each request.
+func NewSpendRawInputs(reqs []SpendRequest) RawInputs {
+	inputs := NewRawInputs()
+	for _, req := range reqs {
+		inputs.VIN = append(inputs.VIN, req.Utxos...)
+		inputs.SegwitSize += len(req.Utxos) * req.WitnessWeight()
+	}
+	return inputs
+}
+
+// AddressSizeUpdater returns the SizeUpdater of spending a utxo of the given address with the key of the address.
+func AddressSizeUpdater(addr btcutil.Address) (SizeUpdater, error) {
+	switch addr.(type) {
+	case *btcutil.AddressWitnessPubKeyHash:
+		return P2wpkhUpdater, nil
+	case *btcutil.AddressTaproot:
+		return P2trUpdater, nil
+	case *btcutil.AddressScriptHash:
+		return NestedP2wpkhUpdater, nil
+	case *btcutil.AddressPubKeyHash:
+		return P2pkhUpdater, nil
+	default:
+		return nil, ErrUnsupportedAddressType(addr)
+	}
+}
+
+// addressInputVirtualSize returns the virtual size of an input spending a utxo of the given address. It falls back to
+// the size of a p2wpkh input for unsupported addresses.
+func addressInputVirtualSize(addr btcutil.Address) int {
+	updater, err := AddressSizeUpdater(addr)
+	if err != nil {
+		updater = P2wpkhUpdater
+	}
+	base, segwit := updater()
+	return base + InputVirtualSize(segwit)
+}
+
+// estimateSignedVirtualSize returns the virtual size of the tx once it's signed in the same way as `signSpendTx` and
+// `signSendTx` do. The utxos of the spend requests are signed from `signIdx` and the cover utxos of the `coverAddr`
+// from `coverIdx`. Inputs before `signIdx` are sacps which already have their witness.
+func estimateSignedVirtualSize(tx *wire.MsgTx, signIdx int, spendRequests []SpendRequest, utxoMap utxoMap, coverAddr btcutil.Address, coverIdx, numCoverUtxos int) int {
+	weights := make([]int, len(tx.TxIn))
+	for i, in := range tx.TxIn {
+		// Unsigned inputs still take a byte for the empty witness
+		weights[i] = in.Witness.SerializeSize()
+	}
+
+	idx := signIdx
+	for _, req := range spendRequests {
+		weight := req.WitnessWeight()
+		for range utxoMap[req.ScriptAddress.EncodeAddress()] {
+			if idx < len(weights) {
+				weights[idx] = weight
+			}
+			idx++
+		}
+	}
+
+	extraBaseSize := 0
+	if numCoverUtxos > 0 {
+		updater, err := AddressSizeUpdater(coverAddr)
+		if err != nil {
+			updater = P2wpkhUpdater
+		}
+		base, segwit := updater()
+		if segwit == 0 {
+			// Legacy inputs have an empty witness
+			segwit = wire.TxWitness{}.SerializeSize()
+		}
+		for i := coverIdx; i < coverIdx+numCoverUtxos && i < len(weights); i++ {
+			extraBaseSize += base
+			weights[i] = segwit
+		}
+	}
+
+	segwitSize, hasWitness := 0, false
+	for _, weight := range weights {
+		segwitSize += weight
+		hasWitness = hasWitness || weight > wire.TxWitness{}.SerializeSize()
+	}
+	// Transactions without any witness are serialized without the marker, the flag and the empty witnesses
+	if !hasWitness {
+		return tx.SerializeSizeStripped() + extraBaseSize
+	}
+	return EstimateVirtualSize(tx, extraBaseSize, segwitSize)
+}
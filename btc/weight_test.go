@@ -0,0 +1,149 @@
+package btc_test
+
+import (
+	"crypto/sha256"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcwallet/waddrmgr"
+	"github.com/btcsuite/btcwallet/wallet/txsizes"
+	"github.com/catalogfi/blockchain/btc"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("witness weight", func() {
+	network := &chaincfg.RegressionNetParams
+
+	It("should match the p2wpkh witness weight", func() {
+		Expect(btc.EstimateWitnessWeight(btc.P2wpkhWitness, txscript.SigHashAll)).Should(Equal(txsizes.RedeemP2WPKHInputWitnessWeight))
+	})
+
+	It("should return the exact weight of a signed tapscript witness", func() {
+		privKey, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		secret := make([]byte, 32)
+		secretHash := sha256.Sum256(secret)
+		leaf, err := btc.RedeemLeaf(schnorr.SerializePubKey(privKey.PubKey()), secretHash[:])
+		Expect(err).To(BeNil())
+
+		internalKey, err := btc.GardenNUMS()
+		Expect(err).To(BeNil())
+		tree := txscript.AssembleTaprootScriptTree(leaf)
+		root := tree.RootNode.TapHash()
+		outputKey := txscript.ComputeTaprootOutputKey(internalKey, root[:])
+		addr, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), network)
+		Expect(err).To(BeNil())
+		pkScript, err := txscript.PayToAddrScript(addr)
+		Expect(err).To(BeNil())
+
+		controlBlock := tree.LeafMerkleProofs[0].ToControlBlock(internalKey)
+		cbBytes, err := controlBlock.ToBytes()
+		Expect(err).To(BeNil())
+
+		for _, hashType := range []txscript.SigHashType{txscript.SigHashDefault, txscript.SigHashAll, btc.SigHashSingleAnyoneCanPay} {
+			req := btc.SpendRequest{
+				Witness:       [][]byte{btc.AddSignatureSchnorrOp, secret, leaf.Script, cbBytes},
+				Leaf:          leaf,
+				ScriptAddress: addr,
+				HashType:      hashType,
+			}
+
+			tx := wire.NewMsgTx(btc.DefaultTxVersion)
+			tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, 0), nil, nil))
+			tx.AddTxOut(wire.NewTxOut(1e5, pkScript))
+			fetcher := txscript.NewCannedPrevOutputFetcher(pkScript, 1e6)
+			sig, err := txscript.RawTxInTapscriptSignature(tx, txscript.NewTxSigHashes(tx, fetcher), 0, 1e6, pkScript, leaf, hashType, privKey)
+			Expect(err).To(BeNil())
+			tx.TxIn[0].Witness = wire.TxWitness{sig, secret, leaf.Script, cbBytes}
+
+			Expect(req.WitnessWeight()).Should(Equal(tx.TxIn[0].Witness.SerializeSize()))
+			Expect(btc.EstimateVirtualSize(tx, 0, req.WitnessWeight())).Should(Equal(btc.TxVirtualSize(tx)))
+		}
+	})
+
+	It("should never underestimate ecdsa signatures", func() {
+		privKey, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		addr, err := btc.PublicKeyAddress(network, waddrmgr.WitnessPubKey, privKey.PubKey())
+		Expect(err).To(BeNil())
+
+		weight := btc.EstimateWitnessWeight(btc.P2wpkhWitness, txscript.SigHashAll)
+		for i := 0; i < 20; i++ {
+			tx := wire.NewMsgTx(btc.DefaultTxVersion)
+			tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{byte(i)}, 0), nil, nil))
+			tx.AddTxOut(wire.NewTxOut(1e5, []byte{txscript.OP_TRUE}))
+			pkScript, err := txscript.PayToAddrScript(addr)
+			Expect(err).To(BeNil())
+			fetcher := txscript.NewCannedPrevOutputFetcher(pkScript, 1e6)
+			witness, err := txscript.WitnessSignature(tx, txscript.NewTxSigHashes(tx, fetcher), 0, 1e6, pkScript, txscript.SigHashAll, privKey, true)
+			Expect(err).To(BeNil())
+			Expect(witness.SerializeSize()).Should(BeNumerically("<=", weight))
+		}
+	})
+
+	It("should build raw inputs from spend requests", func() {
+		req := btc.SpendRequest{
+			Witness:  [][]byte{btc.AddSignatureSchnorrOp, btc.AddSignatureSchnorrOp, make([]byte, 70), make([]byte, 65)},
+			HashType: btc.SigHashSingleAnyoneCanPay,
+			Utxos:    btc.UTXOs{{TxID: chainhash.Hash{1}.String(), Amount: 1e5}, {TxID: chainhash.Hash{2}.String(), Amount: 2e5}},
+		}
+		// item count + 2 * (length + signature with sighash byte) + (length + script) + (length + control block)
+		Expect(req.WitnessWeight()).Should(Equal(1 + 2*(1+65) + 1 + 70 + 1 + 65))
+
+		inputs := btc.NewSpendRawInputs([]btc.SpendRequest{req})
+		Expect(inputs.VIN).Should(HaveLen(2))
+		Expect(inputs.BaseSize).Should(Equal(0))
+		Expect(inputs.SegwitSize).Should(Equal(2 * req.WitnessWeight()))
+
+		base, segwit := btc.SpendRequestUpdater(req)()
+		Expect(base).Should(Equal(0))
+		Expect(segwit).Should(Equal(req.WitnessWeight()))
+	})
+
+	It("should estimate the witness weight of the htlc and multisig scripts", func() {
+		privKey, err := btcec.NewPrivateKey()
+		Expect(err).To(BeNil())
+		pubkey := privKey.PubKey().SerializeCompressed()
+		secret := make([]byte, 32)
+		secretHash := sha256.Sum256(secret)
+		htlc, err := btc.HtlcScript(btcutil.Hash160(pubkey), btcutil.Hash160(pubkey), secretHash[:], 144)
+		Expect(err).To(BeNil())
+		Expect(htlc).Should(HaveLen(btc.NormalHtlcSize))
+		multisig, err := btc.MultisigScript(pubkey, pubkey)
+		Expect(err).To(BeNil())
+
+		tx := wire.NewMsgTx(btc.DefaultTxVersion)
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, 0), nil, nil))
+		tx.AddTxOut(wire.NewTxOut(1e5, []byte{txscript.OP_TRUE}))
+		fetcher := txscript.NewCannedPrevOutputFetcher(nil, 1e6)
+		sig, err := txscript.RawTxInWitnessSignature(tx, txscript.NewTxSigHashes(tx, fetcher), 0, 1e6, htlc, txscript.SigHashAll, privKey)
+		Expect(err).To(BeNil())
+
+		for _, c := range []struct {
+			updater btc.SizeUpdater
+			witness wire.TxWitness
+		}{
+			{btc.HtlcUpdater(len(secret)), btc.HtlcWitness(htlc, pubkey, sig, secret)},
+			{btc.HtlcUpdater(0), btc.HtlcWitness(htlc, pubkey, sig, nil)},
+			{btc.MultisigUpdater, btc.MultisigWitness(multisig, sig, sig)},
+		} {
+			base, segwit := c.updater()
+			Expect(base).Should(Equal(0))
+			Expect(segwit).Should(BeNumerically(">=", c.witness.SerializeSize()))
+			Expect(segwit - c.witness.SerializeSize()).Should(BeNumerically("<=", 2*(btc.EcdsaSignatureMaxSize-len(sig))))
+		}
+		Expect(btc.RedeemHtlcRedeemSigScriptSize(len(secret))).Should(Equal(btc.EstimateWitnessWeight(btc.HtlcWitnessTemplate(len(secret)), txscript.SigHashAll)))
+	})
+
+	It("should return the virtual size of a segwit input", func() {
+		// A p2wpkh input is 69 vbytes (68.25 rounded up)
+		Expect(btc.InputVirtualSize(txsizes.RedeemP2WPKHInputWitnessWeight)).Should(Equal(69))
+	})
+})
@@ -74,7 +74,7 @@ func (chain EvmChain) ValidateAddress(address string) error {
 
 func (chain EvmChain) L2() bool {
 	switch chain.name {
-	case Ethereum, EthereumSepolia, EthereumLocalnet:
+	case Ethereum, EthereumSepolia, EthereumLocalnet, ArbitrumLocalnet:
 		return false
 	case Arbitrum, PolygonZK, PolygonZKTestnet:
 		return true
@@ -83,6 +83,23 @@ func (chain EvmChain) L2() bool {
 	}
 }
 
+// ConfirmationDepth returns the default number of blocks, including the block of a transaction, after which the
+// transaction is considered safe from reorgs.
+func (chain EvmChain) ConfirmationDepth() uint64 {
+	switch chain.name {
+	case Ethereum:
+		return 12
+	case EthereumSepolia:
+		return 6
+	case Arbitrum, PolygonZK, PolygonZKTestnet:
+		return 3
+	case EthereumLocalnet, ArbitrumLocalnet:
+		return 1
+	default:
+		panic(fmt.Sprintf("unknown evm chain = %v", chain))
+	}
+}
+
 type EVMAsset interface {
 	Asset
 
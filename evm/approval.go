@@ -0,0 +1,419 @@
+package evm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/catalogfi/blockchain/evm/bindings/contracts/htlc/gardenhtlc"
+	"github.com/catalogfi/blockchain/evm/bindings/multicall3"
+	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/interfaces/ierc5267"
+	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/token/ERC20/erc20"
+	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/token/ERC20/extensions/ierc20permit"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// ApprovalPolicy is how the HTLC wallet allows the swapper contract to spend the tokens of an initiation, when the
+// allowance of the swapper is too low.
+type ApprovalPolicy int
+
+const (
+	// ApproveUnlimited approves the swapper to spend all the tokens of the wallet, once for all the initiations.
+	ApproveUnlimited ApprovalPolicy = iota
+
+	// ApproveExact approves the swapper to spend the amount of the initiation. The approvals of a token are sent one
+	// at a time, each after the initiation of the previous one, so an initiation never spends the allowance approved
+	// for another one.
+	ApproveExact
+
+	// ApprovePermit signs an EIP-2612 permit for the amount of the initiation, and sends it along with the initiation
+	// in a single Multicall3 transaction through `initiateWithSignature`. It falls back to ApproveExact for the tokens
+	// not supporting permits. The initiations of a token are sent one at a time, as the permits of the wallet use
+	// the nonce of the token which only moves once the previous initiation is mined.
+	ApprovePermit
+)
+
+// permitValidity is the validity of the permits signed for an initiation
+const permitValidity = time.Hour
+
+var ErrPermitNotSupported = errors.New("token does not support permits")
+
+var permitTypeHash = crypto.Keccak256Hash([]byte("Permit(address owner,address spender,uint256 value,uint256 nonce,uint256 deadline)"))
+
+var initiateTypeHash = crypto.Keccak256Hash([]byte("Initiate(address redeemer,uint256 timelock,uint256 amount,bytes32 secretHash)"))
+
+// Permit is an EIP-2612 permit allowing the spender to spend a value of the tokens of the owner until the deadline.
+type Permit struct {
+	Owner    common.Address
+	Spender  common.Address
+	Value    *big.Int
+	Deadline *big.Int
+	V        uint8
+	R        [32]byte
+	S        [32]byte
+}
+
+// WithApprovalPolicy sets the approval policy of the HTLC wallet, it defaults to ApproveUnlimited.
+func WithApprovalPolicy(policy ApprovalPolicy) WalletOption {
+	return func(w *wallet) {
+		w.approvalPolicy = policy
+	}
+}
+
+// approvalKey identifies the allowance of a spender on a token
+type approvalKey struct {
+	chain   blockchain.Name
+	token   common.Address
+	spender common.Address
+}
+
+// eip712Domain is the EIP-712 domain of a contract, fields is the EIP-5267 bitmap of the fields in use.
+type eip712Domain struct {
+	fields            byte
+	name              string
+	version           string
+	chainID           *big.Int
+	verifyingContract common.Address
+	salt              [32]byte
+}
+
+func (domain eip712Domain) separator() common.Hash {
+	fieldTypes := []string{"string name", "string version", "uint256 chainId", "address verifyingContract", "bytes32 salt"}
+	values := [][]byte{
+		crypto.Keccak256([]byte(domain.name)),
+		crypto.Keccak256([]byte(domain.version)),
+		common.LeftPadBytes(domain.chainID.Bytes(), 32),
+		common.LeftPadBytes(domain.verifyingContract.Bytes(), 32),
+		domain.salt[:],
+	}
+
+	var used []string
+	encoded := [][]byte{nil}
+	for i := range fieldTypes {
+		if domain.fields&(1<<i) != 0 {
+			used = append(used, fieldTypes[i])
+			encoded = append(encoded, values[i])
+		}
+	}
+	encoded[0] = crypto.Keccak256([]byte("EIP712Domain(" + strings.Join(used, ",") + ")"))
+	return crypto.Keccak256Hash(encoded...)
+}
+
+// permitDomain returns the EIP-712 domain of the permits of the token. The domain is read from the IERC5267
+// `eip712Domain` of the token, or built from its name and version "1" for the tokens predating EIP-5267, and is
+// checked against its `DOMAIN_SEPARATOR`. ErrPermitNotSupported is returned when the token does not support permits.
+func permitDomain(ctx context.Context, client bind.ContractCaller, chain blockchain.EvmChain, token common.Address) (eip712Domain, error) {
+	opts := &bind.CallOpts{Context: ctx}
+	permitToken, err := ierc20permit.NewIERC20PermitCaller(token, client)
+	if err != nil {
+		return eip712Domain{}, err
+	}
+	separator, err := permitToken.DOMAINSEPARATOR(opts)
+	if err != nil {
+		return eip712Domain{}, notSupported(ctx)
+	}
+
+	domain, err := erc5267Domain(ctx, client, token)
+	if err != nil {
+		erc20Token, err := erc20.NewERC20Caller(token, client)
+		if err != nil {
+			return eip712Domain{}, err
+		}
+		name, err := erc20Token.Name(opts)
+		if err != nil {
+			return eip712Domain{}, notSupported(ctx)
+		}
+		domain = eip712Domain{fields: 0x0f, name: name, version: "1", chainID: chain.ChainID(), verifyingContract: token}
+	}
+	if domain.separator() != separator {
+		return eip712Domain{}, notSupported(ctx)
+	}
+	return domain, nil
+}
+
+// erc5267Domain returns the EIP-712 domain of the contract read from its IERC5267 `eip712Domain`.
+func erc5267Domain(ctx context.Context, client bind.ContractCaller, contract common.Address) (eip712Domain, error) {
+	erc5267, err := ierc5267.NewIERC5267Caller(contract, client)
+	if err != nil {
+		return eip712Domain{}, err
+	}
+	d, err := erc5267.Eip712Domain(&bind.CallOpts{Context: ctx})
+	if err != nil {
+		return eip712Domain{}, err
+	}
+	if len(d.Extensions) != 0 {
+		return eip712Domain{}, fmt.Errorf("unsupported eip712 domain extensions: %v", d.Extensions)
+	}
+	return eip712Domain{
+		fields:            d.Fields[0],
+		name:              d.Name,
+		version:           d.Version,
+		chainID:           d.ChainId,
+		verifyingContract: d.VerifyingContract,
+		salt:              d.Salt,
+	}, nil
+}
+
+// notSupported returns ErrPermitNotSupported, unless the lookups failed because of the context
+func notSupported(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrPermitNotSupported
+}
+
+// SignPermit signs an EIP-2612 permit allowing the spender to spend the amount of tokens of the wallet until the
+// deadline. The permit can be submitted by anyone, e.g. a relayer paying the gas. ErrPermitNotSupported is returned
+// when the token does not support permits.
+func (w *wallet) SignPermit(ctx context.Context, asset blockchain.EVMAsset, spender common.Address, amount, deadline *big.Int) (Permit, error) {
+	token, ok := asset.(blockchain.ERC20)
+	if !ok {
+		return Permit{}, fmt.Errorf("unsupported asset type: %T", asset)
+	}
+	client, ok := w.Client.EvmClient(asset.Chain())
+	if !ok {
+		return Permit{}, fmt.Errorf("unsupported evm chain: %v", asset.Chain().Name())
+	}
+	return w.signPermit(ctx, client, asset.Chain().(blockchain.EvmChain), token.Token, spender, amount, deadline)
+}
+
+func (w *wallet) signPermit(ctx context.Context, client bind.ContractCaller, chain blockchain.EvmChain, token, spender common.Address, amount, deadline *big.Int) (Permit, error) {
+	domain, err := permitDomain(ctx, client, chain, token)
+	if err != nil {
+		return Permit{}, err
+	}
+	permitToken, err := ierc20permit.NewIERC20PermitCaller(token, client)
+	if err != nil {
+		return Permit{}, err
+	}
+	nonce, err := permitToken.Nonces(&bind.CallOpts{Context: ctx}, w.Address())
+	if err != nil {
+		return Permit{}, fmt.Errorf("failed to get permit nonce: %v", err)
+	}
+
+	permitHash := crypto.Keccak256Hash(
+		permitTypeHash[:],
+		common.LeftPadBytes(w.Address().Bytes(), 32),
+		common.LeftPadBytes(spender.Bytes(), 32),
+		common.LeftPadBytes(amount.Bytes(), 32),
+		common.LeftPadBytes(nonce.Bytes(), 32),
+		common.LeftPadBytes(deadline.Bytes(), 32),
+	)
+	separator := domain.separator()
+	sig, err := crypto.Sign(crypto.Keccak256([]byte{0x19, 0x01}, separator[:], permitHash[:]), w.privateKey)
+	if err != nil {
+		return Permit{}, fmt.Errorf("failed to sign permit: %v", err)
+	}
+
+	permit := Permit{Owner: w.Address(), Spender: spender, Value: amount, Deadline: deadline, V: sig[64] + 27}
+	copy(permit.R[:], sig[:32])
+	copy(permit.S[:], sig[32:64])
+	return permit, nil
+}
+
+// approvalState is the state of the approvals of a spender on a token, see `allow`
+type approvalState struct {
+	mu sync.Mutex
+	// pending is the number of initiations sent which may not be mined yet
+	pending atomic.Int64
+}
+
+// allowanceLock holds the approvals of the token of an initiation, returned by `allow`
+type allowanceLock struct {
+	state *approvalState
+	sent  bool
+}
+
+// initiated releases the approvals of the token once the initiation is sent. The next approvals are always sent,
+// after the initiation, as the allowance read from the chain may still be the one of the initiation.
+func (a *allowanceLock) initiated() {
+	if a.state == nil || a.sent {
+		return
+	}
+	a.sent = true
+	a.state.pending.Add(1)
+	a.state.mu.Unlock()
+}
+
+// done must be called once the initiation is mined, or when it was not sent.
+func (a *allowanceLock) done() {
+	if a.state == nil {
+		return
+	}
+	if a.sent {
+		a.state.pending.Add(-1)
+		return
+	}
+	a.state.mu.Unlock()
+}
+
+// allow makes sure the swapper of the asset can spend the amount of tokens of the wallet, following the approval
+// policy of the wallet. The approvals of exact amounts of a token are sent one at a time, until the initiation
+// spending the allowance is sent.
+func (w *wallet) allow(ctx context.Context, client Backend, chain blockchain.EvmChain, tops *bind.TransactOpts, asset blockchain.ERC20, amount *big.Int) (*allowanceLock, error) {
+	allowed := &allowanceLock{}
+	if w.approvalPolicy != ApproveUnlimited {
+		allowed.state = w.approvalState(approvalKey{chain: chain.Name(), token: asset.Token, spender: asset.Swapper()})
+		allowed.state.mu.Lock()
+	}
+
+	if err := w.approve(ctx, client, chain, tops, asset, amount, allowed.state != nil && allowed.state.pending.Load() > 0); err != nil {
+		allowed.done()
+		return nil, err
+	}
+	return allowed, nil
+}
+
+// approve approves the swapper of the asset to spend the amount of tokens when its allowance is too low, or always
+// when force is set.
+func (w *wallet) approve(ctx context.Context, client Backend, chain blockchain.EvmChain, tops *bind.TransactOpts, asset blockchain.ERC20, amount *big.Int, force bool) error {
+	token, err := erc20.NewERC20(asset.Token, client)
+	if err != nil {
+		return err
+	}
+	if !force {
+		allowance, err := token.Allowance(&bind.CallOpts{Context: ctx}, w.Address(), asset.Swapper())
+		if err != nil {
+			return err
+		}
+		if allowance.Cmp(amount) >= 0 {
+			return nil
+		}
+	}
+
+	approval := amount
+	if w.approvalPolicy == ApproveUnlimited {
+		approval = MaxETHAmount
+	}
+	if err := setGas(ctx, w.gasStrategy, client, chain, tops, asset.Token, erc20.ERC20MetaData, "approve", asset.Swapper(), approval); err != nil {
+		return err
+	}
+	tx, err := w.withNonce(ctx, client, chain, tops, func() (*types.Transaction, error) {
+		return token.Approve(tops, asset.Swapper(), approval)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.waitMined(ctx, chain, tx)
+	return err
+}
+
+// initiateWithPermit initiates the order with a permit of its amount, in a single Multicall3 transaction calling the
+// `permit` of the token and the `initiateWithSignature` of the swapper. ErrPermitNotSupported is returned when the
+// token does not support permits.
+func (w *wallet) initiateWithPermit(ctx context.Context, client Backend, chain blockchain.EvmChain, tops *bind.TransactOpts, asset blockchain.ERC20, redeemer common.Address, secretHash [32]byte, expiry, amount *big.Int) (*types.Receipt, error) {
+	state := w.approvalState(approvalKey{chain: chain.Name(), token: asset.Token, spender: asset.Swapper()})
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	deadline := big.NewInt(time.Now().Add(permitValidity).Unix())
+	permit, err := w.signPermit(ctx, client, chain, asset.Token, asset.Swapper(), amount, deadline)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := w.signInitiate(ctx, client, asset.Swapper(), redeemer, secretHash, expiry, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	permitABI, err := ierc20permit.IERC20PermitMetaData.GetAbi()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get abi: %v", err)
+	}
+	permitData, err := permitABI.Pack("permit", permit.Owner, permit.Spender, permit.Value, permit.Deadline, permit.V, permit.R, permit.S)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack permit: %v", err)
+	}
+	htlcABI, err := gardenhtlc.GardenHTLCMetaData.GetAbi()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get abi: %v", err)
+	}
+	initiateData, err := htlcABI.Pack("initiateWithSignature", redeemer, expiry, amount, secretHash, sig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack initiateWithSignature: %v", err)
+	}
+	calls := []multicall3.Multicall3Call3{
+		{Target: asset.Token, CallData: permitData},
+		{Target: asset.Swapper(), CallData: initiateData},
+	}
+
+	contract, err := multicall3.NewMulticall3(Multicall3Address, client)
+	if err != nil {
+		return nil, err
+	}
+	if err := setGas(ctx, w.gasStrategy, client, chain, tops, Multicall3Address, multicall3.Multicall3MetaData, "aggregate3", calls); err != nil {
+		return nil, err
+	}
+	tx, err := w.withNonce(ctx, client, chain, tops, func() (*types.Transaction, error) {
+		return contract.Aggregate3(tops, calls)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w.waitMined(ctx, chain, tx)
+}
+
+// signInitiate signs the EIP-712 initiation of the order, which the swapper initiates from the wallet through
+// `initiateWithSignature`.
+func (w *wallet) signInitiate(ctx context.Context, client bind.ContractCaller, swapper, redeemer common.Address, secretHash [32]byte, expiry, amount *big.Int) ([]byte, error) {
+	domain, err := erc5267Domain(ctx, client, swapper)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get eip712 domain: %v", err)
+	}
+	initiateHash := crypto.Keccak256Hash(
+		initiateTypeHash[:],
+		common.LeftPadBytes(redeemer.Bytes(), 32),
+		common.LeftPadBytes(expiry.Bytes(), 32),
+		common.LeftPadBytes(amount.Bytes(), 32),
+		secretHash[:],
+	)
+	separator := domain.separator()
+	sig, err := crypto.Sign(crypto.Keccak256([]byte{0x19, 0x01}, separator[:], initiateHash[:]), w.privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign initiate: %v", err)
+	}
+	sig[64] += 27
+	return sig, nil
+}
+
+// approvalState returns the state of the approvals of the spender on the token
+func (w *wallet) approvalState(key approvalKey) *approvalState {
+	w.approvalsMu.Lock()
+	defer w.approvalsMu.Unlock()
+	if _, ok := w.approvals[key]; !ok {
+		w.approvals[key] = new(approvalState)
+	}
+	return w.approvals[key]
+}
+
+// RevokeAllowance sets the allowance of the spender on the tokens of the wallet back to zero.
+func (w *wallet) RevokeAllowance(ctx context.Context, asset blockchain.EVMAsset, spender common.Address) (*types.Transaction, error) {
+	erc20Asset, ok := asset.(blockchain.ERC20)
+	if !ok {
+		return nil, fmt.Errorf("unsupported asset type: %T", asset)
+	}
+	client, tops, err := w.transactor(ctx, asset.Chain())
+	if err != nil {
+		return nil, err
+	}
+	chain := asset.Chain().(blockchain.EvmChain)
+	token, err := erc20.NewERC20(erc20Asset.Token, client)
+	if err != nil {
+		return nil, err
+	}
+	if err := setGas(ctx, w.gasStrategy, client, chain, tops, erc20Asset.Token, erc20.ERC20MetaData, "approve", spender, big.NewInt(0)); err != nil {
+		return nil, err
+	}
+	return w.withNonce(ctx, client, chain, tops, func() (*types.Transaction, error) {
+		return token.Approve(tops, spender, big.NewInt(0))
+	})
+}
@@ -0,0 +1,357 @@
+package evm_test
+
+import (
+	"context"
+	"encoding/binary"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/catalogfi/blockchain/evm"
+	"github.com/catalogfi/blockchain/evm/bindings/contracts/htlc/gardenhtlc"
+	"github.com/catalogfi/blockchain/evm/bindings/multicall3"
+	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/interfaces/ierc5267"
+	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/token/ERC20/erc20"
+	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/token/ERC20/extensions/ierc20permit"
+)
+
+var _ = Describe("Approval policy", func() {
+	var sim *simulatedChain
+
+	BeforeEach(func(ctx context.Context) {
+		sim = newSimulatedChain(ctx, 2)
+	})
+
+	initiate := func(ctx context.Context, asset blockchain.EVMAsset, opts ...evm.WalletOption) (evm.HTLCWallet, *big.Int) {
+		wallet := evm.NewHTLCWallet(sim.client, sim.keys[0], append(sim.walletOptions(), opts...)...)
+		amount := big.NewInt(1e6)
+		_, err := wallet.Initiate(ctx, asset, crypto.PubkeyToAddress(sim.keys[1].PublicKey), [32]byte{1}, big.NewInt(100), amount, nil)
+		Expect(err).Should(BeNil())
+		return wallet, amount
+	}
+
+	approvals := func(ctx context.Context, token common.Address) []string {
+		var values []string
+		for _, tx := range sim.txsTo(ctx, token) {
+			args := unpack(erc20.ERC20MetaData, "approve", tx.Data())
+			Expect(args[0]).Should(Equal(sim.htlc))
+			values = append(values, args[1].(*big.Int).String())
+		}
+		return values
+	}
+
+	It("should approve unlimited amounts by default", func(ctx context.Context) {
+		initiate(ctx, sim.asset)
+		Expect(approvals(ctx, sim.token)).Should(Equal([]string{evm.MaxETHAmount.String()}))
+	})
+
+	It("should approve the exact amount", func(ctx context.Context) {
+		wallet, amount := initiate(ctx, sim.asset, evm.WithApprovalPolicy(evm.ApproveExact))
+		Expect(approvals(ctx, sim.token)).Should(Equal([]string{amount.String()}))
+
+		By("Revoke the allowance")
+		tx, err := wallet.RevokeAllowance(ctx, sim.asset, sim.htlc)
+		Expect(err).Should(BeNil())
+		_, err = bind.WaitMined(ctx, sim.backend.Client(), tx)
+		Expect(err).Should(BeNil())
+		Expect(approvals(ctx, sim.token)).Should(Equal([]string{amount.String(), "0"}))
+	})
+
+	It("should approve the exact amounts of concurrent initiations one at a time", func(ctx context.Context) {
+		wallet := evm.NewHTLCWallet(sim.client, sim.keys[0], append(sim.walletOptions(), evm.WithApprovalPolicy(evm.ApproveExact))...)
+		redeemer := crypto.PubkeyToAddress(sim.keys[1].PublicKey)
+		errs := make(chan error, 3)
+		for i := 1; i <= 3; i++ {
+			go func(i int) {
+				_, err := wallet.Initiate(ctx, sim.asset, redeemer, [32]byte{byte(i)}, big.NewInt(100), big.NewInt(int64(i)*1e6), nil)
+				errs <- err
+			}(i)
+		}
+		for i := 0; i < 3; i++ {
+			Eventually(errs).Should(Receive(BeNil()))
+		}
+
+		// Each approval is only sent once the previous initiation is sent
+		head, err := sim.backend.Client().BlockNumber(ctx)
+		Expect(err).Should(BeNil())
+		var order []common.Address
+		for number := uint64(0); number <= head; number++ {
+			block, err := sim.backend.Client().BlockByNumber(ctx, new(big.Int).SetUint64(number))
+			Expect(err).Should(BeNil())
+			for _, tx := range block.Transactions() {
+				if tx.To() != nil && (*tx.To() == sim.token || *tx.To() == sim.htlc) {
+					order = append(order, *tx.To())
+				}
+			}
+		}
+		Expect(order).Should(Equal([]common.Address{sim.token, sim.htlc, sim.token, sim.htlc, sim.token, sim.htlc}))
+		values := approvals(ctx, sim.token)
+		sort.Strings(values)
+		Expect(values).Should(Equal([]string{"1000000", "2000000", "3000000"}))
+	})
+
+	It("should release the approvals of a token once the initiation is sent", func(ctx context.Context) {
+		wallet := evm.NewHTLCWallet(sim.client, sim.keys[0], append(sim.walletOptions(), evm.WithApprovalPolicy(evm.ApproveExact))...)
+		owner := crypto.PubkeyToAddress(sim.keys[0].PublicKey)
+		redeemer := crypto.PubkeyToAddress(sim.keys[1].PublicKey)
+		nonce, err := sim.backend.Client().PendingNonceAt(ctx, owner)
+		Expect(err).Should(BeNil())
+
+		// The allowance of the mock token covers the amount, the first initiation is sent without an approval
+		sim.paused.Store(true)
+		errs := make(chan error, 2)
+		for i := 1; i <= 2; i++ {
+			go func(i int) {
+				_, err := wallet.Initiate(ctx, sim.asset, redeemer, [32]byte{byte(i)}, big.NewInt(100), big.NewInt(1), nil)
+				errs <- err
+			}(i)
+			Eventually(func() uint64 {
+				pending, err := sim.backend.Client().PendingNonceAt(ctx, owner)
+				Expect(err).Should(BeNil())
+				return pending
+			}).Should(Equal(nonce + uint64(i)))
+		}
+		sim.paused.Store(false)
+		for i := 0; i < 2; i++ {
+			Eventually(errs).Should(Receive(BeNil()))
+		}
+		Expect(approvals(ctx, sim.token)).Should(Equal([]string{"1"}))
+	})
+
+	It("should initiate with a permit of the tokens supporting them", func(ctx context.Context) {
+		owner := crypto.PubkeyToAddress(sim.keys[0].PublicKey)
+		nonce, err := sim.backend.Client().PendingNonceAt(ctx, owner)
+		Expect(err).Should(BeNil())
+		token := crypto.CreateAddress(owner, nonce)
+		domain := apitypes.TypedDataDomain{
+			Name:              "Permit Token",
+			Version:           "1",
+			ChainId:           math.NewHexOrDecimal256(sim.chain.ChainID().Int64()),
+			VerifyingContract: token.Hex(),
+		}
+		Expect(sim.deploy(ctx, permitTokenCode(domain, token, sim.chain.ChainID()))).Should(Equal(token))
+		asset := blockchain.NewERC20(sim.chain, token, sim.htlc)
+
+		wallet, amount := initiate(ctx, asset, evm.WithApprovalPolicy(evm.ApprovePermit))
+		Expect(sim.txsTo(ctx, token)).Should(BeEmpty())
+		txs := sim.txsTo(ctx, evm.Multicall3Address)
+		Expect(txs).Should(HaveLen(1))
+		calls := *abi.ConvertType(unpack(multicall3.Multicall3MetaData, "aggregate3", txs[0].Data())[0], new([]multicall3.Multicall3Call3)).(*[]multicall3.Multicall3Call3)
+		Expect(calls).Should(HaveLen(2))
+		Expect(calls[0].Target).Should(Equal(token))
+		permit := unpack(ierc20permit.IERC20PermitMetaData, "permit", calls[0].CallData)
+		Expect(permit[0]).Should(Equal(owner))
+		Expect(permit[1]).Should(Equal(sim.htlc))
+		Expect(permit[2]).Should(Equal(amount))
+		Expect(calls[1].Target).Should(Equal(sim.htlc))
+		unpack(gardenhtlc.GardenHTLCMetaData, "initiateWithSignature", calls[1].CallData)
+
+		orders, errs, err := sim.client.HTLCOrders(ctx, asset, [][32]byte{wallet.OrderID([32]byte{1})})
+		Expect(err).Should(BeNil())
+		Expect(errs[0]).Should(BeNil())
+		Expect(orders[0].Initiator).Should(Equal(owner))
+		Expect(orders[0].Amount).Should(Equal(amount))
+
+		By("Fall back to exact approvals for the tokens without permit support")
+		_, err = wallet.Initiate(ctx, sim.asset, crypto.PubkeyToAddress(sim.keys[1].PublicKey), [32]byte{2}, big.NewInt(100), amount, nil)
+		Expect(err).Should(BeNil())
+		Expect(approvals(ctx, sim.token)).Should(Equal([]string{amount.String()}))
+	})
+
+	It("should not sign permits of the tokens without permit support", func(ctx context.Context) {
+		wallet := evm.NewHTLCWallet(sim.client, sim.keys[0], sim.walletOptions()...)
+		_, err := wallet.SignPermit(ctx, sim.asset, sim.htlc, big.NewInt(1e6), big.NewInt(1))
+		Expect(err).Should(Equal(evm.ErrPermitNotSupported))
+	})
+
+	It("should sign permits of the tokens supporting them", func(ctx context.Context) {
+		owner := crypto.PubkeyToAddress(sim.keys[0].PublicKey)
+		nonce, err := sim.backend.Client().PendingNonceAt(ctx, owner)
+		Expect(err).Should(BeNil())
+		token := crypto.CreateAddress(owner, nonce)
+		domain := apitypes.TypedDataDomain{
+			Name:              "Permit Token",
+			Version:           "2",
+			ChainId:           math.NewHexOrDecimal256(sim.chain.ChainID().Int64()),
+			VerifyingContract: token.Hex(),
+		}
+		Expect(sim.deploy(ctx, permitTokenCode(domain, token, sim.chain.ChainID()))).Should(Equal(token))
+		asset := blockchain.NewERC20(sim.chain, token, sim.htlc)
+
+		wallet := evm.NewHTLCWallet(sim.client, sim.keys[0], sim.walletOptions()...)
+		amount := big.NewInt(1e6)
+		deadline := big.NewInt(time.Now().Add(time.Hour).Unix())
+		permit, err := wallet.SignPermit(ctx, asset, sim.htlc, amount, deadline)
+		Expect(err).Should(BeNil())
+		Expect(permit.Owner).Should(Equal(owner))
+		Expect(permit.Spender).Should(Equal(sim.htlc))
+		Expect(permit.Value).Should(Equal(amount))
+		Expect(permit.Deadline).Should(Equal(deadline))
+
+		typedData := apitypes.TypedData{
+			Types: apitypes.Types{
+				"EIP712Domain": {
+					{Name: "name", Type: "string"},
+					{Name: "version", Type: "string"},
+					{Name: "chainId", Type: "uint256"},
+					{Name: "verifyingContract", Type: "address"},
+				},
+				"Permit": {
+					{Name: "owner", Type: "address"},
+					{Name: "spender", Type: "address"},
+					{Name: "value", Type: "uint256"},
+					{Name: "nonce", Type: "uint256"},
+					{Name: "deadline", Type: "uint256"},
+				},
+			},
+			PrimaryType: "Permit",
+			Domain:      domain,
+			Message: apitypes.TypedDataMessage{
+				"owner":    owner.Hex(),
+				"spender":  sim.htlc.Hex(),
+				"value":    amount.String(),
+				"nonce":    "0",
+				"deadline": deadline.String(),
+			},
+		}
+		digest, _, err := apitypes.TypedDataAndHash(typedData)
+		Expect(err).Should(BeNil())
+		sig := append(append(permit.R[:], permit.S[:]...), permit.V-27)
+		pubKey, err := crypto.SigToPub(digest, sig)
+		Expect(err).Should(BeNil())
+		Expect(crypto.PubkeyToAddress(*pubKey)).Should(Equal(owner))
+	})
+})
+
+// unpack returns the arguments of the call data of the contract method
+func unpack(metaData *bind.MetaData, method string, data []byte) []interface{} {
+	parsed, err := metaData.GetAbi()
+	Expect(err).Should(BeNil())
+	Expect(data[:4]).Should(Equal(parsed.Methods[method].ID))
+	args, err := parsed.Methods[method].Inputs.Unpack(data[4:])
+	Expect(err).Should(BeNil())
+	return args
+}
+
+// permitTokenCode is the creation code of a token supporting EIP-2612 permits in the domain, deployed at the given
+// address. The permits are not verified, and the other calls all return true like mockTokenCode.
+func permitTokenCode(domain apitypes.TypedDataDomain, token common.Address, chainID *big.Int) []byte {
+	typedData := apitypes.TypedData{
+		Types: apitypes.Types{"EIP712Domain": {
+			{Name: "name", Type: "string"},
+			{Name: "version", Type: "string"},
+			{Name: "chainId", Type: "uint256"},
+			{Name: "verifyingContract", Type: "address"},
+		}},
+		Domain: domain,
+	}
+	separator, err := typedData.HashStruct("EIP712Domain", domain.Map())
+	Expect(err).Should(BeNil())
+
+	erc5267, err := ierc5267.IERC5267MetaData.GetAbi()
+	Expect(err).Should(BeNil())
+	eip712Domain, err := erc5267.Methods["eip712Domain"].Outputs.Pack([1]byte{0x0f}, domain.Name, domain.Version, chainID, token, [32]byte{}, []*big.Int{})
+	Expect(err).Should(BeNil())
+	permit, err := ierc20permit.IERC20PermitMetaData.GetAbi()
+	Expect(err).Should(BeNil())
+	nonce, err := permit.Methods["nonces"].Outputs.Pack(big.NewInt(0))
+	Expect(err).Should(BeNil())
+
+	return creationCode(dispatcherCode(map[string][]byte{
+		"DOMAIN_SEPARATOR()": separator,
+		"eip712Domain()":     eip712Domain,
+		"nonces(address)":    nonce,
+	}))
+}
+
+// dispatcherCode is the runtime code of a contract returning constant data for each function signature, and true
+// for the other calls.
+func dispatcherCode(returns map[string][]byte) []byte {
+	signatures := make([]string, 0, len(returns))
+	for signature := range returns {
+		signatures = append(signatures, signature)
+	}
+	sort.Strings(signatures)
+
+	const (
+		headerSize   = 6
+		matchSize    = 11
+		fallbackSize = 10
+		returnSize   = 16
+	)
+	jumps := headerSize + matchSize*len(signatures) + fallbackSize
+	data := jumps + returnSize*len(signatures)
+	push2 := func(v int) []byte {
+		return binary.BigEndian.AppendUint16([]byte{0x61}, uint16(v))
+	}
+
+	// selector := calldata[0:4]
+	code := []byte{0x60, 0x00, 0x35, 0x60, 0xe0, 0x1c}
+	for i, signature := range signatures {
+		// if selector == id { goto jumps[i] }
+		code = append(code, 0x80, 0x63)
+		code = append(code, crypto.Keccak256([]byte(signature))[:4]...)
+		code = append(code, 0x14)
+		code = append(append(code, push2(jumps+returnSize*i)...), 0x57)
+	}
+	// return true
+	code = append(code, 0x60, 0x01, 0x60, 0x00, 0x52, 0x60, 0x20, 0x60, 0x00, 0xf3)
+	for _, signature := range signatures {
+		// return data
+		code = append(code, 0x5b)
+		code = append(append(code, push2(len(returns[signature]))...), push2(data)...)
+		code = append(code, 0x60, 0x00, 0x39)
+		code = append(append(code, push2(len(returns[signature]))...), 0x60, 0x00, 0xf3)
+		data += len(returns[signature])
+	}
+	for _, signature := range signatures {
+		code = append(code, returns[signature]...)
+	}
+	return code
+}
+
+// creationCode is the creation code deploying the runtime code
+func creationCode(runtime []byte) []byte {
+	size := binary.BigEndian.AppendUint16([]byte{0x61}, uint16(len(runtime)))
+	code := append(size, 0x80, 0x61, 0x00, 0x0d, 0x60, 0x00, 0x39, 0x60, 0x00, 0xf3)
+	return append(code, runtime...)
+}
+
+// deploy deploys the creation code from the first account and returns the address of the contract
+func (sim *simulatedChain) deploy(ctx context.Context, code []byte) common.Address {
+	tops, err := bind.NewKeyedTransactorWithChainID(sim.keys[0], sim.chain.ChainID())
+	Expect(err).Should(BeNil())
+	_, tx, _, err := bind.DeployContract(tops, abi.ABI{}, code, sim.backend.Client())
+	Expect(err).Should(BeNil())
+	address, err := bind.WaitDeployed(ctx, sim.backend.Client(), tx)
+	Expect(err).Should(BeNil())
+	return address
+}
+
+// txsTo returns the transactions sent to the address, in the order they were mined
+func (sim *simulatedChain) txsTo(ctx context.Context, to common.Address) []*types.Transaction {
+	head, err := sim.backend.Client().BlockNumber(ctx)
+	Expect(err).Should(BeNil())
+	var txs []*types.Transaction
+	for number := uint64(0); number <= head; number++ {
+		block, err := sim.backend.Client().BlockByNumber(ctx, new(big.Int).SetUint64(number))
+		Expect(err).Should(BeNil())
+		for _, tx := range block.Transactions() {
+			if tx.To() != nil && *tx.To() == to {
+				txs = append(txs, tx)
+			}
+		}
+	}
+	return txs
+}
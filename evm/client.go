@@ -5,48 +5,89 @@ import (
 	"fmt"
 	"math/big"
 	"strings"
+	"time"
 
 	"github.com/catalogfi/blockchain"
 	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/token/ERC20/erc20"
 	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/token/ERC721/erc721"
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
 )
 
+// Backend is the evm node the package depends on. It is implemented by `*ethclient.Client`, and by the client of
+// the go-ethereum simulated backend for testing.
+type Backend interface {
+	bind.ContractBackend
+	bind.DeployBackend
+	ethereum.TransactionReader
+	ethereum.FeeHistoryReader
+	ethereum.ChainIDReader
+	ethereum.BlockNumberReader
+
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+}
+
 type client struct {
-	evmClients map[blockchain.EvmChain]*ethclient.Client
+	evmClients map[blockchain.EvmChain]Backend
 }
 type Client interface {
 	Balance(ctx context.Context, asset blockchain.EVMAsset, owner common.Address, blockNumber *big.Int) (*big.Int, error)
-	EvmClient(chain blockchain.Chain) (*ethclient.Client, bool)
+	EvmClient(chain blockchain.Chain) (Backend, bool)
 }
 
 type Config struct {
 	RPC map[string]string
+
+	// RPCs has several RPC endpoints per chain, in addition to the one in RPC. Reads are sent to the healthiest
+	// endpoint and fail over to the others, transactions are broadcast to all of them.
+	RPCs map[string][]string
+
+	// HealthCheckInterval is the interval between two health checks of the endpoints of a chain, it defaults to
+	// DefaultHealthCheckInterval.
+	HealthCheckInterval time.Duration
+
+	// MaxHeadLag is the number of blocks an endpoint can lag behind the others before it stops being used, it
+	// defaults to DefaultMaxHeadLag.
+	MaxHeadLag uint64
 }
 
 func NewClient(config Config) (Client, error) {
 	return newClient(config)
 }
 
+// NewClientWithBackends returns a client using pre-built backends, e.g. a go-ethereum simulated backend.
+func NewClientWithBackends(backends map[blockchain.EvmChain]Backend) HTLCClient {
+	return &client{evmClients: backends}
+}
+
 func newClient(config Config) (*client, error) {
-	evmClients := map[blockchain.EvmChain]*ethclient.Client{}
-	for chainName, rpc := range config.RPC {
+	urls := map[blockchain.EvmChain][]string{}
+	addURLs := func(chainName string, rpcs ...string) error {
 		chain, ok := blockchain.ChainFromName(blockchain.Name(strings.ToLower(chainName))).(blockchain.EvmChain)
 		if !ok {
-			return nil, fmt.Errorf("unsupported evm chain: %v", chainName)
+			return fmt.Errorf("unsupported evm chain: %v", chainName)
 		}
-		client, err := ethclient.Dial(rpc)
-		if err != nil {
+		urls[chain] = append(urls[chain], rpcs...)
+		return nil
+	}
+	for chainName, rpc := range config.RPC {
+		if err := addURLs(chainName, rpc); err != nil {
 			return nil, err
 		}
-		chainID, err := client.ChainID(context.Background())
-		if err != nil {
+	}
+	for chainName, rpcs := range config.RPCs {
+		if err := addURLs(chainName, rpcs...); err != nil {
 			return nil, err
 		}
-		if chainID.Cmp(chain.ChainID()) != 0 {
-			return nil, fmt.Errorf("invalid rpc url for: %v, chain id mismatch %v != %v", chain.Name(), chainID, chain.ChainID())
+	}
+
+	evmClients := map[blockchain.EvmChain]Backend{}
+	for chain, rpcs := range urls {
+		client, err := newMultiClient(context.Background(), chain, rpcs, config.HealthCheckInterval, config.MaxHeadLag)
+		if err != nil {
+			return nil, err
 		}
 		evmClients[chain] = client
 	}
@@ -78,7 +119,7 @@ func (client *client) Balance(ctx context.Context, asset blockchain.EVMAsset, ow
 	}
 }
 
-func (client *client) EvmClient(chain blockchain.Chain) (*ethclient.Client, bool) {
+func (client *client) EvmClient(chain blockchain.Chain) (Backend, bool) {
 	ec, ok := chain.(blockchain.EvmChain)
 	if !ok {
 		return nil, ok
@@ -0,0 +1,263 @@
+package evm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// DefaultGasMargin is the percentage added to the estimated gas limit
+	DefaultGasMargin = 20
+
+	// DefaultFeeHistoryBlocks is the number of blocks of fee history used to suggest the priority fee
+	DefaultFeeHistoryBlocks = 10
+
+	// DefaultPriorityFeePercentile is the percentile of the priority fees paid in the recent blocks which is
+	// suggested as priority fee
+	DefaultPriorityFeePercentile = 50
+
+	// baseFeeMultiplier makes the fee cap stay above the base fee for 6 consecutive full blocks
+	baseFeeMultiplier = 2
+)
+
+var (
+	ErrMaxFeeCapExceeded = errors.New("base fee exceeds the maximum fee cap")
+
+	// arbitrumNodeInterface is the address of the NodeInterface precompile on Arbitrum chains
+	arbitrumNodeInterface = common.HexToAddress("0x00000000000000000000000000000000000000C8")
+
+	arbitrumNodeInterfaceABI, _ = abi.JSON(strings.NewReader(`[{"inputs":[{"internalType":"address","name":"to","type":"address"},{"internalType":"bool","name":"contractCreation","type":"bool"},{"internalType":"bytes","name":"data","type":"bytes"}],"name":"gasEstimateL1Component","outputs":[{"internalType":"uint64","name":"gasEstimateForL1","type":"uint64"},{"internalType":"uint256","name":"baseFee","type":"uint256"},{"internalType":"uint256","name":"l1BaseFeeEstimate","type":"uint256"}],"stateMutability":"payable","type":"function"}]`))
+)
+
+// GasClient is the part of an evm node client used to estimate the gas of a transaction.
+type GasClient interface {
+	ethereum.ContractCaller
+	ethereum.GasEstimator
+	ethereum.GasPricer
+	ethereum.GasPricer1559
+	ethereum.FeeHistoryReader
+}
+
+// GasParams are the gas fields of a dynamic fee transaction.
+type GasParams struct {
+	GasLimit  uint64
+	GasFeeCap *big.Int
+	GasTipCap *big.Int
+
+	// L1Gas is the part of the gas limit paying for posting the transaction data on the L1, it is only set on L2
+	// chains which charge it in gas units.
+	L1Gas uint64
+}
+
+// GasStrategy decides the gas limit and the fees of the transactions sent by a wallet.
+type GasStrategy interface {
+	GasParams(ctx context.Context, client GasClient, chain blockchain.EvmChain, msg ethereum.CallMsg) (GasParams, error)
+}
+
+type eip1559GasStrategy struct {
+	margin     uint64
+	blocks     uint64
+	percentile float64
+	maxFeeCaps map[blockchain.Name]*big.Int
+}
+
+// GasStrategyOption configures the gas strategy returned by `NewEIP1559GasStrategy`.
+type GasStrategyOption func(*eip1559GasStrategy)
+
+// WithGasMargin sets the percentage added to the estimated gas limit.
+func WithGasMargin(percent uint64) GasStrategyOption {
+	return func(strategy *eip1559GasStrategy) {
+		strategy.margin = percent
+	}
+}
+
+// WithFeeHistoryBlocks sets the number of recent blocks used to suggest the priority fee.
+func WithFeeHistoryBlocks(blocks uint64) GasStrategyOption {
+	return func(strategy *eip1559GasStrategy) {
+		strategy.blocks = blocks
+	}
+}
+
+// WithPriorityFeePercentile sets the percentile, between 0 and 100, of the priority fees paid in the recent blocks
+// which is suggested as priority fee.
+func WithPriorityFeePercentile(percentile float64) GasStrategyOption {
+	return func(strategy *eip1559GasStrategy) {
+		strategy.percentile = percentile
+	}
+}
+
+// WithMaxFeeCap sets the maximum fee per gas the wallet pays on the chain. Transactions are not sent when the base
+// fee is above the cap.
+func WithMaxFeeCap(chain blockchain.Name, maxFeeCap *big.Int) GasStrategyOption {
+	return func(strategy *eip1559GasStrategy) {
+		strategy.maxFeeCaps[chain] = maxFeeCap
+	}
+}
+
+// NewEIP1559GasStrategy returns a gas strategy which
+//   - estimates the gas limit with `eth_estimateGas` plus a safety margin,
+//   - suggests a priority fee from a percentile of the fees paid in the recent blocks, from `eth_feeHistory`,
+//   - sets the fee cap to twice the next base fee plus the priority fee, bounded by the per-chain maximum fee cap,
+//   - accounts for the L1 data fee on L2 chains.
+func NewEIP1559GasStrategy(opts ...GasStrategyOption) GasStrategy {
+	strategy := &eip1559GasStrategy{
+		margin:     DefaultGasMargin,
+		blocks:     DefaultFeeHistoryBlocks,
+		percentile: DefaultPriorityFeePercentile,
+		maxFeeCaps: map[blockchain.Name]*big.Int{},
+	}
+	for _, opt := range opts {
+		opt(strategy)
+	}
+	return strategy
+}
+
+func (strategy *eip1559GasStrategy) GasParams(ctx context.Context, client GasClient, chain blockchain.EvmChain, msg ethereum.CallMsg) (GasParams, error) {
+	gasLimit, err := client.EstimateGas(ctx, msg)
+	if err != nil {
+		return GasParams{}, fmt.Errorf("failed to estimate gas: %w", err)
+	}
+	params := GasParams{GasLimit: gasLimit * (100 + strategy.margin) / 100}
+
+	baseFee, tip, err := strategy.fees(ctx, client)
+	if err != nil {
+		return GasParams{}, err
+	}
+	if chain.L2() {
+		switch chain.Name() {
+		case blockchain.Arbitrum:
+			// The gas estimation of Arbitrum nodes already includes the L1 component, priced in L2 gas at the
+			// current L1 base fee. Add the margin to it one more time as the L1 base fee is a lot more volatile.
+			params.L1Gas, err = arbitrumL1Gas(ctx, client, msg)
+			if err != nil {
+				return GasParams{}, err
+			}
+			params.GasLimit += params.L1Gas * strategy.margin / 100
+			// Priority fees are not used by the Arbitrum sequencer
+			tip = big.NewInt(0)
+		case blockchain.PolygonZK, blockchain.PolygonZKTestnet:
+			// Polygon zkEVM charges the L1 data through the effective gas price of the transaction, which is
+			// included in the gas price suggested by the node.
+			gasPrice, err := client.SuggestGasPrice(ctx)
+			if err != nil {
+				return GasParams{}, fmt.Errorf("failed to get gas price: %w", err)
+			}
+			if gasPrice.Cmp(baseFee) > 0 {
+				baseFee = gasPrice
+			}
+		}
+	}
+
+	params.GasTipCap = tip
+	params.GasFeeCap = new(big.Int).Add(new(big.Int).Mul(baseFee, big.NewInt(baseFeeMultiplier)), tip)
+	if maxFeeCap, ok := strategy.maxFeeCaps[chain.Name()]; ok {
+		if baseFee.Cmp(maxFeeCap) > 0 {
+			return GasParams{}, fmt.Errorf("%w: %v > %v on %v", ErrMaxFeeCapExceeded, baseFee, maxFeeCap, chain.Name())
+		}
+		if params.GasFeeCap.Cmp(maxFeeCap) > 0 {
+			params.GasFeeCap = new(big.Int).Set(maxFeeCap)
+		}
+		if params.GasTipCap.Cmp(params.GasFeeCap) > 0 {
+			params.GasTipCap = new(big.Int).Set(params.GasFeeCap)
+		}
+	}
+	return params, nil
+}
+
+// fees returns the base fee of the next block and the suggested priority fee. It falls back to the gas price
+// suggested by the node when the fee history is not available.
+func (strategy *eip1559GasStrategy) fees(ctx context.Context, client GasClient) (*big.Int, *big.Int, error) {
+	history, err := client.FeeHistory(ctx, strategy.blocks, nil, []float64{strategy.percentile})
+	if err != nil || len(history.BaseFee) == 0 {
+		gasPrice, err := client.SuggestGasPrice(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get gas price: %w", err)
+		}
+		tip, err := client.SuggestGasTipCap(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get gas tip: %w", err)
+		}
+		return gasPrice, tip, nil
+	}
+
+	// The fee history has the base fee of the block after the newest one
+	baseFee := history.BaseFee[len(history.BaseFee)-1]
+	rewards := make([]*big.Int, 0, len(history.Reward))
+	for _, reward := range history.Reward {
+		if len(reward) > 0 && reward[0] != nil {
+			rewards = append(rewards, reward[0])
+		}
+	}
+	sort.Slice(rewards, func(i, j int) bool {
+		return rewards[i].Cmp(rewards[j]) < 0
+	})
+	if len(rewards) == 0 || rewards[len(rewards)/2].Sign() == 0 {
+		tip, err := client.SuggestGasTipCap(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get gas tip: %w", err)
+		}
+		return baseFee, tip, nil
+	}
+	return baseFee, new(big.Int).Set(rewards[len(rewards)/2]), nil
+}
+
+// arbitrumL1Gas returns the gas used to post the transaction data on the L1, using the NodeInterface precompile.
+func arbitrumL1Gas(ctx context.Context, client GasClient, msg ethereum.CallMsg) (uint64, error) {
+	to := common.Address{}
+	if msg.To != nil {
+		to = *msg.To
+	}
+	data, err := arbitrumNodeInterfaceABI.Pack("gasEstimateL1Component", to, msg.To == nil, msg.Data)
+	if err != nil {
+		return 0, err
+	}
+	output, err := client.CallContract(ctx, ethereum.CallMsg{From: msg.From, To: &arbitrumNodeInterface, Data: data}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to estimate the l1 gas: %w", err)
+	}
+	results, err := arbitrumNodeInterfaceABI.Unpack("gasEstimateL1Component", output)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode the l1 gas: %w", err)
+	}
+	return results[0].(uint64), nil
+}
+
+// setGas sets the gas fields of the transact opts for calling the method of the contract. The call is simulated
+// first, a RevertError is returned when it reverts.
+func setGas(ctx context.Context, strategy GasStrategy, client GasClient, chain blockchain.EvmChain, tops *bind.TransactOpts, contract common.Address, metaData *bind.MetaData, method string, args ...interface{}) error {
+	parsed, err := metaData.GetAbi()
+	if err != nil {
+		return fmt.Errorf("failed to get abi: %v", err)
+	}
+	data, err := parsed.Pack(method, args...)
+	if err != nil {
+		return fmt.Errorf("failed to pack %v: %v", method, err)
+	}
+	msg := ethereum.CallMsg{
+		From:  tops.From,
+		To:    &contract,
+		Value: tops.Value,
+		Data:  data,
+	}
+	if err := simulate(ctx, client, msg, nil); err != nil {
+		return err
+	}
+	params, err := strategy.GasParams(ctx, client, chain, msg)
+	if err != nil {
+		return err
+	}
+	tops.GasLimit = params.GasLimit
+	tops.GasFeeCap = params.GasFeeCap
+	tops.GasTipCap = params.GasTipCap
+	return nil
+}
@@ -0,0 +1,143 @@
+package evm_test
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/catalogfi/blockchain/evm"
+)
+
+var _ = Describe("Gas strategy", func() {
+	to := common.HexToAddress("0x70997970C51812dc3A010C7d01b50e0d17dc79C8")
+	msg := ethereum.CallMsg{To: &to, Value: big.NewInt(1), Data: []byte{1, 2, 3}}
+	mainnet := blockchain.NewEvmChain(blockchain.Ethereum)
+
+	var client *gasClient
+
+	BeforeEach(func() {
+		client = &gasClient{
+			gas:      100000,
+			gasPrice: big.NewInt(30),
+			tip:      big.NewInt(1),
+			history: &ethereum.FeeHistory{
+				BaseFee: []*big.Int{big.NewInt(10), big.NewInt(11), big.NewInt(12), big.NewInt(13)},
+				Reward:  [][]*big.Int{{big.NewInt(2)}, {big.NewInt(5)}, {big.NewInt(3)}},
+			},
+		}
+	})
+
+	It("should estimate the gas and fees", func(ctx context.Context) {
+		params, err := evm.NewEIP1559GasStrategy().GasParams(ctx, client, mainnet, msg)
+		Expect(err).Should(BeNil())
+		Expect(params.GasLimit).Should(Equal(uint64(120000)))
+		Expect(params.GasTipCap).Should(Equal(big.NewInt(3)))
+		Expect(params.GasFeeCap).Should(Equal(big.NewInt(2*13 + 3)))
+		Expect(params.L1Gas).Should(BeZero())
+		Expect(client.percentiles).Should(Equal([]float64{evm.DefaultPriorityFeePercentile}))
+
+		By("Use the options")
+		params, err = evm.NewEIP1559GasStrategy(evm.WithGasMargin(50), evm.WithFeeHistoryBlocks(3), evm.WithPriorityFeePercentile(90)).GasParams(ctx, client, mainnet, msg)
+		Expect(err).Should(BeNil())
+		Expect(params.GasLimit).Should(Equal(uint64(150000)))
+		Expect(client.blocks).Should(Equal(uint64(3)))
+		Expect(client.percentiles).Should(Equal([]float64{90}))
+	})
+
+	It("should fall back to the suggested fees", func(ctx context.Context) {
+		client.history.Reward = [][]*big.Int{{big.NewInt(0)}, {big.NewInt(0)}, {big.NewInt(0)}}
+		params, err := evm.NewEIP1559GasStrategy().GasParams(ctx, client, mainnet, msg)
+		Expect(err).Should(BeNil())
+		Expect(params.GasTipCap).Should(Equal(big.NewInt(1)))
+		Expect(params.GasFeeCap).Should(Equal(big.NewInt(2*13 + 1)))
+
+		By("Without fee history")
+		client.history = nil
+		params, err = evm.NewEIP1559GasStrategy().GasParams(ctx, client, mainnet, msg)
+		Expect(err).Should(BeNil())
+		Expect(params.GasFeeCap).Should(Equal(big.NewInt(2*30 + 1)))
+	})
+
+	It("should cap the fees", func(ctx context.Context) {
+		params, err := evm.NewEIP1559GasStrategy(evm.WithMaxFeeCap(blockchain.Ethereum, big.NewInt(20))).GasParams(ctx, client, mainnet, msg)
+		Expect(err).Should(BeNil())
+		Expect(params.GasFeeCap).Should(Equal(big.NewInt(20)))
+		Expect(params.GasTipCap).Should(Equal(big.NewInt(3)))
+
+		By("Cap only the configured chain")
+		params, err = evm.NewEIP1559GasStrategy(evm.WithMaxFeeCap(blockchain.Arbitrum, big.NewInt(20))).GasParams(ctx, client, mainnet, msg)
+		Expect(err).Should(BeNil())
+		Expect(params.GasFeeCap).Should(Equal(big.NewInt(29)))
+
+		By("Refuse to send above the cap")
+		_, err = evm.NewEIP1559GasStrategy(evm.WithMaxFeeCap(blockchain.Ethereum, big.NewInt(12))).GasParams(ctx, client, mainnet, msg)
+		Expect(errors.Is(err, evm.ErrMaxFeeCapExceeded)).Should(BeTrue())
+	})
+
+	It("should account for the Arbitrum L1 gas", func(ctx context.Context) {
+		client.l1Gas = 40000
+		params, err := evm.NewEIP1559GasStrategy().GasParams(ctx, client, blockchain.NewEvmChain(blockchain.Arbitrum), msg)
+		Expect(err).Should(BeNil())
+		Expect(params.L1Gas).Should(Equal(uint64(40000)))
+		Expect(params.GasLimit).Should(Equal(uint64(120000 + 8000)))
+		Expect(params.GasTipCap.Sign()).Should(BeZero())
+		Expect(params.GasFeeCap).Should(Equal(big.NewInt(2 * 13)))
+		Expect(client.called).Should(Equal(common.HexToAddress("0x00000000000000000000000000000000000000C8")))
+	})
+
+	It("should account for the Polygon zkEVM effective gas price", func(ctx context.Context) {
+		params, err := evm.NewEIP1559GasStrategy().GasParams(ctx, client, blockchain.NewEvmChain(blockchain.PolygonZK), msg)
+		Expect(err).Should(BeNil())
+		Expect(params.GasFeeCap).Should(Equal(big.NewInt(2*30 + 3)))
+		Expect(params.L1Gas).Should(BeZero())
+	})
+})
+
+var nodeInterfaceABI, _ = abi.JSON(strings.NewReader(`[{"inputs":[{"name":"to","type":"address"},{"name":"contractCreation","type":"bool"},{"name":"data","type":"bytes"}],"name":"gasEstimateL1Component","outputs":[{"name":"gasEstimateForL1","type":"uint64"},{"name":"baseFee","type":"uint256"},{"name":"l1BaseFeeEstimate","type":"uint256"}],"type":"function"}]`))
+
+// gasClient is a fake evm node returning fixed gas estimations
+type gasClient struct {
+	gas      uint64
+	gasPrice *big.Int
+	tip      *big.Int
+	history  *ethereum.FeeHistory
+	l1Gas    uint64
+
+	blocks      uint64
+	percentiles []float64
+	called      common.Address
+}
+
+func (client *gasClient) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	client.called = *call.To
+	return nodeInterfaceABI.Methods["gasEstimateL1Component"].Outputs.Pack(client.l1Gas, big.NewInt(0), big.NewInt(0))
+}
+
+func (client *gasClient) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	return client.gas, nil
+}
+
+func (client *gasClient) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return client.gasPrice, nil
+}
+
+func (client *gasClient) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	return client.tip, nil
+}
+
+func (client *gasClient) FeeHistory(ctx context.Context, blockCount uint64, lastBlock *big.Int, rewardPercentiles []float64) (*ethereum.FeeHistory, error) {
+	client.blocks = blockCount
+	client.percentiles = rewardPercentiles
+	if client.history == nil {
+		return nil, errors.New("method not supported")
+	}
+	return client.history, nil
+}
@@ -4,15 +4,13 @@ import (
 	"bytes"
 	"context"
 	"crypto/ecdsa"
-	"crypto/sha256"
+	"errors"
 	"fmt"
 	"math/big"
 
 	"github.com/catalogfi/blockchain"
 	"github.com/catalogfi/blockchain/evm/bindings/contracts/htlc/gardenhtlc"
-	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/token/ERC20/erc20"
 	"github.com/ethereum/go-ethereum"
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 )
@@ -24,20 +22,25 @@ type HTLCWallet interface {
 	Initiate(ctx context.Context, asset blockchain.EVMAsset, redeemer common.Address, secretHash [32]byte, expiry *big.Int, amount *big.Int, sig []byte) (*types.Receipt, error)
 	Redeem(ctx context.Context, asset blockchain.EVMAsset, orderID [32]byte, secret []byte) (*types.Receipt, error)
 	Refund(ctx context.Context, asset blockchain.EVMAsset, orderID [32]byte, sig []byte) (*types.Receipt, error)
+	RedeemBatch(ctx context.Context, asset blockchain.EVMAsset, redeems []HTLCRedeem) (*types.Receipt, []error, error)
+	RefundBatch(ctx context.Context, asset blockchain.EVMAsset, orderIDs [][32]byte) (*types.Receipt, []error, error)
+	SignPermit(ctx context.Context, asset blockchain.EVMAsset, spender common.Address, amount, deadline *big.Int) (Permit, error)
+	RevokeAllowance(ctx context.Context, asset blockchain.EVMAsset, spender common.Address) (*types.Transaction, error)
 }
 
 type HTLCClient interface {
 	Client
 
 	HTLCEvents(ctx context.Context, asset blockchain.EVMAsset, fromBlock, toBlock *big.Int) ([]HTLCEvent, error)
+	HTLCOrders(ctx context.Context, asset blockchain.EVMAsset, orderIDs [][32]byte) ([]HTLCOrderStatus, []error, error)
 }
 
 func NewHTLCClient(config Config) (HTLCClient, error) {
 	return newClient(config)
 }
 
-func NewHTLCWallet(client HTLCClient, key *ecdsa.PrivateKey) HTLCWallet {
-	return &wallet{Client: client, privateKey: key}
+func NewHTLCWallet(client HTLCClient, key *ecdsa.PrivateKey, opts ...WalletOption) HTLCWallet {
+	return newWallet(client, key, opts...)
 }
 
 func (w *wallet) SignInitiate(ctx context.Context, asset blockchain.EVMAsset, redeemer common.Address, secretHash [32]byte, expiry *big.Int, amount *big.Int, sig []byte) ([]byte, error) {
@@ -45,7 +48,7 @@ func (w *wallet) SignInitiate(ctx context.Context, asset blockchain.EVMAsset, re
 }
 
 func (w *wallet) OrderID(secretHash [32]byte) [32]byte {
-	return sha256.Sum256(append(secretHash[:], common.BytesToHash(w.Address().Bytes()).Bytes()...))
+	return HTLCOrder{SecretHash: secretHash, Initiator: w.Address()}.ID()
 }
 
 func (w *wallet) Initiate(ctx context.Context, asset blockchain.EVMAsset, redeemer common.Address, secretHash [32]byte, expiry *big.Int, amount *big.Int, sig []byte) (*types.Receipt, error) {
@@ -53,40 +56,45 @@ func (w *wallet) Initiate(ctx context.Context, asset blockchain.EVMAsset, redeem
 	if err != nil {
 		return nil, err
 	}
+	chain := asset.Chain().(blockchain.EvmChain)
 	switch asset := asset.(type) {
 	case blockchain.ERC20:
 		htlc, err := gardenhtlc.NewGardenHTLC(asset.Swapper(), client)
 		if err != nil {
 			return nil, err
 		}
-		erc20, err := erc20.NewERC20(asset.Token, client)
-		if err != nil {
-			return nil, err
+		if sig == nil && w.approvalPolicy == ApprovePermit {
+			receipt, err := w.initiateWithPermit(ctx, client, chain, tops, asset, redeemer, secretHash, expiry, amount)
+			if !errors.Is(err, ErrPermitNotSupported) {
+				return receipt, err
+			}
 		}
-		allowance, err := erc20.Allowance(&bind.CallOpts{}, w.Address(), asset.Swapper())
+		allowed, err := w.allow(ctx, client, chain, tops, asset, amount)
 		if err != nil {
 			return nil, err
 		}
-		if allowance.Cmp(amount) < 0 {
-			tx, err := erc20.Approve(tops, asset.Swapper(), MaxETHAmount)
-			if err != nil {
+		defer allowed.done()
+		var tx *types.Transaction
+		if sig != nil {
+			if err := setGas(ctx, w.gasStrategy, client, chain, tops, asset.Swapper(), gardenhtlc.GardenHTLCMetaData, "initiateWithSignature", redeemer, expiry, amount, secretHash, sig); err != nil {
 				return nil, err
 			}
-			_, err = bind.WaitMined(ctx, client, tx)
-			if err != nil {
+			tx, err = w.withNonce(ctx, client, chain, tops, func() (*types.Transaction, error) {
+				return htlc.InitiateWithSignature(tops, redeemer, expiry, amount, secretHash, sig)
+			})
+		} else {
+			if err := setGas(ctx, w.gasStrategy, client, chain, tops, asset.Swapper(), gardenhtlc.GardenHTLCMetaData, "initiate", redeemer, expiry, amount, secretHash); err != nil {
 				return nil, err
 			}
-		}
-		var tx *types.Transaction
-		if sig != nil {
-			tx, err = htlc.InitiateWithSignature(tops, redeemer, expiry, amount, secretHash, sig)
-		} else {
-			tx, err = htlc.Initiate(tops, redeemer, expiry, amount, secretHash)
+			tx, err = w.withNonce(ctx, client, chain, tops, func() (*types.Transaction, error) {
+				return htlc.Initiate(tops, redeemer, expiry, amount, secretHash)
+			})
 		}
 		if err != nil {
 			return nil, err
 		}
-		return bind.WaitMined(ctx, client, tx)
+		allowed.initiated()
+		return w.waitMined(ctx, chain, tx)
 	default:
 		panic(fmt.Sprintf("unsupported asset type: %T", asset))
 	}
@@ -97,17 +105,23 @@ func (w *wallet) Redeem(ctx context.Context, asset blockchain.EVMAsset, orderID
 	if err != nil {
 		return nil, err
 	}
+	chain := asset.Chain().(blockchain.EvmChain)
 	switch asset := asset.(type) {
 	case blockchain.ERC20:
 		htlc, err := gardenhtlc.NewGardenHTLC(asset.Swapper(), client)
 		if err != nil {
 			return nil, err
 		}
-		tx, err := htlc.Redeem(tops, orderID, secret)
+		if err := setGas(ctx, w.gasStrategy, client, chain, tops, asset.Swapper(), gardenhtlc.GardenHTLCMetaData, "redeem", orderID, secret); err != nil {
+			return nil, err
+		}
+		tx, err := w.withNonce(ctx, client, chain, tops, func() (*types.Transaction, error) {
+			return htlc.Redeem(tops, orderID, secret)
+		})
 		if err != nil {
 			return nil, err
 		}
-		return bind.WaitMined(ctx, client, tx)
+		return w.waitMined(ctx, chain, tx)
 	default:
 		panic(fmt.Sprintf("unsupported asset type: %T", asset))
 	}
@@ -118,6 +132,7 @@ func (w *wallet) Refund(ctx context.Context, asset blockchain.EVMAsset, orderID
 	if err != nil {
 		return nil, err
 	}
+	chain := asset.Chain().(blockchain.EvmChain)
 	switch asset := asset.(type) {
 	case blockchain.ERC20:
 		htlc, err := gardenhtlc.NewGardenHTLC(asset.Swapper(), client)
@@ -126,14 +141,24 @@ func (w *wallet) Refund(ctx context.Context, asset blockchain.EVMAsset, orderID
 		}
 		var tx *types.Transaction
 		if sig != nil {
-			tx, err = htlc.InstantRefund(tops, orderID, sig)
+			if err := setGas(ctx, w.gasStrategy, client, chain, tops, asset.Swapper(), gardenhtlc.GardenHTLCMetaData, "instantRefund", orderID, sig); err != nil {
+				return nil, err
+			}
+			tx, err = w.withNonce(ctx, client, chain, tops, func() (*types.Transaction, error) {
+				return htlc.InstantRefund(tops, orderID, sig)
+			})
 		} else {
-			tx, err = htlc.Refund(tops, orderID)
+			if err := setGas(ctx, w.gasStrategy, client, chain, tops, asset.Swapper(), gardenhtlc.GardenHTLCMetaData, "refund", orderID); err != nil {
+				return nil, err
+			}
+			tx, err = w.withNonce(ctx, client, chain, tops, func() (*types.Transaction, error) {
+				return htlc.Refund(tops, orderID)
+			})
 		}
 		if err != nil {
 			return nil, err
 		}
-		return bind.WaitMined(ctx, client, tx)
+		return w.waitMined(ctx, chain, tx)
 	default:
 		panic(fmt.Sprintf("unsupported asset type: %T", asset))
 	}
@@ -2,15 +2,29 @@ package evm_test
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/sha256"
 	"math/big"
-
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/params"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	"github.com/catalogfi/blockchain"
 	"github.com/catalogfi/blockchain/evm"
+	"github.com/catalogfi/blockchain/evm/bindings/contracts/htlc/gardenhtlc"
+	"github.com/catalogfi/blockchain/evm/bindings/multicall3"
 	"github.com/catalogfi/blockchain/localnet"
 )
 
@@ -73,3 +87,159 @@ var _ = Describe("HTLC", func() {
 		Expect(rEvent.SecretHash).Should(Equal(secretHash))
 	})
 })
+
+var _ = Describe("HTLC on a simulated backend", func() {
+	var sim *simulatedChain
+
+	BeforeEach(func(ctx context.Context) {
+		sim = newSimulatedChain(ctx, 2)
+	})
+
+	It("should initiate, redeem and refund orders", func(ctx context.Context) {
+		initiator := evm.NewHTLCWallet(sim.client, sim.keys[0], sim.walletOptions()...)
+		redeemer := evm.NewHTLCWallet(sim.client, sim.keys[1], sim.walletOptions()...)
+
+		secret := [32]byte{}
+		_, err := rand.Read(secret[:])
+		Expect(err).Should(BeNil())
+		secretHash := sha256.Sum256(secret[:])
+
+		initiated, err := initiator.Initiate(ctx, sim.asset, redeemer.Address(), secretHash, big.NewInt(100), big.NewInt(1e6), nil)
+		Expect(err).Should(BeNil())
+		Expect(initiated.Status).Should(Equal(types.ReceiptStatusSuccessful))
+		redeemed, err := redeemer.Redeem(ctx, sim.asset, initiator.OrderID(secretHash), secret[:])
+		Expect(err).Should(BeNil())
+		Expect(redeemed.Status).Should(Equal(types.ReceiptStatusSuccessful))
+
+		By("Refund an expired order")
+		refundSecretHash := sha256.Sum256(secretHash[:])
+		_, err = initiator.Initiate(ctx, sim.asset, redeemer.Address(), refundSecretHash, big.NewInt(2), big.NewInt(1e6), nil)
+		Expect(err).Should(BeNil())
+		var refunded *types.Receipt
+		Eventually(func() error {
+			refunded, err = initiator.Refund(ctx, sim.asset, initiator.OrderID(refundSecretHash), nil)
+			return err
+		}).Should(Succeed())
+		Expect(refunded.Status).Should(Equal(types.ReceiptStatusSuccessful))
+
+		By("Find the events of the orders")
+		events, err := sim.client.HTLCEvents(ctx, sim.asset, big.NewInt(0), refunded.BlockNumber)
+		Expect(err).Should(BeNil())
+		Expect(events).Should(HaveLen(4))
+
+		iEvent, ok := events[0].(evm.HTLCInitiated)
+		Expect(ok).Should(BeTrue())
+		Expect(iEvent.ID).Should(Equal(initiator.OrderID(secretHash)))
+		Expect(iEvent.SecretHash).Should(Equal(secretHash))
+		Expect(iEvent.Amount).Should(Equal(big.NewInt(1e6)))
+		Expect(iEvent.InitiateTxHash).Should(Equal(initiated.TxHash))
+
+		rEvent, ok := events[1].(evm.HTLCRedeemed)
+		Expect(ok).Should(BeTrue())
+		Expect(rEvent.ID).Should(Equal(initiator.OrderID(secretHash)))
+		Expect(rEvent.Secret).Should(Equal(secret[:]))
+		Expect(rEvent.RedeemTxHash).Should(Equal(redeemed.TxHash))
+
+		fEvent, ok := events[3].(evm.HTLCRefunded)
+		Expect(ok).Should(BeTrue())
+		Expect(fEvent.ID).Should(Equal(initiator.OrderID(refundSecretHash)))
+		Expect(fEvent.RefundTxHash).Should(Equal(refunded.TxHash))
+	})
+
+	It("should not redeem with a wrong secret", func(ctx context.Context) {
+		initiator := evm.NewHTLCWallet(sim.client, sim.keys[0], sim.walletOptions()...)
+		redeemer := evm.NewHTLCWallet(sim.client, sim.keys[1], sim.walletOptions()...)
+		secretHash := sha256.Sum256([]byte("secret"))
+		_, err := initiator.Initiate(ctx, sim.asset, redeemer.Address(), secretHash, big.NewInt(100), big.NewInt(1e6), nil)
+		Expect(err).Should(BeNil())
+		_, err = redeemer.Redeem(ctx, sim.asset, initiator.OrderID(secretHash), []byte("wrong secret"))
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("should wait for the confirmation depth", func(ctx context.Context) {
+		initiator := evm.NewHTLCWallet(sim.client, sim.keys[0], append(sim.walletOptions(), evm.WithConfirmationDepth(3))...)
+		receipt, err := initiator.Initiate(ctx, sim.asset, crypto.PubkeyToAddress(sim.keys[1].PublicKey), sha256.Sum256([]byte("secret")), big.NewInt(100), big.NewInt(1e6), nil)
+		Expect(err).Should(BeNil())
+		head, err := sim.backend.Client().BlockNumber(ctx)
+		Expect(err).Should(BeNil())
+		Expect(head).Should(BeNumerically(">=", receipt.BlockNumber.Uint64()+2))
+	})
+})
+
+// mockTokenCode is the runtime code of a token whose calls all return true, so it accepts any transfer and approval
+var mockTokenCode = common.FromHex("0x600160005260206000f3")
+
+// simulatedChain is a go-ethereum simulated backend mining a block every few milliseconds, with Multicall3 and a
+// GardenHTLC contract deployed for a mock token.
+type simulatedChain struct {
+	chain   blockchain.EvmChain
+	backend *simulated.Backend
+	client  evm.HTLCClient
+	keys    []*ecdsa.PrivateKey
+	token   common.Address
+	htlc    common.Address
+	asset   blockchain.EVMAsset
+	paused  atomic.Bool
+}
+
+func newSimulatedChain(ctx context.Context, accounts int) *simulatedChain {
+	sim := &simulatedChain{
+		chain: blockchain.NewEvmChain(blockchain.EthereumLocalnet),
+		token: common.HexToAddress("0x0000000000000000000000000000000000001000"),
+	}
+	multicall, _, _, err := runtime.Create(common.FromHex(multicall3.Multicall3MetaData.Bin), nil)
+	Expect(err).Should(BeNil())
+	alloc := types.GenesisAlloc{
+		sim.token:             {Code: mockTokenCode, Balance: big.NewInt(0)},
+		evm.Multicall3Address: {Code: multicall, Balance: big.NewInt(0)},
+	}
+	for i := 0; i < accounts; i++ {
+		key, err := crypto.GenerateKey()
+		Expect(err).Should(BeNil())
+		sim.keys = append(sim.keys, key)
+		alloc[crypto.PubkeyToAddress(key.PublicKey)] = types.Account{Balance: new(big.Int).Lsh(big.NewInt(1), 100)}
+	}
+	sim.backend = simulated.NewBackend(alloc, func(nodeConf *node.Config, ethConf *ethconfig.Config) {
+		config := *params.AllDevChainProtocolChanges
+		config.ChainID = sim.chain.ChainID()
+		ethConf.Genesis.Config = &config
+	})
+	DeferCleanup(sim.backend.Close)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !sim.paused.Load() {
+					sim.backend.Commit()
+				}
+			}
+		}
+	}()
+	DeferCleanup(func() {
+		close(done)
+		<-stopped
+	})
+
+	tops, err := bind.NewKeyedTransactorWithChainID(sim.keys[0], sim.chain.ChainID())
+	Expect(err).Should(BeNil())
+	htlc, tx, _, err := gardenhtlc.DeployGardenHTLC(tops, sim.backend.Client(), sim.token, "HTLC", "1")
+	Expect(err).Should(BeNil())
+	_, err = bind.WaitDeployed(ctx, sim.backend.Client(), tx)
+	Expect(err).Should(BeNil())
+	sim.htlc = htlc
+	sim.asset = blockchain.NewERC20(sim.chain, sim.token, sim.htlc)
+	sim.client = evm.NewClientWithBackends(map[blockchain.EvmChain]evm.Backend{sim.chain: sim.backend.Client()})
+	return sim
+}
+
+func (sim *simulatedChain) walletOptions() []evm.WalletOption {
+	return []evm.WalletOption{evm.WithTxTrackerOptions(evm.WithTrackerPollInterval(10 * time.Millisecond))}
+}
@@ -0,0 +1,296 @@
+package evm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/catalogfi/blockchain/evm/bindings/contracts/htlc/gardenhtlc"
+	"github.com/catalogfi/blockchain/evm/bindings/multicall3"
+	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/token/ERC20/erc20"
+	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/token/ERC721/erc721"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Multicall3Address is the address of the Multicall3 contract, which is the same on all the supported chains.
+var Multicall3Address = common.HexToAddress("0xcA11bde05977b3631167028862bE2a173976CA11")
+
+// multicallBatchSize is the maximum number of calls aggregated by a single multicall read
+const multicallBatchSize = 500
+
+var ErrBatchCallFailed = errors.New("batched call failed")
+
+// BalanceQuery is a balance read by `Balances`.
+type BalanceQuery struct {
+	Asset blockchain.EVMAsset
+	Owner common.Address
+}
+
+// HTLCOrderStatus is the state of an order in the GardenHTLC contract. The initiator of the orders which were never
+// initiated is the zero address.
+type HTLCOrderStatus struct {
+	IsFulfilled bool
+	Initiator   common.Address
+	Redeemer    common.Address
+	InitiatedAt *big.Int
+	Timelock    *big.Int
+	Amount      *big.Int
+}
+
+// HTLCRedeem is an order redeemed by `RedeemBatch`.
+type HTLCRedeem struct {
+	OrderID [32]byte
+	Secret  []byte
+}
+
+// multicall sends the calls through the Multicall3 contract, in batches of multicallBatchSize, allowing each of them
+// to fail. It returns the data returned by each call, and the errors of the failed ones.
+func multicall(ctx context.Context, caller bind.ContractCaller, from common.Address, calls []multicall3.Multicall3Call3, blockNumber *big.Int) ([][]byte, []error, error) {
+	bound, err := multicall3.NewMulticall3Caller(Multicall3Address, caller)
+	if err != nil {
+		return nil, nil, err
+	}
+	contract := &multicall3.Multicall3CallerRaw{Contract: bound}
+
+	data := make([][]byte, len(calls))
+	errs := make([]error, len(calls))
+	for start := 0; start < len(calls); start += multicallBatchSize {
+		batch := calls[start:min(start+multicallBatchSize, len(calls))]
+		var out []interface{}
+		if err := contract.Call(&bind.CallOpts{From: from, BlockNumber: blockNumber, Context: ctx}, &out, "aggregate3", batch); err != nil {
+			return nil, nil, fmt.Errorf("failed to multicall: %w", err)
+		}
+		results := *abi.ConvertType(out[0], new([]multicall3.Multicall3Result)).(*[]multicall3.Multicall3Result)
+		for i, result := range results {
+			data[start+i] = result.ReturnData
+			if !result.Success {
+				errs[start+i] = callError(result.ReturnData)
+			}
+		}
+	}
+	return data, errs, nil
+}
+
+// callError returns the error of a failed call, with its revert reason when there is one
+func callError(returnData []byte) error {
+	if reason, err := abi.UnpackRevert(returnData); err == nil {
+		return fmt.Errorf("%w: %v", ErrBatchCallFailed, reason)
+	}
+	return ErrBatchCallFailed
+}
+
+// Balances reads the balances of the queries with one multicall per chain of the client. The balances which could
+// not be read are nil, along with their error.
+func Balances(ctx context.Context, client Client, queries []BalanceQuery, blockNumber *big.Int) ([]*big.Int, []error, error) {
+	erc20ABI, err := erc20.ERC20MetaData.GetAbi()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get abi: %v", err)
+	}
+	erc721ABI, err := erc721.ERC721MetaData.GetAbi()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get abi: %v", err)
+	}
+	multicallABI, err := multicall3.Multicall3MetaData.GetAbi()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get abi: %v", err)
+	}
+
+	type chainQueries struct {
+		indexes []int
+		methods []abi.Method
+		calls   []multicall3.Multicall3Call3
+	}
+	chains := map[blockchain.EvmChain]*chainQueries{}
+	for i, query := range queries {
+		chain, ok := query.Asset.Chain().(blockchain.EvmChain)
+		if !ok {
+			return nil, nil, fmt.Errorf("%v is not an evm chain", query.Asset.Chain().Name())
+		}
+		var target common.Address
+		var method abi.Method
+		switch asset := query.Asset.(type) {
+		case blockchain.ERC20:
+			target, method = asset.Token, erc20ABI.Methods["balanceOf"]
+		case blockchain.ERC721:
+			target, method = asset.Token, erc721ABI.Methods["balanceOf"]
+		case blockchain.ETH:
+			target, method = Multicall3Address, multicallABI.Methods["getEthBalance"]
+		default:
+			panic("constraint violation: unsupported evm asset type")
+		}
+		args, err := method.Inputs.Pack(query.Owner)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to pack %v: %v", method.Name, err)
+		}
+		if chains[chain] == nil {
+			chains[chain] = &chainQueries{}
+		}
+		chains[chain].indexes = append(chains[chain].indexes, i)
+		chains[chain].methods = append(chains[chain].methods, method)
+		chains[chain].calls = append(chains[chain].calls, multicall3.Multicall3Call3{
+			Target:       target,
+			AllowFailure: true,
+			CallData:     append(append([]byte{}, method.ID...), args...),
+		})
+	}
+
+	balances := make([]*big.Int, len(queries))
+	errs := make([]error, len(queries))
+	for chain, chainQueries := range chains {
+		evmClient, ok := client.EvmClient(chain)
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported chain: %v", chain.Name())
+		}
+		data, callErrs, err := multicall(ctx, evmClient, common.Address{}, chainQueries.calls, blockNumber)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, index := range chainQueries.indexes {
+			if callErrs[i] != nil {
+				errs[index] = callErrs[i]
+				continue
+			}
+			out, err := chainQueries.methods[i].Outputs.Unpack(data[i])
+			if err != nil {
+				errs[index] = fmt.Errorf("%w: failed to unpack balance: %v", ErrBatchCallFailed, err)
+				continue
+			}
+			balances[index] = out[0].(*big.Int)
+		}
+	}
+	return balances, errs, nil
+}
+
+// HTLCOrders reads the orders of the GardenHTLC contract of the asset with multicalls.
+func (client *client) HTLCOrders(ctx context.Context, asset blockchain.EVMAsset, orderIDs [][32]byte) ([]HTLCOrderStatus, []error, error) {
+	parsed, err := gardenhtlc.GardenHTLCMetaData.GetAbi()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get abi: %v", err)
+	}
+	evmClient, ok := client.EvmClient(asset.Chain())
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported chain: %v", asset.Chain().Name())
+	}
+
+	calls := make([]multicall3.Multicall3Call3, len(orderIDs))
+	for i, orderID := range orderIDs {
+		data, err := parsed.Pack("orders", orderID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to pack orders: %v", err)
+		}
+		calls[i] = multicall3.Multicall3Call3{Target: asset.Swapper(), AllowFailure: true, CallData: data}
+	}
+	data, errs, err := multicall(ctx, evmClient, common.Address{}, calls, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	orders := make([]HTLCOrderStatus, len(orderIDs))
+	for i := range orders {
+		if errs[i] != nil {
+			continue
+		}
+		if err := parsed.UnpackIntoInterface(&orders[i], "orders", data[i]); err != nil {
+			errs[i] = fmt.Errorf("%w: failed to unpack order: %v", ErrBatchCallFailed, err)
+		}
+	}
+	return orders, errs, nil
+}
+
+// RedeemBatch redeems the orders in a single transaction through the Multicall3 contract. The redeems are simulated
+// first and only the ones which succeed are sent. It returns the receipt of the transaction, which is nil when no
+// redeem could be sent, and the error of each redeem.
+func (w *wallet) RedeemBatch(ctx context.Context, asset blockchain.EVMAsset, redeems []HTLCRedeem) (*types.Receipt, []error, error) {
+	parsed, err := gardenhtlc.GardenHTLCMetaData.GetAbi()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get abi: %v", err)
+	}
+	calls := make([]multicall3.Multicall3Call3, len(redeems))
+	for i, redeem := range redeems {
+		data, err := parsed.Pack("redeem", redeem.OrderID, redeem.Secret)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to pack redeem: %v", err)
+		}
+		calls[i] = multicall3.Multicall3Call3{Target: asset.Swapper(), AllowFailure: true, CallData: data}
+	}
+	return w.aggregate(ctx, asset, calls)
+}
+
+// RefundBatch refunds the expired orders in a single transaction through the Multicall3 contract. The refunds are
+// simulated first and only the ones which succeed are sent. It returns the receipt of the transaction, which is nil
+// when no refund could be sent, and the error of each refund.
+func (w *wallet) RefundBatch(ctx context.Context, asset blockchain.EVMAsset, orderIDs [][32]byte) (*types.Receipt, []error, error) {
+	parsed, err := gardenhtlc.GardenHTLCMetaData.GetAbi()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get abi: %v", err)
+	}
+	calls := make([]multicall3.Multicall3Call3, len(orderIDs))
+	for i, orderID := range orderIDs {
+		data, err := parsed.Pack("refund", orderID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to pack refund: %v", err)
+		}
+		calls[i] = multicall3.Multicall3Call3{Target: asset.Swapper(), AllowFailure: true, CallData: data}
+	}
+	return w.aggregate(ctx, asset, calls)
+}
+
+// aggregate sends the calls on the orders which succeed when simulated in a single Multicall3 transaction. The
+// results of the calls are not part of the receipt, they are decoded from the aggregate3 results of the transaction
+// replayed on the state of the parent block once it is mined.
+func (w *wallet) aggregate(ctx context.Context, asset blockchain.EVMAsset, calls []multicall3.Multicall3Call3) (*types.Receipt, []error, error) {
+	client, tops, err := w.transactor(ctx, asset.Chain())
+	if err != nil {
+		return nil, nil, err
+	}
+	chain := asset.Chain().(blockchain.EvmChain)
+
+	_, errs, err := multicall(ctx, client, w.Address(), calls, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sent []int
+	var batch []multicall3.Multicall3Call3
+	for i := range calls {
+		if errs[i] == nil {
+			sent = append(sent, i)
+			batch = append(batch, calls[i])
+		}
+	}
+	if len(batch) == 0 {
+		return nil, errs, nil
+	}
+
+	contract, err := multicall3.NewMulticall3(Multicall3Address, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := setGas(ctx, w.gasStrategy, client, chain, tops, Multicall3Address, multicall3.Multicall3MetaData, "aggregate3", batch); err != nil {
+		return nil, nil, err
+	}
+	tx, err := w.withNonce(ctx, client, chain, tops, func() (*types.Transaction, error) {
+		return contract.Aggregate3(tops, batch)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	receipt, err := w.waitMined(ctx, chain, tx)
+	if err != nil {
+		return receipt, nil, err
+	}
+
+	parent := new(big.Int).Sub(receipt.BlockNumber, big.NewInt(1))
+	_, results, err := multicall(ctx, client, w.Address(), batch, parent)
+	if err != nil {
+		return receipt, nil, fmt.Errorf("failed to read the results of the batch: %w", err)
+	}
+	for j, i := range sent {
+		errs[i] = results[j]
+	}
+	return receipt, errs, nil
+}
@@ -0,0 +1,125 @@
+package evm_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/catalogfi/blockchain/evm"
+)
+
+var _ = Describe("Multicall", func() {
+	var (
+		sim       *simulatedChain
+		initiator evm.HTLCWallet
+		redeemer  evm.HTLCWallet
+	)
+
+	BeforeEach(func(ctx context.Context) {
+		sim = newSimulatedChain(ctx, 2)
+		initiator = evm.NewHTLCWallet(sim.client, sim.keys[0], sim.walletOptions()...)
+		redeemer = evm.NewHTLCWallet(sim.client, sim.keys[1], sim.walletOptions()...)
+	})
+
+	initiate := func(ctx context.Context, secrets [][]byte, expiry int64) [][32]byte {
+		orderIDs := make([][32]byte, len(secrets))
+		for i, secret := range secrets {
+			secretHash := sha256.Sum256(secret)
+			_, err := initiator.Initiate(ctx, sim.asset, redeemer.Address(), secretHash, big.NewInt(expiry), big.NewInt(1e6), nil)
+			Expect(err).Should(BeNil())
+			orderIDs[i] = initiator.OrderID(secretHash)
+		}
+		return orderIDs
+	}
+
+	It("should read balances of many assets and owners", func(ctx context.Context) {
+		eth := blockchain.NewETH(sim.chain, common.Address{})
+		noToken := blockchain.NewERC20(sim.chain, common.HexToAddress("0x2000"), sim.htlc)
+		balances, errs, err := evm.Balances(ctx, sim.client, []evm.BalanceQuery{
+			{Asset: eth, Owner: initiator.Address()},
+			{Asset: sim.asset, Owner: initiator.Address()},
+			{Asset: eth, Owner: common.HexToAddress("0x3000")},
+			{Asset: noToken, Owner: initiator.Address()},
+		}, nil)
+		Expect(err).Should(BeNil())
+		Expect(errs[:3]).Should(Equal([]error{nil, nil, nil}))
+
+		balance, err := sim.client.Balance(ctx, eth, initiator.Address(), nil)
+		Expect(err).Should(BeNil())
+		Expect(balances[0]).Should(Equal(balance))
+		Expect(balances[1]).Should(Equal(big.NewInt(1)))
+		Expect(balances[2].Sign()).Should(BeZero())
+
+		By("Report the balances which could not be read")
+		Expect(balances[3]).Should(BeNil())
+		Expect(errs[3]).Should(MatchError(evm.ErrBatchCallFailed))
+	})
+
+	It("should read the orders of the HTLC", func(ctx context.Context) {
+		orderIDs := initiate(ctx, [][]byte{[]byte("secret 1"), []byte("secret 2")}, 100)
+		orders, errs, err := sim.client.HTLCOrders(ctx, sim.asset, append(orderIDs, [32]byte{1}))
+		Expect(err).Should(BeNil())
+		Expect(errs).Should(Equal([]error{nil, nil, nil}))
+		for _, order := range orders[:2] {
+			Expect(order.IsFulfilled).Should(BeFalse())
+			Expect(order.Initiator).Should(Equal(initiator.Address()))
+			Expect(order.Redeemer).Should(Equal(redeemer.Address()))
+			Expect(order.Timelock).Should(Equal(big.NewInt(100)))
+			Expect(order.Amount).Should(Equal(big.NewInt(1e6)))
+		}
+		Expect(orders[2].Initiator).Should(Equal(common.Address{}))
+	})
+
+	It("should redeem orders in a single transaction", func(ctx context.Context) {
+		secrets := [][]byte{[]byte("secret 1"), []byte("secret 2"), []byte("secret 3")}
+		orderIDs := initiate(ctx, secrets, 100)
+		receipt, errs, err := redeemer.RedeemBatch(ctx, sim.asset, []evm.HTLCRedeem{
+			{OrderID: orderIDs[0], Secret: secrets[0]},
+			{OrderID: orderIDs[1], Secret: []byte("wrong secret")},
+			{OrderID: orderIDs[2], Secret: secrets[2]},
+		})
+		Expect(err).Should(BeNil())
+		Expect(receipt.Status).Should(Equal(types.ReceiptStatusSuccessful))
+		Expect(errs[0]).Should(BeNil())
+		Expect(errs[1]).Should(MatchError(evm.ErrBatchCallFailed))
+		Expect(errs[2]).Should(BeNil())
+
+		orders, _, err := sim.client.HTLCOrders(ctx, sim.asset, orderIDs)
+		Expect(err).Should(BeNil())
+		Expect(orders[0].IsFulfilled).Should(BeTrue())
+		Expect(orders[1].IsFulfilled).Should(BeFalse())
+		Expect(orders[2].IsFulfilled).Should(BeTrue())
+
+		By("Send nothing when all the redeems fail")
+		receipt, errs, err = redeemer.RedeemBatch(ctx, sim.asset, []evm.HTLCRedeem{{OrderID: orderIDs[0], Secret: secrets[0]}})
+		Expect(err).Should(BeNil())
+		Expect(receipt).Should(BeNil())
+		Expect(errs[0]).Should(MatchError(evm.ErrBatchCallFailed))
+	})
+
+	It("should refund expired orders in a single transaction", func(ctx context.Context) {
+		orderIDs := initiate(ctx, [][]byte{[]byte("secret 1"), []byte("secret 2")}, 2)
+		orders, _, err := sim.client.HTLCOrders(ctx, sim.asset, orderIDs)
+		Expect(err).Should(BeNil())
+		expiry := new(big.Int).Add(orders[1].InitiatedAt, orders[1].Timelock).Uint64()
+		Eventually(func() (uint64, error) {
+			return sim.backend.Client().BlockNumber(ctx)
+		}).Should(BeNumerically(">", expiry))
+
+		receipt, errs, err := initiator.RefundBatch(ctx, sim.asset, orderIDs)
+		Expect(err).Should(BeNil())
+		Expect(receipt.Status).Should(Equal(types.ReceiptStatusSuccessful))
+		Expect(errs).Should(Equal([]error{nil, nil}))
+
+		orders, _, err = sim.client.HTLCOrders(ctx, sim.asset, orderIDs)
+		Expect(err).Should(BeNil())
+		Expect(orders[0].IsFulfilled).Should(BeTrue())
+		Expect(orders[1].IsFulfilled).Should(BeTrue())
+	})
+})
@@ -0,0 +1,378 @@
+package evm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	// DefaultHealthCheckInterval is the interval between two health checks of the RPC endpoints of a chain
+	DefaultHealthCheckInterval = 30 * time.Second
+
+	// DefaultMaxHeadLag is the number of blocks an RPC endpoint can lag behind the others before it stops being used
+	DefaultMaxHeadLag = 5
+
+	healthCheckTimeout = 5 * time.Second
+)
+
+var ErrNoHealthyEndpoint = errors.New("no healthy rpc endpoint")
+
+type endpoint struct {
+	url    string
+	client *ethclient.Client
+
+	chainVerified bool
+	healthy       bool
+	head          uint64
+	failures      int
+}
+
+// multiClient is a Backend using several RPC endpoints of the same chain. Reads are routed to the healthiest
+// endpoint and fail over to the next ones, writes are broadcast to all the endpoints. Endpoints are health checked
+// on their chain ID and head block, the ones lagging behind the others are not used.
+type multiClient struct {
+	mu        sync.Mutex
+	chain     blockchain.EvmChain
+	endpoints []*endpoint
+	checking  bool
+	checkedAt time.Time
+
+	interval   time.Duration
+	maxHeadLag uint64
+}
+
+func newMultiClient(ctx context.Context, chain blockchain.EvmChain, urls []string, interval time.Duration, maxHeadLag uint64) (*multiClient, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no rpc url for: %v", chain.Name())
+	}
+	if interval == 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	if maxHeadLag == 0 {
+		maxHeadLag = DefaultMaxHeadLag
+	}
+	client := &multiClient{
+		chain:      chain,
+		endpoints:  make([]*endpoint, len(urls)),
+		interval:   interval,
+		maxHeadLag: maxHeadLag,
+	}
+	for i, url := range urls {
+		ethClient, err := ethclient.Dial(url)
+		if err != nil {
+			return nil, err
+		}
+		client.endpoints[i] = &endpoint{url: url, client: ethClient}
+	}
+
+	errs := client.check(ctx)
+	for _, err := range errs {
+		if errors.Is(err, errChainIDMismatch) {
+			return nil, err
+		}
+	}
+	if len(errs) == len(urls) {
+		return nil, errs[0]
+	}
+	return client, nil
+}
+
+var errChainIDMismatch = errors.New("chain id mismatch")
+
+// check updates the health of the endpoints, it returns the errors of the unreachable or misconfigured endpoints.
+// The endpoints are probed without holding the lock, only their health is updated under it afterwards. An endpoint
+// which failed a request in the meantime stays unhealthy until the next check.
+func (c *multiClient) check(ctx context.Context) []error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	type probe struct {
+		chainVerified bool
+		failures      int
+		healthy       bool
+		head          uint64
+	}
+	c.mu.Lock()
+	probes := make([]probe, len(c.endpoints))
+	for i, e := range c.endpoints {
+		probes[i] = probe{chainVerified: e.chainVerified, failures: e.failures}
+	}
+	c.mu.Unlock()
+
+	errs := make([]error, len(probes))
+	wg := new(sync.WaitGroup)
+	for i := range probes {
+		wg.Add(1)
+		go func(e *endpoint, p *probe, err *error) {
+			defer wg.Done()
+			if !p.chainVerified {
+				chainID, chainErr := e.client.ChainID(ctx)
+				if chainErr != nil {
+					*err = chainErr
+					return
+				}
+				if chainID.Cmp(c.chain.ChainID()) != 0 {
+					*err = fmt.Errorf("invalid rpc url for: %v, %w %v != %v", c.chain.Name(), errChainIDMismatch, chainID, c.chain.ChainID())
+					return
+				}
+				p.chainVerified = true
+			}
+			head, headErr := e.client.BlockNumber(ctx)
+			if headErr != nil {
+				*err = headErr
+				return
+			}
+			p.head = head
+			p.healthy = true
+		}(c.endpoints[i], &probes[i], &errs[i])
+	}
+	wg.Wait()
+
+	maxHead := uint64(0)
+	for _, p := range probes {
+		if p.healthy && p.head > maxHead {
+			maxHead = p.head
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range probes {
+		e := c.endpoints[i]
+		e.chainVerified = p.chainVerified
+		if !p.healthy {
+			e.healthy = false
+			continue
+		}
+		e.head = p.head
+		if e.failures == p.failures {
+			e.healthy = p.head+c.maxHeadLag >= maxHead
+			e.failures = 0
+		}
+	}
+	c.checking = false
+	c.checkedAt = time.Now()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return failed
+}
+
+// route returns the endpoints to use, from the healthiest one. All the endpoints are returned when none of them is
+// healthy. The endpoints are health checked first when the last check is too old.
+func (c *multiClient) route(ctx context.Context) []*endpoint {
+	c.mu.Lock()
+	due := !c.checking && time.Since(c.checkedAt) >= c.interval
+	if due {
+		c.checking = true
+	}
+	c.mu.Unlock()
+	if due {
+		c.check(ctx)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	healthy := make([]*endpoint, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		if e.healthy {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		return append(healthy, c.endpoints...)
+	}
+	sort.SliceStable(healthy, func(i, j int) bool {
+		if healthy[i].head != healthy[j].head {
+			return healthy[i].head > healthy[j].head
+		}
+		return healthy[i].failures < healthy[j].failures
+	})
+	return healthy
+}
+
+// failed marks the endpoint unhealthy until the next health check
+func (c *multiClient) failed(e *endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.healthy = false
+	e.failures++
+}
+
+// shouldFailover returns true if the request failed because of the endpoint rather than the request itself
+func shouldFailover(ctx context.Context, err error) bool {
+	var rpcErr rpc.Error
+	return err != nil && ctx.Err() == nil && !errors.Is(err, ethereum.NotFound) && !errors.As(err, &rpcErr)
+}
+
+// read sends the request to the healthiest endpoint, failing over to the next ones
+func read[T any](ctx context.Context, c *multiClient, request func(*ethclient.Client) (T, error)) (T, error) {
+	var result T
+	err := ErrNoHealthyEndpoint
+	for _, e := range c.route(ctx) {
+		result, err = request(e.client)
+		if !shouldFailover(ctx, err) {
+			return result, err
+		}
+		c.failed(e)
+	}
+	return result, err
+}
+
+func (c *multiClient) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	return read(ctx, c, func(client *ethclient.Client) ([]byte, error) {
+		return client.CodeAt(ctx, contract, blockNumber)
+	})
+}
+
+func (c *multiClient) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	return read(ctx, c, func(client *ethclient.Client) ([]byte, error) {
+		return client.CallContract(ctx, call, blockNumber)
+	})
+}
+
+func (c *multiClient) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return read(ctx, c, func(client *ethclient.Client) (*types.Header, error) {
+		return client.HeaderByNumber(ctx, number)
+	})
+}
+
+func (c *multiClient) PendingCodeAt(ctx context.Context, account common.Address) ([]byte, error) {
+	return read(ctx, c, func(client *ethclient.Client) ([]byte, error) {
+		return client.PendingCodeAt(ctx, account)
+	})
+}
+
+func (c *multiClient) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return read(ctx, c, func(client *ethclient.Client) (uint64, error) {
+		return client.PendingNonceAt(ctx, account)
+	})
+}
+
+func (c *multiClient) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return read(ctx, c, func(client *ethclient.Client) (*big.Int, error) {
+		return client.SuggestGasPrice(ctx)
+	})
+}
+
+func (c *multiClient) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	return read(ctx, c, func(client *ethclient.Client) (*big.Int, error) {
+		return client.SuggestGasTipCap(ctx)
+	})
+}
+
+func (c *multiClient) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	return read(ctx, c, func(client *ethclient.Client) (uint64, error) {
+		return client.EstimateGas(ctx, call)
+	})
+}
+
+func (c *multiClient) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	return read(ctx, c, func(client *ethclient.Client) ([]types.Log, error) {
+		return client.FilterLogs(ctx, query)
+	})
+}
+
+func (c *multiClient) SubscribeFilterLogs(ctx context.Context, query ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	return read(ctx, c, func(client *ethclient.Client) (ethereum.Subscription, error) {
+		return client.SubscribeFilterLogs(ctx, query, ch)
+	})
+}
+
+func (c *multiClient) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	type result struct {
+		tx        *types.Transaction
+		isPending bool
+	}
+	r, err := read(ctx, c, func(client *ethclient.Client) (result, error) {
+		tx, isPending, err := client.TransactionByHash(ctx, hash)
+		return result{tx, isPending}, err
+	})
+	return r.tx, r.isPending, err
+}
+
+func (c *multiClient) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	return read(ctx, c, func(client *ethclient.Client) (*types.Receipt, error) {
+		return client.TransactionReceipt(ctx, hash)
+	})
+}
+
+func (c *multiClient) FeeHistory(ctx context.Context, blockCount uint64, lastBlock *big.Int, rewardPercentiles []float64) (*ethereum.FeeHistory, error) {
+	return read(ctx, c, func(client *ethclient.Client) (*ethereum.FeeHistory, error) {
+		return client.FeeHistory(ctx, blockCount, lastBlock, rewardPercentiles)
+	})
+}
+
+func (c *multiClient) ChainID(ctx context.Context) (*big.Int, error) {
+	return read(ctx, c, func(client *ethclient.Client) (*big.Int, error) {
+		return client.ChainID(ctx)
+	})
+}
+
+func (c *multiClient) BlockNumber(ctx context.Context) (uint64, error) {
+	return read(ctx, c, func(client *ethclient.Client) (uint64, error) {
+		return client.BlockNumber(ctx)
+	})
+}
+
+func (c *multiClient) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	return read(ctx, c, func(client *ethclient.Client) (*big.Int, error) {
+		return client.BalanceAt(ctx, account, blockNumber)
+	})
+}
+
+func (c *multiClient) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	return read(ctx, c, func(client *ethclient.Client) (uint64, error) {
+		return client.NonceAt(ctx, account, blockNumber)
+	})
+}
+
+// SendTransaction broadcasts the transaction to all the endpoints, it succeeds if any of them accepts it. The error
+// of the healthiest endpoint is returned when none does.
+func (c *multiClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	routed := c.route(ctx)
+	endpoints := append([]*endpoint{}, routed...)
+	for _, e := range c.endpoints {
+		if !slices.Contains(routed, e) {
+			endpoints = append(endpoints, e)
+		}
+	}
+
+	errs := make([]error, len(endpoints))
+	wg := new(sync.WaitGroup)
+	for i, e := range endpoints {
+		wg.Add(1)
+		go func(i int, e *endpoint) {
+			defer wg.Done()
+			errs[i] = e.client.SendTransaction(ctx, tx)
+		}(i, e)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err == nil {
+			return nil
+		}
+		if shouldFailover(ctx, err) && i < len(routed) {
+			c.failed(endpoints[i])
+		}
+	}
+	return errs[0]
+}
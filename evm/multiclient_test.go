@@ -0,0 +1,250 @@
+package evm_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/catalogfi/blockchain/evm"
+)
+
+var _ = Describe("Multi-RPC client", func() {
+	chain := blockchain.NewEvmChain(blockchain.EthereumLocalnet)
+	eth := blockchain.NewETH(chain, common.Address{})
+	owner := common.HexToAddress("0x70997970C51812dc3A010C7d01b50e0d17dc79C8")
+
+	var nodes []*rpcNode
+
+	BeforeEach(func() {
+		nodes = []*rpcNode{
+			newRPCNode(31337, 100, 1),
+			newRPCNode(31337, 102, 2),
+			newRPCNode(31337, 90, 3),
+		}
+		DeferCleanup(func() {
+			for _, node := range nodes {
+				node.Close()
+			}
+		})
+	})
+
+	newClient := func() evm.Client {
+		client, err := evm.NewClient(evm.Config{
+			RPC:  map[string]string{string(blockchain.EthereumLocalnet): nodes[0].URL},
+			RPCs: map[string][]string{string(blockchain.EthereumLocalnet): {nodes[1].URL, nodes[2].URL}},
+		})
+		Expect(err).Should(BeNil())
+		return client
+	}
+
+	It("should route reads to the healthiest node", func(ctx context.Context) {
+		client := newClient()
+		balance, err := client.Balance(ctx, eth, owner, nil)
+		Expect(err).Should(BeNil())
+		Expect(balance).Should(Equal(big.NewInt(2)))
+
+		By("Fail over when the node is down")
+		nodes[1].setDown(true)
+		balance, err = client.Balance(ctx, eth, owner, nil)
+		Expect(err).Should(BeNil())
+		Expect(balance).Should(Equal(big.NewInt(1)))
+		balance, err = client.Balance(ctx, eth, owner, nil)
+		Expect(err).Should(BeNil())
+		Expect(balance).Should(Equal(big.NewInt(1)))
+		Expect(nodes[1].count("eth_getBalance")).Should(Equal(2))
+
+		By("Never use the lagging node")
+		Expect(nodes[2].count("eth_getBalance")).Should(BeZero())
+	})
+
+	It("should keep the nodes failing during a health check unhealthy", func(ctx context.Context) {
+		client, err := evm.NewClient(evm.Config{
+			RPC:                 map[string]string{string(blockchain.EthereumLocalnet): nodes[0].URL},
+			RPCs:                map[string][]string{string(blockchain.EthereumLocalnet): {nodes[1].URL, nodes[2].URL}},
+			HealthCheckInterval: 100 * time.Millisecond,
+		})
+		Expect(err).Should(BeNil())
+		time.Sleep(100 * time.Millisecond)
+
+		By("Fail a read while the health check is probing the nodes")
+		nodes[0].setDelay("eth_blockNumber", 300*time.Millisecond)
+		checked := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(checked)
+			_, err := client.Balance(ctx, eth, owner, nil)
+			Expect(err).Should(BeNil())
+		}()
+		Eventually(func() int { return nodes[0].count("eth_blockNumber") }).Should(Equal(2))
+		nodes[1].setFailing("eth_getBalance")
+		balance, err := client.Balance(ctx, eth, owner, nil)
+		Expect(err).Should(BeNil())
+		Expect(balance).Should(Equal(big.NewInt(1)))
+		<-checked
+
+		By("Skip the failed node until the next health check")
+		balance, err = client.Balance(ctx, eth, owner, nil)
+		Expect(err).Should(BeNil())
+		Expect(balance).Should(Equal(big.NewInt(1)))
+		Expect(nodes[1].count("eth_getBalance")).Should(Equal(1))
+	})
+
+	It("should not fail over on node errors", func(ctx context.Context) {
+		client := newClient()
+		nodes[1].setRPCError(true)
+		_, err := client.Balance(ctx, eth, owner, nil)
+		Expect(err).Should(MatchError(ContainSubstring("execution reverted")))
+		Expect(nodes[0].count("eth_getBalance")).Should(BeZero())
+	})
+
+	It("should broadcast transactions to all the nodes", func(ctx context.Context) {
+		client := newClient()
+		evmClient, ok := client.EvmClient(chain)
+		Expect(ok).Should(BeTrue())
+		key, err := crypto.GenerateKey()
+		Expect(err).Should(BeNil())
+		tx, err := types.SignNewTx(key, types.LatestSignerForChainID(chain.ChainID()), &types.DynamicFeeTx{
+			ChainID:   chain.ChainID(),
+			GasTipCap: big.NewInt(1),
+			GasFeeCap: big.NewInt(1),
+			Gas:       21000,
+			To:        &owner,
+			Value:     big.NewInt(1),
+		})
+		Expect(err).Should(BeNil())
+
+		nodes[0].setDown(true)
+		Expect(evmClient.SendTransaction(ctx, tx)).Should(Succeed())
+		Expect(nodes[0].count("eth_sendRawTransaction")).Should(Equal(1))
+		Expect(nodes[1].count("eth_sendRawTransaction")).Should(Equal(1))
+		Expect(nodes[2].count("eth_sendRawTransaction")).Should(Equal(1))
+
+		By("Fail when no node accepts it")
+		for _, node := range nodes {
+			node.setDown(true)
+		}
+		Expect(evmClient.SendTransaction(ctx, tx)).ShouldNot(Succeed())
+	})
+
+	It("should reject nodes of other chains", func() {
+		nodes = append(nodes, newRPCNode(1, 100, 0))
+		_, err := evm.NewClient(evm.Config{
+			RPCs: map[string][]string{string(blockchain.EthereumLocalnet): {nodes[0].URL, nodes[3].URL}},
+		})
+		Expect(err).Should(MatchError(ContainSubstring("chain id mismatch")))
+
+		By("Fail when no node is reachable")
+		nodes[0].setDown(true)
+		_, err = evm.NewClient(evm.Config{
+			RPCs: map[string][]string{string(blockchain.EthereumLocalnet): {nodes[0].URL}},
+		})
+		Expect(err).ShouldNot(BeNil())
+	})
+})
+
+// rpcNode is a fake evm JSON-RPC node
+type rpcNode struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	chainID  int64
+	head     uint64
+	balance  int64
+	down     bool
+	rpcError bool
+	failing  string
+	delays   map[string]time.Duration
+	calls    map[string]int
+}
+
+func newRPCNode(chainID int64, head uint64, balance int64) *rpcNode {
+	node := &rpcNode{chainID: chainID, head: head, balance: balance, delays: map[string]time.Duration{}, calls: map[string]int{}}
+	node.Server = httptest.NewServer(http.HandlerFunc(node.serve))
+	return node
+}
+
+func (node *rpcNode) setDown(down bool) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.down = down
+}
+
+func (node *rpcNode) setRPCError(rpcError bool) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.rpcError = rpcError
+}
+
+// setFailing makes the node fail the requests of the method as if it was down
+func (node *rpcNode) setFailing(method string) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.failing = method
+}
+
+// setDelay delays the responses to the requests of the method
+func (node *rpcNode) setDelay(method string, delay time.Duration) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.delays[method] = delay
+}
+
+func (node *rpcNode) count(method string) int {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.calls[method]
+}
+
+func (node *rpcNode) serve(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	node.mu.Lock()
+	node.calls[req.Method]++
+	delay := node.delays[req.Method]
+	node.mu.Unlock()
+	time.Sleep(delay)
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.down || node.failing == req.Method {
+		http.Error(w, "node down", http.StatusServiceUnavailable)
+		return
+	}
+
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+	switch {
+	case node.rpcError:
+		resp["error"] = map[string]interface{}{"code": -32000, "message": "execution reverted"}
+	case req.Method == "eth_chainId":
+		resp["result"] = fmt.Sprintf("0x%x", node.chainID)
+	case req.Method == "eth_blockNumber":
+		resp["result"] = fmt.Sprintf("0x%x", node.head)
+	case req.Method == "eth_getBalance":
+		resp["result"] = fmt.Sprintf("0x%x", node.balance)
+	case req.Method == "eth_sendRawTransaction":
+		resp["result"] = common.Hash{}.Hex()
+	default:
+		resp["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,309 @@
+package evm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// NonceClient is the part of an evm node client used to sync the nonces of an account.
+type NonceClient interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+}
+
+// DefaultNonceSyncInterval is the interval after which the nonces of an account are synced with the chain while
+// some of its nonces are in flight
+const DefaultNonceSyncInterval = 30 * time.Second
+
+// DefaultNonceInFlightTimeout is the time after which a nonce in flight which is still not pending on the chain is
+// considered dropped and handed out again
+const DefaultNonceInFlightTimeout = 5 * time.Minute
+
+// NonceManager hands out the nonces of the accounts of a wallet, so transactions can be sent concurrently without
+// reusing a nonce. Accounts are keyed by chain and address.
+type NonceManager interface {
+	// Next reserves the next nonce of the account. The nonce must be released if the transaction is not sent.
+	Next(ctx context.Context, client NonceClient, chain blockchain.EvmChain, account common.Address) (uint64, error)
+
+	// Release gives back a reserved nonce which was not used, it is handed out again before any new nonce.
+	Release(ctx context.Context, chain blockchain.EvmChain, account common.Address, nonce uint64) error
+
+	// Resync resets the nonce of the account to the pending nonce on the chain, keeping the nonces still in flight.
+	// The nonces below them which are not pending on the chain are handed out again. It is used when the local nonce
+	// drifted from the chain, e.g. after a transaction was rejected because of its nonce.
+	Resync(ctx context.Context, client NonceClient, chain blockchain.EvmChain, account common.Address) error
+}
+
+// NonceStore persists the next nonce of the accounts of a NonceManager across restarts.
+type NonceStore interface {
+	// SaveNonce saves the next nonce of the account.
+	SaveNonce(ctx context.Context, chain blockchain.Name, account common.Address, nonce uint64) error
+	// ReadNonce reads the next nonce of the account, it returns false when the account has no saved nonce.
+	ReadNonce(ctx context.Context, chain blockchain.Name, account common.Address) (uint64, bool, error)
+}
+
+// NonceManagerOption configures the nonce manager returned by `NewNonceManager`.
+type NonceManagerOption func(*nonceManager)
+
+// WithNonceSyncInterval sets the interval after which the nonces of an account are synced with the chain while some
+// of its nonces are in flight. They are always synced once none is in flight.
+func WithNonceSyncInterval(interval time.Duration) NonceManagerOption {
+	return func(m *nonceManager) {
+		m.syncInterval = interval
+	}
+}
+
+// WithNonceInFlightTimeout sets the time after which a nonce in flight which is still not pending on the chain is
+// considered dropped, e.g. when its transaction never reached the node, and handed out again.
+func WithNonceInFlightTimeout(timeout time.Duration) NonceManagerOption {
+	return func(m *nonceManager) {
+		m.inFlightTimeout = timeout
+	}
+}
+
+type nonceKey struct {
+	chain   blockchain.Name
+	account common.Address
+}
+
+type accountNonce struct {
+	mu       sync.Mutex
+	loaded   bool
+	syncedAt time.Time
+	next     uint64
+	released []uint64
+	// inFlight are the nonces handed out which are not pending on the chain yet, with the time they were handed out
+	inFlight map[uint64]time.Time
+}
+
+type nonceManager struct {
+	mu              sync.Mutex
+	store           NonceStore
+	syncInterval    time.Duration
+	inFlightTimeout time.Duration
+	accounts        map[nonceKey]*accountNonce
+}
+
+// NewNonceManager returns a nonce manager persisting the nonces in the store. Nonces are only kept in memory when
+// the store is nil.
+func NewNonceManager(store NonceStore, opts ...NonceManagerOption) NonceManager {
+	m := &nonceManager{
+		store:           store,
+		syncInterval:    DefaultNonceSyncInterval,
+		inFlightTimeout: DefaultNonceInFlightTimeout,
+		accounts:        map[nonceKey]*accountNonce{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+func (m *nonceManager) account(chain blockchain.EvmChain, account common.Address) *accountNonce {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := nonceKey{chain: chain.Name(), account: account}
+	if _, ok := m.accounts[key]; !ok {
+		m.accounts[key] = &accountNonce{inFlight: map[uint64]time.Time{}}
+	}
+	return m.accounts[key]
+}
+
+func (m *nonceManager) Next(ctx context.Context, client NonceClient, chain blockchain.EvmChain, account common.Address) (uint64, error) {
+	state := m.account(chain, account)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	restored := false
+	if !state.loaded && m.store != nil {
+		nonce, ok, err := m.store.ReadNonce(ctx, chain.Name(), account)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read nonce: %w", err)
+		}
+		if ok {
+			state.next = nonce
+			restored = true
+		}
+	}
+
+	// The nonces are handed out locally while some are in flight, the chain is only checked once in a while
+	if !state.loaded || len(state.inFlight) == 0 || time.Since(state.syncedAt) >= m.syncInterval {
+		pending, err := client.PendingNonceAt(ctx, account)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get pending nonce: %w", err)
+		}
+		state.loaded = true
+		state.sync(pending, m.inFlightTimeout)
+
+		// Transactions were sent by someone else, skip their nonces
+		if pending > state.next {
+			state.next = pending
+		}
+		// Nothing is in flight but the chain is behind, the transactions of the gap were dropped. The saved nonce
+		// is kept after a restart as the transactions sent before may not have reached the node yet.
+		if pending < state.next && len(state.inFlight) == 0 && !restored {
+			state.next = pending
+			state.released = nil
+		}
+	}
+
+	// Fill the gaps left by the released nonces first
+	nonce := state.next
+	if len(state.released) > 0 {
+		nonce, state.released = state.released[0], state.released[1:]
+	} else {
+		state.next++
+	}
+	state.inFlight[nonce] = time.Now()
+	if err := m.save(ctx, chain, account, state); err != nil {
+		state.release(nonce)
+		return 0, err
+	}
+	return nonce, nil
+}
+
+func (m *nonceManager) Release(ctx context.Context, chain blockchain.EvmChain, account common.Address, nonce uint64) error {
+	state := m.account(chain, account)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if nonce >= state.next {
+		return nil
+	}
+	state.release(nonce)
+	return m.save(ctx, chain, account, state)
+}
+
+func (m *nonceManager) Resync(ctx context.Context, client NonceClient, chain blockchain.EvmChain, account common.Address) error {
+	state := m.account(chain, account)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	pending, err := client.PendingNonceAt(ctx, account)
+	if err != nil {
+		return fmt.Errorf("failed to get pending nonce: %w", err)
+	}
+	state.loaded = true
+	state.sync(pending, m.inFlightTimeout)
+
+	// Never move below the nonces still held by the other transactions
+	state.next = pending
+	for nonce := range state.inFlight {
+		if nonce >= state.next {
+			state.next = nonce + 1
+		}
+	}
+	state.released = nil
+	for nonce := pending; nonce < state.next; nonce++ {
+		if _, ok := state.inFlight[nonce]; !ok {
+			state.released = append(state.released, nonce)
+		}
+	}
+	return m.save(ctx, chain, account, state)
+}
+
+func (m *nonceManager) save(ctx context.Context, chain blockchain.EvmChain, account common.Address, state *accountNonce) error {
+	if m.store == nil {
+		return nil
+	}
+	if err := m.store.SaveNonce(ctx, chain.Name(), account, state.next); err != nil {
+		return fmt.Errorf("failed to save nonce: %w", err)
+	}
+	return nil
+}
+
+// sync drops the nonces in flight and the released nonces below the pending nonce on the chain. The nonces in flight
+// for longer than the timeout which are still not pending are released, their transactions were dropped.
+func (state *accountNonce) sync(pending uint64, timeout time.Duration) {
+	state.syncedAt = time.Now()
+	for nonce, reservedAt := range state.inFlight {
+		if nonce < pending {
+			delete(state.inFlight, nonce)
+		} else if time.Since(reservedAt) >= timeout {
+			state.release(nonce)
+		}
+	}
+	for len(state.released) > 0 && state.released[0] < pending {
+		state.released = state.released[1:]
+	}
+}
+
+// release adds the nonce to the released ones, moving the next nonce back when the released nonces are the last
+// ones handed out.
+func (state *accountNonce) release(nonce uint64) {
+	delete(state.inFlight, nonce)
+	i := sort.Search(len(state.released), func(i int) bool {
+		return state.released[i] >= nonce
+	})
+	if i < len(state.released) && state.released[i] == nonce {
+		return
+	}
+	state.released = append(state.released[:i], append([]uint64{nonce}, state.released[i:]...)...)
+	for len(state.released) > 0 && state.released[len(state.released)-1] == state.next-1 {
+		state.released = state.released[:len(state.released)-1]
+		state.next--
+	}
+}
+
+// isNonceError returns true if the node rejected the transaction because of its nonce
+func isNonceError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "nonce too low") ||
+		strings.Contains(msg, "nonce too high") ||
+		strings.Contains(msg, "replacement transaction underpriced")
+}
+
+// isRejected returns true if the node answered the request with an error, i.e. the transaction was not accepted
+func isRejected(err error) bool {
+	var rpcErr rpc.Error
+	return errors.As(err, &rpcErr) || isNonceError(err)
+}
+
+// nonceStore is a leveldb implementation of the NonceStore
+type nonceStore struct {
+	db *leveldb.DB
+}
+
+func NewNonceStore(db *leveldb.DB) NonceStore {
+	return &nonceStore{db: db}
+}
+
+func (s *nonceStore) nonceKey(chain blockchain.Name, account common.Address) []byte {
+	return []byte(fmt.Sprintf("evm_nonce_%v_%v", chain, account.Hex()))
+}
+
+func (s *nonceStore) SaveNonce(_ context.Context, chain blockchain.Name, account common.Address, nonce uint64) error {
+	data, err := json.Marshal(nonce)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(s.nonceKey(chain, account), data, nil)
+}
+
+func (s *nonceStore) ReadNonce(_ context.Context, chain blockchain.Name, account common.Address) (uint64, bool, error) {
+	data, err := s.db.Get(s.nonceKey(chain, account), nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	var nonce uint64
+	if err := json.Unmarshal(data, &nonce); err != nil {
+		return 0, false, err
+	}
+	return nonce, true, nil
+}
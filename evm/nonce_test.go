@@ -0,0 +1,210 @@
+package evm_test
+
+import (
+	"context"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/catalogfi/blockchain/evm"
+)
+
+var _ = Describe("Nonce manager", func() {
+	chain := blockchain.NewEvmChain(blockchain.EthereumLocalnet)
+	account := common.HexToAddress("0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266")
+
+	var (
+		client *nonceClient
+		store  evm.NonceStore
+	)
+
+	BeforeEach(func() {
+		db, err := leveldb.Open(storage.NewMemStorage(), nil)
+		Expect(err).Should(BeNil())
+		DeferCleanup(db.Close)
+		store = evm.NewNonceStore(db)
+		client = &nonceClient{pending: 5}
+	})
+
+	next := func(ctx context.Context, nonces evm.NonceManager) uint64 {
+		nonce, err := nonces.Next(ctx, client, chain, account)
+		Expect(err).Should(BeNil())
+		return nonce
+	}
+
+	It("should hand out unique nonces concurrently", func(ctx context.Context) {
+		nonces := evm.NewNonceManager(store)
+		handedOut := make([]uint64, 50)
+		wg := new(sync.WaitGroup)
+		for i := range handedOut {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				handedOut[i] = next(ctx, nonces)
+			}(i)
+		}
+		wg.Wait()
+		sort.Slice(handedOut, func(i, j int) bool { return handedOut[i] < handedOut[j] })
+		for i, nonce := range handedOut {
+			Expect(nonce).Should(Equal(uint64(5 + i)))
+		}
+		Expect(client.calls).Should(Equal(1))
+
+		By("Keep the accounts of other chains apart")
+		nonce, err := nonces.Next(ctx, client, blockchain.NewEvmChain(blockchain.ArbitrumLocalnet), account)
+		Expect(err).Should(BeNil())
+		Expect(nonce).Should(Equal(uint64(5)))
+	})
+
+	It("should hand out the released nonces first", func(ctx context.Context) {
+		nonces := evm.NewNonceManager(nil)
+		Expect(next(ctx, nonces)).Should(Equal(uint64(5)))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(6)))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(7)))
+		Expect(nonces.Release(ctx, chain, account, 6)).Should(Succeed())
+		Expect(next(ctx, nonces)).Should(Equal(uint64(6)))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(8)))
+
+		By("Move back when the last nonce is released")
+		Expect(nonces.Release(ctx, chain, account, 8)).Should(Succeed())
+		Expect(next(ctx, nonces)).Should(Equal(uint64(8)))
+	})
+
+	It("should resync from the chain", func(ctx context.Context) {
+		nonces := evm.NewNonceManager(nil)
+		Expect(next(ctx, nonces)).Should(Equal(uint64(5)))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(6)))
+		Expect(nonces.Release(ctx, chain, account, 5)).Should(Succeed())
+		Expect(nonces.Release(ctx, chain, account, 6)).Should(Succeed())
+
+		By("Skip the nonces used by someone else")
+		client.pending = 10
+		Expect(next(ctx, nonces)).Should(Equal(uint64(10)))
+
+		By("Move back to the chain nonce without reusing the nonces in flight")
+		client.pending = 8
+		Expect(nonces.Resync(ctx, client, chain, account)).Should(Succeed())
+		Expect(next(ctx, nonces)).Should(Equal(uint64(8)))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(9)))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(11)))
+	})
+
+	It("should refill the nonces of the dropped transactions", func(ctx context.Context) {
+		nonces := evm.NewNonceManager(nil, evm.WithNonceSyncInterval(0))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(5)))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(6)))
+
+		By("Keep the nonces in flight until they are pending on the chain")
+		Expect(next(ctx, nonces)).Should(Equal(uint64(7)))
+		client.pending = 8
+		Expect(nonces.Resync(ctx, client, chain, account)).Should(Succeed())
+
+		By("Hand out the nonces of the gap again")
+		client.pending = 6
+		Expect(next(ctx, nonces)).Should(Equal(uint64(6)))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(7)))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(8)))
+	})
+
+	It("should hand out the nonces of the transactions dropped before reaching the node", func(ctx context.Context) {
+		nonces := evm.NewNonceManager(nil, evm.WithNonceSyncInterval(0), evm.WithNonceInFlightTimeout(100*time.Millisecond))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(5)))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(6)))
+
+		By("Keep the nonces in flight until they time out")
+		client.pending = 6
+		Expect(next(ctx, nonces)).Should(Equal(uint64(7)))
+
+		By("Hand out the nonces which are still not pending again")
+		time.Sleep(150 * time.Millisecond)
+		Expect(next(ctx, nonces)).Should(Equal(uint64(6)))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(7)))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(8)))
+	})
+
+	It("should persist the nonces across restarts", func(ctx context.Context) {
+		nonces := evm.NewNonceManager(store)
+		Expect(next(ctx, nonces)).Should(Equal(uint64(5)))
+		Expect(next(ctx, nonces)).Should(Equal(uint64(6)))
+
+		// The transactions are not in the mempool of the node yet
+		nonces = evm.NewNonceManager(store)
+		Expect(next(ctx, nonces)).Should(Equal(uint64(7)))
+		saved, ok, err := store.ReadNonce(ctx, chain.Name(), account)
+		Expect(err).Should(BeNil())
+		Expect(ok).Should(BeTrue())
+		Expect(saved).Should(Equal(uint64(8)))
+	})
+
+	It("should only release the nonces of the transactions which were not sent", func(ctx context.Context) {
+		sim := newSimulatedChain(ctx, 2)
+		backend := &lossyBackend{Backend: sim.backend.Client()}
+		wallet := evm.NewWallet(evm.NewClientWithBackends(map[blockchain.EvmChain]evm.Backend{sim.chain: backend}), sim.keys[1], evm.WithNonceManager(evm.NewNonceManager(nil)))
+		eth := blockchain.NewETH(sim.chain, common.Address{})
+		to := crypto.PubkeyToAddress(sim.keys[0].PublicKey)
+
+		By("Keep the nonce when the node may have got the transaction")
+		backend.err = context.DeadlineExceeded
+		_, err := wallet.Send(ctx, eth, to, big.NewInt(1))
+		Expect(err).Should(MatchError(context.DeadlineExceeded))
+
+		By("Release the nonce when the node rejects the transaction")
+		backend.err = rejection("already known")
+		_, err = wallet.Send(ctx, eth, to, big.NewInt(1))
+		Expect(err).Should(MatchError(backend.err))
+
+		backend.err = nil
+		tx, err := wallet.Send(ctx, eth, to, big.NewInt(1))
+		Expect(err).Should(BeNil())
+		Expect(tx.Nonce()).Should(Equal(uint64(1)))
+	})
+})
+
+// nonceClient is a fake evm node with a fixed pending nonce
+type nonceClient struct {
+	mu      sync.Mutex
+	pending uint64
+	calls   int
+}
+
+func (client *nonceClient) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.calls++
+	return client.pending, nil
+}
+
+// lossyBackend is a backend dropping the transactions sent while err is set, as if they never reached the node
+type lossyBackend struct {
+	evm.Backend
+	err error
+}
+
+func (backend *lossyBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if backend.err != nil {
+		return backend.err
+	}
+	return backend.Backend.SendTransaction(ctx, tx)
+}
+
+// rejection is a json-rpc error returned by the node
+type rejection string
+
+func (err rejection) Error() string {
+	return string(err)
+}
+
+func (err rejection) ErrorCode() int {
+	return -32000
+}
@@ -0,0 +1,169 @@
+package evm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+)
+
+// OrderEncodingVersion is the version of the order encoding produced by `EncodeOrder` and `EncodeOrderJSON`.
+const OrderEncodingVersion uint8 = 1
+
+const orderChecksumSize = 4
+
+var (
+	ErrOrderChecksumMismatch = errors.New("order checksum mismatch")
+	ErrInvalidOrderEncoding  = errors.New("invalid order encoding")
+)
+
+// HTLCOrder has the parameters of an order of the GardenHTLC contract, which are needed to redeem or refund it.
+type HTLCOrder struct {
+	Chain      blockchain.Name
+	Swapper    common.Address
+	Initiator  common.Address
+	Redeemer   common.Address
+	SecretHash [32]byte
+	Expiry     *big.Int
+	Amount     *big.Int
+}
+
+// ID returns the id of the order in the GardenHTLC contract.
+func (order HTLCOrder) ID() [32]byte {
+	return sha256.Sum256(append(order.SecretHash[:], common.BytesToHash(order.Initiator.Bytes()).Bytes()...))
+}
+
+// EncodeOrder returns the canonical binary encoding of the order, which is
+//
+//	version || uint8(len(chain)) || chain || swapper || initiator || redeemer || secret hash ||
+//	uint256(expiry) || uint256(amount) || checksum
+//
+// where the checksum is the first 4 bytes of the double sha256 of the preceding bytes.
+func EncodeOrder(order HTLCOrder) ([]byte, error) {
+	if len(order.Chain) > math.MaxUint8 {
+		return nil, fmt.Errorf("chain name too long: %v", order.Chain)
+	}
+	if order.Expiry == nil || order.Amount == nil || order.Expiry.Sign() < 0 || order.Amount.Sign() < 0 ||
+		order.Expiry.BitLen() > 256 || order.Amount.BitLen() > 256 {
+		return nil, fmt.Errorf("invalid order expiry or amount")
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(OrderEncodingVersion)
+	buf.WriteByte(uint8(len(order.Chain)))
+	buf.WriteString(string(order.Chain))
+	buf.Write(order.Swapper.Bytes())
+	buf.Write(order.Initiator.Bytes())
+	buf.Write(order.Redeemer.Bytes())
+	buf.Write(order.SecretHash[:])
+	buf.Write(math.U256Bytes(new(big.Int).Set(order.Expiry)))
+	buf.Write(math.U256Bytes(new(big.Int).Set(order.Amount)))
+	buf.Write(orderChecksum(buf.Bytes()))
+	return buf.Bytes(), nil
+}
+
+// DecodeOrder decodes an order encoded with `EncodeOrder` after verifying its checksum.
+func DecodeOrder(data []byte) (HTLCOrder, error) {
+	if len(data) < 2+orderChecksumSize {
+		return HTLCOrder{}, ErrInvalidOrderEncoding
+	}
+	payload, checksum := data[:len(data)-orderChecksumSize], data[len(data)-orderChecksumSize:]
+	if !bytes.Equal(orderChecksum(payload), checksum) {
+		return HTLCOrder{}, ErrOrderChecksumMismatch
+	}
+	if payload[0] != OrderEncodingVersion {
+		return HTLCOrder{}, fmt.Errorf("unsupported order encoding version %d", payload[0])
+	}
+	chainLen := int(payload[1])
+	if len(payload) != 2+chainLen+3*common.AddressLength+32+2*32 {
+		return HTLCOrder{}, ErrInvalidOrderEncoding
+	}
+
+	payload = payload[2:]
+	next := func(n int) []byte {
+		field := payload[:n]
+		payload = payload[n:]
+		return field
+	}
+	order := HTLCOrder{Chain: blockchain.Name(next(chainLen))}
+	order.Swapper = common.BytesToAddress(next(common.AddressLength))
+	order.Initiator = common.BytesToAddress(next(common.AddressLength))
+	order.Redeemer = common.BytesToAddress(next(common.AddressLength))
+	copy(order.SecretHash[:], next(32))
+	order.Expiry = new(big.Int).SetBytes(next(32))
+	order.Amount = new(big.Int).SetBytes(next(32))
+	return order, nil
+}
+
+// orderJSON is the JSON encoding of an order, the checksum is the one of its binary encoding.
+type orderJSON struct {
+	Version    uint8           `json:"version"`
+	Chain      blockchain.Name `json:"chain"`
+	Swapper    common.Address  `json:"swapper"`
+	Initiator  common.Address  `json:"initiator"`
+	Redeemer   common.Address  `json:"redeemer"`
+	SecretHash common.Hash     `json:"secret_hash"`
+	Expiry     *hexutil.Big    `json:"expiry"`
+	Amount     *hexutil.Big    `json:"amount"`
+	Checksum   hexutil.Bytes   `json:"checksum"`
+}
+
+// EncodeOrderJSON returns the JSON encoding of the order, with the same version and checksum as `EncodeOrder`.
+func EncodeOrderJSON(order HTLCOrder) ([]byte, error) {
+	encoded, err := EncodeOrder(order)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(orderJSON{
+		Version:    OrderEncodingVersion,
+		Chain:      order.Chain,
+		Swapper:    order.Swapper,
+		Initiator:  order.Initiator,
+		Redeemer:   order.Redeemer,
+		SecretHash: order.SecretHash,
+		Expiry:     (*hexutil.Big)(order.Expiry),
+		Amount:     (*hexutil.Big)(order.Amount),
+		Checksum:   encoded[len(encoded)-orderChecksumSize:],
+	})
+}
+
+// DecodeOrderJSON decodes an order encoded with `EncodeOrderJSON` after verifying its checksum.
+func DecodeOrderJSON(data []byte) (HTLCOrder, error) {
+	var encoded orderJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return HTLCOrder{}, fmt.Errorf("%w: %v", ErrInvalidOrderEncoding, err)
+	}
+	if encoded.Version != OrderEncodingVersion {
+		return HTLCOrder{}, fmt.Errorf("unsupported order encoding version %d", encoded.Version)
+	}
+	order := HTLCOrder{
+		Chain:      encoded.Chain,
+		Swapper:    encoded.Swapper,
+		Initiator:  encoded.Initiator,
+		Redeemer:   encoded.Redeemer,
+		SecretHash: encoded.SecretHash,
+		Expiry:     (*big.Int)(encoded.Expiry),
+		Amount:     (*big.Int)(encoded.Amount),
+	}
+	binaryEncoded, err := EncodeOrder(order)
+	if err != nil {
+		return HTLCOrder{}, err
+	}
+	if !bytes.Equal(binaryEncoded[len(binaryEncoded)-orderChecksumSize:], encoded.Checksum) {
+		return HTLCOrder{}, ErrOrderChecksumMismatch
+	}
+	return order, nil
+}
+
+func orderChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:orderChecksumSize]
+}
@@ -0,0 +1,75 @@
+package evm_test
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/catalogfi/blockchain/evm"
+)
+
+var _ = Describe("HTLC order", func() {
+	var order evm.HTLCOrder
+
+	BeforeEach(func() {
+		order = evm.HTLCOrder{
+			Chain:      blockchain.ArbitrumLocalnet,
+			Swapper:    common.HexToAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3"),
+			Initiator:  common.HexToAddress("0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"),
+			Redeemer:   common.HexToAddress("0x70997970C51812dc3A010C7d01b50e0d17dc79C8"),
+			SecretHash: sha256.Sum256([]byte("secret")),
+			Expiry:     big.NewInt(7200),
+			Amount:     new(big.Int).Lsh(big.NewInt(1), 200),
+		}
+	})
+
+	It("should encode and decode an order", func() {
+		encoded, err := evm.EncodeOrder(order)
+		Expect(err).Should(BeNil())
+		Expect(encoded[0]).Should(Equal(evm.OrderEncodingVersion))
+		decoded, err := evm.DecodeOrder(encoded)
+		Expect(err).Should(BeNil())
+		Expect(decoded).Should(Equal(order))
+
+		By("Reject a corrupted encoding")
+		encoded[10] ^= 1
+		_, err = evm.DecodeOrder(encoded)
+		Expect(err).Should(Equal(evm.ErrOrderChecksumMismatch))
+
+		By("Reject negative amounts")
+		order.Amount = big.NewInt(-1)
+		_, err = evm.EncodeOrder(order)
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("should encode and decode an order in JSON", func() {
+		encoded, err := evm.EncodeOrderJSON(order)
+		Expect(err).Should(BeNil())
+		decoded, err := evm.DecodeOrderJSON(encoded)
+		Expect(err).Should(BeNil())
+		Expect(decoded).Should(Equal(order))
+
+		By("Reject a tampered field")
+		fields := map[string]interface{}{}
+		Expect(json.Unmarshal(encoded, &fields)).Should(Succeed())
+		fields["redeemer"] = order.Initiator.Hex()
+		tampered, err := json.Marshal(fields)
+		Expect(err).Should(BeNil())
+		_, err = evm.DecodeOrderJSON(tampered)
+		Expect(err).Should(Equal(evm.ErrOrderChecksumMismatch))
+	})
+
+	It("should have the same id as the wallet", func() {
+		key, err := crypto.GenerateKey()
+		Expect(err).Should(BeNil())
+		wallet := evm.NewHTLCWallet(nil, key)
+		order.Initiator = wallet.Address()
+		Expect(order.ID()).Should(Equal(wallet.OrderID(order.SecretHash)))
+	})
+})
@@ -0,0 +1,206 @@
+package evm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/catalogfi/blockchain/evm/bindings/contracts/htlc/gardenhtlc"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var (
+	ErrReverted      = errors.New("execution reverted")
+	ErrContractPanic = errors.New("contract panicked")
+	ErrTxReverted    = errors.New("transaction reverted")
+
+	ErrOrderNotInitiated        = errors.New("order not initiated")
+	ErrOrderFulfilled           = errors.New("order already fulfilled")
+	ErrOrderNotExpired          = errors.New("order not expired")
+	ErrDuplicateOrder           = errors.New("duplicate order")
+	ErrInvalidOrder             = errors.New("invalid order")
+	ErrInvalidSecret            = errors.New("invalid secret")
+	ErrInvalidRedeemerSignature = errors.New("invalid redeemer signature")
+	ErrInvalidSignature         = errors.New("invalid signature")
+	ErrTokenTransferFailed      = errors.New("token transfer failed")
+)
+
+// revertReasons maps the revert reasons of the GardenHTLC contract, and the libraries it uses, to typed errors
+var revertReasons = map[string]error{
+	"HTLC: order not initiated":         ErrOrderNotInitiated,
+	"HTLC: order fulfilled":             ErrOrderFulfilled,
+	"HTLC: order not expired":           ErrOrderNotExpired,
+	"HTLC: duplicate order":             ErrDuplicateOrder,
+	"HTLC: zero address redeemer":       ErrInvalidOrder,
+	"HTLC: zero timelock":               ErrInvalidOrder,
+	"HTLC: zero amount":                 ErrInvalidOrder,
+	"HTLC: same initiator and redeemer": ErrInvalidOrder,
+	"HTLC: incorrect secret":            ErrInvalidSecret,
+	"HTLC: invalid redeemer signature":  ErrInvalidRedeemerSignature,
+}
+
+// revertReasonPrefixes maps the prefixes of revert reasons to typed errors, for the reasons with variable parts
+var revertReasonPrefixes = map[string]error{
+	"ECDSA: ":     ErrInvalidSignature,
+	"SafeERC20: ": ErrTokenTransferFailed,
+	"ERC20: ":     ErrTokenTransferFailed,
+}
+
+// panicReasons are the descriptions of the Solidity panic codes
+var panicReasons = map[uint64]string{
+	0x00: "generic panic",
+	0x01: "assert failed",
+	0x11: "arithmetic overflow or underflow",
+	0x12: "division or modulo by zero",
+	0x21: "invalid enum value",
+	0x22: "invalid storage byte array encoding",
+	0x31: "pop on an empty array",
+	0x32: "array index out of bounds",
+	0x41: "out of memory",
+	0x51: "call to an uninitialized function",
+}
+
+var (
+	errorSelector = []byte{0x08, 0xc3, 0x79, 0xa0}
+	panicSelector = []byte{0x4e, 0x48, 0x7b, 0x71}
+)
+
+// RevertError is the error of a reverted call or transaction. It unwraps to ErrReverted, and to the typed error of
+// the revert reason when it is known, e.g. ErrOrderFulfilled.
+type RevertError struct {
+	// Reason is the decoded revert reason, which is the message of an `Error(string)`, the description of a
+	// `Panic(uint256)` or the signature of a custom error with its arguments.
+	Reason string
+
+	// Data is the raw revert data
+	Data []byte
+
+	err error
+}
+
+func (e *RevertError) Error() string {
+	if e.Reason == "" {
+		return ErrReverted.Error()
+	}
+	return fmt.Sprintf("%v: %v", ErrReverted, e.Reason)
+}
+
+func (e *RevertError) Unwrap() []error {
+	if e.err == nil {
+		return []error{ErrReverted}
+	}
+	return []error{ErrReverted, e.err}
+}
+
+// DecodeRevert decodes the revert data of a call into a RevertError. `Error(string)` and `Panic(uint256)` are
+// decoded, as well as the custom errors of the GardenHTLC contract and the given ABIs.
+func DecodeRevert(data []byte, abis ...*abi.ABI) *RevertError {
+	revertErr := &RevertError{Data: data}
+	switch {
+	case len(data) < 4:
+	case bytes.Equal(data[:4], errorSelector):
+		reason, err := abi.UnpackRevert(data)
+		if err != nil {
+			break
+		}
+		revertErr.Reason = reason
+		revertErr.err = revertReasons[reason]
+		for prefix, err := range revertReasonPrefixes {
+			if strings.HasPrefix(reason, prefix) {
+				revertErr.err = err
+			}
+		}
+	case bytes.Equal(data[:4], panicSelector):
+		code := new(big.Int).SetBytes(data[4:])
+		reason, ok := panicReasons[code.Uint64()]
+		if !ok || !code.IsUint64() {
+			reason = fmt.Sprintf("unknown panic code %#x", code)
+		}
+		revertErr.Reason = "panic: " + reason
+		revertErr.err = ErrContractPanic
+	default:
+		if parsed, err := gardenhtlc.GardenHTLCMetaData.GetAbi(); err == nil {
+			abis = append(abis, parsed)
+		}
+		for _, parsed := range abis {
+			for _, customErr := range parsed.Errors {
+				if !bytes.Equal(data[:4], customErr.ID[:4]) {
+					continue
+				}
+				args, err := customErr.Inputs.Unpack(data[4:])
+				if err != nil {
+					continue
+				}
+				values := make([]string, len(args))
+				for i, arg := range args {
+					values[i] = fmt.Sprint(arg)
+				}
+				revertErr.Reason = fmt.Sprintf("%v(%v)", customErr.Name, strings.Join(values, ", "))
+				return revertErr
+			}
+		}
+	}
+	return revertErr
+}
+
+// revertError returns the decoded RevertError of a failed call, or the error itself when it is not a revert
+func revertError(err error) error {
+	var dataErr rpc.DataError
+	if !errors.As(err, &dataErr) {
+		return err
+	}
+	var data []byte
+	switch errData := dataErr.ErrorData().(type) {
+	case string:
+		decoded, decodeErr := hexutil.Decode(errData)
+		if decodeErr != nil {
+			return err
+		}
+		data = decoded
+	case []byte:
+		data = errData
+	default:
+		return err
+	}
+	return DecodeRevert(data)
+}
+
+// simulate runs the call with eth_call, it returns a RevertError when the call reverts.
+func simulate(ctx context.Context, client ethereum.ContractCaller, msg ethereum.CallMsg, blockNumber *big.Int) error {
+	if _, err := client.CallContract(ctx, msg, blockNumber); err != nil {
+		return revertError(err)
+	}
+	return nil
+}
+
+// checkReceipt returns an error wrapping ErrTxReverted when the transaction of the receipt failed. The reason of the
+// failure is found by replaying the transaction on the state of the block it was mined in.
+func checkReceipt(ctx context.Context, client Backend, from common.Address, receipt *types.Receipt) error {
+	if receipt.Status == types.ReceiptStatusSuccessful {
+		return nil
+	}
+	tx, _, err := client.TransactionByHash(ctx, receipt.TxHash)
+	if err != nil {
+		return fmt.Errorf("%w %v, failed to get transaction: %v", ErrTxReverted, receipt.TxHash, err)
+	}
+	err = simulate(ctx, client, ethereum.CallMsg{
+		From:  from,
+		To:    tx.To(),
+		Gas:   tx.Gas(),
+		Value: tx.Value(),
+		Data:  tx.Data(),
+	}, receipt.BlockNumber)
+	var revertErr *RevertError
+	if !errors.As(err, &revertErr) {
+		return fmt.Errorf("%w %v", ErrTxReverted, receipt.TxHash)
+	}
+	return fmt.Errorf("%w %v: %w", ErrTxReverted, receipt.TxHash, revertErr)
+}
@@ -0,0 +1,124 @@
+package evm_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/crypto"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/catalogfi/blockchain/evm"
+)
+
+var _ = Describe("Revert errors", func() {
+	revertData := func(signature string, types []string, args ...interface{}) []byte {
+		arguments := abi.Arguments{}
+		for _, t := range types {
+			abiType, err := abi.NewType(t, "", nil)
+			Expect(err).Should(BeNil())
+			arguments = append(arguments, abi.Argument{Type: abiType})
+		}
+		data, err := arguments.Pack(args...)
+		Expect(err).Should(BeNil())
+		return append(crypto.Keccak256([]byte(signature))[:4], data...)
+	}
+
+	It("should decode the revert reasons", func() {
+		err := evm.DecodeRevert(revertData("Error(string)", []string{"string"}, "HTLC: order fulfilled"))
+		Expect(err.Reason).Should(Equal("HTLC: order fulfilled"))
+		Expect(err).Should(MatchError(evm.ErrOrderFulfilled))
+		Expect(err).Should(MatchError(evm.ErrReverted))
+
+		err = evm.DecodeRevert(revertData("Error(string)", []string{"string"}, "SafeERC20: ERC20 operation did not succeed"))
+		Expect(err).Should(MatchError(evm.ErrTokenTransferFailed))
+
+		By("Decode panics")
+		err = evm.DecodeRevert(revertData("Panic(uint256)", []string{"uint256"}, big.NewInt(0x11)))
+		Expect(err.Reason).Should(Equal("panic: arithmetic overflow or underflow"))
+		Expect(err).Should(MatchError(evm.ErrContractPanic))
+
+		By("Decode custom errors")
+		err = evm.DecodeRevert(revertData("StringTooLong(string)", []string{"string"}, "name"))
+		Expect(err.Reason).Should(Equal("StringTooLong(name)"))
+		Expect(err).Should(MatchError(evm.ErrReverted))
+
+		By("Keep the unknown revert data")
+		data := revertData("Unknown()", nil)
+		err = evm.DecodeRevert(data)
+		Expect(err.Reason).Should(BeEmpty())
+		Expect(err.Data).Should(Equal(data))
+		Expect(err).Should(MatchError(evm.ErrReverted))
+	})
+
+	Context("on a simulated backend", func() {
+		var (
+			sim        *simulatedChain
+			initiator  evm.HTLCWallet
+			redeemer   evm.HTLCWallet
+			secret     []byte
+			secretHash [32]byte
+		)
+
+		BeforeEach(func(ctx context.Context) {
+			sim = newSimulatedChain(ctx, 2)
+			initiator = evm.NewHTLCWallet(sim.client, sim.keys[0], sim.walletOptions()...)
+			redeemer = evm.NewHTLCWallet(sim.client, sim.keys[1], sim.walletOptions()...)
+			secret = []byte("secret")
+			secretHash = sha256.Sum256(secret)
+			_, err := initiator.Initiate(ctx, sim.asset, redeemer.Address(), secretHash, big.NewInt(100), big.NewInt(1e6), nil)
+			Expect(err).Should(BeNil())
+		})
+
+		It("should fail before sending reverting transactions", func(ctx context.Context) {
+			orderID := initiator.OrderID(secretHash)
+			_, err := initiator.Initiate(ctx, sim.asset, redeemer.Address(), secretHash, big.NewInt(100), big.NewInt(1e6), nil)
+			Expect(err).Should(MatchError(evm.ErrDuplicateOrder))
+			_, err = initiator.Refund(ctx, sim.asset, orderID, nil)
+			Expect(err).Should(MatchError(evm.ErrOrderNotExpired))
+			_, err = redeemer.Redeem(ctx, sim.asset, orderID, []byte("wrong secret"))
+			Expect(err).Should(MatchError(evm.ErrInvalidSecret))
+			_, err = redeemer.Redeem(ctx, sim.asset, [32]byte{1}, secret)
+			Expect(err).Should(MatchError(evm.ErrOrderNotInitiated))
+
+			_, err = redeemer.Redeem(ctx, sim.asset, orderID, secret)
+			Expect(err).Should(BeNil())
+			_, err = redeemer.Redeem(ctx, sim.asset, orderID, secret)
+			Expect(err).Should(MatchError(evm.ErrOrderFulfilled))
+		})
+
+		It("should report the reason of mined transactions which reverted", func(ctx context.Context) {
+			orderID := initiator.OrderID(secretHash)
+			sim.paused.Store(true)
+			errs := make(chan error, 2)
+			for _, wallet := range []evm.HTLCWallet{initiator, redeemer} {
+				nonce, err := sim.backend.Client().PendingNonceAt(ctx, wallet.Address())
+				Expect(err).Should(BeNil())
+				go func(wallet evm.HTLCWallet) {
+					_, err := wallet.Redeem(ctx, sim.asset, orderID, secret)
+					errs <- err
+				}(wallet)
+				Eventually(func() (uint64, error) {
+					return sim.backend.Client().PendingNonceAt(ctx, wallet.Address())
+				}).Should(Equal(nonce + 1))
+			}
+			sim.paused.Store(false)
+
+			var failed []error
+			for i := 0; i < 2; i++ {
+				if err := <-errs; err != nil {
+					failed = append(failed, err)
+				}
+			}
+			Expect(failed).Should(HaveLen(1))
+			Expect(failed[0]).Should(MatchError(evm.ErrTxReverted))
+			Expect(failed[0]).Should(MatchError(evm.ErrOrderFulfilled))
+			var revertErr *evm.RevertError
+			Expect(errors.As(failed[0], &revertErr)).Should(BeTrue())
+			Expect(revertErr.Reason).Should(Equal("HTLC: order fulfilled"))
+		})
+	})
+})
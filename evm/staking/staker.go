@@ -0,0 +1,267 @@
+package staking
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/catalogfi/blockchain/evm"
+	"github.com/catalogfi/blockchain/evm/bindings/contracts/stake/gardenstaker"
+	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/token/ERC20/erc20"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Staker sends the transactions of a filler, or of a delegate, to a GardenStaker contract. The calls are validated
+// against the state and the constants of the staker before they are sent, and the SEED of the stakes is approved
+// when the allowance of the staker is too low.
+type Staker interface {
+	Client
+
+	// Register registers the wallet as a filler, staking FillerStake SEED.
+	Register(ctx context.Context) (*types.Receipt, error)
+
+	// Deregister deregisters the filler of the wallet, its stake can be refunded after the filler cooldown.
+	Deregister(ctx context.Context) (*types.Receipt, error)
+
+	// Refund refunds the stake of the deregistered filler once its cooldown is over.
+	Refund(ctx context.Context, filler common.Address) (*types.Receipt, error)
+
+	// UpdateFee updates the fee of the filler of the wallet, in basis points.
+	UpdateFee(ctx context.Context, feeInBips uint16) (*types.Receipt, error)
+
+	// Vote stakes units of DelegateStake SEED for lockBlocks blocks, voting for the filler. It returns the ID of the
+	// new stake.
+	Vote(ctx context.Context, filler common.Address, units, lockBlocks *big.Int) ([32]byte, *types.Receipt, error)
+
+	// ChangeVote moves the votes of the unexpired stake to another filler.
+	ChangeVote(ctx context.Context, stakeID [32]byte, newFiller common.Address) (*types.Receipt, error)
+
+	// Extend extends the lock of the unexpired stake by lockBlocks blocks.
+	Extend(ctx context.Context, stakeID [32]byte, lockBlocks *big.Int) (*types.Receipt, error)
+
+	// Renew locks the expired stake again for lockBlocks blocks.
+	Renew(ctx context.Context, stakeID [32]byte, lockBlocks *big.Int) (*types.Receipt, error)
+
+	// RefundStake refunds the SEED of the expired stake.
+	RefundStake(ctx context.Context, stakeID [32]byte) (*types.Receipt, error)
+}
+
+type staker struct {
+	*client
+	wallet evm.Wallet
+}
+
+// NewStaker returns a staker sending the transactions of the wallet to the GardenStaker contract at the address.
+func NewStaker(wallet evm.Wallet, chain blockchain.EvmChain, address common.Address, opts ...ClientOption) Staker {
+	return &staker{client: newClient(wallet, chain, address, opts...), wallet: wallet}
+}
+
+func (s *staker) Register(ctx context.Context) (*types.Receipt, error) {
+	params, err := s.Params(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filler, err := s.Filler(ctx, s.wallet.Address())
+	if err != nil {
+		return nil, err
+	}
+	if filler.Registered {
+		return nil, ErrFillerRegistered
+	}
+	if err := s.approve(ctx, params, params.FillerStake); err != nil {
+		return nil, err
+	}
+	return s.transact(ctx, "register")
+}
+
+func (s *staker) Deregister(ctx context.Context) (*types.Receipt, error) {
+	if err := s.isFiller(ctx, s.wallet.Address()); err != nil {
+		return nil, err
+	}
+	return s.transact(ctx, "deregister")
+}
+
+func (s *staker) Refund(ctx context.Context, filler common.Address) (*types.Receipt, error) {
+	cooldown, err := s.FillerCooldown(ctx, filler)
+	if err != nil {
+		return nil, err
+	}
+	if cooldown > 0 {
+		return nil, fmt.Errorf("%w: %v blocks left", ErrFillerCooldown, cooldown)
+	}
+	return s.transact(ctx, "refund0", filler)
+}
+
+func (s *staker) UpdateFee(ctx context.Context, feeInBips uint16) (*types.Receipt, error) {
+	params, err := s.Params(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if feeInBips > params.MaxFeeInBips {
+		return nil, fmt.Errorf("%w: %v bips", ErrInvalidFee, feeInBips)
+	}
+	if err := s.isFiller(ctx, s.wallet.Address()); err != nil {
+		return nil, err
+	}
+	return s.transact(ctx, "updateFee", feeInBips)
+}
+
+func (s *staker) Vote(ctx context.Context, filler common.Address, units, lockBlocks *big.Int) ([32]byte, *types.Receipt, error) {
+	if units == nil || units.Sign() <= 0 {
+		return [32]byte{}, nil, ErrZeroUnits
+	}
+	params, err := s.Params(ctx)
+	if err != nil {
+		return [32]byte{}, nil, err
+	}
+	if _, err := params.VoteMultiplier(lockBlocks); err != nil {
+		return [32]byte{}, nil, err
+	}
+	if err := s.isFiller(ctx, filler); err != nil {
+		return [32]byte{}, nil, err
+	}
+	if err := s.approve(ctx, params, new(big.Int).Mul(units, params.DelegateStake)); err != nil {
+		return [32]byte{}, nil, err
+	}
+	receipt, err := s.transact(ctx, "vote", filler, units, lockBlocks)
+	if err != nil {
+		return [32]byte{}, receipt, err
+	}
+	stakeID, err := s.stakeID(receipt)
+	return stakeID, receipt, err
+}
+
+func (s *staker) ChangeVote(ctx context.Context, stakeID [32]byte, newFiller common.Address) (*types.Receipt, error) {
+	if _, err := s.ownedStake(ctx, stakeID, false); err != nil {
+		return nil, err
+	}
+	if err := s.isFiller(ctx, newFiller); err != nil {
+		return nil, err
+	}
+	return s.transact(ctx, "changeVote", stakeID, newFiller)
+}
+
+func (s *staker) Extend(ctx context.Context, stakeID [32]byte, lockBlocks *big.Int) (*types.Receipt, error) {
+	if err := s.validLock(ctx, lockBlocks); err != nil {
+		return nil, err
+	}
+	stake, err := s.ownedStake(ctx, stakeID, false)
+	if err != nil {
+		return nil, err
+	}
+	if stake.Permanent() {
+		return nil, ErrStakePermanent
+	}
+	return s.transact(ctx, "extend", stakeID, lockBlocks)
+}
+
+func (s *staker) Renew(ctx context.Context, stakeID [32]byte, lockBlocks *big.Int) (*types.Receipt, error) {
+	if err := s.validLock(ctx, lockBlocks); err != nil {
+		return nil, err
+	}
+	if _, err := s.ownedStake(ctx, stakeID, true); err != nil {
+		return nil, err
+	}
+	return s.transact(ctx, "renew", stakeID, lockBlocks)
+}
+
+func (s *staker) RefundStake(ctx context.Context, stakeID [32]byte) (*types.Receipt, error) {
+	if _, err := s.ownedStake(ctx, stakeID, true); err != nil {
+		return nil, err
+	}
+	return s.transact(ctx, "refund", stakeID)
+}
+
+func (s *staker) transact(ctx context.Context, method string, args ...interface{}) (*types.Receipt, error) {
+	return s.wallet.Transact(ctx, s.chain, s.address, gardenstaker.GardenStakerMetaData, method, args...)
+}
+
+// validLock returns ErrInvalidLockBlocks when the lock duration is not one of the staker
+func (s *staker) validLock(ctx context.Context, lockBlocks *big.Int) error {
+	params, err := s.Params(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = params.VoteMultiplier(lockBlocks)
+	return err
+}
+
+// isFiller returns ErrNotFiller when the filler is not registered
+func (s *staker) isFiller(ctx context.Context, filler common.Address) error {
+	info, err := s.Filler(ctx, filler)
+	if err != nil {
+		return err
+	}
+	if !info.Registered {
+		return fmt.Errorf("%w: %v", ErrNotFiller, filler)
+	}
+	return nil
+}
+
+// ownedStake returns the stake when it is owned by the wallet, and expired or not in the next block as requested
+func (s *staker) ownedStake(ctx context.Context, stakeID [32]byte, expired bool) (Stake, error) {
+	stake, err := s.Stake(ctx, stakeID)
+	if err != nil {
+		return Stake{}, err
+	}
+	if stake.Owner != s.wallet.Address() {
+		return Stake{}, ErrNotStakeOwner
+	}
+	next, err := s.nextBlock(ctx)
+	if err != nil {
+		return Stake{}, err
+	}
+	switch {
+	case expired && !stake.Expired(next):
+		return Stake{}, ErrStakeNotExpired
+	case !expired && stake.Expired(next):
+		return Stake{}, ErrStakeExpired
+	}
+	return stake, nil
+}
+
+// approve makes sure the wallet has the amount of SEED, and that the staker can spend it
+func (s *staker) approve(ctx context.Context, params Params, amount *big.Int) error {
+	backend, err := s.backend()
+	if err != nil {
+		return err
+	}
+	token, err := erc20.NewERC20Caller(params.Seed, backend)
+	if err != nil {
+		return fmt.Errorf("failed to load erc20 bindings: %v", err)
+	}
+	opts := &bind.CallOpts{Context: ctx}
+	balance, err := token.BalanceOf(opts, s.wallet.Address())
+	if err != nil {
+		return fmt.Errorf("failed to get the SEED balance: %w", err)
+	}
+	if balance.Cmp(amount) < 0 {
+		return fmt.Errorf("%w: %v < %v", ErrInsufficientSEED, balance, amount)
+	}
+	allowance, err := token.Allowance(opts, s.wallet.Address(), s.address)
+	if err != nil {
+		return fmt.Errorf("failed to get the SEED allowance: %w", err)
+	}
+	if allowance.Cmp(amount) >= 0 {
+		return nil
+	}
+	_, err = s.wallet.Transact(ctx, s.chain, params.Seed, erc20.ERC20MetaData, "approve", s.address, amount)
+	return err
+}
+
+// stakeID returns the ID of the stake created in the transaction of the receipt
+func (s *staker) stakeID(receipt *types.Receipt) ([32]byte, error) {
+	parsed, err := gardenstaker.GardenStakerMetaData.GetAbi()
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("failed to get abi: %v", err)
+	}
+	for _, log := range receipt.Logs {
+		if log.Address == s.address && len(log.Topics) > 1 && log.Topics[0] == parsed.Events["Staked"].ID {
+			return log.Topics[1], nil
+		}
+	}
+	return [32]byte{}, fmt.Errorf("no Staked event in transaction %v", receipt.TxHash)
+}
@@ -0,0 +1,333 @@
+package staking
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/catalogfi/blockchain/evm"
+	"github.com/catalogfi/blockchain/evm/bindings/contracts/stake/gardenstaker"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DefaultBlocksPerDay is the number of blocks a day the lock durations of the delegate stakes are counted in, the
+// one of the chains with 12 second blocks.
+const DefaultBlocksPerDay = 7200
+
+// maxFeeInBips is the highest fee a filler can charge, in basis points
+const maxFeeInBips = 10000
+
+// LockPermanent is the lock duration of the delegate stakes which never expire, in blocks.
+var LockPermanent = new(big.Int).Set(evm.MaxETHAmount)
+
+var (
+	ErrFillerRegistered      = errors.New("filler already registered")
+	ErrNotFiller             = errors.New("not a registered filler")
+	ErrFillerNotDeregistered = errors.New("filler not deregistered")
+	ErrFillerCooldown        = errors.New("filler cooldown not over")
+	ErrInvalidFee            = errors.New("fee above the maximum fee")
+	ErrZeroUnits             = errors.New("zero stake units")
+	ErrInvalidLockBlocks     = errors.New("unsupported lock duration")
+	ErrStakeNotFound         = errors.New("stake not found")
+	ErrNotStakeOwner         = errors.New("stake not owned by the wallet")
+	ErrStakeExpired          = errors.New("stake expired")
+	ErrStakeNotExpired       = errors.New("stake not expired")
+	ErrStakePermanent        = errors.New("stake is permanent")
+	ErrInsufficientSEED      = errors.New("insufficient SEED balance")
+)
+
+// Params are the constants of a GardenStaker contract. The highest fee and the lock durations are not exposed by the
+// contract, they are derived from the blocks per day of the client.
+type Params struct {
+	// Seed is the address of the SEED token which is staked
+	Seed common.Address
+
+	// FillerStake is the amount of SEED a filler stakes to register
+	FillerStake *big.Int
+
+	// FillerCooldown is the number of blocks after deregistering before the stake of a filler can be refunded
+	FillerCooldown *big.Int
+
+	// DelegateStake is the amount of SEED of a unit of delegate stake
+	DelegateStake *big.Int
+
+	// MaxFeeInBips is the highest fee a filler can charge, in basis points
+	MaxFeeInBips uint16
+
+	// LockHalfYear, LockOneYear, LockTwoYears and LockFourYears are the lock durations of the delegate stakes, in
+	// blocks. A stake can also be locked for LockPermanent blocks, it then never expires.
+	LockHalfYear  *big.Int
+	LockOneYear   *big.Int
+	LockTwoYears  *big.Int
+	LockFourYears *big.Int
+}
+
+// VoteMultiplier returns the number of votes of each unit of a stake locked for the number of blocks, from 1 for
+// half a year to 4 for four years, and 7 for a permanent stake. ErrInvalidLockBlocks is returned for the other
+// durations.
+func (params Params) VoteMultiplier(lockBlocks *big.Int) (int64, error) {
+	if lockBlocks == nil {
+		return 0, ErrInvalidLockBlocks
+	}
+	for i, duration := range []*big.Int{params.LockHalfYear, params.LockOneYear, params.LockTwoYears, params.LockFourYears} {
+		if lockBlocks.Cmp(duration) == 0 {
+			return int64(i + 1), nil
+		}
+	}
+	if lockBlocks.Cmp(LockPermanent) == 0 {
+		return 7, nil
+	}
+	return 0, fmt.Errorf("%w: %v blocks", ErrInvalidLockBlocks, lockBlocks)
+}
+
+// Filler is a filler of the staker, registered or not.
+type Filler struct {
+	Address          common.Address
+	Registered       bool
+	FeeInBips        uint16
+	Stake            *big.Int
+	DeregisteredAt   *big.Int
+	DelegateStakeIDs [][32]byte
+}
+
+// Deregistered tells if the filler deregistered and has not been refunded yet.
+func (filler Filler) Deregistered() bool {
+	return filler.DeregisteredAt.Sign() != 0
+}
+
+// Stake is a delegate stake voting for a filler.
+type Stake struct {
+	ID     [32]byte
+	Owner  common.Address
+	Stake  *big.Int
+	Units  *big.Int
+	Votes  *big.Int
+	Filler common.Address
+	Expiry *big.Int
+}
+
+// Permanent tells if the stake never expires.
+func (stake Stake) Permanent() bool {
+	return stake.Expiry.Cmp(LockPermanent) == 0
+}
+
+// Expired tells if the stake is expired in the block.
+func (stake Stake) Expired(blockNumber *big.Int) bool {
+	return stake.Expiry.Cmp(blockNumber) < 0
+}
+
+// Client reads the state of a GardenStaker contract.
+type Client interface {
+	// Params returns the constants of the staker, they are read once.
+	Params(ctx context.Context) (Params, error)
+
+	// Filler returns the filler, an unknown filler is returned with zero values.
+	Filler(ctx context.Context, filler common.Address) (Filler, error)
+
+	// Stake returns the delegate stake, ErrStakeNotFound is returned for unknown stakes.
+	Stake(ctx context.Context, stakeID [32]byte) (Stake, error)
+
+	// Votes returns the votes of the delegate stakes voting for the filler.
+	Votes(ctx context.Context, filler common.Address) (*big.Int, error)
+
+	// FillerCooldown returns the number of blocks left before the stake of the deregistered filler can be
+	// refunded, 0 when it can be refunded in the next block.
+	FillerCooldown(ctx context.Context, filler common.Address) (uint64, error)
+}
+
+type client struct {
+	evm.Client
+	chain        blockchain.EvmChain
+	address      common.Address
+	blocksPerDay int64
+
+	paramsMu sync.Mutex
+	params   *Params
+}
+
+// ClientOption configures the clients returned by `NewClient` and `NewStaker`.
+type ClientOption func(*client)
+
+// WithBlocksPerDay sets the number of blocks a day the lock durations of the delegate stakes are counted in, it
+// defaults to DefaultBlocksPerDay.
+func WithBlocksPerDay(blocks int64) ClientOption {
+	return func(client *client) {
+		client.blocksPerDay = blocks
+	}
+}
+
+// NewClient returns a client of the GardenStaker contract at the address.
+func NewClient(evmClient evm.Client, chain blockchain.EvmChain, address common.Address, opts ...ClientOption) Client {
+	return newClient(evmClient, chain, address, opts...)
+}
+
+func newClient(evmClient evm.Client, chain blockchain.EvmChain, address common.Address, opts ...ClientOption) *client {
+	client := &client{Client: evmClient, chain: chain, address: address, blocksPerDay: DefaultBlocksPerDay}
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client
+}
+
+func (client *client) backend() (evm.Backend, error) {
+	backend, ok := client.EvmClient(client.chain)
+	if !ok {
+		return nil, fmt.Errorf("unsupported evm chain: %v", client.chain.Name())
+	}
+	return backend, nil
+}
+
+func (client *client) caller() (*gardenstaker.GardenStakerCaller, error) {
+	backend, err := client.backend()
+	if err != nil {
+		return nil, err
+	}
+	caller, err := gardenstaker.NewGardenStakerCaller(client.address, backend)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load staker bindings: %v", err)
+	}
+	return caller, nil
+}
+
+func (client *client) Params(ctx context.Context) (Params, error) {
+	client.paramsMu.Lock()
+	defer client.paramsMu.Unlock()
+	if client.params != nil {
+		return *client.params, nil
+	}
+
+	caller, err := client.caller()
+	if err != nil {
+		return Params{}, err
+	}
+	opts := &bind.CallOpts{Context: ctx}
+	seed, err := caller.SEED(opts)
+	if err != nil {
+		return Params{}, fmt.Errorf("failed to get SEED: %w", err)
+	}
+	fillerStake, err := caller.FILLERSTAKE(opts)
+	if err != nil {
+		return Params{}, fmt.Errorf("failed to get FILLER_STAKE: %w", err)
+	}
+	fillerCooldown, err := caller.FILLERCOOLDOWN(opts)
+	if err != nil {
+		return Params{}, fmt.Errorf("failed to get FILLER_COOL_DOWN: %w", err)
+	}
+	delegateStake, err := caller.DELEGATESTAKE(opts)
+	if err != nil {
+		return Params{}, fmt.Errorf("failed to get DELEGATE_STAKE: %w", err)
+	}
+	client.params = &Params{
+		Seed:           seed,
+		FillerStake:    fillerStake,
+		FillerCooldown: fillerCooldown,
+		DelegateStake:  delegateStake,
+		MaxFeeInBips:   maxFeeInBips,
+		LockHalfYear:   big.NewInt(180 * client.blocksPerDay),
+		LockOneYear:    big.NewInt(365 * client.blocksPerDay),
+		LockTwoYears:   big.NewInt(730 * client.blocksPerDay),
+		LockFourYears:  big.NewInt(1460 * client.blocksPerDay),
+	}
+	return *client.params, nil
+}
+
+func (client *client) Filler(ctx context.Context, filler common.Address) (Filler, error) {
+	caller, err := client.caller()
+	if err != nil {
+		return Filler{}, err
+	}
+	opts := &bind.CallOpts{Context: ctx}
+	role, err := caller.FILLER(opts)
+	if err != nil {
+		return Filler{}, fmt.Errorf("failed to get the filler role: %w", err)
+	}
+	registered, err := caller.HasRole(opts, role, filler)
+	if err != nil {
+		return Filler{}, fmt.Errorf("failed to get the role of the filler: %w", err)
+	}
+	info, err := caller.GetFiller(opts, filler)
+	if err != nil {
+		return Filler{}, fmt.Errorf("failed to get the filler: %w", err)
+	}
+	return Filler{
+		Address:          filler,
+		Registered:       registered,
+		FeeInBips:        info.FeeInBips,
+		Stake:            info.Stake,
+		DeregisteredAt:   info.DeregisteredAt,
+		DelegateStakeIDs: info.DelegateStakeIDs,
+	}, nil
+}
+
+func (client *client) Stake(ctx context.Context, stakeID [32]byte) (Stake, error) {
+	caller, err := client.caller()
+	if err != nil {
+		return Stake{}, err
+	}
+	stake, err := caller.Stakes(&bind.CallOpts{Context: ctx}, stakeID)
+	if err != nil {
+		return Stake{}, fmt.Errorf("failed to get the stake: %w", err)
+	}
+	if stake.Owner == (common.Address{}) {
+		return Stake{}, ErrStakeNotFound
+	}
+	return Stake{
+		ID:     stakeID,
+		Owner:  stake.Owner,
+		Stake:  stake.Stake,
+		Units:  stake.Units,
+		Votes:  stake.Votes,
+		Filler: stake.Filler,
+		Expiry: stake.Expiry,
+	}, nil
+}
+
+func (client *client) Votes(ctx context.Context, filler common.Address) (*big.Int, error) {
+	caller, err := client.caller()
+	if err != nil {
+		return nil, err
+	}
+	return caller.GetVotes(&bind.CallOpts{Context: ctx}, filler)
+}
+
+func (client *client) FillerCooldown(ctx context.Context, filler common.Address) (uint64, error) {
+	params, err := client.Params(ctx)
+	if err != nil {
+		return 0, err
+	}
+	info, err := client.Filler(ctx, filler)
+	if err != nil {
+		return 0, err
+	}
+	if !info.Deregistered() {
+		return 0, ErrFillerNotDeregistered
+	}
+	next, err := client.nextBlock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// the stake is refundable once the cooldown is strictly over
+	refundableAt := new(big.Int).Add(info.DeregisteredAt, params.FillerCooldown)
+	refundableAt.Add(refundableAt, big.NewInt(1))
+	if refundableAt.Cmp(next) <= 0 {
+		return 0, nil
+	}
+	return new(big.Int).Sub(refundableAt, next).Uint64(), nil
+}
+
+// nextBlock returns the number of the block the next transactions are mined in, at the earliest
+func (client *client) nextBlock(ctx context.Context) (*big.Int, error) {
+	backend, err := client.backend()
+	if err != nil {
+		return nil, err
+	}
+	head, err := backend.BlockNumber(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the block number: %w", err)
+	}
+	return new(big.Int).SetUint64(head + 1), nil
+}
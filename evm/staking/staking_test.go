@@ -0,0 +1,445 @@
+package staking_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/params"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/catalogfi/blockchain/evm"
+	"github.com/catalogfi/blockchain/evm/bindings/contracts/stake/gardenstaker"
+	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/token/ERC20/erc20"
+	"github.com/catalogfi/blockchain/evm/staking"
+)
+
+var _ = Describe("Staking", func() {
+	var (
+		sim    *stakingChain
+		staker staking.Staker
+		params staking.Params
+		owner  common.Address
+		filler common.Address
+	)
+
+	BeforeEach(func(ctx context.Context) {
+		sim = newStakingChain(ctx)
+		wallet := evm.NewWallet(sim.client, sim.key, evm.WithTxTrackerOptions(evm.WithTrackerPollInterval(10*time.Millisecond)))
+		staker = staking.NewStaker(wallet, sim.chain, sim.staker)
+		var err error
+		params, err = staker.Params(ctx)
+		Expect(err).Should(BeNil())
+		owner = wallet.Address()
+		filler = common.HexToAddress("0x4000")
+		sim.state.fillers[filler] = &fillerState{registered: true, stake: sim.state.fillerStake, deregisteredAt: big.NewInt(0)}
+	})
+
+	It("should read the staker", func(ctx context.Context) {
+		Expect(params).Should(Equal(staking.Params{
+			Seed:           sim.seed,
+			FillerStake:    sim.state.fillerStake,
+			FillerCooldown: sim.state.fillerCooldown,
+			DelegateStake:  sim.state.delegateStake,
+			MaxFeeInBips:   10000,
+			LockHalfYear:   big.NewInt(180 * 7200),
+			LockOneYear:    big.NewInt(365 * 7200),
+			LockTwoYears:   big.NewInt(730 * 7200),
+			LockFourYears:  big.NewInt(1460 * 7200),
+		}))
+
+		By("Count the lock durations in the blocks of the chain")
+		fastParams, err := staking.NewClient(sim.client, sim.chain, sim.staker, staking.WithBlocksPerDay(43200)).Params(ctx)
+		Expect(err).Should(BeNil())
+		Expect(fastParams.LockOneYear).Should(Equal(big.NewInt(365 * 43200)))
+		multiplier, err := fastParams.VoteMultiplier(params.LockOneYear)
+		Expect(err).Should(MatchError(staking.ErrInvalidLockBlocks))
+		Expect(multiplier).Should(BeZero())
+
+		stakeID := [32]byte{1}
+		sim.state.fillers[filler].fee = 30
+		sim.state.fillers[filler].stakeIDs = [][32]byte{stakeID}
+		sim.state.votes[filler] = big.NewInt(14)
+		info, err := staker.Filler(ctx, filler)
+		Expect(err).Should(BeNil())
+		Expect(info.Registered).Should(BeTrue())
+		Expect(info.Deregistered()).Should(BeFalse())
+		Expect(info.FeeInBips).Should(Equal(uint16(30)))
+		Expect(info.Stake).Should(Equal(sim.state.fillerStake))
+		Expect(info.DelegateStakeIDs).Should(Equal([][32]byte{stakeID}))
+		votes, err := staker.Votes(ctx, filler)
+		Expect(err).Should(BeNil())
+		Expect(votes).Should(Equal(big.NewInt(14)))
+
+		sim.state.stakes[stakeID] = staking.Stake{ID: stakeID, Owner: owner, Stake: big.NewInt(2e18), Units: big.NewInt(2), Votes: big.NewInt(14), Filler: filler, Expiry: staking.LockPermanent}
+		stake, err := staker.Stake(ctx, stakeID)
+		Expect(err).Should(BeNil())
+		Expect(stake).Should(Equal(sim.state.stakes[stakeID]))
+		Expect(stake.Permanent()).Should(BeTrue())
+		_, err = staker.Stake(ctx, [32]byte{2})
+		Expect(err).Should(Equal(staking.ErrStakeNotFound))
+
+		By("Read the cooldown of deregistered fillers")
+		_, err = staker.FillerCooldown(ctx, filler)
+		Expect(err).Should(Equal(staking.ErrFillerNotDeregistered))
+		head := sim.head(ctx)
+		sim.state.fillers[filler].deregisteredAt = new(big.Int).SetUint64(head)
+		cooldown, err := staker.FillerCooldown(ctx, filler)
+		Expect(err).Should(BeNil())
+		Expect(cooldown).Should(BeNumerically("<=", sim.state.fillerCooldown.Uint64()))
+		Expect(cooldown).Should(BeNumerically(">", 0))
+	})
+
+	It("should register fillers", func(ctx context.Context) {
+		_, err := staker.Register(ctx)
+		Expect(err).Should(MatchError(staking.ErrInsufficientSEED))
+		Expect(sim.txsTo(ctx, sim.staker)).Should(BeEmpty())
+
+		sim.state.balance = new(big.Int).Set(sim.state.fillerStake)
+		_, err = staker.Register(ctx)
+		Expect(err).Should(BeNil())
+		approvals := sim.txsTo(ctx, sim.seed)
+		Expect(approvals).Should(HaveLen(1))
+		Expect(unpack(erc20.ERC20MetaData, "approve", approvals[0].Data())).Should(Equal([]interface{}{sim.staker, sim.state.fillerStake}))
+		txs := sim.txsTo(ctx, sim.staker)
+		Expect(txs).Should(HaveLen(1))
+		Expect(unpack(gardenstaker.GardenStakerMetaData, "register", txs[0].Data())).Should(BeEmpty())
+
+		By("Update the fee of registered fillers")
+		sim.state.fillers[owner] = &fillerState{registered: true, stake: sim.state.fillerStake, deregisteredAt: big.NewInt(0)}
+		_, err = staker.Register(ctx)
+		Expect(err).Should(Equal(staking.ErrFillerRegistered))
+		_, err = staker.UpdateFee(ctx, params.MaxFeeInBips+1)
+		Expect(err).Should(MatchError(staking.ErrInvalidFee))
+		_, err = staker.UpdateFee(ctx, 30)
+		Expect(err).Should(BeNil())
+		txs = sim.txsTo(ctx, sim.staker)
+		Expect(txs).Should(HaveLen(2))
+		Expect(unpack(gardenstaker.GardenStakerMetaData, "updateFee", txs[1].Data())).Should(Equal([]interface{}{uint16(30)}))
+	})
+
+	It("should deregister and refund fillers after the cooldown", func(ctx context.Context) {
+		_, err := staker.Deregister(ctx)
+		Expect(err).Should(MatchError(staking.ErrNotFiller))
+		_, err = staker.Refund(ctx, owner)
+		Expect(err).Should(Equal(staking.ErrFillerNotDeregistered))
+
+		sim.state.fillers[owner] = &fillerState{registered: true, stake: sim.state.fillerStake, deregisteredAt: big.NewInt(0)}
+		_, err = staker.Deregister(ctx)
+		Expect(err).Should(BeNil())
+		txs := sim.txsTo(ctx, sim.staker)
+		Expect(txs).Should(HaveLen(1))
+		Expect(unpack(gardenstaker.GardenStakerMetaData, "deregister", txs[0].Data())).Should(BeEmpty())
+
+		sim.state.fillers[owner].registered = false
+		sim.state.fillers[owner].deregisteredAt = new(big.Int).SetUint64(sim.head(ctx))
+		_, err = staker.Refund(ctx, owner)
+		Expect(err).Should(MatchError(staking.ErrFillerCooldown))
+		Eventually(func() (uint64, error) {
+			return staker.FillerCooldown(ctx, owner)
+		}).Should(BeZero())
+		_, err = staker.Refund(ctx, owner)
+		Expect(err).Should(BeNil())
+		txs = sim.txsTo(ctx, sim.staker)
+		Expect(txs).Should(HaveLen(2))
+		Expect(unpack(gardenstaker.GardenStakerMetaData, "refund0", txs[1].Data())).Should(Equal([]interface{}{owner}))
+	})
+
+	It("should vote for fillers", func(ctx context.Context) {
+		sim.state.balance = big.NewInt(5e18)
+		_, _, err := staker.Vote(ctx, filler, big.NewInt(0), params.LockOneYear)
+		Expect(err).Should(Equal(staking.ErrZeroUnits))
+		_, _, err = staker.Vote(ctx, filler, big.NewInt(2), big.NewInt(100))
+		Expect(err).Should(MatchError(staking.ErrInvalidLockBlocks))
+		_, _, err = staker.Vote(ctx, common.HexToAddress("0x5000"), big.NewInt(2), params.LockOneYear)
+		Expect(err).Should(MatchError(staking.ErrNotFiller))
+		_, _, err = staker.Vote(ctx, filler, big.NewInt(6), params.LockOneYear)
+		Expect(err).Should(MatchError(staking.ErrInsufficientSEED))
+		Expect(sim.txsTo(ctx, sim.staker)).Should(BeEmpty())
+
+		stakeID, receipt, err := staker.Vote(ctx, filler, big.NewInt(2), params.LockOneYear)
+		Expect(err).Should(BeNil())
+		Expect(receipt.Status).Should(Equal(types.ReceiptStatusSuccessful))
+		approvals := sim.txsTo(ctx, sim.seed)
+		Expect(approvals).Should(HaveLen(1))
+		Expect(unpack(erc20.ERC20MetaData, "approve", approvals[0].Data())).Should(Equal([]interface{}{sim.staker, big.NewInt(2e18)}))
+		txs := sim.txsTo(ctx, sim.staker)
+		Expect(txs).Should(HaveLen(1))
+		Expect(unpack(gardenstaker.GardenStakerMetaData, "vote", txs[0].Data())).Should(Equal([]interface{}{filler, big.NewInt(2), params.LockOneYear}))
+		Expect(stakeID).Should(Equal([32]byte(crypto.Keccak256Hash(txs[0].Data()))))
+
+		By("Skip the approval when the allowance is enough")
+		sim.state.allowance = big.NewInt(2e18)
+		_, _, err = staker.Vote(ctx, filler, big.NewInt(2), staking.LockPermanent)
+		Expect(err).Should(BeNil())
+		Expect(sim.txsTo(ctx, sim.seed)).Should(HaveLen(1))
+		Expect(sim.txsTo(ctx, sim.staker)).Should(HaveLen(2))
+	})
+
+	It("should manage the delegate stakes", func(ctx context.Context) {
+		head := sim.head(ctx)
+		newStake := func(id byte, owner common.Address, expiry *big.Int) [32]byte {
+			stakeID := [32]byte{id}
+			sim.state.stakes[stakeID] = staking.Stake{ID: stakeID, Owner: owner, Stake: big.NewInt(1e18), Units: big.NewInt(1), Votes: big.NewInt(2), Filler: filler, Expiry: expiry}
+			return stakeID
+		}
+		active := newStake(1, owner, new(big.Int).SetUint64(head+1000))
+		expired := newStake(2, owner, big.NewInt(1))
+		permanent := newStake(3, owner, staking.LockPermanent)
+		others := newStake(4, common.HexToAddress("0x5000"), new(big.Int).SetUint64(head+1000))
+
+		_, err := staker.Extend(ctx, others, params.LockOneYear)
+		Expect(err).Should(Equal(staking.ErrNotStakeOwner))
+		_, err = staker.Extend(ctx, [32]byte{5}, params.LockOneYear)
+		Expect(err).Should(Equal(staking.ErrStakeNotFound))
+		_, err = staker.Extend(ctx, expired, params.LockOneYear)
+		Expect(err).Should(Equal(staking.ErrStakeExpired))
+		_, err = staker.Extend(ctx, permanent, params.LockOneYear)
+		Expect(err).Should(Equal(staking.ErrStakePermanent))
+		_, err = staker.Extend(ctx, active, big.NewInt(100))
+		Expect(err).Should(MatchError(staking.ErrInvalidLockBlocks))
+		_, err = staker.ChangeVote(ctx, expired, filler)
+		Expect(err).Should(Equal(staking.ErrStakeExpired))
+		_, err = staker.ChangeVote(ctx, active, common.HexToAddress("0x5000"))
+		Expect(err).Should(MatchError(staking.ErrNotFiller))
+		_, err = staker.Renew(ctx, active, params.LockOneYear)
+		Expect(err).Should(Equal(staking.ErrStakeNotExpired))
+		_, err = staker.RefundStake(ctx, permanent)
+		Expect(err).Should(Equal(staking.ErrStakeNotExpired))
+		Expect(sim.txsTo(ctx, sim.staker)).Should(BeEmpty())
+
+		_, err = staker.Extend(ctx, active, params.LockTwoYears)
+		Expect(err).Should(BeNil())
+		_, err = staker.ChangeVote(ctx, active, filler)
+		Expect(err).Should(BeNil())
+		_, err = staker.Renew(ctx, expired, params.LockHalfYear)
+		Expect(err).Should(BeNil())
+		_, err = staker.RefundStake(ctx, expired)
+		Expect(err).Should(BeNil())
+
+		txs := sim.txsTo(ctx, sim.staker)
+		Expect(txs).Should(HaveLen(4))
+		Expect(unpack(gardenstaker.GardenStakerMetaData, "extend", txs[0].Data())).Should(Equal([]interface{}{active, params.LockTwoYears}))
+		Expect(unpack(gardenstaker.GardenStakerMetaData, "changeVote", txs[1].Data())).Should(Equal([]interface{}{active, filler}))
+		Expect(unpack(gardenstaker.GardenStakerMetaData, "renew", txs[2].Data())).Should(Equal([]interface{}{expired, params.LockHalfYear}))
+		Expect(unpack(gardenstaker.GardenStakerMetaData, "refund", txs[3].Data())).Should(Equal([]interface{}{expired}))
+	})
+})
+
+// unpack returns the arguments of the call data of the contract method
+func unpack(metaData *bind.MetaData, method string, data []byte) []interface{} {
+	parsed, err := metaData.GetAbi()
+	Expect(err).Should(BeNil())
+	Expect(data[:4]).Should(Equal(parsed.Methods[method].ID))
+	args, err := parsed.Methods[method].Inputs.Unpack(data[4:])
+	Expect(err).Should(BeNil())
+	return args
+}
+
+// stakerCode is the runtime code of a fake staker whose calls all succeed, emitting a Staked event with the hash of
+// the call data as the stake ID and the caller as the owner.
+var stakerCode = append(append(
+	common.FromHex("0x3660006000373336600020"+"7f"),
+	crypto.Keccak256([]byte("Staked(bytes32,address,uint256,uint256)"))...),
+	common.FromHex("0x60006000a3600160005260206000f3")...,
+)
+
+// mockTokenCode is the runtime code of a token whose calls all return true
+var mockTokenCode = common.FromHex("0x600160005260206000f3")
+
+type fillerState struct {
+	registered     bool
+	fee            uint16
+	stake          *big.Int
+	deregisteredAt *big.Int
+	stakeIDs       [][32]byte
+}
+
+// stakerState is the state of the fake staker and of the SEED of the wallet, which the tests set directly
+type stakerState struct {
+	fillerStake    *big.Int
+	fillerCooldown *big.Int
+	delegateStake  *big.Int
+	fillers        map[common.Address]*fillerState
+	stakes         map[[32]byte]staking.Stake
+	votes          map[common.Address]*big.Int
+	balance        *big.Int
+	allowance      *big.Int
+}
+
+// stakingBackend serves the reads of the fake staker and SEED token from their state, and forwards the rest to the
+// simulated backend.
+type stakingBackend struct {
+	simulated.Client
+	staker common.Address
+	seed   common.Address
+	state  *stakerState
+}
+
+func (backend *stakingBackend) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	if msg.To == nil || len(msg.Data) < 4 || (*msg.To != backend.staker && *msg.To != backend.seed) {
+		return backend.Client.CallContract(ctx, msg, blockNumber)
+	}
+	metaData := erc20.ERC20MetaData
+	if *msg.To == backend.staker {
+		metaData = gardenstaker.GardenStakerMetaData
+	}
+	parsed, err := metaData.GetAbi()
+	Expect(err).Should(BeNil())
+	method, err := parsed.MethodById(msg.Data[:4])
+	if err != nil || !method.IsConstant() {
+		return backend.Client.CallContract(ctx, msg, blockNumber)
+	}
+	args, err := method.Inputs.Unpack(msg.Data[4:])
+	Expect(err).Should(BeNil())
+	return method.Outputs.Pack(backend.read(method.Name, args)...)
+}
+
+func (backend *stakingBackend) read(method string, args []interface{}) []interface{} {
+	state := backend.state
+	filler := func(address common.Address) *fillerState {
+		if info, ok := state.fillers[address]; ok {
+			return info
+		}
+		return &fillerState{stake: big.NewInt(0), deregisteredAt: big.NewInt(0)}
+	}
+	switch method {
+	case "SEED":
+		return []interface{}{backend.seed}
+	case "FILLER_STAKE":
+		return []interface{}{state.fillerStake}
+	case "FILLER_COOL_DOWN":
+		return []interface{}{state.fillerCooldown}
+	case "DELEGATE_STAKE":
+		return []interface{}{state.delegateStake}
+	case "FILLER":
+		return []interface{}{crypto.Keccak256Hash([]byte("FILLER"))}
+	case "hasRole":
+		return []interface{}{args[0].([32]byte) == crypto.Keccak256Hash([]byte("FILLER")) && filler(args[1].(common.Address)).registered}
+	case "getFiller":
+		info := filler(args[0].(common.Address))
+		return []interface{}{info.fee, info.stake, info.deregisteredAt, info.stakeIDs}
+	case "getVotes":
+		if votes, ok := state.votes[args[0].(common.Address)]; ok {
+			return []interface{}{votes}
+		}
+		return []interface{}{big.NewInt(0)}
+	case "stakes":
+		stake, ok := state.stakes[args[0].([32]byte)]
+		if !ok {
+			return []interface{}{common.Address{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), common.Address{}, big.NewInt(0)}
+		}
+		return []interface{}{stake.Owner, stake.Stake, stake.Units, stake.Votes, stake.Filler, stake.Expiry}
+	case "balanceOf":
+		return []interface{}{state.balance}
+	case "allowance":
+		return []interface{}{state.allowance}
+	default:
+		Fail("unexpected call to " + method)
+		return nil
+	}
+}
+
+// stakingChain is a go-ethereum simulated backend mining a block every few milliseconds, with a fake staker and SEED
+// token.
+type stakingChain struct {
+	chain   blockchain.EvmChain
+	backend *simulated.Backend
+	client  evm.Client
+	key     *ecdsa.PrivateKey
+	staker  common.Address
+	seed    common.Address
+	state   *stakerState
+}
+
+func newStakingChain(ctx context.Context) *stakingChain {
+	key, err := crypto.GenerateKey()
+	Expect(err).Should(BeNil())
+	sim := &stakingChain{
+		chain:  blockchain.NewEvmChain(blockchain.EthereumLocalnet),
+		key:    key,
+		staker: common.HexToAddress("0x3000"),
+		seed:   common.HexToAddress("0x2000"),
+		state: &stakerState{
+			fillerStake:    big.NewInt(1e18),
+			fillerCooldown: big.NewInt(20),
+			delegateStake:  big.NewInt(1e18),
+			fillers:        map[common.Address]*fillerState{},
+			stakes:         map[[32]byte]staking.Stake{},
+			votes:          map[common.Address]*big.Int{},
+			balance:        big.NewInt(0),
+			allowance:      big.NewInt(0),
+		},
+	}
+	sim.backend = simulated.NewBackend(types.GenesisAlloc{
+		sim.staker:                            {Code: stakerCode, Balance: big.NewInt(0)},
+		sim.seed:                              {Code: mockTokenCode, Balance: big.NewInt(0)},
+		crypto.PubkeyToAddress(key.PublicKey): {Balance: new(big.Int).Lsh(big.NewInt(1), 100)},
+	}, func(nodeConf *node.Config, ethConf *ethconfig.Config) {
+		config := *params.AllDevChainProtocolChanges
+		config.ChainID = sim.chain.ChainID()
+		ethConf.Genesis.Config = &config
+	})
+	DeferCleanup(sim.backend.Close)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				sim.backend.Commit()
+			}
+		}
+	}()
+	DeferCleanup(func() {
+		close(done)
+		<-stopped
+	})
+
+	Eventually(func() uint64 {
+		return sim.head(ctx)
+	}).Should(BeNumerically(">", 1))
+
+	backend := &stakingBackend{Client: sim.backend.Client(), staker: sim.staker, seed: sim.seed, state: sim.state}
+	sim.client = evm.NewClientWithBackends(map[blockchain.EvmChain]evm.Backend{sim.chain: backend})
+	return sim
+}
+
+func (sim *stakingChain) head(ctx context.Context) uint64 {
+	head, err := sim.backend.Client().BlockNumber(ctx)
+	Expect(err).Should(BeNil())
+	return head
+}
+
+// txsTo returns the transactions sent to the address, in the order they were mined
+func (sim *stakingChain) txsTo(ctx context.Context, to common.Address) []*types.Transaction {
+	var txs []*types.Transaction
+	head := sim.head(ctx)
+	for number := uint64(0); number <= head; number++ {
+		block, err := sim.backend.Client().BlockByNumber(ctx, new(big.Int).SetUint64(number))
+		Expect(err).Should(BeNil())
+		for _, tx := range block.Transactions() {
+			if tx.To() != nil && *tx.To() == to {
+				txs = append(txs, tx)
+			}
+		}
+	}
+	return txs
+}
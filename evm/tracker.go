@@ -0,0 +1,484 @@
+package evm
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	// DefaultStuckTimeout is the time after which an unmined transaction is replaced with higher fees
+	DefaultStuckTimeout = 2 * time.Minute
+
+	// DefaultTrackerPollInterval is the interval between two checks of the tracked transactions
+	DefaultTrackerPollInterval = 5 * time.Second
+
+	// MinFeeBump is the minimum percentage by which the fees of a replacement transaction are increased, which is
+	// the minimum accepted by the nodes to replace a transaction
+	MinFeeBump = 10
+
+	// cancelGasLimit is the minimum gas limit of a cancellation, the gas of a plain transfer. It is estimated as
+	// the L2 chains charge their L1 data fee in gas.
+	cancelGasLimit = 21000
+)
+
+var (
+	ErrTxAlreadyMined      = errors.New("transaction already mined")
+	ErrTxCancelled         = errors.New("transaction cancelled")
+	ErrTxNonceUsed         = errors.New("transaction nonce used by an unknown transaction")
+	ErrTxNotFound          = errors.New("transaction not found")
+	ErrReplacementFeeCap   = errors.New("replacement fee exceeds the maximum fee cap")
+	ErrTxNotFromTrackerKey = errors.New("transaction not sent by the tracker key")
+	ErrTxReorged           = errors.New("transaction receipt reorged out of the chain")
+)
+
+// TxClient is the part of an evm node client used to track transactions.
+type TxClient interface {
+	ethereum.TransactionReader
+	ethereum.TransactionSender
+	ethereum.GasPricer
+	ethereum.GasPricer1559
+	ethereum.GasEstimator
+
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+// TxTracker monitors the transactions sent by an account, replacing them with higher fees when they are stuck in
+// the mempool. A replacement has the same nonce and fees bumped by at least `MinFeeBump` percent.
+type TxTracker interface {
+	// WaitMined waits for the transaction, or one of its replacements, to be mined. The transaction is replaced
+	// with higher fees each time it is not mined within the stuck timeout. The returned receipt is the one of the
+	// mined transaction, its hash might differ from the one of tx. ErrTxCancelled is returned along with the
+	// receipt when the transaction was cancelled.
+	WaitMined(ctx context.Context, tx *types.Transaction) (*types.Receipt, error)
+
+	// WaitConfirmed waits for the transaction to be mined like WaitMined, then for its block to be `depth` blocks
+	// deep in the chain, the block of the transaction being the first one. The block hash of the receipt is checked
+	// against the canonical chain at each new head, ErrTxReorged is returned along with the receipt when the block
+	// is reorged out of the chain.
+	WaitConfirmed(ctx context.Context, tx *types.Transaction, depth uint64) (*types.Receipt, error)
+
+	// SpeedUp replaces the pending transaction with the given hash, or the latest replacement of it, with higher
+	// fees.
+	SpeedUp(ctx context.Context, hash common.Hash) (*types.Transaction, error)
+
+	// Cancel replaces the pending transaction with the given hash, or the latest replacement of it, with a
+	// 0-value transfer to the sender using the same nonce. Waiting on the transaction afterwards returns
+	// ErrTxCancelled once the cancellation is mined.
+	Cancel(ctx context.Context, hash common.Hash) (*types.Transaction, error)
+
+	// Pending returns the latest replacement of the tracked transactions.
+	Pending() []*types.Transaction
+}
+
+// trackedTx has all the versions of a transaction sent with the same nonce
+type trackedTx struct {
+	mu          sync.Mutex
+	txs         []*types.Transaction
+	submittedAt time.Time
+	// cancelIndex is the index of the first cancellation in txs, 0 when the transaction is not cancelled
+	cancelIndex int
+}
+
+func (entry *trackedTx) latest() *types.Transaction {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	return entry.txs[len(entry.txs)-1]
+}
+
+// isCancellation returns true if the transaction with the given hash is a cancellation of the tracked one
+func (entry *trackedTx) isCancellation(hash common.Hash) bool {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.cancelIndex == 0 {
+		return false
+	}
+	for _, tx := range entry.txs[entry.cancelIndex:] {
+		if tx.Hash() == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func (entry *trackedTx) hashes() []common.Hash {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	hashes := make([]common.Hash, len(entry.txs))
+	for i, tx := range entry.txs {
+		hashes[i] = tx.Hash()
+	}
+	return hashes
+}
+
+type txTracker struct {
+	mu      sync.Mutex
+	client  TxClient
+	chain   blockchain.EvmChain
+	key     *ecdsa.PrivateKey
+	from    common.Address
+	signer  types.Signer
+	tracked map[common.Hash]*trackedTx
+
+	stuckTimeout time.Duration
+	pollInterval time.Duration
+	maxFeeCap    *big.Int
+}
+
+// TxTrackerOption configures the tracker returned by `NewTxTracker`.
+type TxTrackerOption func(*txTracker)
+
+// WithStuckTimeout sets the time after which an unmined transaction is replaced with higher fees.
+func WithStuckTimeout(timeout time.Duration) TxTrackerOption {
+	return func(tracker *txTracker) {
+		tracker.stuckTimeout = timeout
+	}
+}
+
+// WithTrackerPollInterval sets the interval between two checks of the tracked transactions.
+func WithTrackerPollInterval(interval time.Duration) TxTrackerOption {
+	return func(tracker *txTracker) {
+		tracker.pollInterval = interval
+	}
+}
+
+// WithMaxReplacementFeeCap sets the maximum fee per gas of the replacements, a stuck transaction is not replaced
+// anymore once its fees would exceed the cap.
+func WithMaxReplacementFeeCap(maxFeeCap *big.Int) TxTrackerOption {
+	return func(tracker *txTracker) {
+		tracker.maxFeeCap = maxFeeCap
+	}
+}
+
+// NewTxTracker returns a tracker of the transactions sent by the key on the chain.
+func NewTxTracker(client TxClient, chain blockchain.EvmChain, key *ecdsa.PrivateKey, opts ...TxTrackerOption) TxTracker {
+	tracker := &txTracker{
+		client:       client,
+		chain:        chain,
+		key:          key,
+		from:         crypto.PubkeyToAddress(key.PublicKey),
+		signer:       types.LatestSignerForChainID(chain.ChainID()),
+		tracked:      map[common.Hash]*trackedTx{},
+		stuckTimeout: DefaultStuckTimeout,
+		pollInterval: DefaultTrackerPollInterval,
+	}
+	for _, opt := range opts {
+		opt(tracker)
+	}
+	return tracker
+}
+
+func (t *txTracker) WaitMined(ctx context.Context, tx *types.Transaction) (*types.Receipt, error) {
+	entry, err := t.track(tx)
+	if err != nil {
+		return nil, err
+	}
+	defer t.untrack(entry)
+
+	ticker := time.NewTicker(t.pollInterval)
+	defer ticker.Stop()
+	for {
+		receipt, err := t.minedReceipt(ctx, entry)
+		if err != nil {
+			return nil, err
+		}
+		if receipt != nil {
+			if entry.isCancellation(receipt.TxHash) {
+				return receipt, ErrTxCancelled
+			}
+			return receipt, nil
+		}
+
+		entry.mu.Lock()
+		stuck := time.Since(entry.submittedAt) >= t.stuckTimeout
+		entry.mu.Unlock()
+		if stuck {
+			if _, err := t.replace(ctx, entry, false); err != nil && !errors.Is(err, ErrReplacementFeeCap) {
+				// The nonce is used or the replacement already sent, the receipt is fetched at the next poll
+				if !isNonceError(err) && !isAlreadyKnownError(err) {
+					// The transaction might have been mined while replacing it
+					receipt, minedErr := t.minedReceipt(ctx, entry)
+					if minedErr != nil || receipt == nil {
+						return nil, err
+					}
+					continue
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *txTracker) WaitConfirmed(ctx context.Context, tx *types.Transaction, depth uint64) (*types.Receipt, error) {
+	receipt, err := t.WaitMined(ctx, tx)
+	if err != nil && !errors.Is(err, ErrTxCancelled) {
+		return receipt, err
+	}
+	if confirmErr := t.confirm(ctx, receipt, depth); confirmErr != nil {
+		return receipt, confirmErr
+	}
+	return receipt, err
+}
+
+// confirm waits for the block of the receipt to be depth blocks deep in the chain, checking it is still part of the
+// chain at each new head. The receipt is only reorged once another block is canonical at its height.
+func (t *txTracker) confirm(ctx context.Context, receipt *types.Receipt, depth uint64) error {
+	ticker := time.NewTicker(t.pollInterval)
+	defer ticker.Stop()
+	lastHead := common.Hash{}
+	for {
+		head, err := t.client.HeaderByNumber(ctx, nil)
+		if err != nil {
+			return err
+		}
+		// A node behind the one of the receipt has no block at its height yet, which is not a reorg
+		if head.Hash() != lastHead && head.Number.Cmp(receipt.BlockNumber) >= 0 {
+			header, err := t.client.HeaderByNumber(ctx, receipt.BlockNumber)
+			if err != nil && !errors.Is(err, ethereum.NotFound) {
+				return err
+			}
+			if err == nil {
+				lastHead = head.Hash()
+				if header.Hash() != receipt.BlockHash {
+					return ErrTxReorged
+				}
+				if new(big.Int).Sub(head.Number, receipt.BlockNumber).Uint64()+1 >= depth {
+					return nil
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *txTracker) SpeedUp(ctx context.Context, hash common.Hash) (*types.Transaction, error) {
+	entry, err := t.pending(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return t.replace(ctx, entry, false)
+}
+
+func (t *txTracker) Cancel(ctx context.Context, hash common.Hash) (*types.Transaction, error) {
+	entry, err := t.pending(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return t.replace(ctx, entry, true)
+}
+
+func (t *txTracker) Pending() []*types.Transaction {
+	t.mu.Lock()
+	entries := map[*trackedTx]struct{}{}
+	for _, entry := range t.tracked {
+		entries[entry] = struct{}{}
+	}
+	t.mu.Unlock()
+
+	txs := make([]*types.Transaction, 0, len(entries))
+	for entry := range entries {
+		txs = append(txs, entry.latest())
+	}
+	return txs
+}
+
+func (t *txTracker) track(tx *types.Transaction) (*trackedTx, error) {
+	from, err := types.Sender(t.signer, tx)
+	if err != nil {
+		return nil, err
+	}
+	if from != t.from {
+		return nil, ErrTxNotFromTrackerKey
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if entry, ok := t.tracked[tx.Hash()]; ok {
+		return entry, nil
+	}
+	entry := &trackedTx{txs: []*types.Transaction{tx}, submittedAt: time.Now()}
+	t.tracked[tx.Hash()] = entry
+	return entry, nil
+}
+
+func (t *txTracker) untrack(entry *trackedTx) {
+	hashes := entry.hashes()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, hash := range hashes {
+		delete(t.tracked, hash)
+	}
+}
+
+// pending returns the tracked entry of the pending transaction, tracking it if it is not yet. It stays tracked until
+// waited on with WaitMined.
+func (t *txTracker) pending(ctx context.Context, hash common.Hash) (*trackedTx, error) {
+	t.mu.Lock()
+	entry, ok := t.tracked[hash]
+	t.mu.Unlock()
+	if !ok {
+		tx, isPending, err := t.client.TransactionByHash(ctx, hash)
+		if err != nil {
+			if errors.Is(err, ethereum.NotFound) {
+				return nil, ErrTxNotFound
+			}
+			return nil, err
+		}
+		if !isPending {
+			return nil, ErrTxAlreadyMined
+		}
+		entry, err = t.track(tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	receipt, err := t.minedReceipt(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+	if receipt != nil {
+		return nil, ErrTxAlreadyMined
+	}
+	return entry, nil
+}
+
+// minedReceipt returns the receipt of the mined version of the transaction, or nil when its nonce is not used yet.
+func (t *txTracker) minedReceipt(ctx context.Context, entry *trackedTx) (*types.Receipt, error) {
+	nonce, err := t.client.NonceAt(ctx, t.from, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nonce: %w", err)
+	}
+	if nonce <= entry.latest().Nonce() {
+		return nil, nil
+	}
+	for _, hash := range entry.hashes() {
+		receipt, err := t.client.TransactionReceipt(ctx, hash)
+		if err != nil {
+			if errors.Is(err, ethereum.NotFound) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get receipt: %w", err)
+		}
+		return receipt, nil
+	}
+	return nil, ErrTxNonceUsed
+}
+
+// replace sends a replacement of the latest version of the transaction, with fees bumped by at least `MinFeeBump`
+// percent. Once cancelled, the replacements are 0-value transfers to the sender.
+func (t *txTracker) replace(ctx context.Context, entry *trackedTx, cancel bool) (*types.Transaction, error) {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	latest := entry.txs[len(entry.txs)-1]
+	gasTipCap, err := t.client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gas tip: %w", err)
+	}
+	gasPrice, err := t.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gas price: %w", err)
+	}
+	gasTipCap = bigMax(bumpFee(latest.GasTipCap()), gasTipCap)
+	gasFeeCap := bigMax(bumpFee(latest.GasFeeCap()), new(big.Int).Add(gasPrice, gasTipCap))
+	if t.maxFeeCap != nil && gasFeeCap.Cmp(t.maxFeeCap) > 0 {
+		return nil, fmt.Errorf("%w: %v > %v", ErrReplacementFeeCap, gasFeeCap, t.maxFeeCap)
+	}
+
+	replacement := &types.DynamicFeeTx{
+		ChainID:    t.chain.ChainID(),
+		Nonce:      latest.Nonce(),
+		GasTipCap:  gasTipCap,
+		GasFeeCap:  gasFeeCap,
+		Gas:        latest.Gas(),
+		To:         latest.To(),
+		Value:      latest.Value(),
+		Data:       latest.Data(),
+		AccessList: latest.AccessList(),
+	}
+	cancelled := entry.cancelIndex > 0 || cancel
+	if cancelled {
+		replacement.To = &t.from
+		replacement.Value = big.NewInt(0)
+		replacement.Data = nil
+		replacement.AccessList = nil
+		replacement.Gas, err = t.cancelGas(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tx, err := types.SignNewTx(t.key, t.signer, replacement)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.client.SendTransaction(ctx, tx); err != nil {
+		return nil, fmt.Errorf("failed to send replacement: %w", err)
+	}
+
+	if cancelled && entry.cancelIndex == 0 {
+		entry.cancelIndex = len(entry.txs)
+	}
+	entry.txs = append(entry.txs, tx)
+	entry.submittedAt = time.Now()
+	t.mu.Lock()
+	if _, ok := t.tracked[latest.Hash()]; ok {
+		t.tracked[tx.Hash()] = entry
+	}
+	t.mu.Unlock()
+	return tx, nil
+}
+
+// cancelGas returns the estimated gas limit of a 0-value transfer to the sender, with the `DefaultGasMargin`.
+func (t *txTracker) cancelGas(ctx context.Context) (uint64, error) {
+	gas, err := t.client.EstimateGas(ctx, ethereum.CallMsg{From: t.from, To: &t.from, Value: big.NewInt(0)})
+	if err != nil {
+		return 0, fmt.Errorf("failed to estimate cancellation gas: %w", err)
+	}
+	gas = gas * (100 + DefaultGasMargin) / 100
+	if gas < cancelGasLimit {
+		gas = cancelGasLimit
+	}
+	return gas, nil
+}
+
+// isAlreadyKnownError returns true if the node already has the transaction in its mempool
+func isAlreadyKnownError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "already known")
+}
+
+// bumpFee returns the fee increased by `MinFeeBump` percent, rounded up
+func bumpFee(fee *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(fee, big.NewInt(100+MinFeeBump))
+	bumped.Add(bumped, big.NewInt(99))
+	return bumped.Div(bumped, big.NewInt(100))
+}
+
+func bigMax(x, y *big.Int) *big.Int {
+	if x.Cmp(y) >= 0 {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,325 @@
+package evm_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/catalogfi/blockchain"
+	"github.com/catalogfi/blockchain/evm"
+)
+
+var _ = Describe("Transaction tracker", func() {
+	chain := blockchain.NewEvmChain(blockchain.EthereumLocalnet)
+	to := common.HexToAddress("0x70997970C51812dc3A010C7d01b50e0d17dc79C8")
+
+	var (
+		key    *ecdsa.PrivateKey
+		from   common.Address
+		client *txClient
+		tx     *types.Transaction
+	)
+
+	BeforeEach(func(ctx context.Context) {
+		var err error
+		key, err = crypto.GenerateKey()
+		Expect(err).Should(BeNil())
+		from = crypto.PubkeyToAddress(key.PublicKey)
+		client = &txClient{nonce: 7, gasPrice: big.NewInt(10), tip: big.NewInt(1)}
+
+		tx, err = types.SignNewTx(key, types.LatestSignerForChainID(chain.ChainID()), &types.DynamicFeeTx{
+			ChainID:   chain.ChainID(),
+			Nonce:     7,
+			GasTipCap: big.NewInt(1),
+			GasFeeCap: big.NewInt(20),
+			Gas:       50000,
+			To:        &to,
+			Value:     big.NewInt(1000),
+			Data:      []byte{1, 2, 3},
+		})
+		Expect(err).Should(BeNil())
+		Expect(client.SendTransaction(ctx, tx)).Should(Succeed())
+	})
+
+	It("should replace stuck transactions until mined", func(ctx context.Context) {
+		tracker := evm.NewTxTracker(client, chain, key, evm.WithStuckTimeout(0), evm.WithTrackerPollInterval(time.Millisecond))
+		client.mineAfter = 4
+		receipt, err := tracker.WaitMined(ctx, tx)
+		Expect(err).Should(BeNil())
+		Expect(client.sent).Should(HaveLen(4))
+		Expect(receipt.TxHash).ShouldNot(Equal(tx.Hash()))
+		Expect(receipt.TxHash).Should(Equal(client.sent[3].Hash()))
+
+		for i := 1; i < len(client.sent); i++ {
+			prev, replacement := client.sent[i-1], client.sent[i]
+			Expect(replacement.Nonce()).Should(Equal(tx.Nonce()))
+			Expect(replacement.To()).Should(Equal(&to))
+			Expect(replacement.Value()).Should(Equal(tx.Value()))
+			Expect(replacement.Data()).Should(Equal(tx.Data()))
+			Expect(replacement.Gas()).Should(Equal(tx.Gas()))
+			Expect(new(big.Int).Mul(replacement.GasFeeCap(), big.NewInt(100)).Cmp(new(big.Int).Mul(prev.GasFeeCap(), big.NewInt(110)))).Should(BeNumerically(">=", 0))
+			Expect(new(big.Int).Mul(replacement.GasTipCap(), big.NewInt(100)).Cmp(new(big.Int).Mul(prev.GasTipCap(), big.NewInt(110)))).Should(BeNumerically(">=", 0))
+		}
+		Expect(tracker.Pending()).Should(BeEmpty())
+	})
+
+	It("should stop replacing above the maximum fee cap", func(ctx context.Context) {
+		tracker := evm.NewTxTracker(client, chain, key, evm.WithStuckTimeout(0), evm.WithTrackerPollInterval(time.Millisecond), evm.WithMaxReplacementFeeCap(big.NewInt(24)))
+		client.mineAfter = 5
+		receipt, err := tracker.WaitMined(ctx, tx)
+		Expect(err).Should(BeNil())
+		Expect(client.sent).Should(HaveLen(2))
+		Expect(client.sent[1].GasFeeCap()).Should(Equal(big.NewInt(22)))
+		Expect(receipt.TxHash).Should(Equal(client.sent[1].Hash()))
+	})
+
+	It("should keep waiting when the replacement fails", func(ctx context.Context) {
+		tracker := evm.NewTxTracker(client, chain, key, evm.WithStuckTimeout(0), evm.WithTrackerPollInterval(time.Millisecond))
+		client.sendErr = errors.New("already known")
+		client.mineAfter = 3
+		receipt, err := tracker.WaitMined(ctx, tx)
+		Expect(err).Should(BeNil())
+		Expect(receipt.TxHash).Should(Equal(tx.Hash()))
+
+		By("Fetch the receipt of the transaction mined while replacing it")
+		client.nonce, client.mined, client.calls, client.mineAfter = 7, nil, 0, 0
+		client.sendErr = errors.New("connection reset")
+		client.mineOnSend = true
+		receipt, err = tracker.WaitMined(ctx, tx)
+		Expect(err).Should(BeNil())
+		Expect(receipt.TxHash).Should(Equal(tx.Hash()))
+
+		By("Fail when the transaction is not mined")
+		client.nonce, client.mined = 7, nil
+		client.mineOnSend = false
+		_, err = tracker.WaitMined(ctx, tx)
+		Expect(err).Should(MatchError(ContainSubstring("connection reset")))
+	})
+
+	It("should cancel a pending transaction", func(ctx context.Context) {
+		tracker := evm.NewTxTracker(client, chain, key, evm.WithTrackerPollInterval(time.Millisecond))
+		client.estimate = 30000
+		cancel, err := tracker.Cancel(ctx, tx.Hash())
+		Expect(err).Should(BeNil())
+		Expect(cancel.Nonce()).Should(Equal(tx.Nonce()))
+		Expect(cancel.To()).Should(Equal(&from))
+		Expect(cancel.Value().Sign()).Should(BeZero())
+		Expect(cancel.Data()).Should(BeEmpty())
+		Expect(cancel.Gas()).Should(Equal(uint64(30000 * (100 + evm.DefaultGasMargin) / 100)))
+		Expect(tracker.Pending()).Should(Equal([]*types.Transaction{cancel}))
+
+		By("Report the cancellation once mined")
+		client.mineAfter = 2
+		receipt, err := tracker.WaitMined(ctx, tx)
+		Expect(err).Should(Equal(evm.ErrTxCancelled))
+		Expect(receipt.TxHash).Should(Equal(cancel.Hash()))
+
+		_, err = tracker.Cancel(ctx, tx.Hash())
+		Expect(err).Should(Equal(evm.ErrTxAlreadyMined))
+	})
+
+	It("should cancel a transaction being waited on", func(ctx context.Context) {
+		tracker := evm.NewTxTracker(client, chain, key, evm.WithTrackerPollInterval(time.Millisecond))
+		done := make(chan error)
+		go func() {
+			_, err := tracker.WaitMined(ctx, tx)
+			done <- err
+		}()
+		Eventually(tracker.Pending).Should(HaveLen(1))
+		_, err := tracker.Cancel(ctx, tracker.Pending()[0].Hash())
+		Expect(err).Should(BeNil())
+		client.mine()
+		Eventually(done).Should(Receive(Equal(evm.ErrTxCancelled)))
+	})
+
+	It("should wait for the confirmations", func(ctx context.Context) {
+		tracker := evm.NewTxTracker(client, chain, key, evm.WithTrackerPollInterval(time.Millisecond))
+		client.mineAfter = 1
+		receipt, err := tracker.WaitConfirmed(ctx, tx, 5)
+		Expect(err).Should(BeNil())
+		Expect(receipt.TxHash).Should(Equal(tx.Hash()))
+		Expect(client.head - receipt.BlockNumber.Uint64() + 1).Should(Equal(uint64(5)))
+	})
+
+	It("should keep waiting on the nodes behind the receipt", func(ctx context.Context) {
+		tracker := evm.NewTxTracker(client, chain, key, evm.WithTrackerPollInterval(time.Millisecond))
+		client.head = 10
+		client.mineAfter = 1
+		client.lagging, client.missing = 3, 3
+		receipt, err := tracker.WaitConfirmed(ctx, tx, 2)
+		Expect(err).Should(BeNil())
+		Expect(receipt.TxHash).Should(Equal(tx.Hash()))
+		Expect(client.lagging).Should(BeZero())
+		Expect(client.missing).Should(BeZero())
+	})
+
+	It("should report reorged receipts", func(ctx context.Context) {
+		tracker := evm.NewTxTracker(client, chain, key, evm.WithTrackerPollInterval(time.Millisecond))
+		client.mineAfter = 1
+		done := make(chan error)
+		go func() {
+			_, err := tracker.WaitConfirmed(ctx, tx, 1000)
+			done <- err
+		}()
+		Eventually(func() uint64 {
+			client.mu.Lock()
+			defer client.mu.Unlock()
+			return client.head
+		}).Should(BeNumerically(">", 10))
+
+		client.mu.Lock()
+		client.fork++
+		client.mu.Unlock()
+		Eventually(done).Should(Receive(Equal(evm.ErrTxReorged)))
+	})
+
+	It("should detect nonces used by other transactions", func(ctx context.Context) {
+		tracker := evm.NewTxTracker(client, chain, key, evm.WithTrackerPollInterval(time.Millisecond))
+		client.nonce = 8
+		_, err := tracker.WaitMined(ctx, tx)
+		Expect(err).Should(Equal(evm.ErrTxNonceUsed))
+
+		By("Reject transactions of other accounts")
+		other, err := crypto.GenerateKey()
+		Expect(err).Should(BeNil())
+		_, err = evm.NewTxTracker(client, chain, other).WaitMined(ctx, tx)
+		Expect(err).Should(Equal(evm.ErrTxNotFromTrackerKey))
+	})
+})
+
+// txClient is a fake evm node which mines the latest sent transaction after some nonce queries. A block is added to
+// the chain each time the head is queried, and changing the fork replaces all the blocks. Sending fails with sendErr
+// when set, after mining the latest transaction with mineOnSend. The next lagging head queries return the genesis
+// block, and the next missing block queries are not found, like a node behind the others.
+type txClient struct {
+	mu         sync.Mutex
+	sent       []*types.Transaction
+	mined      *types.Transaction
+	minedAt    uint64
+	nonce      uint64
+	mineAfter  int
+	calls      int
+	head       uint64
+	fork       byte
+	gasPrice   *big.Int
+	tip        *big.Int
+	estimate   uint64
+	lagging    int
+	missing    int
+	sendErr    error
+	mineOnSend bool
+}
+
+func (client *txClient) mine() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.mined = client.sent[len(client.sent)-1]
+	client.minedAt = client.head
+	client.nonce = client.mined.Nonce() + 1
+}
+
+func (client *txClient) header(number uint64) *types.Header {
+	return &types.Header{Number: new(big.Int).SetUint64(number), Extra: []byte{client.fork}}
+}
+
+func (client *txClient) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if number == nil {
+		if client.lagging > 0 {
+			client.lagging--
+			return client.header(0), nil
+		}
+		client.head++
+		return client.header(client.head), nil
+	}
+	if client.missing > 0 {
+		client.missing--
+		return nil, ethereum.NotFound
+	}
+	if number.Uint64() > client.head {
+		return nil, ethereum.NotFound
+	}
+	return client.header(number.Uint64()), nil
+}
+
+func (client *txClient) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	client.mu.Lock()
+	client.calls++
+	mine := client.mined == nil && client.mineAfter > 0 && client.calls >= client.mineAfter
+	client.mu.Unlock()
+	if mine {
+		client.mine()
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.nonce, nil
+}
+
+func (client *txClient) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	for _, tx := range client.sent {
+		if tx.Hash() == hash {
+			return tx, client.mined == nil, nil
+		}
+	}
+	return nil, false, ethereum.NotFound
+}
+
+func (client *txClient) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.mined == nil || client.mined.Hash() != hash {
+		return nil, ethereum.NotFound
+	}
+	return &types.Receipt{
+		TxHash:      hash,
+		Status:      types.ReceiptStatusSuccessful,
+		BlockNumber: new(big.Int).SetUint64(client.minedAt),
+		BlockHash:   client.header(client.minedAt).Hash(),
+	}, nil
+}
+
+func (client *txClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.mined != nil {
+		return errors.New("nonce too low")
+	}
+	if client.sendErr != nil {
+		if client.mineOnSend {
+			client.mined = client.sent[len(client.sent)-1]
+			client.minedAt = client.head
+			client.nonce = client.mined.Nonce() + 1
+		}
+		return client.sendErr
+	}
+	client.sent = append(client.sent, tx)
+	return nil
+}
+
+func (client *txClient) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	if client.estimate == 0 {
+		return 21000, nil
+	}
+	return client.estimate, nil
+}
+
+func (client *txClient) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return client.gasPrice, nil
+}
+
+func (client *txClient) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	return client.tip, nil
+}
@@ -5,48 +5,149 @@ import (
 	"crypto/ecdsa"
 	"fmt"
 	"math/big"
+	"sync"
 
 	"github.com/catalogfi/blockchain"
 	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/token/ERC20/erc20"
 	"github.com/catalogfi/blockchain/evm/bindings/openzeppelin/contracts/token/ERC721/erc721"
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
 )
 
 var MaxETHAmount, _ = new(big.Int).SetString("ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
 
 type wallet struct {
 	Client
-	privateKey *ecdsa.PrivateKey
+	privateKey  *ecdsa.PrivateKey
+	gasStrategy GasStrategy
+	nonces      NonceManager
+
+	approvalPolicy    ApprovalPolicy
+	approvalsMu       sync.Mutex
+	approvals         map[approvalKey]*approvalState
+	confirmationDepth uint64
+
+	trackersMu     sync.Mutex
+	trackers       map[blockchain.Name]TxTracker
+	trackerOptions []TxTrackerOption
+}
+
+// WalletOption configures the wallets returned by `NewWallet`, `NewGardenWallet` and `NewHTLCWallet`.
+type WalletOption func(*wallet)
+
+// WithGasStrategy sets the gas strategy of the wallet, it defaults to `NewEIP1559GasStrategy()`.
+func WithGasStrategy(strategy GasStrategy) WalletOption {
+	return func(w *wallet) {
+		w.gasStrategy = strategy
+	}
+}
+
+// WithNonceManager sets the nonce manager of the wallet, it defaults to an in-memory `NewNonceManager(nil)`. Wallets
+// sharing an account should share the nonce manager.
+func WithNonceManager(nonces NonceManager) WalletOption {
+	return func(w *wallet) {
+		w.nonces = nonces
+	}
+}
+
+// WithTxTrackerOptions sets the options of the trackers of the transactions sent by the wallet.
+func WithTxTrackerOptions(opts ...TxTrackerOption) WalletOption {
+	return func(w *wallet) {
+		w.trackerOptions = opts
+	}
+}
+
+// WithConfirmationDepth sets the number of blocks the transactions of the wallet wait for before the operations
+// return, including the block of the transaction. A depth of 1 returns as soon as the transactions are mined, without
+// waiting for more blocks. A depth of 0, the default, uses the `ConfirmationDepth` of the chain.
+func WithConfirmationDepth(depth uint64) WalletOption {
+	return func(w *wallet) {
+		w.confirmationDepth = depth
+	}
 }
 
 type Wallet interface {
 	Client
 
 	Address() common.Address
+	TxTracker(chain blockchain.Chain) (TxTracker, error)
 	Send(ctx context.Context, asset blockchain.EVMAsset, to common.Address, amount *big.Int) (*types.Transaction, error)
 	SendAll(ctx context.Context, asset blockchain.EVMAsset, to common.Address) (*types.Transaction, error)
+
+	// Transact calls the method of the contract in a transaction and waits for it to be mined, like the other
+	// operations of the wallet. The call is simulated first, and a RevertError is returned when it reverts.
+	Transact(ctx context.Context, chain blockchain.EvmChain, contract common.Address, metaData *bind.MetaData, method string, args ...interface{}) (*types.Receipt, error)
 }
 
 type GardenWallet interface {
 	HTLCWallet
 }
 
-func NewWallet(client Client, key *ecdsa.PrivateKey) Wallet {
-	return &wallet{Client: client, privateKey: key}
+func NewWallet(client Client, key *ecdsa.PrivateKey, opts ...WalletOption) Wallet {
+	return newWallet(client, key, opts...)
+}
+
+func NewGardenWallet(client Client, key *ecdsa.PrivateKey, opts ...WalletOption) GardenWallet {
+	return newWallet(client, key, opts...)
 }
 
-func NewGardenWallet(client Client, key *ecdsa.PrivateKey) GardenWallet {
-	return &wallet{Client: client, privateKey: key}
+func newWallet(client Client, key *ecdsa.PrivateKey, opts ...WalletOption) *wallet {
+	w := &wallet{Client: client, privateKey: key, gasStrategy: NewEIP1559GasStrategy(), nonces: NewNonceManager(nil), trackers: map[blockchain.Name]TxTracker{}, approvals: map[approvalKey]*approvalState{}}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
 }
 
 func (w *wallet) Address() common.Address {
 	return crypto.PubkeyToAddress(w.privateKey.PublicKey)
 }
 
+// TxTracker returns the tracker of the transactions sent by the wallet on the chain, which can speed up or cancel
+// them.
+func (w *wallet) TxTracker(chain blockchain.Chain) (TxTracker, error) {
+	evmChain, ok := chain.(blockchain.EvmChain)
+	if !ok {
+		return nil, fmt.Errorf("%v is not an evm chain", chain.Name())
+	}
+	client, ok := w.Client.EvmClient(chain)
+	if !ok {
+		return nil, fmt.Errorf("unsupported evm chain: %v", chain.Name())
+	}
+
+	w.trackersMu.Lock()
+	defer w.trackersMu.Unlock()
+	if _, ok := w.trackers[chain.Name()]; !ok {
+		w.trackers[chain.Name()] = NewTxTracker(client, evmChain, w.privateKey, w.trackerOptions...)
+	}
+	return w.trackers[chain.Name()], nil
+}
+
+// waitMined waits for the transaction to be mined at the confirmation depth of the wallet, replacing it when it is
+// stuck. An error wrapping ErrTxReverted is returned along with the receipt when the mined transaction failed.
+func (w *wallet) waitMined(ctx context.Context, chain blockchain.Chain, tx *types.Transaction) (*types.Receipt, error) {
+	tracker, err := w.TxTracker(chain)
+	if err != nil {
+		return nil, err
+	}
+	depth := w.confirmationDepth
+	if depth == 0 {
+		depth = chain.(blockchain.EvmChain).ConfirmationDepth()
+	}
+	receipt, err := tracker.WaitConfirmed(ctx, tx, depth)
+	if err != nil {
+		return receipt, err
+	}
+	client, ok := w.Client.EvmClient(chain)
+	if !ok {
+		return nil, fmt.Errorf("unsupported evm chain: %v", chain.Name())
+	}
+	return receipt, checkReceipt(ctx, client, w.Address(), receipt)
+}
+
 func (w *wallet) Send(ctx context.Context, asset blockchain.EVMAsset, to common.Address, amount *big.Int) (*types.Transaction, error) {
 	evmChain, ok := asset.Chain().(blockchain.EvmChain)
 	if !ok {
@@ -63,39 +164,47 @@ func (w *wallet) Send(ctx context.Context, asset blockchain.EVMAsset, to common.
 		if err != nil {
 			return nil, err
 		}
-		return token.Transfer(tops, to, amount)
-	case blockchain.ERC721:
-		nft, err := erc721.NewERC721(asset.Token, client)
-		if err != nil {
+		if err := setGas(ctx, w.gasStrategy, client, evmChain, tops, asset.Token, erc20.ERC20MetaData, "transfer", to, amount); err != nil {
 			return nil, err
 		}
-		return nft.TransferFrom(tops, tops.From, to, amount)
-	case blockchain.ETH:
-		nonce, err := client.PendingNonceAt(ctx, tops.From)
+		return w.withNonce(ctx, client, evmChain, tops, func() (*types.Transaction, error) {
+			return token.Transfer(tops, to, amount)
+		})
+	case blockchain.ERC721:
+		nft, err := erc721.NewERC721(asset.Token, client)
 		if err != nil {
 			return nil, err
 		}
-		gasPrice, err := client.SuggestGasPrice(ctx)
-		if err != nil {
+		if err := setGas(ctx, w.gasStrategy, client, evmChain, tops, asset.Token, erc721.ERC721MetaData, "transferFrom", tops.From, to, amount); err != nil {
 			return nil, err
 		}
-		gasTip, err := client.SuggestGasTipCap(ctx)
-		if err != nil {
-			return nil, err
-		}
-		signedTx, err := tops.Signer(tops.From, types.NewTx(&types.DynamicFeeTx{
-			ChainID:   evmChain.ChainID(),
-			Nonce:     nonce,
-			To:        &to,
-			GasFeeCap: gasPrice,
-			GasTipCap: gasTip,
-			Gas:       21000,
-			Value:     amount,
-		}))
+		return w.withNonce(ctx, client, evmChain, tops, func() (*types.Transaction, error) {
+			return nft.TransferFrom(tops, tops.From, to, amount)
+		})
+	case blockchain.ETH:
+		params, err := w.gasStrategy.GasParams(ctx, client, evmChain, ethereum.CallMsg{
+			From:  tops.From,
+			To:    &to,
+			Value: amount,
+		})
 		if err != nil {
 			return nil, err
 		}
-		return signedTx, client.SendTransaction(ctx, signedTx)
+		return w.withNonce(ctx, client, evmChain, tops, func() (*types.Transaction, error) {
+			signedTx, err := tops.Signer(tops.From, types.NewTx(&types.DynamicFeeTx{
+				ChainID:   evmChain.ChainID(),
+				Nonce:     tops.Nonce.Uint64(),
+				To:        &to,
+				GasFeeCap: params.GasFeeCap,
+				GasTipCap: params.GasTipCap,
+				Gas:       params.GasLimit,
+				Value:     amount,
+			}))
+			if err != nil {
+				return nil, err
+			}
+			return signedTx, client.SendTransaction(ctx, signedTx)
+		})
 	default:
 		panic(fmt.Sprintf("constraint violation: unsupported asset type: %T", asset))
 	}
@@ -109,7 +218,29 @@ func (w *wallet) SendAll(ctx context.Context, asset blockchain.EVMAsset, to comm
 	return w.Send(ctx, asset, to, balance)
 }
 
-func (w *wallet) transactor(ctx context.Context, chain blockchain.Chain) (*ethclient.Client, *bind.TransactOpts, error) {
+func (w *wallet) Transact(ctx context.Context, chain blockchain.EvmChain, contract common.Address, metaData *bind.MetaData, method string, args ...interface{}) (*types.Receipt, error) {
+	client, tops, err := w.transactor(ctx, chain)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := metaData.GetAbi()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get abi: %v", err)
+	}
+	bound := bind.NewBoundContract(contract, *parsed, client, client, client)
+	if err := setGas(ctx, w.gasStrategy, client, chain, tops, contract, metaData, method, args...); err != nil {
+		return nil, err
+	}
+	tx, err := w.withNonce(ctx, client, chain, tops, func() (*types.Transaction, error) {
+		return bound.Transact(tops, method, args...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w.waitMined(ctx, chain, tx)
+}
+
+func (w *wallet) transactor(ctx context.Context, chain blockchain.Chain) (Backend, *bind.TransactOpts, error) {
 	client, ok := w.Client.EvmClient(chain)
 	if !ok {
 		return nil, nil, fmt.Errorf("unsupported evm chain: %v", chain.Name())
@@ -121,3 +252,42 @@ func (w *wallet) transactor(ctx context.Context, chain blockchain.Chain) (*ethcl
 	tops.Context = ctx
 	return client, tops, nil
 }
+
+// withNonce reserves a nonce for the transaction sent by send, through `tops.Nonce`. The nonce is released when the
+// transaction is not sent, i.e. it fails before being signed or the node rejects it, and the nonces of the account
+// are resynced from the chain when the node rejects it because of its nonce. The nonce is kept reserved when it is
+// unknown whether the node got the transaction, e.g. on a timeout, until the chain catches up or it expires.
+func (w *wallet) withNonce(ctx context.Context, client NonceClient, chain blockchain.EvmChain, tops *bind.TransactOpts, send func() (*types.Transaction, error)) (*types.Transaction, error) {
+	nonce, err := w.nonces.Next(ctx, client, chain, tops.From)
+	if err != nil {
+		return nil, err
+	}
+	tops.Nonce = new(big.Int).SetUint64(nonce)
+
+	// The transaction is sent right after it is signed
+	signed := false
+	signer := tops.Signer
+	defer func() { tops.Signer = signer }()
+	tops.Signer = func(from common.Address, tx *types.Transaction) (*types.Transaction, error) {
+		signedTx, err := signer(from, tx)
+		signed = err == nil
+		return signedTx, err
+	}
+
+	tx, err := send()
+	if err != nil {
+		if !signed || isRejected(err) {
+			if releaseErr := w.nonces.Release(ctx, chain, tops.From, nonce); releaseErr != nil {
+				return nil, fmt.Errorf("%v, failed to release nonce: %v", err, releaseErr)
+			}
+			if !isNonceError(err) {
+				return nil, err
+			}
+		}
+		if resyncErr := w.nonces.Resync(ctx, client, chain, tops.From); resyncErr != nil {
+			return nil, fmt.Errorf("%v, failed to resync nonce: %v", err, resyncErr)
+		}
+		return nil, err
+	}
+	return tx, nil
+}